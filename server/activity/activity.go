@@ -0,0 +1,215 @@
+package activity
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	bucketEntries = []byte("entries")
+	bucketUsers   = []byte("users")
+)
+
+// Kinds of activity
+const (
+	Created      = "created"
+	Modified     = "modified"
+	Renamed      = "renamed"
+	Moved        = "moved"
+	Deleted      = "deleted"
+	ShareCreated = "share_created"
+	ShareRevoked = "share_revoked"
+	LinkCreated  = "link_created"
+	LinkRevoked  = "link_revoked"
+	ChatCreated  = "chat_created"
+)
+
+// Something which happened to a user's files, shares or chats
+type Entry struct {
+	Id   uint64 `json:"id"`
+	Type string `json:"type"`
+	Time int64  `json:"time"`
+
+	// The user who caused the activity and everyone it is shown to
+	Actor string   `json:"actor"`
+	Users []string `json:"users"`
+
+	// Paths are relative to the actor's files
+	Path string `json:"path,omitempty"`
+	From string `json:"from,omitempty"`
+	Chat string `json:"chat,omitempty"`
+}
+
+// Check if an entry affects a file which may still exist
+func (e *Entry) touchedFile() bool {
+	return e.Type == Created || e.Type == Modified || e.Type == Renamed || e.Type == Moved
+}
+
+// An append-only record of activity with a feed for each user
+type Feed struct {
+	db *bolt.DB
+}
+
+// Create an activity feed
+func New(db *bolt.DB) (*Feed, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketActivity)
+		for _, name := range [][]byte{bucketEntries, bucketUsers} {
+			if _, err := bucket.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &Feed{db: db}, nil
+}
+
+// Record activity caused by a user, shown to them and any other users
+func (f *Feed) Record(kind, actor string, others []string, details Entry) {
+	details.Type = kind
+	details.Time = time.Now().Unix()
+	details.Actor = actor
+	details.Users = append([]string{actor}, others...)
+
+	if err := f.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketActivity)
+		entries := root.Bucket(bucketEntries)
+
+		id, err := entries.NextSequence()
+		if err != nil {
+			return err
+		}
+		details.Id = id
+
+		buf, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		if err := entries.Put(key(id), buf); err != nil {
+			return err
+		}
+
+		// Index the entry in each user's feed
+		for _, username := range details.Users {
+			feed, err := root.Bucket(bucketUsers).CreateBucketIfNotExists([]byte(username))
+			if err != nil {
+				return err
+			}
+			if err := feed.Put(key(id), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("ERROR: failed to record %s activity for %s: %v\n", kind, actor, err)
+	}
+}
+
+// Record changes to users' files
+func (f *Feed) Handle(event events.Event) {
+	switch event.Type {
+	case events.Created:
+		f.Record(Created, event.User, nil, Entry{Path: relative(event.Path)})
+	case events.Modified:
+		f.Record(Modified, event.User, nil, Entry{Path: relative(event.Path)})
+	case events.Moved:
+		kind := Moved
+		if path.Dir(event.From) == path.Dir(event.Path) {
+			kind = Renamed
+		}
+		f.Record(kind, event.User, nil, Entry{Path: relative(event.Path), From: relative(event.From)})
+	case events.Deleted:
+		// Deleted users no longer have a feed
+		if event.Path == event.User {
+			f.removeUser(event.User)
+			return
+		}
+		f.Record(Deleted, event.User, nil, Entry{Path: relative(event.Path)})
+	}
+}
+
+// Get a page of a user's activity, newest first, starting before an id if non-zero
+func (f *Feed) List(username string, before uint64, limit int, filter func(entry *Entry) bool) ([]*Entry, error) {
+	found := []*Entry{}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketActivity)
+		feed := root.Bucket(bucketUsers).Bucket([]byte(username))
+		if feed == nil {
+			return nil
+		}
+
+		cursor := feed.Cursor()
+		var k []byte
+		if before == 0 {
+			k, _ = cursor.Last()
+		} else if k, _ = cursor.Seek(key(before)); k == nil {
+			k, _ = cursor.Last()
+		} else {
+			k, _ = cursor.Prev()
+		}
+
+		for ; k != nil && (limit <= 0 || len(found) < limit); k, _ = cursor.Prev() {
+			var entry Entry
+			if err := json.Unmarshal(root.Bucket(bucketEntries).Get(k), &entry); err != nil {
+				return err
+			}
+			if filter == nil || filter(&entry) {
+				found = append(found, &entry)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Get the paths of the files a user most recently touched, newest first, passing each to a check
+// which decides if it is still worth showing
+func (f *Feed) Recent(username string, limit int, exists func(namespacedPath string) bool) ([]*Entry, error) {
+	seen := make(map[string]bool)
+	return f.List(username, 0, limit, func(entry *Entry) bool {
+		if entry.Actor != username || !entry.touchedFile() || seen[entry.Path] {
+			return false
+		}
+		seen[entry.Path] = true
+		return exists(path.Join(username, entry.Path))
+	})
+}
+
+// Forget a user's feed, leaving the entries shown to other users
+func (f *Feed) removeUser(username string) {
+	if err := f.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(models.BucketActivity).Bucket(bucketUsers)
+		if users.Bucket([]byte(username)) == nil {
+			return nil
+		}
+		return users.DeleteBucket([]byte(username))
+	}); err != nil {
+		log.Printf("ERROR: failed to remove activity feed for %s: %v\n", username, err)
+	}
+}
+
+// Encode an id so entries sort in the order they were recorded
+func key(id uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	return buf
+}
+
+// Get a namespaced path relative to its owner's files
+func relative(namespacedPath string) string {
+	parts := strings.SplitN(namespacedPath, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,308 @@
+package annotations
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	uuid "github.com/satori/go.uuid"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"sort"
+	"strings"
+)
+
+var (
+	bucketPaths = []byte("paths")
+	bucketNotes = []byte("notes")
+)
+
+const (
+	MaxTags           = 32
+	MaxTagLength      = 64
+	MaxDescriptionLen = 4096
+)
+
+var (
+	ErrTooManyTags        = errors.New("at most 32 tags are allowed")
+	ErrInvalidTag         = errors.New("tags must be between 1 and 64 characters without commas")
+	ErrDescriptionTooLong = errors.New("description must be at most 4096 characters")
+)
+
+// User supplied information about a file or directory, following it when it moves
+type Annotation struct {
+	Id          string   `json:"id"`
+	Path        string   `json:"path"`
+	Tags        []string `json:"tags"`
+	Starred     bool     `json:"starred"`
+	Description string   `json:"description"`
+}
+
+// Check if an annotation carries any information worth keeping
+func (a *Annotation) empty() bool {
+	return len(a.Tags) == 0 && !a.Starred && a.Description == ""
+}
+
+// Check if an annotation has a tag
+func (a *Annotation) HasTag(tag string) bool {
+	tag = normalizeTag(tag)
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes to make to an annotation, leaving anything nil as it is
+type Update struct {
+	Tags        *[]string `json:"tags"`
+	Starred     *bool     `json:"starred"`
+	Description *string   `json:"description"`
+}
+
+// Check an update can be applied
+func (u *Update) Validate() error {
+	if u.Tags != nil {
+		if len(*u.Tags) > MaxTags {
+			return ErrTooManyTags
+		}
+		for _, tag := range *u.Tags {
+			if tag = normalizeTag(tag); tag == "" || len(tag) > MaxTagLength || strings.Contains(tag, ",") {
+				return ErrInvalidTag
+			}
+		}
+	}
+	if u.Description != nil && len(*u.Description) > MaxDescriptionLen {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+// Keeps annotations on users' files with an identity assigned on first use
+type Store struct {
+	db *bolt.DB
+}
+
+// Create an annotation store
+func New(db *bolt.DB) (*Store, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketAnnotations)
+		for _, name := range [][]byte{bucketPaths, bucketNotes} {
+			if _, err := bucket.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Get the annotation for a path, nil if it has none
+func (s *Store) Get(namespacedPath string) (*Annotation, error) {
+	var annotation *Annotation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		annotation, err = get(tx.Bucket(models.BucketAnnotations), namespacedPath)
+		return err
+	})
+	return annotation, err
+}
+
+// Change the annotation for a path, assigning it an identity if it does not yet have one
+func (s *Store) Set(namespacedPath string, update Update) (*Annotation, error) {
+	if err := update.Validate(); err != nil {
+		return nil, err
+	}
+
+	annotation := &Annotation{Path: namespacedPath, Tags: []string{}}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketAnnotations)
+		if existing, err := get(root, namespacedPath); err != nil {
+			return err
+		} else if existing != nil {
+			annotation = existing
+		} else {
+			annotation.Id = uuid.NewV4().String()
+		}
+
+		if update.Tags != nil {
+			annotation.Tags = normalizeTags(*update.Tags)
+		}
+		if update.Starred != nil {
+			annotation.Starred = *update.Starred
+		}
+		if update.Description != nil {
+			annotation.Description = strings.TrimSpace(*update.Description)
+		}
+
+		// Nothing is kept for files without any annotations
+		if annotation.empty() {
+			return remove(root, namespacedPath, annotation.Id)
+		}
+		return put(root, annotation)
+	})
+	return annotation, err
+}
+
+// Get all of a user's annotations matching a filter, ordered by path
+func (s *Store) Find(username string, filter func(annotation *Annotation) bool) ([]*Annotation, error) {
+	found := []*Annotation{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketAnnotations)
+		prefix := []byte(username + "/")
+		cursor := root.Bucket(bucketPaths).Cursor()
+		for k, id := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = cursor.Next() {
+			var annotation Annotation
+			if err := json.Unmarshal(root.Bucket(bucketNotes).Get(id), &annotation); err != nil {
+				return err
+			}
+			if filter(&annotation) {
+				found = append(found, &annotation)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Count how many of a user's files have each tag
+func (s *Store) Tags(username string) (map[string]int, error) {
+	counts := make(map[string]int)
+	_, err := s.Find(username, func(annotation *Annotation) bool {
+		for _, tag := range annotation.Tags {
+			counts[tag]++
+		}
+		return false
+	})
+	return counts, err
+}
+
+// Keep annotations following their files
+func (s *Store) Handle(event events.Event) {
+	var err error
+	switch event.Type {
+	case events.Moved:
+		err = s.move(event.From, event.Path)
+	case events.Deleted:
+		err = s.removeUnder(event.Path)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to update annotations for %s: %v\n", event.Path, err)
+	}
+}
+
+// Point the annotations for a path and everything beneath it at their new location
+func (s *Store) move(from, to string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketAnnotations)
+		paths := root.Bucket(bucketPaths)
+
+		moved := make(map[string][]byte)
+		for _, key := range keysUnder(paths, from) {
+			moved[to+strings.TrimPrefix(key, from)] = append([]byte{}, paths.Get([]byte(key))...)
+			if err := paths.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		for namespacedPath, id := range moved {
+			var annotation Annotation
+			if err := json.Unmarshal(root.Bucket(bucketNotes).Get(id), &annotation); err != nil {
+				return err
+			}
+			annotation.Path = namespacedPath
+			if err := put(root, &annotation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove the annotations for a path and everything beneath it
+func (s *Store) removeUnder(namespacedPath string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketAnnotations)
+		for _, key := range keysUnder(root.Bucket(bucketPaths), namespacedPath) {
+			if err := remove(root, key, string(root.Bucket(bucketPaths).Get([]byte(key)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Read the annotation for a path
+func get(root *bolt.Bucket, namespacedPath string) (*Annotation, error) {
+	id := root.Bucket(bucketPaths).Get([]byte(namespacedPath))
+	if id == nil {
+		return nil, nil
+	}
+
+	var annotation Annotation
+	if err := json.Unmarshal(root.Bucket(bucketNotes).Get(id), &annotation); err != nil {
+		return nil, err
+	}
+	return &annotation, nil
+}
+
+// Write an annotation and point its path at it
+func put(root *bolt.Bucket, annotation *Annotation) error {
+	buf, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+
+	if err := root.Bucket(bucketNotes).Put([]byte(annotation.Id), buf); err != nil {
+		return err
+	}
+	return root.Bucket(bucketPaths).Put([]byte(annotation.Path), []byte(annotation.Id))
+}
+
+// Delete an annotation and its path
+func remove(root *bolt.Bucket, namespacedPath, id string) error {
+	if err := root.Bucket(bucketNotes).Delete([]byte(id)); err != nil {
+		return err
+	}
+	return root.Bucket(bucketPaths).Delete([]byte(namespacedPath))
+}
+
+// Get a path and all the paths beneath it
+func keysUnder(bucket *bolt.Bucket, namespacedPath string) []string {
+	var keys []string
+	if bucket.Get([]byte(namespacedPath)) != nil {
+		keys = append(keys, namespacedPath)
+	}
+
+	prefix := []byte(namespacedPath + "/")
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+// Tags are compared without case or surrounding whitespace
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Normalize, deduplicate and sort a set of tags
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
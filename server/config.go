@@ -3,6 +3,9 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type config struct {
@@ -11,6 +14,22 @@ type config struct {
 	Database       string
 	FilesDirectory string
 	Reset          bool
+	Quota          int64
+	VersionsKeep   int
+	VersionsMaxAge time.Duration
+	IndexThrottle  time.Duration
+	Storage        string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	PhysicalQuota  bool
+	Encryption     bool
+	ScrubInterval  time.Duration
+	Admins         []string
+	EditMaxSize    int64
+	WatchFiles     bool
 }
 
 func loadEnv() (cfg config) {
@@ -21,6 +40,19 @@ func loadEnv() (cfg config) {
 		Database:       os.Getenv("DATABASE"),
 		FilesDirectory: os.Getenv("FILES_DIR"),
 		Reset:          false,
+		Quota:          0,
+		VersionsKeep:   10,
+		VersionsMaxAge: 30 * 24 * time.Hour,
+		IndexThrottle:  250 * time.Millisecond,
+		ScrubInterval:  24 * time.Hour,
+		EditMaxSize:    1 << 20,
+		WatchFiles:     true,
+		Storage:        os.Getenv("STORAGE"),
+		S3Endpoint:     os.Getenv("S3_ENDPOINT"),
+		S3Region:       os.Getenv("S3_REGION"),
+		S3Bucket:       os.Getenv("S3_BUCKET"),
+		S3AccessKey:    os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:    os.Getenv("S3_SECRET_KEY"),
 	}
 
 	// Set defaults if not exist
@@ -36,9 +68,47 @@ func loadEnv() (cfg config) {
 	if cfg.FilesDirectory == "" {
 		cfg.FilesDirectory = "./files"
 	}
+	if cfg.Storage == "" {
+		cfg.Storage = "local"
+	}
+	if cfg.S3Region == "" {
+		cfg.S3Region = "us-east-1"
+	}
+	if accounting := os.Getenv("QUOTA_ACCOUNTING"); accounting == "physical" || accounting == "PHYSICAL" {
+		cfg.PhysicalQuota = true
+	}
+	if encryption := os.Getenv("ENCRYPTION"); encryption == "yes" || encryption == "YES" {
+		cfg.Encryption = true
+	}
+	if watch := os.Getenv("WATCH_FILES"); watch == "no" || watch == "NO" {
+		cfg.WatchFiles = false
+	}
 	if reset := os.Getenv("RESET"); reset == "YES" || reset == "yes" {
 		cfg.Reset = true
 	}
+	if quota, err := strconv.ParseInt(os.Getenv("QUOTA"), 10, 64); err == nil && quota > 0 {
+		cfg.Quota = quota
+	}
+	if keep, err := strconv.Atoi(os.Getenv("VERSIONS_KEEP")); err == nil && keep >= 0 {
+		cfg.VersionsKeep = keep
+	}
+	if maxAge, err := time.ParseDuration(os.Getenv("VERSIONS_MAX_AGE")); err == nil && maxAge >= 0 {
+		cfg.VersionsMaxAge = maxAge
+	}
+	if throttle, err := time.ParseDuration(os.Getenv("INDEX_THROTTLE")); err == nil && throttle >= 0 {
+		cfg.IndexThrottle = throttle
+	}
+	if interval, err := time.ParseDuration(os.Getenv("SCRUB_INTERVAL")); err == nil && interval > 0 {
+		cfg.ScrubInterval = interval
+	}
+	if size, err := strconv.ParseInt(os.Getenv("EDIT_MAX_SIZE"), 10, 64); err == nil && size > 0 {
+		cfg.EditMaxSize = size
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMINS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			cfg.Admins = append(cfg.Admins, admin)
+		}
+	}
 
 	// Set path as absolute
 	cfg.FilesDirectory, _ = filepath.Abs(cfg.FilesDirectory)
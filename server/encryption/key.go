@@ -0,0 +1,133 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Length of data keys and the keys wrapping them
+const KeySize = 32
+
+var ErrInvalidKey = errors.New("key could not be unwrapped")
+
+// Generate a random data key for encrypting a user's files
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt a data key with a key encryption key
+func Wrap(key, wrapping []byte) ([]byte, error) {
+	aead, err := newAEAD(wrapping)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// Decrypt a data key with the key encryption key it was wrapped by
+func Unwrap(wrapped, wrapping []byte) ([]byte, error) {
+	aead, err := newAEAD(wrapping)
+	if err != nil {
+		return nil, err
+	} else if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalidKey
+	}
+
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// Create an AES-256-GCM cipher from a key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Unwrapped data keys held in memory while their users are logged in
+type Keyring struct {
+	keys map[string]*heldKey
+	lock sync.RWMutex
+}
+
+type heldKey struct {
+	key        []byte
+	references int
+}
+
+// Create an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*heldKey)}
+}
+
+// Hold a user's key until released as many times as it was acquired
+func (k *Keyring) Acquire(username string, key []byte) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if held, ok := k.keys[username]; ok {
+		held.references++
+		return
+	}
+	k.keys[username] = &heldKey{key: append([]byte{}, key...), references: 1}
+}
+
+// Release a hold on a user's key, forgetting it once unused
+func (k *Keyring) Release(username string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if held, ok := k.keys[username]; ok {
+		if held.references--; held.references <= 0 {
+			forget(held)
+			delete(k.keys, username)
+		}
+	}
+}
+
+// Immediately forget a user's key regardless of any holds
+func (k *Keyring) Forget(username string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if held, ok := k.keys[username]; ok {
+		forget(held)
+		delete(k.keys, username)
+	}
+}
+
+// Get a copy of a user's key if it is held
+func (k *Keyring) Key(username string) []byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if held, ok := k.keys[username]; ok {
+		return append([]byte{}, held.key...)
+	}
+	return nil
+}
+
+// Overwrite a key which is no longer needed
+func forget(held *heldKey) {
+	for i := range held.key {
+		held.key[i] = 0
+	}
+}
@@ -0,0 +1,261 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted files start with a magic number and a random nonce prefix, followed by chunks
+// of plaintext each sealed with AES-GCM. Every chunk's nonce is the prefix and its index,
+// and the final chunk is marked in its additional data so truncation is detected.
+const (
+	ChunkSize = 64 << 10
+
+	magic       = "BPE\x01"
+	prefixSize  = 8
+	HeaderSize  = len(magic) + prefixSize
+	overhead    = 16
+	sealedChunk = ChunkSize + overhead
+)
+
+var (
+	ErrCorrupt = errors.New("encrypted file is corrupt")
+	errClosed  = errors.New("encrypted writer is closed")
+)
+
+// Check if the start of a file is an encryption header
+func IsEncrypted(header []byte) bool {
+	return len(header) >= HeaderSize && bytes.HasPrefix(header, []byte(magic))
+}
+
+// Get the size of the plaintext within an encrypted file of some size
+func PlaintextSize(size int64) int64 {
+	body := size - int64(HeaderSize)
+	if body <= 0 {
+		return 0
+	}
+
+	full, remaining := body/sealedChunk, body%sealedChunk
+	if remaining < overhead {
+		return full * ChunkSize
+	}
+	return full*ChunkSize + remaining - overhead
+}
+
+// Build the nonce and additional data for a chunk
+func chunkParameters(prefix []byte, index uint32, final bool) ([]byte, []byte) {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], index)
+
+	if final {
+		return nonce, []byte{1}
+	}
+	return nonce, []byte{0}
+}
+
+// Encrypts everything written to it, the final chunk is written on close
+type Writer struct {
+	out    io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buffer []byte
+	closed bool
+}
+
+// Start encrypting to an output with a data key, writing the header immediately
+func NewWriter(out io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(append([]byte(magic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		out:    out,
+		aead:   aead,
+		prefix: prefix,
+		buffer: make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it is not the last
+		if len(w.buffer) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buffer[len(w.buffer):ChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Seal and write the buffered chunk
+func (w *Writer) seal(final bool) error {
+	nonce, additional := chunkParameters(w.prefix, w.index, final)
+	if _, err := w.out.Write(w.aead.Seal(nil, nonce, w.buffer, additional)); err != nil {
+		return err
+	}
+
+	w.index++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// Write the final chunk, leaving the output open
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// Decrypts any part of an encrypted file on demand
+type Reader struct {
+	in     io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	sealed int64
+	offset int64
+	cached int64
+	plain  []byte
+	chunks int64
+}
+
+// Open an encrypted file of some size with a data key
+func NewReader(in io.ReaderAt, size int64, key []byte) (*Reader, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := in.ReadAt(header, 0); err != nil {
+		return nil, err
+	} else if !IsEncrypted(header) {
+		return nil, ErrCorrupt
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := size - int64(HeaderSize)
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	if body < overhead || body%sealedChunk != 0 && body%sealedChunk < overhead {
+		return nil, ErrCorrupt
+	}
+
+	return &Reader{
+		in:     in,
+		aead:   aead,
+		prefix: header[len(magic):],
+		size:   PlaintextSize(size),
+		sealed: size,
+		cached: -1,
+		chunks: chunks,
+	}, nil
+}
+
+// Get the size of the plaintext
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Decrypt a chunk, keeping the most recent one
+func (r *Reader) chunk(index int64) ([]byte, error) {
+	if index == r.cached {
+		return r.plain, nil
+	}
+
+	start := int64(HeaderSize) + index*sealedChunk
+	end := start + sealedChunk
+	if end > r.sealed {
+		end = r.sealed
+	}
+
+	sealed := make([]byte, end-start)
+	if _, err := r.in.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	nonce, additional := chunkParameters(r.prefix, uint32(index), index == r.chunks-1)
+	plain, err := r.aead.Open(sealed[:0], nonce, sealed, additional)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+
+	r.cached, r.plain = index, plain
+	return plain, nil
+}
+
+func (r *Reader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("encryption: negative offset")
+	}
+
+	read := 0
+	for read < len(p) {
+		if offset >= r.size {
+			return read, io.EOF
+		}
+
+		plain, err := r.chunk(offset / ChunkSize)
+		if err != nil {
+			return read, err
+		}
+
+		n := copy(p[read:], plain[offset%ChunkSize:])
+		read += n
+		offset += int64(n)
+	}
+	return read, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("encryption: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("encryption: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
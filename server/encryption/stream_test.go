@@ -0,0 +1,248 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Sizes around the chunk boundaries
+var sizes = []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize, 3*ChunkSize + 7}
+
+func newKey(t *testing.T) []byte {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func random(t *testing.T, size int) []byte {
+	plaintext := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+// Encrypt some plaintext, writing it in uneven pieces
+func encrypt(t *testing.T, key, plaintext []byte) []byte {
+	var out bytes.Buffer
+	w, err := NewWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rest := plaintext; len(rest) > 0; {
+		n := 1000
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// Read all of an encrypted file, returning the first error seen
+func decrypt(sealed, key []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, size := range sizes {
+		plaintext := random(t, size)
+		sealed := encrypt(t, key, plaintext)
+
+		if !IsEncrypted(sealed) {
+			t.Errorf("%d bytes: missing header", size)
+		} else if PlaintextSize(int64(len(sealed))) != int64(size) {
+			t.Errorf("%d bytes: plaintext size is %d", size, PlaintextSize(int64(len(sealed))))
+		} else if bytes.Contains(sealed, plaintext) && size > 0 {
+			t.Errorf("%d bytes: plaintext is visible", size)
+		}
+
+		decrypted, err := decrypt(sealed, key)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes: decrypted contents differ", size)
+		}
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	w, err := NewWriter(ioutil.Discard, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := w.Write([]byte("late")); err != errClosed {
+		t.Fatalf("wrote after closing with %v", err)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	key := newKey(t)
+	plaintext := random(t, 3*ChunkSize+7)
+	sealed := encrypt(t, key, plaintext)
+
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	} else if r.Size() != int64(len(plaintext)) {
+		t.Fatalf("size is %d instead of %d", r.Size(), len(plaintext))
+	}
+
+	end := int64(len(plaintext))
+	for _, c := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{0, io.SeekStart, 0},
+		{ChunkSize - 3, io.SeekStart, ChunkSize - 3},
+		{10, io.SeekCurrent, ChunkSize + 17},
+		{-7, io.SeekEnd, end - 7},
+		{2 * ChunkSize, io.SeekStart, 2 * ChunkSize},
+		{-1, io.SeekCurrent, 2*ChunkSize + 9},
+		{0, io.SeekEnd, end},
+	} {
+		position, err := r.Seek(c.offset, c.whence)
+		if err != nil || position != c.want {
+			t.Fatalf("seek(%d, %d) = %d, %v instead of %d", c.offset, c.whence, position, err, c.want)
+		}
+
+		// Each read moves the position on and spans the next chunk boundary when there is one
+		buf := make([]byte, 10)
+		n, err := io.ReadFull(r, buf)
+		want := plaintext[c.want:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("read at %d gave different contents", c.want)
+		} else if len(want) < len(buf) && err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.Fatalf("read at %d past the end gave %v", c.want, err)
+		}
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("seeked before the start")
+	} else if _, err := r.Seek(0, 42); err == nil {
+		t.Fatal("seeked with an invalid whence")
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	key := newKey(t)
+	plaintext := random(t, 2*ChunkSize+100)
+	sealed := encrypt(t, key, plaintext)
+
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		offset int64
+		length int
+		err    error
+	}{
+		{0, 1, nil},
+		{ChunkSize - 1, 2, nil},
+		{ChunkSize, ChunkSize, nil},
+		{10, 2 * ChunkSize, nil},
+		{2*ChunkSize + 50, 100, io.EOF},
+		{int64(len(plaintext)), 1, io.EOF},
+	} {
+		buf := make([]byte, c.length)
+		n, err := r.ReadAt(buf, c.offset)
+		want := plaintext[c.offset:]
+		if len(want) > c.length {
+			want = want[:c.length]
+		}
+		if err != c.err {
+			t.Errorf("read %d at %d gave %v instead of %v", c.length, c.offset, err, c.err)
+		} else if !bytes.Equal(buf[:n], want) {
+			t.Errorf("read %d at %d gave different contents", c.length, c.offset)
+		}
+	}
+
+	if _, err := r.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Error("read at a negative offset")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := newKey(t)
+	plaintext := random(t, 3*ChunkSize+7)
+	sealed := encrypt(t, key, plaintext)
+	chunk := func(index int) []byte {
+		start := HeaderSize + index*sealedChunk
+		end := start + sealedChunk
+		if end > len(sealed) {
+			end = len(sealed)
+		}
+		return sealed[start:end]
+	}
+	join := func(parts ...[]byte) []byte {
+		var joined []byte
+		for _, part := range parts {
+			joined = append(joined, part...)
+		}
+		return joined
+	}
+	flipped := append([]byte{}, sealed...)
+	flipped[HeaderSize+sealedChunk+5] ^= 1
+
+	for _, c := range []struct {
+		name   string
+		sealed []byte
+		key    []byte
+	}{
+		{"wrong key", sealed, newKey(t)},
+		{"flipped bit", flipped, key},
+		{"reordered chunks", join(sealed[:HeaderSize], chunk(1), chunk(0), chunk(2), chunk(3)), key},
+		{"duplicated chunk", join(sealed[:HeaderSize], chunk(0), chunk(0), chunk(2), chunk(3)), key},
+		{"dropped final chunk", join(sealed[:HeaderSize], chunk(0), chunk(1), chunk(2)), key},
+		{"dropped middle chunk", join(sealed[:HeaderSize], chunk(0), chunk(2), chunk(3)), key},
+		{"truncated final chunk", sealed[:len(sealed)-3], key},
+		{"truncated within overhead", sealed[:HeaderSize+3*sealedChunk+overhead-1], key},
+		{"truncated to the header", sealed[:HeaderSize], key},
+		{"appended chunk", join(sealed, chunk(3)), key},
+		{"changed prefix", join([]byte(magic), make([]byte, prefixSize), sealed[HeaderSize:]), key},
+	} {
+		if decrypted, err := decrypt(c.sealed, c.key); err != ErrCorrupt {
+			t.Errorf("%s: decrypted %d bytes with %v", c.name, len(decrypted), err)
+		}
+	}
+}
+
+func TestNotEncrypted(t *testing.T) {
+	for _, contents := range [][]byte{
+		nil,
+		[]byte("plain text"),
+		[]byte(magic),
+		append([]byte("BPE\x02"), make([]byte, 64)...),
+	} {
+		if IsEncrypted(contents) {
+			t.Errorf("%q is detected as encrypted", contents)
+		} else if _, err := NewReader(bytes.NewReader(contents), int64(len(contents)), newKey(t)); err == nil {
+			t.Errorf("%q opened as an encrypted file", contents)
+		}
+	}
+}
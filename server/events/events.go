@@ -0,0 +1,71 @@
+package events
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	Created  = "created"
+	Modified = "modified"
+	Moved    = "moved"
+	Deleted  = "deleted"
+)
+
+// A change made to a file or directory in a user's storage
+type Event struct {
+	Type string
+	User string
+	Path string
+	From string
+}
+
+// Create an event for a change to a namespaced path
+func New(kind, namespacedPath string) Event {
+	return Event{
+		Type: kind,
+		User: owner(namespacedPath),
+		Path: namespacedPath,
+	}
+}
+
+// Create an event for a file or directory changing location
+func NewMove(from, to string) Event {
+	event := New(Moved, to)
+	event.From = from
+	return event
+}
+
+// Distributes file events to all interested subscribers
+type Bus struct {
+	subscribers []func(Event)
+	lock        sync.RWMutex
+}
+
+// Create an event bus without any subscribers
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Register a function to be called for every published event
+func (b *Bus) Subscribe(subscriber func(Event)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers = append(b.subscribers, subscriber)
+}
+
+// Send an event to all subscribers
+// Subscribers are called synchronously so should hand off any slow work
+func (b *Bus) Publish(event Event) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, subscriber := range b.subscribers {
+		subscriber(event)
+	}
+}
+
+// Get the user owning a namespaced path
+func owner(path string) string {
+	return strings.SplitN(path, "/", 2)[0]
+}
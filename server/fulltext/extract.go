@@ -0,0 +1,320 @@
+package fulltext
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"github.com/akrantz01/bookpi/server/storage"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files larger than this are not indexed
+const maxFileSize = 32 << 20
+
+var errUnsupported = errors.New("unsupported file type")
+
+// Check if text can be extracted from a file
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".markdown", ".html", ".htm", ".xhtml", ".epub", ".pdf":
+		return true
+	default:
+		return false
+	}
+}
+
+// Extract the plain text contents of a file
+func extract(files storage.Storage, file string) (string, error) {
+	in, err := files.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	} else if info.Size() > maxFileSize {
+		return "", nil
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".txt", ".md", ".markdown":
+		buf, err := ioutil.ReadAll(in)
+		return string(buf), err
+
+	case ".html", ".htm", ".xhtml":
+		return extractHTML(in), nil
+
+	case ".epub":
+		return extractEPUB(in, info.Size())
+
+	case ".pdf":
+		buf, err := ioutil.ReadAll(in)
+		if err != nil {
+			return "", err
+		}
+		return extractPDF(buf), nil
+
+	default:
+		return "", errUnsupported
+	}
+}
+
+// Get the visible text from an HTML document
+func extractHTML(in io.Reader) string {
+	var text strings.Builder
+	skip := 0
+
+	tokenizer := html.NewTokenizer(in)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return text.String()
+
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if tag := string(name); tag == "script" || tag == "style" || tag == "head" {
+				skip++
+			}
+			text.WriteByte(' ')
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if tag := string(name); (tag == "script" || tag == "style" || tag == "head") && skip > 0 {
+				skip--
+			}
+			text.WriteByte(' ')
+
+		case html.TextToken:
+			if skip == 0 {
+				text.Write(tokenizer.Text())
+			}
+		}
+	}
+}
+
+// Get the text of every chapter in an EPUB in reading order
+func extractEPUB(in io.ReaderAt, size int64) (string, error) {
+	archive, err := zip.NewReader(in, size)
+	if err != nil {
+		return "", err
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	// Find the chapters from the package document
+	chapters := epubSpine(files)
+	if len(chapters) == 0 {
+		// Fall back to every HTML document in the archive
+		for _, f := range archive.File {
+			if ext := strings.ToLower(path.Ext(f.Name)); ext == ".html" || ext == ".htm" || ext == ".xhtml" {
+				chapters = append(chapters, f.Name)
+			}
+		}
+	}
+
+	var text strings.Builder
+	for _, chapter := range chapters {
+		f, ok := files[chapter]
+		if !ok {
+			continue
+		}
+
+		in, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(extractHTML(in))
+		text.WriteByte('\n')
+		_ = in.Close()
+	}
+
+	return text.String(), nil
+}
+
+// Get the paths of an EPUB's chapters from its package document
+func epubSpine(files map[string]*zip.File) []string {
+	// Locate the package document
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := decodeXML(files["META-INF/container.xml"], &container); err != nil || len(container.Rootfiles) == 0 {
+		return nil
+	}
+	packagePath := container.Rootfiles[0].FullPath
+
+	// Read the manifest and reading order
+	var pkg struct {
+		Items []struct {
+			Id   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IdRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := decodeXML(files[packagePath], &pkg); err != nil {
+		return nil
+	}
+
+	hrefs := make(map[string]string)
+	for _, item := range pkg.Items {
+		hrefs[item.Id] = path.Join(path.Dir(packagePath), item.Href)
+	}
+
+	var chapters []string
+	for _, ref := range pkg.Spine {
+		if href, ok := hrefs[ref.IdRef]; ok {
+			chapters = append(chapters, href)
+		}
+	}
+	return chapters
+}
+
+// Decode an XML document from a file in an archive
+func decodeXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return os.ErrNotExist
+	}
+
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return xml.NewDecoder(in).Decode(v)
+}
+
+var pdfStream = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+
+// Get whatever text can be found in a PDF's compressed content streams
+// Fonts with custom encodings will not produce readable text
+func extractPDF(buf []byte) string {
+	var text strings.Builder
+
+	for _, match := range pdfStream.FindAllSubmatchIndex(buf, -1) {
+		dictionary := buf[match[2]:match[3]]
+		start := match[1]
+		end := bytes.Index(buf[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+
+		// Only flate compressed and uncompressed streams can be read
+		data := buf[start : start+end]
+		if bytes.Contains(dictionary, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			data, _ = ioutil.ReadAll(io.LimitReader(reader, maxFileSize))
+			_ = reader.Close()
+		} else if bytes.Contains(dictionary, []byte("/Filter")) {
+			continue
+		}
+
+		pdfText(data, &text)
+	}
+
+	return text.String()
+}
+
+// Collect the strings shown by text operators in a content stream
+func pdfText(stream []byte, text *strings.Builder) {
+	inText := false
+	for i := 0; i < len(stream); i++ {
+		switch c := stream[i]; {
+		case c == '(' && inText:
+			value, next := pdfString(stream, i)
+			text.WriteString(value)
+			i = next
+
+		case c == 'B' && i+1 < len(stream) && stream[i+1] == 'T' && pdfDelimited(stream, i, 2):
+			inText = true
+			i++
+
+		case c == 'E' && i+1 < len(stream) && stream[i+1] == 'T' && pdfDelimited(stream, i, 2):
+			inText = false
+			text.WriteByte('\n')
+			i++
+
+		case (c == 'T' || c == '\'' || c == '"') && inText:
+			// Moving to a new line or showing text separates words
+			text.WriteByte(' ')
+		}
+	}
+}
+
+// Check if an operator is surrounded by whitespace or the stream boundaries
+func pdfDelimited(stream []byte, start, length int) bool {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\n' || c == '\r' || c == '\t' }
+	before := start == 0 || isSpace(stream[start-1])
+	after := start+length >= len(stream) || isSpace(stream[start+length])
+	return before && after
+}
+
+// Parse a literal string starting at an opening parenthesis
+func pdfString(stream []byte, start int) (string, int) {
+	var value strings.Builder
+	depth := 0
+
+	for i := start; i < len(stream); i++ {
+		switch c := stream[i]; c {
+		case '\\':
+			if i+1 >= len(stream) {
+				return value.String(), i
+			}
+			i++
+			switch escaped := stream[i]; escaped {
+			case 'n', 'r':
+				value.WriteByte(' ')
+			case 't':
+				value.WriteByte('\t')
+			case 'b', 'f':
+			default:
+				// Skip octal character codes as they depend on the font encoding
+				if escaped >= '0' && escaped <= '7' {
+					for j := 0; j < 2 && i+1 < len(stream) && stream[i+1] >= '0' && stream[i+1] <= '7'; j++ {
+						i++
+					}
+					continue
+				}
+				value.WriteByte(escaped)
+			}
+
+		case '(':
+			if depth > 0 {
+				value.WriteByte(c)
+			}
+			depth++
+
+		case ')':
+			depth--
+			if depth == 0 {
+				return value.String(), i
+			}
+			value.WriteByte(c)
+
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return value.String(), len(stream)
+}
@@ -0,0 +1,624 @@
+package fulltext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Returned from searches when the index is turned off because the files are encrypted
+var ErrDisabled = errors.New("full-text search is unavailable while files are encrypted")
+
+var (
+	bucketTerms     = []byte("terms")
+	bucketDocuments = []byte("documents")
+	keyStatistics   = []byte("statistics")
+)
+
+const (
+	// Only this much extracted text is kept for generating snippets
+	maxStoredText = 256 << 10
+
+	// Characters of context on either side of a match in a snippet
+	snippetContext = 80
+
+	// BM25 ranking parameters
+	k1 = 1.2
+	b  = 0.75
+)
+
+// An indexed document
+type document struct {
+	Terms    []string `json:"terms"`
+	Length   int      `json:"length"`
+	Modified int64    `json:"modified"`
+	Text     string   `json:"text"`
+}
+
+// Totals across all indexed documents
+type statistics struct {
+	Documents   int   `json:"documents"`
+	TotalLength int64 `json:"total_length"`
+}
+
+// A document matching a query
+type Hit struct {
+	Path    string  `json:"path"`
+	Name    string  `json:"name"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// Inverted index of the text within users' files
+type Index struct {
+	files    storage.Storage
+	throttle time.Duration
+	db       *bolt.DB
+
+	// Nothing is indexed when the files are encrypted since the terms would reveal their contents
+	disabled bool
+
+	pending map[string]bool
+	signal  chan struct{}
+	lock    sync.Mutex
+}
+
+// Create a full-text index, waiting between each indexed file to keep the system responsive
+func New(files storage.Storage, throttle time.Duration, db *bolt.DB) (*Index, error) {
+	_, sealed := files.(storage.Sealer)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketFulltext)
+
+		// Throw away anything indexed before encryption was turned on
+		if sealed {
+			for _, name := range [][]byte{bucketTerms, bucketDocuments} {
+				if err := bucket.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			if err := bucket.Delete(keyStatistics); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range [][]byte{bucketTerms, bucketDocuments} {
+			if _, err := bucket.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &Index{
+		files:    files,
+		throttle: throttle,
+		db:       db,
+		disabled: sealed,
+		pending:  make(map[string]bool),
+		signal:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Queue changed files for indexing
+func (i *Index) Handle(event events.Event) {
+	if i.disabled {
+		return
+	}
+
+	switch event.Type {
+	case events.Created, events.Modified:
+		i.queue(event.Path)
+	case events.Moved:
+		i.queue(event.From)
+		i.queue(event.Path)
+	case events.Deleted:
+		i.queue(event.Path)
+	}
+}
+
+// Add a path to be re-indexed
+func (i *Index) queue(namespacedPath string) {
+	i.lock.Lock()
+	i.pending[namespacedPath] = true
+	i.lock.Unlock()
+
+	// Wake the worker if it is idle
+	select {
+	case i.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Process queued paths one at a time
+func (i *Index) Run() {
+	for range i.signal {
+		for {
+			// Take the next pending path
+			i.lock.Lock()
+			var next string
+			for p := range i.pending {
+				next = p
+				break
+			}
+			delete(i.pending, next)
+			i.lock.Unlock()
+
+			if next == "" {
+				break
+			}
+
+			if err := i.sync(next); err != nil {
+				log.Printf("ERROR: failed to update full-text index for %s: %v\n", next, err)
+			}
+		}
+	}
+}
+
+// Periodically queue any files changed outside of the API
+func (i *Index) Walk(interval time.Duration) {
+	if i.disabled {
+		return
+	}
+
+	for {
+		if err := i.rescan(); err != nil {
+			log.Printf("ERROR: failed to scan for full-text index changes: %v\n", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Queue every file whose indexed modification time is out of date
+func (i *Index) rescan() error {
+	// Get the current state of the index
+	indexed := make(map[string]int64)
+	if err := i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketFulltext).Bucket(bucketDocuments).ForEach(func(k, v []byte) error {
+			var doc document
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return err
+			}
+			indexed[string(k)] = doc.Modified
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	// Find new and modified files
+	err := i.files.Walk("", func(relative string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip internal storage directories
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && relative != "" {
+			return filepath.SkipDir
+		} else if info.IsDir() || !Supported(info.Name()) {
+			return nil
+		}
+
+		if modified, ok := indexed[relative]; !ok || modified != info.ModTime().UnixNano() {
+			i.queue(relative)
+		}
+		delete(indexed, relative)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Anything left over no longer exists
+	for missing := range indexed {
+		i.queue(missing)
+	}
+
+	return nil
+}
+
+// Bring the index up to date for a path and everything beneath it
+func (i *Index) sync(namespacedPath string) error {
+	// Drop everything that no longer exists
+	info, err := i.files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		return i.removeUnder(namespacedPath)
+	} else if err != nil {
+		return err
+	}
+
+	// Queue the contents of directories individually
+	if info.IsDir() {
+		if err := i.removeMissing(namespacedPath); err != nil {
+			return err
+		}
+
+		children, err := i.files.List(namespacedPath)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if child.IsDir() || Supported(child.Name()) {
+				i.queue(path.Join(namespacedPath, child.Name()))
+			}
+		}
+		return nil
+	}
+
+	if !Supported(info.Name()) {
+		return nil
+	}
+
+	// Leave the system some room between files
+	time.Sleep(i.throttle)
+
+	// The file may have moved while waiting, and locked files are indexed once their owner logs in
+	text, err := extract(i.files, namespacedPath)
+	if os.IsNotExist(err) || err == storage.ErrLocked {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return i.add(namespacedPath, text, info.ModTime().UnixNano())
+}
+
+// Store a document's terms in the index
+func (i *Index) add(namespacedPath, text string, modified int64) error {
+	// Count the occurrences of each term
+	frequencies := make(map[string]uint64)
+	length := 0
+	for _, term := range tokenize(text) {
+		frequencies[term]++
+		length++
+	}
+
+	doc := document{
+		Terms:    make([]string, 0, len(frequencies)),
+		Length:   length,
+		Modified: modified,
+		Text:     truncate(text, maxStoredText),
+	}
+	for term := range frequencies {
+		doc.Terms = append(doc.Terms, term)
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketFulltext)
+		terms, documents := root.Bucket(bucketTerms), root.Bucket(bucketDocuments)
+
+		if err := remove(root, namespacedPath); err != nil {
+			return err
+		}
+
+		// Write postings as term, separator, path
+		for term, frequency := range frequencies {
+			buf := make([]byte, binary.MaxVarintLen64)
+			n := binary.PutUvarint(buf, frequency)
+			if err := terms.Put(postingKey(term, namespacedPath), buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err := documents.Put([]byte(namespacedPath), encoded); err != nil {
+			return err
+		}
+
+		return updateStatistics(root, 1, int64(length))
+	})
+}
+
+// Remove a path and everything beneath it from the index
+func (i *Index) removeUnder(namespacedPath string) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketFulltext)
+		for _, key := range keysUnder(root.Bucket(bucketDocuments), namespacedPath) {
+			if err := remove(root, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove any documents beneath a directory that no longer exist
+func (i *Index) removeMissing(namespacedPath string) error {
+	var keys []string
+	if err := i.db.View(func(tx *bolt.Tx) error {
+		keys = keysUnder(tx.Bucket(models.BucketFulltext).Bucket(bucketDocuments), namespacedPath)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := i.files.Stat(key); os.IsNotExist(err) {
+			if err := i.removeUnder(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Find documents within a user's storage containing every query term
+func (i *Index) Search(username, scope, query string, limit, offset int) ([]Hit, int, error) {
+	if i.disabled {
+		return nil, 0, ErrDisabled
+	}
+
+	terms := unique(tokenize(query))
+	if len(terms) == 0 {
+		return []Hit{}, 0, nil
+	}
+	prefix := path.Join(username, path.Join("/", scope)) + "/"
+
+	var hits []Hit
+	total := 0
+	err := i.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(models.BucketFulltext)
+		postings, documents := root.Bucket(bucketTerms), root.Bucket(bucketDocuments)
+
+		stats := readStatistics(root)
+		if stats.Documents == 0 {
+			return nil
+		}
+		averageLength := float64(stats.TotalLength) / float64(stats.Documents)
+
+		// Score documents containing each term
+		scores := make(map[string]float64)
+		matched := make(map[string]int)
+		for _, term := range terms {
+			frequencies := make(map[string]uint64)
+			termPrefix := postingKey(term, "")
+			cursor := postings.Cursor()
+			for k, v := cursor.Seek(termPrefix); k != nil && bytes.HasPrefix(k, termPrefix); k, v = cursor.Next() {
+				frequency, _ := binary.Uvarint(v)
+				frequencies[string(k[len(termPrefix):])] = frequency
+			}
+
+			found := float64(len(frequencies))
+			idf := math.Log(1 + (float64(stats.Documents)-found+0.5)/(found+0.5))
+			for p, frequency := range frequencies {
+				if !strings.HasPrefix(p, prefix) {
+					continue
+				}
+
+				var doc document
+				if err := json.Unmarshal(documents.Get([]byte(p)), &doc); err != nil {
+					return err
+				}
+
+				tf := float64(frequency)
+				scores[p] += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(doc.Length)/averageLength))
+				matched[p]++
+			}
+		}
+
+		// Only keep documents with every term
+		for p, score := range scores {
+			if matched[p] == len(terms) {
+				hits = append(hits, Hit{
+					Path:  strings.TrimPrefix(p, username),
+					Name:  path.Base(p),
+					Score: score,
+				})
+			}
+		}
+
+		// Best matches first
+		sort.Slice(hits, func(x, y int) bool {
+			if hits[x].Score == hits[y].Score {
+				return hits[x].Path < hits[y].Path
+			}
+			return hits[x].Score > hits[y].Score
+		})
+
+		// Paginate the hits
+		total = len(hits)
+		if offset >= total {
+			hits = []Hit{}
+			return nil
+		}
+		hits = hits[offset:]
+		if limit > 0 && limit < len(hits) {
+			hits = hits[:limit]
+		}
+
+		// Only generate snippets for the returned hits
+		for j := range hits {
+			var doc document
+			if err := json.Unmarshal(documents.Get([]byte(username+hits[j].Path)), &doc); err != nil {
+				return err
+			}
+			hits[j].Snippet = snippet(doc.Text, terms)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	} else if hits == nil {
+		hits = []Hit{}
+	}
+
+	return hits, total, nil
+}
+
+// Delete a document and its postings
+func remove(root *bolt.Bucket, namespacedPath string) error {
+	documents, terms := root.Bucket(bucketDocuments), root.Bucket(bucketTerms)
+
+	raw := documents.Get([]byte(namespacedPath))
+	if raw == nil {
+		return nil
+	}
+
+	var doc document
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+
+	for _, term := range doc.Terms {
+		if err := terms.Delete(postingKey(term, namespacedPath)); err != nil {
+			return err
+		}
+	}
+	if err := documents.Delete([]byte(namespacedPath)); err != nil {
+		return err
+	}
+
+	return updateStatistics(root, -1, -int64(doc.Length))
+}
+
+// Get the index totals
+func readStatistics(root *bolt.Bucket) statistics {
+	var stats statistics
+	_ = json.Unmarshal(root.Get(keyStatistics), &stats)
+	return stats
+}
+
+// Adjust the index totals
+func updateStatistics(root *bolt.Bucket, documents int, length int64) error {
+	stats := readStatistics(root)
+	stats.Documents += documents
+	stats.TotalLength += length
+
+	encoded, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return root.Put(keyStatistics, encoded)
+}
+
+// Build the key for a term's posting in a document
+func postingKey(term, namespacedPath string) []byte {
+	return []byte(term + "\x00" + namespacedPath)
+}
+
+// Get all keys equal to or nested under a path
+func keysUnder(bucket *bolt.Bucket, namespacedPath string) []string {
+	var keys []string
+	if bucket.Get([]byte(namespacedPath)) != nil {
+		keys = append(keys, namespacedPath)
+	}
+
+	prefix := []byte(namespacedPath + "/")
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+// Split text into lowercase terms
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Remove duplicate terms while keeping order
+func unique(terms []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			result = append(result, term)
+		}
+	}
+	return result
+}
+
+// Cut text to at most some number of bytes without splitting a character
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	for length > 0 && !utf8.RuneStart(text[length]) {
+		length--
+	}
+	return text[:length]
+}
+
+// Get the text surrounding the first occurrence of any term
+func snippet(text string, terms []string) string {
+	// Find the earliest match
+	position := -1
+	for _, term := range terms {
+		if index := indexFold(text, term); index >= 0 && (position < 0 || index < position) {
+			position = index
+		}
+	}
+	if position < 0 {
+		position = 0
+	}
+
+	// Expand to the surrounding context on character boundaries
+	start, end := position-snippetContext, position+snippetContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	result := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		result = "…" + result
+	}
+	if end < len(text) {
+		result += "…"
+	}
+	return result
+}
+
+// Find the first occurrence of a term in text ignoring case, as an offset into the text itself.
+// Changing case can change the length of text, so the text is compared in place a character at a time.
+func indexFold(text, term string) int {
+	length := utf8.RuneCountInString(term)
+	if length == 0 {
+		return -1
+	}
+
+	for start := range text {
+		end := start
+		for n := 0; n < length && end < len(text); n++ {
+			_, size := utf8.DecodeRuneInString(text[end:])
+			end += size
+		}
+		if strings.EqualFold(text[start:end], term) {
+			return start
+		}
+	}
+	return -1
+}
@@ -0,0 +1,39 @@
+package fulltext
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSnippetCaseChangingRunes(t *testing.T) {
+	// Lowercasing these changes their length in bytes
+	for _, text := range []string{
+		strings.Repeat("Ⱥ", 200) + " needle",
+		strings.Repeat("İ", 200) + " needle " + strings.Repeat("İ", 200),
+		"needle " + strings.Repeat("ȺİK", 100),
+	} {
+		result := snippet(text, []string{"needle"})
+		if !utf8.ValidString(result) {
+			t.Errorf("snippet is not valid UTF-8: %q", result)
+		} else if !strings.Contains(result, "needle") {
+			t.Errorf("snippet does not contain the match: %q", result)
+		}
+	}
+}
+
+func TestIndexFold(t *testing.T) {
+	for _, c := range []struct {
+		text, term string
+		want       int
+	}{
+		{"Hello World", "world", 6},
+		{"ȺȺ Straße", "straße", 5},
+		{"İstanbul", "x", -1},
+		{"abc", "", -1},
+	} {
+		if got := indexFold(c.text, c.term); got != c.want {
+			t.Errorf("indexFold(%q, %q) = %d, want %d", c.text, c.term, got, c.want)
+		}
+	}
+}
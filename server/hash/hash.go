@@ -26,3 +26,31 @@ func Hash(password string, p *Params) (encodedHash string, err error) {
 
 	return encodeHash(hash, salt, p), nil
 }
+
+// Generate the parameters and salt for deriving a key from a password with the default configuration
+func DefaultKeyParams() (string, error) {
+	p := &Params{
+		memory:      32 * 1024,
+		iterations:  4,
+		parallelism: 4,
+		saltLength:  16,
+		keyLength:   32,
+	}
+
+	salt, err := randomBytes(p.saltLength)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeHash(nil, salt, p), nil
+}
+
+// Derive a 32 byte key from a password using previously generated parameters
+func DeriveKey(password, encodedParams string) ([]byte, error) {
+	p, salt, _, err := decodeHash(encodedParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, 32), nil
+}
@@ -0,0 +1,467 @@
+package integrity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	bucketSums    = []byte("sums")
+	bucketReports = []byte("reports")
+)
+
+// Kinds of problems found while scrubbing
+const (
+	ProblemMismatch   = "mismatch"
+	ProblemMissing    = "missing"
+	ProblemUnreadable = "unreadable"
+)
+
+// The SHA-256 of a file's contents when it had a size and modification time
+type Checksum struct {
+	Sum      string `json:"sum"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+	Verified int64  `json:"verified"`
+}
+
+// Check if a checksum still describes a file
+func (c *Checksum) Matches(info os.FileInfo) bool {
+	return c.Size == info.Size() && c.Modified == info.ModTime().UnixNano()
+}
+
+// A file whose contents could not be verified
+type Problem struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Found    int64  `json:"found"`
+}
+
+// Problems with a user's files, kept until the user clears them
+type Report struct {
+	User     string    `json:"user"`
+	Checked  int       `json:"checked"`
+	Scrubbed int64     `json:"scrubbed"`
+	Problems []Problem `json:"problems"`
+}
+
+// Keeps checksums of users' files and periodically verifies them
+type Store struct {
+	files storage.Storage
+	db    *bolt.DB
+	lock  sync.Mutex
+}
+
+// Create a checksum store for users' files
+func New(files storage.Storage, db *bolt.DB) (*Store, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketChecksums)
+		for _, name := range [][]byte{bucketSums, bucketReports} {
+			if _, err := bucket.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		files: files,
+		db:    db,
+	}, nil
+}
+
+// Hash contents as they are copied to an output
+func NewHasher(out io.Writer) (io.Writer, func() string) {
+	h := sha256.New()
+	return io.MultiWriter(out, h), func() string {
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// Save the checksum of a file's current contents
+func (s *Store) Record(namespacedPath, sum string) error {
+	info, err := s.files.Stat(namespacedPath)
+	if err != nil {
+		return err
+	}
+
+	return s.save(namespacedPath, &Checksum{
+		Sum:      sum,
+		Size:     info.Size(),
+		Modified: info.ModTime().UnixNano(),
+		Verified: time.Now().Unix(),
+	})
+}
+
+// Get the checksum of a file if it is known for its current contents
+func (s *Store) Get(namespacedPath string, info os.FileInfo) *Checksum {
+	var sum Checksum
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(models.BucketChecksums).Bucket(bucketSums).Get([]byte(namespacedPath)), &sum)
+	}); err != nil || !sum.Matches(info) {
+		return nil
+	}
+	return &sum
+}
+
+// Keep checksums following their files
+func (s *Store) Handle(event events.Event) {
+	var err error
+	switch event.Type {
+	case events.Moved:
+		err = s.move(event.From, event.Path)
+	case events.Deleted:
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			// Deleted users no longer need their report
+			if event.Path == event.User {
+				if err := tx.Bucket(models.BucketChecksums).Bucket(bucketReports).Delete([]byte(event.User)); err != nil {
+					return err
+				}
+			}
+			return removeUnder(tx.Bucket(models.BucketChecksums).Bucket(bucketSums), event.Path)
+		})
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to update checksums for %s: %v\n", event.Path, err)
+	}
+}
+
+// Get the problems found with a user's files
+func (s *Store) Report(username string) (*Report, error) {
+	report := &Report{User: username, Problems: []Problem{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if buf := tx.Bucket(models.BucketChecksums).Bucket(bucketReports).Get([]byte(username)); buf != nil {
+			return json.Unmarshal(buf, report)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// Get the reports for every user with problems
+func (s *Store) Reports() ([]*Report, error) {
+	reports := []*Report{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketChecksums).Bucket(bucketReports).ForEach(func(_, v []byte) error {
+			var report Report
+			if err := json.Unmarshal(v, &report); err != nil {
+				return err
+			}
+			if len(report.Problems) > 0 {
+				reports = append(reports, &report)
+			}
+			return nil
+		})
+	})
+	return reports, err
+}
+
+// Acknowledge the problems found with a user's files
+func (s *Store) Clear(username string) error {
+	return s.updateReport(username, func(report *Report) {
+		report.Problems = []Problem{}
+	})
+}
+
+// Periodically re-hash every file and report any that changed without being written
+func (s *Store) Scrub(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := s.scrub(); err != nil {
+			log.Printf("ERROR: failed to scrub users' files: %v\n", err)
+		}
+	}
+}
+
+// Verify every file against its checksum, adopting files written outside of uploads
+func (s *Store) scrub() error {
+	// Only one scrub at a time
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Get all the known checksums
+	known := make(map[string]Checksum)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketChecksums).Bucket(bucketSums).ForEach(func(k, v []byte) error {
+			var sum Checksum
+			if err := json.Unmarshal(v, &sum); err != nil {
+				return err
+			}
+			known[string(k)] = sum
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	checked := make(map[string]int)
+	problems := make(map[string][]Problem)
+	err := s.files.Walk("", func(namespacedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip internal storage directories
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && namespacedPath != "" {
+			return filepath.SkipDir
+		} else if info.IsDir() {
+			return nil
+		}
+
+		previous, ok := known[namespacedPath]
+		delete(known, namespacedPath)
+
+		problem, err := s.verify(namespacedPath, info, previous, ok)
+		if err != nil {
+			return err
+		} else if problem != nil {
+			log.Printf("WARNING: integrity check failed for %s: %s\n", namespacedPath, problem.Kind)
+			problems[owner(namespacedPath)] = append(problems[owner(namespacedPath)], *problem)
+		}
+		checked[owner(namespacedPath)]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Files with checksums that were never removed have gone missing
+	now := time.Now().Unix()
+	for namespacedPath, previous := range known {
+		// Files deleted during the scrub have already had their checksums removed
+		missing := false
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(models.BucketChecksums).Bucket(bucketSums)
+			if bucket.Get([]byte(namespacedPath)) == nil {
+				return nil
+			}
+
+			// Only report missing files once
+			missing = true
+			return bucket.Delete([]byte(namespacedPath))
+		}); err != nil {
+			return err
+		} else if !missing {
+			continue
+		}
+
+		log.Printf("WARNING: integrity check failed for %s: %s\n", namespacedPath, ProblemMissing)
+		problems[owner(namespacedPath)] = append(problems[owner(namespacedPath)], Problem{
+			Path:     relative(namespacedPath),
+			Kind:     ProblemMissing,
+			Expected: previous.Sum,
+			Found:    now,
+		})
+	}
+
+	// Add to each user's outstanding problems
+	for username := range merge(checked, problems) {
+		if err := s.updateReport(username, func(report *Report) {
+			report.Checked = checked[username]
+			report.Scrubbed = now
+			report.Problems = addProblems(report.Problems, problems[username])
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Re-hash a file, comparing it with its checksum if its contents should not have changed
+func (s *Store) verify(namespacedPath string, info os.FileInfo, previous Checksum, known bool) (*Problem, error) {
+	sum, err := s.hash(namespacedPath)
+	if os.IsNotExist(err) || err == storage.ErrLocked {
+		// Removed since the walk or cannot be read until its owner logs in
+		return nil, nil
+	} else if err != nil {
+		return &Problem{
+			Path:     relative(namespacedPath),
+			Kind:     ProblemUnreadable,
+			Expected: previous.Sum,
+			Found:    time.Now().Unix(),
+		}, nil
+	}
+
+	// Ignore files which changed while being read
+	if current, err := s.files.Stat(namespacedPath); err != nil || current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		return nil, nil
+	}
+
+	// Contents written since the last scrub become the new checksum
+	if !known || !previous.Matches(info) {
+		return nil, s.save(namespacedPath, &Checksum{
+			Sum:      sum,
+			Size:     info.Size(),
+			Modified: info.ModTime().UnixNano(),
+			Verified: time.Now().Unix(),
+		})
+	}
+
+	if sum != previous.Sum {
+		return &Problem{
+			Path:     relative(namespacedPath),
+			Kind:     ProblemMismatch,
+			Expected: previous.Sum,
+			Actual:   sum,
+			Found:    time.Now().Unix(),
+		}, nil
+	}
+
+	previous.Verified = time.Now().Unix()
+	return nil, s.save(namespacedPath, &previous)
+}
+
+// Compute the SHA-256 of a file's contents
+func (s *Store) hash(namespacedPath string) (string, error) {
+	in, err := s.files.Open(namespacedPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Write a file's checksum
+func (s *Store) save(namespacedPath string, sum *Checksum) error {
+	buf, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketChecksums).Bucket(bucketSums).Put([]byte(namespacedPath), buf)
+	})
+}
+
+// Move the checksums for a path and everything beneath it
+func (s *Store) move(from, to string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketChecksums).Bucket(bucketSums)
+
+		moved := make(map[string][]byte)
+		if buf := bucket.Get([]byte(from)); buf != nil {
+			moved[to] = append([]byte{}, buf...)
+		}
+		prefix := []byte(from + "/")
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			moved[to+"/"+string(k[len(prefix):])] = append([]byte{}, v...)
+		}
+
+		if err := removeUnder(bucket, from); err != nil {
+			return err
+		}
+		for k, v := range moved {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Change a user's report
+func (s *Store) updateReport(username string, update func(report *Report)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketChecksums).Bucket(bucketReports)
+
+		report := Report{User: username, Problems: []Problem{}}
+		if buf := bucket.Get([]byte(username)); buf != nil {
+			if err := json.Unmarshal(buf, &report); err != nil {
+				return err
+			}
+		}
+		update(&report)
+
+		buf, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
+// Delete a key and everything beneath it
+func removeUnder(bucket *bolt.Bucket, namespacedPath string) error {
+	var keys [][]byte
+	prefix := []byte(namespacedPath + "/")
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	keys = append(keys, []byte(namespacedPath))
+
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add newly found problems, replacing any already reported for the same file
+func addProblems(existing, found []Problem) []Problem {
+	replaced := make(map[string]bool)
+	for _, problem := range found {
+		replaced[problem.Path] = true
+	}
+
+	problems := []Problem{}
+	for _, problem := range existing {
+		if !replaced[problem.Path] {
+			problems = append(problems, problem)
+		}
+	}
+	return append(problems, found...)
+}
+
+// Get every user with files checked or problems found
+func merge(checked map[string]int, problems map[string][]Problem) map[string]bool {
+	users := make(map[string]bool)
+	for username := range checked {
+		users[username] = true
+	}
+	for username := range problems {
+		users[username] = true
+	}
+	return users
+}
+
+// Get the user owning a namespaced path
+func owner(namespacedPath string) string {
+	return strings.SplitN(namespacedPath, "/", 2)[0]
+}
+
+// Get a namespaced path relative to its owner's files
+func relative(namespacedPath string) string {
+	parts := strings.SplitN(namespacedPath, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,164 @@
+package jobs
+
+import (
+	uuid "github.com/satori/go.uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// A long running operation performed on behalf of a user
+type Job struct {
+	Id       string
+	Owner    string
+	Kind     string
+	status   string
+	total    int64
+	done     int64
+	err      string
+	started  time.Time
+	finished time.Time
+	lock     sync.Mutex
+}
+
+// Set the total amount of work to be done
+func (j *Job) SetTotal(total int64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.total = total
+}
+
+// Record some amount of completed work
+func (j *Job) Advance(amount int64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.done += amount
+}
+
+// Check if the job is no longer running
+func (j *Job) Finished() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.status != StatusRunning
+}
+
+// Mark the job as finished with an optional error
+func (j *Job) finish(err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.finished = time.Now()
+	if err != nil {
+		j.status = StatusFailed
+		j.err = err.Error()
+	} else {
+		j.status = StatusCompleted
+	}
+}
+
+// Get a description of the job's current state
+func (j *Job) Describe() map[string]interface{} {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	description := map[string]interface{}{
+		"id":       j.Id,
+		"kind":     j.Kind,
+		"status":   j.status,
+		"total":    j.total,
+		"done":     j.done,
+		"started":  j.started.Unix(),
+		"finished": nil,
+		"error":    nil,
+	}
+	if !j.finished.IsZero() {
+		description["finished"] = j.finished.Unix()
+	}
+	if j.err != "" {
+		description["error"] = j.err
+	}
+
+	return description
+}
+
+// Tracks running and recently finished jobs
+type Manager struct {
+	retention time.Duration
+	jobs      map[string]*Job
+	lock      sync.Mutex
+}
+
+// Create a job manager keeping finished jobs for some duration
+func New(retention time.Duration) *Manager {
+	return &Manager{
+		retention: retention,
+		jobs:      make(map[string]*Job),
+	}
+}
+
+// Run a function in the background as a job
+func (m *Manager) Start(owner, kind string, run func(job *Job) error) *Job {
+	job := &Job{
+		Id:      uuid.NewV4().String(),
+		Owner:   owner,
+		Kind:    kind,
+		status:  StatusRunning,
+		started: time.Now(),
+	}
+
+	m.lock.Lock()
+	m.expire()
+	m.jobs[job.Id] = job
+	m.lock.Unlock()
+
+	go func() {
+		err := run(job)
+		if err != nil {
+			log.Printf("ERROR: %s job %s failed: %v\n", kind, job.Id, err)
+		}
+		job.finish(err)
+	}()
+
+	return job
+}
+
+// Find a job by its id
+func (m *Manager) Find(id string) *Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.jobs[id]
+}
+
+// Get all the jobs owned by a user
+func (m *Manager) List(owner string) []*Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var jobs []*Job
+	for _, job := range m.jobs {
+		if job.Owner == owner {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// Forget jobs that finished longer ago than the retention period
+func (m *Manager) expire() {
+	cutoff := time.Now().Add(-m.retention)
+	for id, job := range m.jobs {
+		job.lock.Lock()
+		expired := !job.finished.IsZero() && job.finished.Before(cutoff)
+		job.lock.Unlock()
+
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package library
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Largest cover image which will be read from a book
+const maxCoverSize = 8 << 20
+
+var errNoPackage = errors.New("epub has no package document")
+
+// The parts of an EPUB package document describing the book
+type epubPackage struct {
+	Metadata struct {
+		Titles      []string `xml:"title"`
+		Creators    []string `xml:"creator"`
+		Languages   []string `xml:"language"`
+		Identifiers []string `xml:"identifier"`
+		Description string   `xml:"description"`
+		Publisher   string   `xml:"publisher"`
+		Date        string   `xml:"date"`
+		Subjects    []string `xml:"subject"`
+		Meta        []struct {
+			Name     string `xml:"name,attr"`
+			Content  string `xml:"content,attr"`
+			Property string `xml:"property,attr"`
+			Id       string `xml:"id,attr"`
+			Refines  string `xml:"refines,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Items []struct {
+		Id         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+}
+
+// Read a book's details from the package document of an EPUB
+func parseEPUB(in io.ReaderAt, size int64) (*Book, error) {
+	archive, err := zip.NewReader(in, size)
+	if err != nil {
+		return nil, err
+	}
+
+	packagePath, err := epubPackagePath(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkg epubPackage
+	if err := decodeXML(findFile(archive, packagePath), &pkg); err != nil {
+		return nil, err
+	}
+	metadata := pkg.Metadata
+
+	book := &Book{
+		Format:      FormatEPUB,
+		Authors:     []string{},
+		Subjects:    []string{},
+		Description: strings.TrimSpace(metadata.Description),
+		Publisher:   strings.TrimSpace(metadata.Publisher),
+		Published:   strings.TrimSpace(metadata.Date),
+	}
+	if len(metadata.Titles) > 0 {
+		book.Title = strings.TrimSpace(metadata.Titles[0])
+	}
+	if len(metadata.Languages) > 0 {
+		book.Language = strings.TrimSpace(metadata.Languages[0])
+	}
+	if len(metadata.Identifiers) > 0 {
+		book.Identifier = strings.TrimSpace(metadata.Identifiers[0])
+	}
+	for _, creator := range metadata.Creators {
+		if creator = strings.TrimSpace(creator); creator != "" {
+			book.Authors = append(book.Authors, creator)
+		}
+	}
+	for _, subject := range metadata.Subjects {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			book.Subjects = append(book.Subjects, subject)
+		}
+	}
+
+	// Series are described by calibre's metadata in EPUB 2 and collections in EPUB 3
+	coverId := ""
+	collections := make(map[string]string)
+	for _, meta := range metadata.Meta {
+		switch {
+		case meta.Name == "cover":
+			coverId = meta.Content
+		case meta.Name == "calibre:series":
+			book.Series = strings.TrimSpace(meta.Content)
+		case meta.Name == "calibre:series_index":
+			book.SeriesIndex, _ = strconv.ParseFloat(meta.Content, 64)
+		case meta.Property == "belongs-to-collection" && book.Series == "":
+			book.Series = strings.TrimSpace(meta.Value)
+			collections[meta.Id] = book.Series
+		case meta.Property == "group-position" && collections[strings.TrimPrefix(meta.Refines, "#")] != "":
+			book.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(meta.Value), 64)
+		}
+	}
+
+	// Find the cover image from the manifest
+	for _, item := range pkg.Items {
+		if item.Id == coverId || strings.Contains(" "+item.Properties+" ", " cover-image ") {
+			if strings.HasPrefix(item.MediaType, "image/") {
+				book.Cover = path.Join(path.Dir(packagePath), item.Href)
+				book.CoverType = item.MediaType
+				break
+			}
+		}
+	}
+
+	return book, nil
+}
+
+// Read the cover image of an EPUB
+func epubCover(in io.ReaderAt, size int64, cover string) ([]byte, error) {
+	archive, err := zip.NewReader(in, size)
+	if err != nil {
+		return nil, err
+	}
+
+	f := findFile(archive, cover)
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+
+	reader, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(io.LimitReader(reader, maxCoverSize))
+}
+
+// Locate the package document of an EPUB from its container
+func epubPackagePath(archive *zip.Reader) (string, error) {
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := decodeXML(findFile(archive, "META-INF/container.xml"), &container); err != nil {
+		return "", err
+	} else if len(container.Rootfiles) == 0 {
+		return "", errNoPackage
+	}
+	return container.Rootfiles[0].FullPath, nil
+}
+
+// Get a file within an archive
+func findFile(archive *zip.Reader, name string) *zip.File {
+	for _, f := range archive.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Decode an XML document from a file in an archive
+func decodeXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return os.ErrNotExist
+	}
+
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return xml.NewDecoder(in).Decode(v)
+}
@@ -0,0 +1,441 @@
+package library
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatEPUB = "epub"
+	FormatPDF  = "pdf"
+)
+
+// Returned from queries when the library is turned off because the files are encrypted
+var ErrDisabled = errors.New("the library is unavailable while files are encrypted")
+
+var ErrNoCover = errors.New("book has no cover")
+
+// An ebook found within a user's files
+type Book struct {
+	Path        string   `json:"path"`
+	Format      string   `json:"format"`
+	Title       string   `json:"title"`
+	Authors     []string `json:"authors"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex float64  `json:"series_index,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Identifier  string   `json:"identifier,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	Published   string   `json:"published,omitempty"`
+	Subjects    []string `json:"subjects"`
+	Cover       string   `json:"cover,omitempty"`
+	CoverType   string   `json:"cover_type,omitempty"`
+
+	// KOReader's partial MD5 of the contents used to identify the document when syncing
+	Hash string `json:"hash,omitempty"`
+
+	// Used to determine if the indexed copy is stale
+	Size     int64 `json:"size"`
+	Modified int64 `json:"modified"`
+}
+
+// Get the book's path relative to its owner's files
+func (b *Book) RelativePath() string {
+	parts := strings.SplitN(b.Path, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Check if a book matches a search query against its title, authors, series and subjects
+func (b *Book) Matches(query string) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	fields := append([]string{b.Title, b.Series, b.Description}, b.Authors...)
+	fields = append(fields, b.Subjects...)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a file can be added to the library
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".epub", ".pdf":
+		return true
+	default:
+		return false
+	}
+}
+
+// Index of the ebooks in users' files, kept up to date in the background
+type Library struct {
+	files storage.Storage
+	db    *bolt.DB
+
+	// Nothing is cataloged when the files are encrypted since the tags would reveal their contents
+	disabled bool
+
+	pending map[string]bool
+	signal  chan struct{}
+	lock    sync.Mutex
+}
+
+// Create a library for users' files
+func New(files storage.Storage, db *bolt.DB) (*Library, error) {
+	// Throw away anything cataloged before encryption was turned on
+	_, sealed := files.(storage.Sealer)
+	if sealed {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(models.BucketLibrary); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err := tx.CreateBucket(models.BucketLibrary)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Library{
+		files:    files,
+		db:       db,
+		disabled: sealed,
+		pending:  make(map[string]bool),
+		signal:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Queue changed books for indexing
+func (l *Library) Handle(event events.Event) {
+	if l.disabled {
+		return
+	}
+
+	switch event.Type {
+	case events.Created, events.Modified, events.Deleted:
+		l.queue(event.Path)
+	case events.Moved:
+		l.queue(event.From)
+		l.queue(event.Path)
+	}
+}
+
+// Add a path to be re-indexed
+func (l *Library) queue(namespacedPath string) {
+	l.lock.Lock()
+	l.pending[namespacedPath] = true
+	l.lock.Unlock()
+
+	// Wake the worker if it is idle
+	select {
+	case l.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Process queued paths one at a time
+func (l *Library) Run() {
+	for range l.signal {
+		for {
+			// Take the next pending path
+			l.lock.Lock()
+			var next string
+			for p := range l.pending {
+				next = p
+				break
+			}
+			delete(l.pending, next)
+			l.lock.Unlock()
+
+			if next == "" {
+				break
+			}
+
+			if err := l.sync(next); err != nil {
+				log.Printf("ERROR: failed to update library for %s: %v\n", next, err)
+			}
+		}
+	}
+}
+
+// Periodically queue any books changed outside of the API
+func (l *Library) Walk(interval time.Duration) {
+	if l.disabled {
+		return
+	}
+
+	for {
+		if err := l.rescan(); err != nil {
+			log.Printf("ERROR: failed to scan for library changes: %v\n", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Queue every book whose indexed modification time is out of date
+func (l *Library) rescan() error {
+	indexed := make(map[string]int64)
+	if err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketLibrary).ForEach(func(k, v []byte) error {
+			var book Book
+			if err := json.Unmarshal(v, &book); err != nil {
+				return err
+			}
+
+			// Books indexed before they were hashed are treated as stale
+			indexed[string(k)] = book.Modified
+			if book.Hash == "" {
+				indexed[string(k)] = 0
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	err := l.files.Walk("", func(namespacedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip internal storage directories
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && namespacedPath != "" {
+			return filepath.SkipDir
+		} else if info.IsDir() || !Supported(info.Name()) {
+			return nil
+		}
+
+		if modified, ok := indexed[namespacedPath]; !ok || modified != info.ModTime().UnixNano() {
+			l.queue(namespacedPath)
+		}
+		delete(indexed, namespacedPath)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Anything left over no longer exists
+	for missing := range indexed {
+		l.queue(missing)
+	}
+	return nil
+}
+
+// Bring the library up to date for a path and everything beneath it
+func (l *Library) sync(namespacedPath string) error {
+	info, err := l.files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		return l.removeUnder(namespacedPath)
+	} else if err != nil {
+		return err
+	}
+
+	// Directories which moved in bring their books with them
+	if info.IsDir() {
+		return l.files.Walk(namespacedPath, func(name string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && Supported(name) {
+				l.queue(name)
+			}
+			return err
+		})
+	} else if !Supported(namespacedPath) {
+		return nil
+	}
+
+	in, err := l.files.Open(namespacedPath)
+	if err == storage.ErrLocked {
+		// Indexed on a later scan once the owner logs in
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	hash, err := partialMD5(in, info.Size())
+	if err != nil {
+		return err
+	}
+
+	book, err := l.read(in, namespacedPath, info)
+	if err != nil {
+		// Unreadable books are still listed by their file name
+		log.Printf("ERROR: failed to read book details for %s: %v\n", namespacedPath, err)
+		book = &Book{Format: strings.TrimPrefix(strings.ToLower(path.Ext(namespacedPath)), "."), Authors: []string{}, Subjects: []string{}}
+	}
+
+	book.Path = namespacedPath
+	book.Hash = hash
+	book.Size = info.Size()
+	book.Modified = info.ModTime().UnixNano()
+	if book.Title == "" {
+		book.Title = strings.TrimSuffix(path.Base(namespacedPath), path.Ext(namespacedPath))
+	}
+
+	buf, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketLibrary).Put([]byte(namespacedPath), buf)
+	})
+}
+
+// Read a book's details from its contents
+func (l *Library) read(in io.ReaderAt, namespacedPath string, info os.FileInfo) (*Book, error) {
+	if strings.ToLower(path.Ext(namespacedPath)) == ".pdf" {
+		return parsePDF(in, info.Size())
+	}
+	return parseEPUB(in, info.Size())
+}
+
+// Remove a path and everything beneath it from the library
+func (l *Library) removeUnder(namespacedPath string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketLibrary)
+
+		keys := [][]byte{[]byte(namespacedPath)}
+		prefix := []byte(namespacedPath + "/")
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get all of a user's books ordered by title
+func (l *Library) Books(username string) ([]*Book, error) {
+	if l.disabled {
+		return nil, ErrDisabled
+	}
+
+	books := []*Book{}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(username + "/")
+		cursor := tx.Bucket(models.BucketLibrary).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var book Book
+			if err := json.Unmarshal(v, &book); err != nil {
+				return err
+			}
+			books = append(books, &book)
+		}
+		return nil
+	})
+
+	sort.SliceStable(books, func(i, j int) bool {
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+	return books, err
+}
+
+// Get a single book from a user's library
+func (l *Library) Find(namespacedPath string) (*Book, error) {
+	if l.disabled {
+		return nil, ErrDisabled
+	}
+
+	var book *Book
+	err := l.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(models.BucketLibrary).Get([]byte(namespacedPath))
+		if buf == nil {
+			return nil
+		}
+		book = &Book{}
+		return json.Unmarshal(buf, book)
+	})
+	return book, err
+}
+
+// Get the book in a user's library which KOReader identifies by a document hash, either of its
+// contents or of its file name
+func (l *Library) FindDocument(username, document string) (*Book, error) {
+	books, err := l.Books(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, book := range books {
+		if book.Hash == document {
+			return book, nil
+		}
+	}
+	for _, book := range books {
+		if sum := md5.Sum([]byte(path.Base(book.Path))); hex.EncodeToString(sum[:]) == document {
+			return book, nil
+		}
+	}
+	return nil, nil
+}
+
+// Read the cover image of a book
+func (l *Library) Cover(book *Book) ([]byte, error) {
+	if book.Cover == "" {
+		return nil, ErrNoCover
+	}
+
+	in, err := l.files.Open(book.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return epubCover(in, info.Size(), book.Cover)
+}
+
+// Hash samples of a file at growing offsets the same way as KOReader so books can be matched
+// to the documents it syncs
+func partialMD5(in io.ReaderAt, size int64) (string, error) {
+	sum := md5.New()
+	sample := make([]byte, 1024)
+	for i := -1; i <= 10; i++ {
+		// KOReader's shift wraps around for the first sample, starting it at the beginning
+		var offset int64
+		if i >= 0 {
+			offset = 1024 << uint(2*i)
+		}
+		if offset >= size {
+			break
+		}
+
+		n, err := in.ReadAt(sample, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		sum.Write(sample[:n])
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,111 @@
+package library
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+// A file of any size whose contents depend on their offset, so large files need no memory
+type patterned int64
+
+func (p patterned) ReadAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for ; n < len(b) && offset+int64(n) < int64(p); n++ {
+		position := offset + int64(n)
+		b[n] = byte(position*7 + position>>10)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// A file which cannot be read past some offset
+type failing int64
+
+func (f failing) ReadAt(b []byte, offset int64) (int, error) {
+	if offset >= int64(f) {
+		return 0, errors.New("read failed")
+	}
+	return patterned(1<<30).ReadAt(b, offset)
+}
+
+// Hash the given ranges of a file
+func sampled(in io.ReaderAt, ranges ...[2]int64) string {
+	sum := md5.New()
+	for _, r := range ranges {
+		buf := make([]byte, r[1]-r[0])
+		n, _ := in.ReadAt(buf, r[0])
+		sum.Write(buf[:n])
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func TestPartialMD5(t *testing.T) {
+	for _, c := range []struct {
+		size int64
+		want string
+	}{
+		{0, "d41d8cd98f00b204e9800998ecf8427e"},
+		{1, sampled(patterned(1), [2]int64{0, 1})},
+		{1024, sampled(patterned(1024), [2]int64{0, 1024})},
+		{1025, sampled(patterned(1025), [2]int64{0, 1024}, [2]int64{1024, 1025})},
+		{5000, sampled(patterned(5000), [2]int64{0, 1024}, [2]int64{1024, 2048}, [2]int64{4096, 5000})},
+		{16384, sampled(patterned(16384), [2]int64{0, 1024}, [2]int64{1024, 2048}, [2]int64{4096, 5120})},
+		{16385, sampled(patterned(16385), [2]int64{0, 1024}, [2]int64{1024, 2048}, [2]int64{4096, 5120}, [2]int64{16384, 16385})},
+
+		// Every sample is taken, the last a gigabyte in
+		{3 << 30, sampled(patterned(3<<30),
+			[2]int64{0, 1024}, [2]int64{1024, 2048}, [2]int64{4096, 5120}, [2]int64{16384, 17408},
+			[2]int64{65536, 66560}, [2]int64{262144, 263168}, [2]int64{1 << 20, 1<<20 + 1024},
+			[2]int64{4 << 20, 4<<20 + 1024}, [2]int64{16 << 20, 16<<20 + 1024}, [2]int64{64 << 20, 64<<20 + 1024},
+			[2]int64{256 << 20, 256<<20 + 1024}, [2]int64{1 << 30, 1<<30 + 1024},
+		)},
+	} {
+		hash, err := partialMD5(patterned(c.size), c.size)
+		if err != nil {
+			t.Errorf("%d bytes: %v", c.size, err)
+		} else if hash != c.want {
+			t.Errorf("%d bytes: hashed to %s instead of %s", c.size, hash, c.want)
+		}
+	}
+}
+
+func TestPartialMD5ReadError(t *testing.T) {
+	if _, err := partialMD5(failing(4096), 8192); err == nil {
+		t.Error("hashed a file which could not be read")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	book := &Book{
+		Title:       "The Left Hand of Darkness",
+		Authors:     []string{"Ursula K. Le Guin"},
+		Series:      "Hainish Cycle",
+		Description: "An envoy visits the planet Gethen",
+		Subjects:    []string{"Science Fiction"},
+	}
+
+	for _, c := range []struct {
+		query string
+		match bool
+	}{
+		{"darkness", true},
+		{"  LE GUIN ", true},
+		{"hainish", true},
+		{"gethen", true},
+		{"science fiction", true},
+		{"dispossessed", false},
+	} {
+		if book.Matches(c.query) != c.match {
+			t.Errorf("matching %q should be %v", c.query, c.match)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package library
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// Only the ends of a PDF are searched for its document information
+const pdfSearchSize = 256 << 10
+
+var pdfInfo = regexp.MustCompile(`/(Title|Author|Subject)\s*\(`)
+
+// Read a book's details from the document information dictionary of a PDF
+func parsePDF(in io.ReaderAt, size int64) (*Book, error) {
+	book := &Book{
+		Format:   FormatPDF,
+		Authors:  []string{},
+		Subjects: []string{},
+	}
+
+	// The information dictionary is usually near the start or in the trailer at the end
+	for _, start := range []int64{0, size - pdfSearchSize} {
+		if start < 0 {
+			start = 0
+		}
+		length := int64(pdfSearchSize)
+		if start+length > size {
+			length = size - start
+		}
+
+		buf := make([]byte, length)
+		if _, err := in.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		for _, match := range pdfInfo.FindAllSubmatchIndex(buf, -1) {
+			value := strings.TrimSpace(pdfLiteral(buf[match[1]:]))
+			if value == "" {
+				continue
+			}
+
+			switch string(buf[match[2]:match[3]]) {
+			case "Title":
+				if book.Title == "" {
+					book.Title = value
+				}
+			case "Author":
+				if len(book.Authors) == 0 {
+					book.Authors = append(book.Authors, value)
+				}
+			case "Subject":
+				if book.Description == "" {
+					book.Description = value
+				}
+			}
+		}
+	}
+
+	return book, nil
+}
+
+// Decode a PDF literal string starting just after its opening parenthesis
+func pdfLiteral(buf []byte) string {
+	var value bytes.Buffer
+	depth := 0
+	for i := 0; i < len(buf); i++ {
+		switch c := buf[i]; c {
+		case '\\':
+			if i+1 >= len(buf) {
+				break
+			}
+			i++
+			switch escaped := buf[i]; escaped {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case '\r', '\n':
+			default:
+				// Octal escapes are up to three digits
+				if escaped >= '0' && escaped <= '7' {
+					code := 0
+					for j := 0; j < 3 && i < len(buf) && buf[i] >= '0' && buf[i] <= '7'; j++ {
+						code = code*8 + int(buf[i]-'0')
+						i++
+					}
+					i--
+					value.WriteByte(byte(code))
+				} else {
+					value.WriteByte(escaped)
+				}
+			}
+		case '(':
+			depth++
+			value.WriteByte(c)
+		case ')':
+			if depth == 0 {
+				return decodePDFText(value.Bytes())
+			}
+			depth--
+			value.WriteByte(c)
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return ""
+}
+
+// Decode a PDF text string which is either UTF-16 with a byte order mark or close enough to Latin-1
+func decodePDFText(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		units := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
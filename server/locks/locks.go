@@ -0,0 +1,379 @@
+package locks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	uuid "github.com/satori/go.uuid"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDuration = 10 * time.Minute
+	MaxDuration     = time.Hour
+)
+
+var (
+	ErrLocked     = errors.New("file is locked")
+	ErrNoSuchLock = errors.New("lock does not exist")
+	ErrHeld       = errors.New("lock is in use by another request")
+	ErrNotOwner   = errors.New("lock is owned by another user")
+)
+
+// An advisory lock on a file or directory, claimed by whoever holds its token
+type Lock struct {
+	Token string `json:"token"`
+	Path  string `json:"path"`
+	Owner string `json:"owner"`
+
+	// Description of the client holding the lock
+	Info string `json:"info,omitempty"`
+
+	// Whether only the path itself is locked rather than everything beneath it too
+	ZeroDepth bool `json:"zero_depth"`
+
+	Created int64 `json:"created"`
+	Expires int64 `json:"expires"`
+}
+
+// Check if the lock has lapsed without being refreshed
+func (l *Lock) Expired(now time.Time) bool {
+	return now.Unix() >= l.Expires
+}
+
+// Check if a path is protected by the lock
+func (l *Lock) Covers(namespacedPath string) bool {
+	return l.Path == namespacedPath || (!l.ZeroDepth && strings.HasPrefix(namespacedPath, l.Path+"/"))
+}
+
+// Get the lock's path relative to its owner's files
+func (l *Lock) RelativePath() string {
+	parts := strings.SplitN(l.Path, "/", 2)
+	if len(parts) < 2 {
+		return "/"
+	}
+	return "/" + parts[1]
+}
+
+// Keeps locks on users' files, shared between the file API and WebDAV
+type Store struct {
+	db *bolt.DB
+
+	// Locks confirmed by WebDAV requests which are still in progress
+	held map[string]bool
+	lock sync.Mutex
+}
+
+// Create a lock store
+func New(db *bolt.DB) *Store {
+	return &Store{
+		db:   db,
+		held: make(map[string]bool),
+	}
+}
+
+// Clamp a requested duration to what is allowed
+func clamp(duration time.Duration) time.Duration {
+	if duration <= 0 || duration > MaxDuration {
+		return MaxDuration
+	}
+	return duration
+}
+
+// Lock a path unless it or anything beneath it is already locked
+func (s *Store) Acquire(namespacedPath, owner, info string, zeroDepth bool, duration time.Duration) (*Lock, error) {
+	now := time.Now()
+	lock := &Lock{
+		Token:     "opaquelocktoken:" + uuid.NewV4().String(),
+		Path:      namespacedPath,
+		Owner:     owner,
+		Info:      info,
+		ZeroDepth: zeroDepth,
+		Created:   now.Unix(),
+		Expires:   now.Add(clamp(duration)).Unix(),
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketLocks)
+		conflict, err := conflicting(bucket, namespacedPath, nil, !zeroDepth, now)
+		if err != nil {
+			return err
+		} else if conflict != nil {
+			return ErrLocked
+		}
+		return put(bucket, lock)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Extend an owner's lock so it expires after the duration from now
+func (s *Store) Refresh(token, owner string, duration time.Duration) (*Lock, error) {
+	if s.isHeld(token) {
+		return nil, ErrHeld
+	}
+
+	var lock *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketLocks)
+		var err error
+		if lock, err = byToken(bucket, token, time.Now()); err != nil {
+			return err
+		} else if lock.Owner != owner {
+			return ErrNotOwner
+		}
+
+		lock.Expires = time.Now().Add(clamp(duration)).Unix()
+		return put(bucket, lock)
+	})
+	return lock, err
+}
+
+// Remove an owner's lock by its token
+func (s *Store) Release(token, owner string) (*Lock, error) {
+	if s.isHeld(token) {
+		return nil, ErrHeld
+	}
+
+	var lock *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketLocks)
+		var err error
+		if lock, err = byToken(bucket, token, time.Now()); err != nil {
+			return err
+		} else if lock.Owner != owner {
+			return ErrNotOwner
+		}
+		return bucket.Delete([]byte(lock.Path))
+	})
+	return lock, err
+}
+
+// Remove the lock on a path without its token
+func (s *Store) Break(namespacedPath string) (*Lock, error) {
+	var lock *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketLocks)
+		var err error
+		if lock, err = get(bucket, namespacedPath); err != nil {
+			return err
+		} else if lock == nil || lock.Expired(time.Now()) {
+			return ErrNoSuchLock
+		}
+		return bucket.Delete([]byte(namespacedPath))
+	})
+	return lock, err
+}
+
+// Get an unexpired lock by its token
+func (s *Store) Find(token string) (*Lock, error) {
+	var lock *Lock
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lock, err = byToken(tx.Bucket(models.BucketLocks), token, time.Now())
+		return err
+	})
+	return lock, err
+}
+
+// Get the lock protecting a path, nil if it is not locked
+func (s *Store) Covering(namespacedPath string) (*Lock, error) {
+	var lock *Lock
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lock, err = conflicting(tx.Bucket(models.BucketLocks), namespacedPath, nil, false, time.Now())
+		return err
+	})
+	return lock, err
+}
+
+// Get a lock which prevents changing a path without one of the tokens, nil if it can be changed.
+// Changes to a directory can also be prevented by locks on anything beneath it.
+func (s *Store) Conflicting(namespacedPath string, tokens []string, descendants bool) (*Lock, error) {
+	var lock *Lock
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lock, err = conflicting(tx.Bucket(models.BucketLocks), namespacedPath, tokens, descendants, time.Now())
+		return err
+	})
+	return lock, err
+}
+
+// Get the current locks on a user's files, or everyone's if no user is given, ordered by path
+func (s *Store) List(username string) ([]*Lock, error) {
+	locks := []*Lock{}
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte{}
+		if username != "" {
+			prefix = []byte(username + "/")
+		}
+
+		cursor := tx.Bucket(models.BucketLocks).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var lock Lock
+			if err := json.Unmarshal(v, &lock); err != nil {
+				return err
+			} else if !lock.Expired(now) {
+				locks = append(locks, &lock)
+			}
+		}
+		return nil
+	})
+
+	sort.SliceStable(locks, func(i, j int) bool {
+		return locks[i].Path < locks[j].Path
+	})
+	return locks, err
+}
+
+// Drop the locks on files which no longer exist where they were locked
+func (s *Store) Handle(event events.Event) {
+	var err error
+	switch event.Type {
+	case events.Deleted:
+		err = s.removeUnder(event.Path)
+	case events.Moved:
+		err = s.removeUnder(event.From)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to update locks for %s: %v\n", event.Path, err)
+	}
+}
+
+// Remove the locks on a path and everything beneath it
+func (s *Store) removeUnder(namespacedPath string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketLocks)
+
+		keys := [][]byte{[]byte(namespacedPath)}
+		prefix := []byte(namespacedPath + "/")
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Mark a lock as in use until the returned function is called
+func (s *Store) hold(token string) (func(), bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.held[token] {
+		return nil, false
+	}
+
+	s.held[token] = true
+	return func() {
+		s.lock.Lock()
+		delete(s.held, token)
+		s.lock.Unlock()
+	}, true
+}
+
+// Check if a lock is in use
+func (s *Store) isHeld(token string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.held[token]
+}
+
+// Find an unexpired lock not claimed by any of the tokens on a path, its ancestors, or optionally its descendants
+func conflicting(bucket *bolt.Bucket, namespacedPath string, tokens []string, descendants bool, now time.Time) (*Lock, error) {
+	claimed := func(lock *Lock) bool {
+		for _, token := range tokens {
+			if token == lock.Token {
+				return true
+			}
+		}
+		return false
+	}
+
+	for current := namespacedPath; ; current = path.Dir(current) {
+		lock, err := get(bucket, current)
+		if err != nil {
+			return nil, err
+		} else if lock != nil && !lock.Expired(now) && lock.Covers(namespacedPath) && !claimed(lock) {
+			return lock, nil
+		}
+
+		if current == "." || current == "/" || !strings.Contains(current, "/") {
+			break
+		}
+	}
+
+	if descendants {
+		prefix := []byte(namespacedPath + "/")
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var lock Lock
+			if err := json.Unmarshal(v, &lock); err != nil {
+				return nil, err
+			} else if !lock.Expired(now) && !claimed(&lock) {
+				return &lock, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Find an unexpired lock by its token
+func byToken(bucket *bolt.Bucket, token string, now time.Time) (*Lock, error) {
+	var found *Lock
+	err := bucket.ForEach(func(k, v []byte) error {
+		var lock Lock
+		if err := json.Unmarshal(v, &lock); err != nil {
+			return err
+		} else if lock.Token == token && !lock.Expired(now) {
+			found = &lock
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	} else if found == nil {
+		return nil, ErrNoSuchLock
+	}
+	return found, nil
+}
+
+// Get the lock rooted at a path, nil if there is none
+func get(bucket *bolt.Bucket, namespacedPath string) (*Lock, error) {
+	buf := bucket.Get([]byte(namespacedPath))
+	if buf == nil {
+		return nil, nil
+	}
+
+	var lock Lock
+	if err := json.Unmarshal(buf, &lock); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// Store a lock under its path
+func put(bucket *bolt.Bucket, lock *Lock) error {
+	buf, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(lock.Path), buf)
+}
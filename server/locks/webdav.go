@@ -0,0 +1,137 @@
+package locks
+
+import (
+	"golang.org/x/net/webdav"
+	"path"
+	"strings"
+	"time"
+)
+
+// Locks on a user's files as seen by WebDAV, whose names are relative to the user's files
+type davLocks struct {
+	store    *Store
+	username string
+}
+
+// Get the lock system for a user's WebDAV requests
+func (s *Store) LockSystem(username string) webdav.LockSystem {
+	return &davLocks{store: s, username: username}
+}
+
+// Get the namespaced path for a WebDAV name
+func (d *davLocks) resolve(name string) string {
+	return path.Join(d.username, path.Clean("/"+name))
+}
+
+// Find the lock on a name claimed by one of the conditions
+func (d *davLocks) claim(name string, conditions []webdav.Condition) (string, bool) {
+	namespacedPath := d.resolve(name)
+	for _, condition := range conditions {
+		if condition.Not || condition.Token == "" || d.store.isHeld(condition.Token) {
+			continue
+		}
+
+		lock, err := d.store.Conflicting(namespacedPath, nil, false)
+		if err == nil && lock != nil && lock.Token == condition.Token {
+			return lock.Token, true
+		}
+	}
+	return "", false
+}
+
+func (d *davLocks) Confirm(_ time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	var tokens []string
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+
+		token, ok := d.claim(name, conditions)
+		if !ok {
+			return nil, webdav.ErrConfirmationFailed
+		} else if len(tokens) == 0 || tokens[0] != token {
+			tokens = append(tokens, token)
+		}
+	}
+
+	// Hold the claimed locks until the request finishes
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, token := range tokens {
+		r, ok := d.store.hold(token)
+		if !ok {
+			release()
+			return nil, webdav.ErrConfirmationFailed
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+func (d *davLocks) Create(_ time.Time, details webdav.LockDetails) (string, error) {
+	lock, err := d.store.Acquire(d.resolve(details.Root), d.username, strings.TrimSpace(details.OwnerXML), details.ZeroDepth, details.Duration)
+	if err == ErrLocked {
+		return "", webdav.ErrLocked
+	} else if err != nil {
+		return "", err
+	}
+	return lock.Token, nil
+}
+
+func (d *davLocks) Refresh(_ time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	if !d.owns(token) {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+
+	lock, err := d.store.Refresh(token, d.username, duration)
+	if err == ErrNoSuchLock {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	} else if err == ErrNotOwner {
+		return webdav.LockDetails{}, webdav.ErrForbidden
+	} else if err == ErrHeld {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	} else if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	return webdav.LockDetails{
+		Root:      lock.RelativePath(),
+		Duration:  time.Until(time.Unix(lock.Expires, 0)).Round(time.Second),
+		OwnerXML:  lock.Info,
+		ZeroDepth: lock.ZeroDepth,
+	}, nil
+}
+
+func (d *davLocks) Unlock(_ time.Time, token string) error {
+	if !d.owns(token) {
+		return webdav.ErrNoSuchLock
+	}
+
+	_, err := d.store.Release(token, d.username)
+	if err == ErrNoSuchLock {
+		return webdav.ErrNoSuchLock
+	} else if err == ErrNotOwner {
+		return webdav.ErrForbidden
+	} else if err == ErrHeld {
+		return webdav.ErrLocked
+	}
+	return err
+}
+
+// Check if a lock is on the user's files
+func (d *davLocks) owns(token string) bool {
+	locks, err := d.store.List(d.username)
+	if err != nil {
+		return false
+	}
+	for _, lock := range locks {
+		if lock.Token == token {
+			return true
+		}
+	}
+	return false
+}
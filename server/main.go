@@ -5,10 +5,27 @@ package main
 import (
 	"context"
 	"errors"
+	"github.com/akrantz01/bookpi/server/activity"
+	"github.com/akrantz01/bookpi/server/annotations"
 	"github.com/akrantz01/bookpi/server/assets"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/fulltext"
+	"github.com/akrantz01/bookpi/server/integrity"
+	"github.com/akrantz01/bookpi/server/jobs"
+	"github.com/akrantz01/bookpi/server/library"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/metadata"
 	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/music"
+	"github.com/akrantz01/bookpi/server/render"
 	"github.com/akrantz01/bookpi/server/responses"
 	"github.com/akrantz01/bookpi/server/routes"
+	"github.com/akrantz01/bookpi/server/search"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/thumbnails"
+	"github.com/akrantz01/bookpi/server/versions"
+	"github.com/akrantz01/bookpi/server/watcher"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	bolt "go.etcd.io/bbolt"
@@ -16,6 +33,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 )
@@ -57,7 +75,7 @@ func main() {
 
 	// Create database buckets if not exist
 	if err := db.Update(func(tx *bolt.Tx) error {
-		for _, b := range [][]byte{models.BucketUsers, models.BucketSessions, models.BucketChats, models.BucketShares} {
+		for _, b := range [][]byte{models.BucketUsers, models.BucketSessions, models.BucketChats, models.BucketShares, models.BucketVersions, models.BucketIndex, models.BucketFulltext, models.BucketMetadata, models.BucketTokens, models.BucketChecksums, models.BucketAnnotations, models.BucketActivity, models.BucketLibrary, models.BucketProgress, models.BucketMusic, models.BucketDrafts, models.BucketLocks, models.BucketWatcher, models.BucketLinks} {
 			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
 				return err
 			}
@@ -67,8 +85,171 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v\n", err)
 	}
 
+	// Initialize the storage backend for users' files
+	files, err := openStorage(cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize file storage: %v\n", err)
+	}
+
+	// Encrypt users' files with keys held while they are logged in
+	var keys *encryption.Keyring
+	if cfg.Encryption {
+		keys = encryption.NewKeyring()
+		files = storage.NewEncrypted(files, keys)
+	}
+
+	// Initialize file version storage
+	store, err := versions.New(cfg.FilesDirectory, files, cfg.VersionsKeep, cfg.VersionsMaxAge, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize version storage: %v\n", err)
+	}
+
+	// Track background jobs for an hour after they finish
+	manager := jobs.New(time.Hour)
+
+	// Distribute file changes to the indexes
+	bus := events.NewBus()
+
+	// Keep the search index up to date, rebuilding it periodically
+	index, err := search.New(files, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize search index: %v\n", err)
+	}
+	bus.Subscribe(index.Handle)
+	go index.Walk(6 * time.Hour)
+
+	// Index file contents in the background
+	contents, err := fulltext.New(files, cfg.IndexThrottle, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize full-text index: %v\n", err)
+	}
+	bus.Subscribe(contents.Handle)
+	go contents.Run()
+	go contents.Walk(6 * time.Hour)
+
+	// Generate image thumbnails with two workers
+	thumbs, err := thumbnails.New(cfg.FilesDirectory, files, 2, 64)
+	if err != nil {
+		log.Fatalf("Failed to initialize thumbnail cache: %v\n", err)
+	}
+	bus.Subscribe(thumbs.Handle)
+
+	// Cache sniffed content types and media information
+	meta, err := metadata.New(files, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize metadata cache: %v\n", err)
+	}
+	bus.Subscribe(meta.Handle)
+
+	// Record file checksums and verify them periodically
+	sums, err := integrity.New(files, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize checksum store: %v\n", err)
+	}
+	bus.Subscribe(sums.Handle)
+	go sums.Scrub(cfg.ScrubInterval)
+
+	// Keep users' tags, stars and descriptions with their files
+	notes, err := annotations.New(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize annotation store: %v\n", err)
+	}
+	bus.Subscribe(notes.Handle)
+
+	// Record what happens to users' files, shares and chats
+	feed, err := activity.New(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize activity feed: %v\n", err)
+	}
+	bus.Subscribe(feed.Handle)
+
+	// Catalog the ebooks in users' files for e-readers
+	books, err := library.New(files, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize ebook library: %v\n", err)
+	}
+	bus.Subscribe(books.Handle)
+	go books.Run()
+	go books.Walk(6 * time.Hour)
+
+	// Catalog the music in users' files for players
+	tracks, err := music.New(files, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize music library: %v\n", err)
+	}
+	bus.Subscribe(tracks.Handle)
+	go tracks.Run()
+	go tracks.Walk(6 * time.Hour)
+
+	// Share advisory locks on users' files between the file API and WebDAV
+	fileLocks := locks.New(db)
+	bus.Subscribe(fileLocks.Handle)
+
+	// Render text documents for viewing, keeping the most recent in memory
+	renderer := render.New(files, 64)
+
+	// Keep unsaved editor drafts with their files
+	bus.Subscribe(func(event events.Event) {
+		var err error
+		switch event.Type {
+		case events.Moved:
+			err = models.MoveDrafts(event.From, event.Path, db)
+		case events.Deleted:
+			err = models.DeleteDrafts(event.Path, db)
+		}
+
+		if err != nil {
+			log.Printf("ERROR: failed to update drafts for %s: %v\n", event.Path, err)
+		}
+	})
+
+	// Keep public links pointing at their files
+	bus.Subscribe(func(event events.Event) {
+		var err error
+		switch event.Type {
+		case events.Moved:
+			err = models.MoveLinks(event.From, event.Path, db)
+		case events.Deleted:
+			err = models.DeleteLinks(event.Path, db)
+		}
+
+		if err != nil {
+			log.Printf("ERROR: failed to update links for %s: %v\n", event.Path, err)
+		}
+	})
+
+	// Flag shares whose files disappear, clearing the flag if they come back
+	bus.Subscribe(func(event events.Event) {
+		var err error
+		switch event.Type {
+		case events.Created:
+			err = models.FlagShares(event.Path, false, db)
+		case events.Moved:
+			if err = models.FlagShares(event.From, true, db); err == nil {
+				err = models.FlagShares(event.Path, false, db)
+			}
+		case events.Deleted:
+			err = models.FlagShares(event.Path, true, db)
+		}
+
+		if err != nil {
+			log.Printf("ERROR: failed to update shares for %s: %v\n", event.Path, err)
+		}
+	})
+
+	// Find changes made to the files directory outside the server
+	var watch *watcher.Watcher
+	if cfg.WatchFiles && cfg.Storage == "local" {
+		watch, err = watcher.New(cfg.FilesDirectory, bus, db)
+		if err != nil {
+			log.Fatalf("Failed to initialize files watcher: %v\n", err)
+		}
+		bus.Subscribe(watch.Handle)
+		go watch.Run()
+	}
+
 	// Listen for OS signals
-	shutdown := make(chan os.Signal)
+	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
 	// Add server router
@@ -76,15 +257,24 @@ func main() {
 
 	// Register API routes
 	api := router.PathPrefix("/api").Subrouter()
-	routes.Authentication(cfg.FilesDirectory, db, api)
-	routes.Users(cfg.FilesDirectory, db, api)
-	routes.Chats(db, api)
+	routes.Authentication(files, keys, db, api)
+	routes.Users(files, keys, store, bus, db, api)
+	routes.Chats(feed, db, api)
 	routes.Messages(db, api)
-	routes.Files(cfg.FilesDirectory, api)
-	routes.Shares(cfg.FilesDirectory, db, api)
+	routes.Search(index, contents, api)
+	routes.Files(files, cfg.Quota, cfg.EditMaxSize, store, fileLocks, manager, bus, thumbs, meta, sums, notes, renderer, db, api)
+	routes.Annotations(files, notes, api)
+	routes.Activity(files, feed, api)
+	routes.Integrity(sums, cfg.Admins, api)
+	routes.Shares(files, feed, renderer, db, api)
+	routes.Links(files, feed, db, api)
+	routes.Jobs(manager, api)
+	routes.Tokens(keys, db, api)
+	routes.Progress(books, db, api)
+	routes.Locks(files, fileLocks, cfg.Admins, db, api)
 
 	// Register session middleware
-	api.Use(sessionMiddleware(db))
+	api.Use(sessionMiddleware(db, keys))
 
 	// Handle API errors
 	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +284,21 @@ func main() {
 		responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
 	})
 
+	// Serve files through public links without a session
+	routes.PublicLinks(files, db, router)
+
+	// Serve users' files over WebDAV
+	routes.WebDAV(files, keys, cfg.Quota, store, fileLocks, bus, sums, db, router)
+
+	// Serve users' books as an OPDS catalog
+	routes.OPDS(files, keys, books, db, router)
+
+	// Sync reading progress with KOReader
+	routes.KOSync(db, router)
+
+	// Stream users' music to Subsonic clients
+	routes.Subsonic(files, keys, tracks, db, router)
+
 	// Serve embedded files
 	router.PathPrefix("/").Handler(assets.StaticServer)
 
@@ -133,5 +338,33 @@ func main() {
 		log.Fatalf("Failed to gracefully shutdown th server: %v\n", err)
 	}
 
+	// Remember what is on disk for the next start
+	if watch != nil {
+		if err := watch.Save(); err != nil {
+			log.Printf("ERROR: failed to save known files: %v\n", err)
+		}
+	}
+
 	log.Println("server is shutdown, goodbye")
 }
+
+// Create the configured storage backend, with anything kept locally under the files directory
+func openStorage(cfg config, db *bolt.DB) (storage.Storage, error) {
+	switch cfg.Storage {
+	case "local":
+		return storage.NewLocal(cfg.FilesDirectory)
+	case "dedup":
+		dedup, err := storage.NewDedup(cfg.FilesDirectory, models.BucketFiles, cfg.PhysicalQuota, db)
+		if err != nil {
+			return nil, err
+		}
+		go dedup.Collect(time.Hour)
+		return dedup, nil
+	case "memory":
+		return storage.NewMemory(), nil
+	case "s3":
+		return storage.NewS3(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, filepath.Join(cfg.FilesDirectory, ".uploads"))
+	default:
+		return nil, errors.New("unknown storage backend '" + cfg.Storage + "'")
+	}
+}
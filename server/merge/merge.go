@@ -0,0 +1,218 @@
+package merge
+
+import "strings"
+
+// Largest number of differing lines searched for before the changed region is treated as a whole
+const maxEdits = 2000
+
+// A region of lines which differs between the versions being merged
+type Hunk struct {
+	// Position of the region within the common ancestor, counting from zero
+	BaseStart int `json:"base_start"`
+
+	Base     []string `json:"base"`
+	Mine     []string `json:"mine"`
+	Theirs   []string `json:"theirs"`
+	Conflict bool     `json:"conflict"`
+}
+
+// The outcome of merging two sets of changes to a common ancestor
+type Result struct {
+	// Merged text with conflict markers around regions which were changed by both sides
+	Merged    string `json:"merged"`
+	Conflicts int    `json:"conflicts"`
+	Hunks     []Hunk `json:"hunks"`
+}
+
+// Merge the changes made in two descendants of a common ancestor line by line
+func ThreeWay(base, mine, theirs string) *Result {
+	baseLines, mineLines, theirLines := Lines(base), Lines(mine), Lines(theirs)
+	toMine, toTheirs := matches(baseLines, mineLines), matches(baseLines, theirLines)
+
+	result := &Result{Hunks: []Hunk{}}
+	var merged strings.Builder
+
+	o, a, b := 0, 0, 0
+	for {
+		// Find the next ancestor line kept by both sides
+		k := o
+		for ; k < len(baseLines); k++ {
+			if toMine[k] >= a && toTheirs[k] >= b {
+				break
+			}
+		}
+
+		endMine, endTheirs := len(mineLines), len(theirLines)
+		if k < len(baseLines) {
+			endMine, endTheirs = toMine[k], toTheirs[k]
+		}
+
+		// Resolve the unstable region before it
+		if k > o || endMine > a || endTheirs > b {
+			hunk := Hunk{BaseStart: o, Base: baseLines[o:k], Mine: mineLines[a:endMine], Theirs: theirLines[b:endTheirs]}
+			switch {
+			case equal(hunk.Base, hunk.Mine):
+				writeLines(&merged, hunk.Theirs)
+			case equal(hunk.Base, hunk.Theirs), equal(hunk.Mine, hunk.Theirs):
+				writeLines(&merged, hunk.Mine)
+			default:
+				hunk.Conflict = true
+				result.Conflicts++
+				writeConflict(&merged, hunk)
+			}
+			result.Hunks = append(result.Hunks, hunk)
+		}
+
+		if k >= len(baseLines) {
+			break
+		}
+		merged.WriteString(baseLines[k])
+		o, a, b = k+1, endMine+1, endTheirs+1
+	}
+
+	result.Merged = merged.String()
+	return result
+}
+
+// Split text into lines, keeping their endings so the text can be rebuilt exactly
+func Lines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Write lines to the merged text
+func writeLines(out *strings.Builder, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+// Write both sides of a conflicting region between markers
+func writeConflict(out *strings.Builder, hunk Hunk) {
+	section := func(marker string, lines []string) {
+		out.WriteString(marker + "\n")
+		writeLines(out, lines)
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			out.WriteString("\n")
+		}
+	}
+
+	section("<<<<<<< mine", hunk.Mine)
+	section("||||||| base", hunk.Base)
+	section("=======", hunk.Theirs)
+	out.WriteString(">>>>>>> theirs\n")
+}
+
+// Check if two sets of lines are the same
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Find the line in b each line of a is kept as, or -1 if it was removed
+func matches(a, b []string) []int {
+	matched := make([]int, len(a))
+	for i := range matched {
+		matched[i] = -1
+	}
+
+	// Lines at either end which did not change are matched without searching
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matched[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		matched[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	for _, pair := range commonLines(middleA, middleB) {
+		matched[prefix+pair[0]] = prefix + pair[1]
+	}
+	return matched
+}
+
+// Find the longest common subsequence of lines with Myers' algorithm, returning pairs of
+// indices into a and b, or nothing if the lines differ too much to be worth searching
+func commonLines(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return nil
+	}
+
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+
+	// Keep the furthest reaching path on each diagonal after every step to walk back through
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int{}
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int{}, v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(trace, offset, n, m)
+			}
+		}
+	}
+	return nil
+}
+
+// Walk back through the search to find the lines which were kept
+func backtrack(trace [][]int, offset, x, y int) [][2]int {
+	pairs := [][2]int{}
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var previous int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			previous = k + 1
+		} else {
+			previous = k - 1
+		}
+		startX := v[offset+previous]
+		startY := startX - previous
+
+		for x > startX && y > startY {
+			x, y = x-1, y-1
+			pairs = append(pairs, [2]int{x, y})
+		}
+		if d > 0 {
+			x, y = startX, startY
+		}
+	}
+
+	// Pairs were found from the end
+	for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	}
+	return pairs
+}
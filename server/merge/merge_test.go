@@ -0,0 +1,224 @@
+package merge
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Number lines so they are easy to tell apart
+func numbered(from, to int, suffix string) string {
+	var lines strings.Builder
+	for i := from; i < to; i++ {
+		fmt.Fprintf(&lines, "line %d%s\n", i, suffix)
+	}
+	return lines.String()
+}
+
+func TestThreeWay(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		base      string
+		mine      string
+		theirs    string
+		merged    string
+		conflicts int
+	}{
+		{
+			name:   "unchanged",
+			base:   "a\nb\nc\n",
+			mine:   "a\nb\nc\n",
+			theirs: "a\nb\nc\n",
+			merged: "a\nb\nc\n",
+		},
+		{
+			name:   "changed by mine",
+			base:   "a\nb\nc\n",
+			mine:   "a\nB\nc\n",
+			theirs: "a\nb\nc\n",
+			merged: "a\nB\nc\n",
+		},
+		{
+			name:   "changed by theirs",
+			base:   "a\nb\nc\n",
+			mine:   "a\nb\nc\n",
+			theirs: "a\nb\nC\n",
+			merged: "a\nb\nC\n",
+		},
+		{
+			name:   "same change on both sides",
+			base:   "a\nb\nc\n",
+			mine:   "a\nB\nc\n",
+			theirs: "a\nB\nc\n",
+			merged: "a\nB\nc\n",
+		},
+		{
+			name:   "separate changes",
+			base:   "a\nb\nc\nd\ne\n",
+			mine:   "A\nb\nc\nd\ne\n",
+			theirs: "a\nb\nc\nd\nE\n",
+			merged: "A\nb\nc\nd\nE\n",
+		},
+		{
+			name:   "insertion and deletion",
+			base:   "a\nb\nc\nd\n",
+			mine:   "a\nnew\nb\nc\nd\n",
+			theirs: "a\nb\nc\n",
+			merged: "a\nnew\nb\nc\n",
+		},
+		{
+			name:      "different changes to a line",
+			base:      "a\nb\nc\n",
+			mine:      "a\nmine\nc\n",
+			theirs:    "a\ntheirs\nc\n",
+			merged:    "a\n<<<<<<< mine\nmine\n||||||| base\nb\n=======\ntheirs\n>>>>>>> theirs\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "changes to adjacent lines",
+			base:      "a\nb\n",
+			mine:      "A\nb\n",
+			theirs:    "a\nB\n",
+			merged:    "<<<<<<< mine\nA\nb\n||||||| base\na\nb\n=======\na\nB\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+		{
+			name:      "removed by mine and changed by theirs",
+			base:      "a\nb\nc\n",
+			mine:      "a\nc\n",
+			theirs:    "a\nB\nc\n",
+			merged:    "a\n<<<<<<< mine\n||||||| base\nb\n=======\nB\n>>>>>>> theirs\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:   "removed by both",
+			base:   "a\nb\nc\n",
+			mine:   "a\nc\n",
+			theirs: "a\nc\n",
+			merged: "a\nc\n",
+		},
+		{
+			name:      "different additions at the end",
+			base:      "a\n",
+			mine:      "a\nmine\n",
+			theirs:    "a\ntheirs\n",
+			merged:    "a\n<<<<<<< mine\nmine\n||||||| base\n=======\ntheirs\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+		{
+			name:      "different additions to an empty file",
+			base:      "",
+			mine:      "mine\n",
+			theirs:    "theirs\n",
+			merged:    "<<<<<<< mine\nmine\n||||||| base\n=======\ntheirs\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+		{
+			name:      "conflicting lines without a final newline",
+			base:      "a\nb",
+			mine:      "a\nmine",
+			theirs:    "a\ntheirs",
+			merged:    "a\n<<<<<<< mine\nmine\n||||||| base\nb\n=======\ntheirs\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+		{
+			name:   "final newline added by one side",
+			base:   "a\nb\nc",
+			mine:   "a\nb\nc\n",
+			theirs: "A\nb\nc",
+			merged: "A\nb\nc\n",
+		},
+		{
+			name:      "several conflicts",
+			base:      "a\nb\nc\nd\ne\n",
+			mine:      "1\nb\nc\nd\n1\n",
+			theirs:    "2\nb\nc\nd\n2\n",
+			merged:    "<<<<<<< mine\n1\n||||||| base\na\n=======\n2\n>>>>>>> theirs\nb\nc\nd\n<<<<<<< mine\n1\n||||||| base\ne\n=======\n2\n>>>>>>> theirs\n",
+			conflicts: 2,
+		},
+		{
+			name:   "too different to search",
+			base:   numbered(0, 1500, ""),
+			mine:   numbered(0, 1500, " changed"),
+			theirs: numbered(0, 1500, ""),
+			merged: numbered(0, 1500, " changed"),
+		},
+		{
+			name:      "too different to search and changed by both",
+			base:      "first\n" + numbered(0, 1500, "") + "last\n",
+			mine:      "first\n" + numbered(0, 1500, " mine") + "last\n",
+			theirs:    "first\n" + numbered(0, 1500, " theirs") + "last\n",
+			merged:    "first\n<<<<<<< mine\n" + numbered(0, 1500, " mine") + "||||||| base\n" + numbered(0, 1500, "") + "=======\n" + numbered(0, 1500, " theirs") + ">>>>>>> theirs\nlast\n",
+			conflicts: 1,
+		},
+	} {
+		result := ThreeWay(c.base, c.mine, c.theirs)
+		if result.Merged != c.merged {
+			t.Errorf("%s: merged into %q instead of %q", c.name, result.Merged, c.merged)
+		}
+
+		conflicts := 0
+		for _, hunk := range result.Hunks {
+			if hunk.Conflict {
+				conflicts++
+			}
+		}
+		if result.Conflicts != c.conflicts || conflicts != c.conflicts {
+			t.Errorf("%s: found %d conflicts in %d hunks instead of %d", c.name, result.Conflicts, conflicts, c.conflicts)
+		}
+	}
+}
+
+func TestHunks(t *testing.T) {
+	result := ThreeWay("a\nb\nc\nd\n", "a\nmine\nc\nd\n", "a\ntheirs\nc\nD\n")
+	if len(result.Hunks) != 2 {
+		t.Fatalf("found %d hunks instead of 2", len(result.Hunks))
+	}
+
+	conflict, change := result.Hunks[0], result.Hunks[1]
+	if !conflict.Conflict || conflict.BaseStart != 1 || !equal(conflict.Base, []string{"b\n"}) ||
+		!equal(conflict.Mine, []string{"mine\n"}) || !equal(conflict.Theirs, []string{"theirs\n"}) {
+		t.Errorf("conflict is %+v", conflict)
+	}
+	if change.Conflict || change.BaseStart != 3 || !equal(change.Base, []string{"d\n"}) ||
+		!equal(change.Mine, []string{"d\n"}) || !equal(change.Theirs, []string{"D\n"}) {
+		t.Errorf("change is %+v", change)
+	}
+}
+
+func TestLines(t *testing.T) {
+	for _, c := range []struct {
+		text  string
+		lines []string
+	}{
+		{"", []string{}},
+		{"\n", []string{"\n"}},
+		{"a", []string{"a"}},
+		{"a\nb", []string{"a\n", "b"}},
+		{"a\r\nb\n\n", []string{"a\r\n", "b\n", "\n"}},
+	} {
+		if lines := Lines(c.text); !equal(lines, c.lines) {
+			t.Errorf("split %q into %q instead of %q", c.text, lines, c.lines)
+		}
+	}
+}
+
+func FuzzThreeWay(f *testing.F) {
+	f.Add("a\nb\nc\n", "a\nB\nc\n", "a\nb\nC\n")
+	f.Add("", "mine\n", "theirs")
+	f.Add("a\nb", "b\na", "a\n\nb\n")
+
+	f.Fuzz(func(t *testing.T, base, mine, theirs string) {
+		// Changes made by only one side always merge cleanly into that side
+		if result := ThreeWay(base, mine, base); result.Conflicts != 0 || result.Merged != mine {
+			t.Fatalf("merging only mine gave %q with %d conflicts", result.Merged, result.Conflicts)
+		} else if result := ThreeWay(base, base, theirs); result.Conflicts != 0 || result.Merged != theirs {
+			t.Fatalf("merging only theirs gave %q with %d conflicts", result.Merged, result.Conflicts)
+		}
+
+		// The same changes made by both sides never conflict
+		if result := ThreeWay(base, mine, mine); result.Conflicts != 0 || result.Merged != mine {
+			t.Fatalf("merging the same changes gave %q with %d conflicts", result.Merged, result.Conflicts)
+		}
+	})
+}
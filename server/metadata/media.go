@@ -0,0 +1,320 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Get the width and height of an image without decoding it
+func dimensions(in io.Reader) (int, int) {
+	config, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// Get the capture time from a JPEG's EXIF data as a unix timestamp
+func captured(in io.Reader) int64 {
+	// Check for the JPEG start of image marker
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(in, header); err != nil || header[0] != 0xFF || header[1] != 0xD8 {
+		return 0
+	}
+
+	// Walk the segments until the EXIF segment is found
+	for {
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(in, marker); err != nil || marker[0] != 0xFF {
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 0
+		}
+
+		// Image data begins so there is no EXIF
+		if marker[1] == 0xDA {
+			return 0
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(in, segment); err != nil {
+			return 0
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifDate(segment[6:])
+		}
+	}
+}
+
+// Find the original capture date within a TIFF structure
+func exifDate(tiff []byte) int64 {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	// Look for the date in the EXIF directory first, then the image directory
+	ifd0 := order.Uint32(tiff[4:])
+	exif, modified := uint32(0), ""
+	for _, entry := range ifdEntries(tiff, ifd0, order) {
+		switch entry.tag {
+		case 0x8769:
+			exif = entry.value
+		case 0x0132:
+			modified = ifdString(tiff, entry, order)
+		}
+	}
+
+	if exif != 0 {
+		for _, entry := range ifdEntries(tiff, exif, order) {
+			if entry.tag == 0x9003 {
+				if date := parseExifDate(ifdString(tiff, entry, order)); date != 0 {
+					return date
+				}
+			}
+		}
+	}
+
+	return parseExifDate(modified)
+}
+
+type ifdEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value uint32
+}
+
+// Read the entries of an image file directory
+func ifdEntries(tiff []byte, offset uint32, order binary.ByteOrder) []ifdEntry {
+	if int(offset)+2 > len(tiff) {
+		return nil
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	var entries []ifdEntry
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+
+		entries = append(entries, ifdEntry{
+			tag:   order.Uint16(tiff[start:]),
+			kind:  order.Uint16(tiff[start+2:]),
+			count: order.Uint32(tiff[start+4:]),
+			value: order.Uint32(tiff[start+8:]),
+		})
+	}
+	return entries
+}
+
+// Read an ASCII value from a directory entry
+func ifdString(tiff []byte, entry ifdEntry, order binary.ByteOrder) string {
+	if entry.kind != 2 || entry.count <= 4 || int(entry.value)+int(entry.count) > len(tiff) {
+		return ""
+	}
+	return string(bytes.TrimRight(tiff[entry.value:entry.value+entry.count], "\x00"))
+}
+
+// Parse an EXIF formatted date
+func parseExifDate(raw string) int64 {
+	date, err := time.Parse("2006:01:02 15:04:05", raw)
+	if err != nil {
+		return 0
+	}
+	return date.Unix()
+}
+
+// Get the length of an audio file in seconds where it can be cheaply determined
+func duration(in io.ReadSeeker, extension string, size int64) int64 {
+	switch extension {
+	case ".wav":
+		return wavDuration(in)
+	case ".flac":
+		return flacDuration(in)
+	case ".mp3":
+		return mp3Duration(in, size)
+	case ".m4a", ".m4b", ".mp4", ".aac":
+		return mp4Duration(in, size)
+	default:
+		return 0
+	}
+}
+
+// Calculate a WAV file's length from its format and data chunks
+func wavDuration(in io.Reader) int64 {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return 0
+	}
+
+	var byteRate uint32
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(in, chunk); err != nil {
+			return 0
+		}
+		length := binary.LittleEndian.Uint32(chunk[4:])
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			format := make([]byte, length)
+			if _, err := io.ReadFull(in, format); err != nil || len(format) < 12 {
+				return 0
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+		case "data":
+			if byteRate == 0 {
+				return 0
+			}
+			return int64(length / byteRate)
+		default:
+			if _, err := io.CopyN(ioutil.Discard, in, int64(length)); err != nil {
+				return 0
+			}
+		}
+	}
+}
+
+// Calculate a FLAC file's length from its stream info block
+func flacDuration(in io.Reader) int64 {
+	header := make([]byte, 4+4+18)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:4]) != "fLaC" || header[4]&0x7F != 0 {
+		return 0
+	}
+
+	info := header[8:]
+	sampleRate := uint64(info[10])<<12 | uint64(info[11])<<4 | uint64(info[12])>>4
+	samples := uint64(info[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(info[14:]))
+	if sampleRate == 0 {
+		return 0
+	}
+	return int64(samples / sampleRate)
+}
+
+var mp3Bitrates = [16]int64{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+var mp3SampleRates = [4]int64{44100, 48000, 32000, 0}
+
+// Estimate an MP3's length from its first frame, using the frame count if present
+func mp3Duration(in io.ReadSeeker, size int64) int64 {
+	// Skip over any ID3v2 tag
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return 0
+	}
+	offset := int64(0)
+	if string(header[:3]) == "ID3" {
+		offset = 10 + (int64(header[6]&0x7F)<<21 | int64(header[7]&0x7F)<<14 | int64(header[8]&0x7F)<<7 | int64(header[9]&0x7F))
+	}
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return 0
+	}
+
+	// Read the first frame, only MPEG-1 layer 3 is supported
+	frame := make([]byte, 4+32+12)
+	if _, err := io.ReadFull(in, frame); err != nil {
+		return 0
+	}
+	if frame[0] != 0xFF || frame[1]&0xFE != 0xFA {
+		return 0
+	}
+	bitrate := mp3Bitrates[frame[2]>>4] * 1000
+	sampleRate := mp3SampleRates[(frame[2]>>2)&0x03]
+	if bitrate == 0 || sampleRate == 0 {
+		return 0
+	}
+
+	// Variable bitrate files have the total frame count in a Xing or Info header
+	sideInfo := 32
+	if frame[3]>>6 == 3 {
+		sideInfo = 17
+	}
+	xing := frame[4+sideInfo:]
+	if tag := string(xing[:4]); (tag == "Xing" || tag == "Info") && xing[7]&0x01 != 0 {
+		frames := int64(binary.BigEndian.Uint32(xing[8:]))
+		return frames * 1152 / sampleRate
+	}
+
+	return (size - offset) * 8 / bitrate
+}
+
+// Read the duration from an MP4 container's movie header
+func mp4Duration(in io.ReadSeeker, size int64) int64 {
+	return mp4Find(in, 0, size, []string{"moov", "mvhd"})
+}
+
+// Walk nested MP4 boxes to the movie header
+func mp4Find(in io.ReadSeeker, start, end int64, path []string) int64 {
+	for position := start; position+8 <= end; {
+		if _, err := in.Seek(position, io.SeekStart); err != nil {
+			return 0
+		}
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(in, header); err != nil {
+			return 0
+		}
+
+		length := int64(binary.BigEndian.Uint32(header))
+		headerLength := int64(8)
+		if length == 1 {
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(in, large); err != nil {
+				return 0
+			}
+			length = int64(binary.BigEndian.Uint64(large))
+			headerLength = 16
+		} else if length == 0 {
+			length = end - position
+		}
+		if length < headerLength {
+			return 0
+		}
+
+		if string(header[4:]) == path[0] {
+			if len(path) > 1 {
+				return mp4Find(in, position+headerLength, position+length, path[1:])
+			}
+
+			// Parse the movie header for its time scale and duration
+			body := make([]byte, 32)
+			if _, err := io.ReadFull(in, body); err != nil {
+				return 0
+			}
+			if body[0] == 1 {
+				scale := int64(binary.BigEndian.Uint32(body[20:]))
+				if scale == 0 {
+					return 0
+				}
+				return int64(binary.BigEndian.Uint64(body[24:])) / scale
+			}
+			scale := int64(binary.BigEndian.Uint32(body[12:]))
+			if scale == 0 {
+				return 0
+			}
+			return int64(binary.BigEndian.Uint32(body[16:])) / scale
+		}
+
+		position += length
+	}
+	return 0
+}
@@ -0,0 +1,232 @@
+package metadata
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ClassImage    = "image"
+	ClassAudio    = "audio"
+	ClassVideo    = "video"
+	ClassDocument = "document"
+	ClassArchive  = "archive"
+	ClassEbook    = "ebook"
+	ClassOther    = "other"
+)
+
+// Information about a file's contents
+type Metadata struct {
+	MimeType string `json:"mime_type"`
+	Class    string `json:"class"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	Captured int64  `json:"captured,omitempty"`
+
+	// Used to determine if the cached metadata is stale
+	Size     int64 `json:"size"`
+	Modified int64 `json:"modified"`
+}
+
+// Describes files and caches the results in the database
+type Cache struct {
+	files storage.Storage
+	db    *bolt.DB
+
+	// Nothing is cached when the files are encrypted since it would reveal their contents
+	disabled bool
+}
+
+// Create a metadata cache for users' files
+func New(files storage.Storage, db *bolt.DB) (*Cache, error) {
+	// Throw away anything cached before encryption was turned on
+	_, sealed := files.(storage.Sealer)
+	if sealed {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(models.BucketMetadata); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err := tx.CreateBucket(models.BucketMetadata)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Cache{
+		files:    files,
+		db:       db,
+		disabled: sealed,
+	}, nil
+}
+
+// Get the metadata for a file, reading it only if changed since last described
+func (c *Cache) Describe(namespacedPath string, info os.FileInfo) (*Metadata, error) {
+	if info.IsDir() {
+		return nil, nil
+	} else if c.disabled {
+		return c.read(namespacedPath, info)
+	}
+
+	// Use the cached copy if the file hasn't changed
+	var cached Metadata
+	if err := c.db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(models.BucketMetadata).Get([]byte(namespacedPath)), &cached)
+	}); err == nil && cached.Size == info.Size() && cached.Modified == info.ModTime().UnixNano() {
+		return &cached, nil
+	}
+
+	described, err := c.read(namespacedPath, info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save for next time
+	buf, err := json.Marshal(described)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketMetadata).Put([]byte(namespacedPath), buf)
+	}); err != nil {
+		return nil, err
+	}
+
+	return described, nil
+}
+
+// Drop cached metadata for files that moved or were removed
+func (c *Cache) Handle(event events.Event) {
+	if c.disabled {
+		return
+	}
+
+	var err error
+	switch event.Type {
+	case events.Moved:
+		err = c.remove(event.From)
+	case events.Deleted:
+		err = c.remove(event.Path)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to remove cached metadata for %s: %v\n", event.Path, err)
+	}
+}
+
+// Remove a path and everything beneath it from the cache
+func (c *Cache) remove(namespacedPath string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketMetadata)
+		if err := bucket.Delete([]byte(namespacedPath)); err != nil {
+			return err
+		}
+
+		var keys [][]byte
+		prefix := namespacedPath + "/"
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Read a file's metadata from its contents
+func (c *Cache) read(file string, info os.FileInfo) (*Metadata, error) {
+	in, err := c.files.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	// Sniff the content type from the start of the file
+	header := make([]byte, 512)
+	n, err := io.ReadFull(in, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	extension := strings.ToLower(filepath.Ext(file))
+	described := &Metadata{
+		MimeType: mimeType(header[:n], extension),
+		Size:     info.Size(),
+		Modified: info.ModTime().UnixNano(),
+	}
+	described.Class = class(described.MimeType, extension)
+
+	// Reading media information is best effort
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch described.Class {
+	case ClassImage:
+		described.Width, described.Height = dimensions(in)
+		if _, err := in.Seek(0, io.SeekStart); err == nil {
+			described.Captured = captured(in)
+		}
+	case ClassAudio:
+		described.Duration = duration(in, extension, info.Size())
+	}
+
+	return described, nil
+}
+
+// Determine the content type from the contents, preferring the extension for generic types
+func mimeType(header []byte, extension string) string {
+	sniffed := strings.SplitN(http.DetectContentType(header), ";", 2)[0]
+	byExtension := strings.SplitN(mime.TypeByExtension(extension), ";", 2)[0]
+
+	switch sniffed {
+	case "application/octet-stream", "text/plain", "application/zip", "text/xml":
+		if byExtension != "" {
+			return byExtension
+		}
+	}
+	return sniffed
+}
+
+// Group a file into a broad class of content
+func class(mimeType, extension string) string {
+	switch extension {
+	case ".epub", ".mobi", ".azw", ".azw3", ".fb2", ".cbz", ".cbr", ".djvu":
+		return ClassEbook
+	case ".mp3", ".flac", ".m4a", ".m4b", ".aac", ".ogg", ".opus", ".wav", ".wma":
+		return ClassAudio
+	case ".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".7z", ".rar", ".zst":
+		return ClassArchive
+	case ".pdf", ".txt", ".md", ".markdown", ".html", ".htm", ".doc", ".docx", ".odt", ".rtf", ".csv", ".xls", ".xlsx", ".ods", ".ppt", ".pptx", ".odp":
+		return ClassDocument
+	}
+
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return ClassImage
+	case strings.HasPrefix(mimeType, "audio/"):
+		return ClassAudio
+	case strings.HasPrefix(mimeType, "video/"):
+		return ClassVideo
+	case strings.HasPrefix(mimeType, "text/"):
+		return ClassDocument
+	case mimeType == "application/zip" || mimeType == "application/x-gzip" || mimeType == "application/x-rar-compressed":
+		return ClassArchive
+	default:
+		return ClassOther
+	}
+}
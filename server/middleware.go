@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"github.com/akrantz01/bookpi/server/encryption"
 	"github.com/akrantz01/bookpi/server/models"
 	"github.com/akrantz01/bookpi/server/responses"
 	"github.com/gorilla/handlers"
@@ -23,12 +24,13 @@ func applyWrappers(router *mux.Router) http.Handler {
 		Debug:              false,
 		AllowedMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
 		AllowedHeaders:     []string{"*"},
+		ExposedHeaders:     []string{"ETag"},
 		AllowedOrigins:     []string{"http://localhost:*", "http://book.pi", "https://book.pi"},
 	}).Handler(logging)
 	return corsEnabled
 }
 
-func sessionMiddleware(db *bolt.DB) func(next http.Handler) http.Handler {
+func sessionMiddleware(db *bolt.DB, keys *encryption.Keyring) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Allow if authenticating or registering
@@ -62,6 +64,12 @@ func sessionMiddleware(db *bolt.DB) func(next http.Handler) http.Handler {
 				return
 			}
 
+			// Sessions from before a restart can no longer reach encrypted files
+			if keys != nil && keys.Key(session.User.Username) == nil && r.RequestURI != "/api/auth/logout" {
+				responses.Error(w, http.StatusUnauthorized, "files are locked, log in again")
+				return
+			}
+
 			// Set data from session to headers
 			r.Header.Set("X-BPI-Session-Id", cookie.Value)
 			r.Header.Set("X-BPI-Username", session.User.Username)
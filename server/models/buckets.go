@@ -1,8 +1,24 @@
 package models
 
 var (
-	BucketUsers    = []byte("users")
-	BucketSessions = []byte("sessions")
-	BucketChats    = []byte("chats")
-	BucketShares   = []byte("shares")
+	BucketUsers       = []byte("users")
+	BucketSessions    = []byte("sessions")
+	BucketChats       = []byte("chats")
+	BucketShares      = []byte("shares")
+	BucketVersions    = []byte("versions")
+	BucketIndex       = []byte("index")
+	BucketFulltext    = []byte("fulltext")
+	BucketMetadata    = []byte("metadata")
+	BucketTokens      = []byte("tokens")
+	BucketFiles       = []byte("files")
+	BucketChecksums   = []byte("checksums")
+	BucketAnnotations = []byte("annotations")
+	BucketActivity    = []byte("activity")
+	BucketLibrary     = []byte("library")
+	BucketProgress    = []byte("progress")
+	BucketMusic       = []byte("music")
+	BucketDrafts      = []byte("drafts")
+	BucketLocks       = []byte("locks")
+	BucketWatcher     = []byte("watcher")
+	BucketLinks       = []byte("links")
 )
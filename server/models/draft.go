@@ -0,0 +1,125 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Unsaved changes to a text file autosaved by the editor
+type Draft struct {
+	Path    string `json:"-"`
+	Content string `json:"content"`
+	Saved   int64  `json:"saved"`
+
+	// The file the changes were made to, used to merge them if it changed since
+	BaseTag     string `json:"base_etag"`
+	BaseContent string `json:"base_content"`
+
+	// Both contents are encrypted with the owner's key and base64 encoded when files are encrypted
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+// Drafts stores:
+//   key: namespaced path
+//   - value -> JSON encoded draft
+
+// Create a new draft of a file
+func NewDraft(path, content, baseTag, baseContent string) *Draft {
+	return &Draft{
+		Path:        path,
+		Content:     content,
+		Saved:       time.Now().Unix(),
+		BaseTag:     baseTag,
+		BaseContent: baseContent,
+	}
+}
+
+// Find the draft of a file by path
+func FindDraft(path string, db *bolt.DB) (*Draft, error) {
+	var draft Draft
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketDrafts)
+
+		// Decode draft
+		buf := bucket.Get([]byte(path))
+		return json.Unmarshal(buf, &draft)
+	})
+
+	switch err.(type) {
+	case *json.SyntaxError:
+		return nil, nil
+	case nil:
+		draft.Path = path
+		return &draft, nil
+	default:
+		return nil, err
+	}
+}
+
+// Save a draft to the database
+func (d *Draft) Save(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketDrafts)
+
+		// Marshal draft data into bytes
+		buf, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(d.Path), buf)
+	})
+}
+
+// Delete the drafts of a path and everything beneath it
+func DeleteDrafts(path string, db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return deleteUnder(tx.Bucket(BucketDrafts), path)
+	})
+}
+
+// Delete a key and every key beneath it as a path
+func deleteUnder(bucket *bolt.Bucket, path string) error {
+	keys := [][]byte{[]byte(path)}
+	prefix := []byte(path + "/")
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Point the drafts of a path and everything beneath it at their new location
+func MoveDrafts(from, to string, db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketDrafts)
+
+		moved := make(map[string][]byte)
+		if buf := bucket.Get([]byte(from)); buf != nil {
+			moved[to] = append([]byte{}, buf...)
+		}
+		prefix := []byte(from + "/")
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			moved[to+string(k[len(from):])] = append([]byte{}, v...)
+		}
+
+		if err := deleteUnder(bucket, from); err != nil {
+			return err
+		}
+		for path, buf := range moved {
+			if err := bucket.Put([]byte(path), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
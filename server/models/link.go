@@ -0,0 +1,193 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A public link to a file or directory which can be used without an account
+type Link struct {
+	Token     string `json:"-"`
+	Path      string `json:"path"`
+	Owner     string `json:"owner"`
+	Directory bool   `json:"directory"`
+	Created   int64  `json:"created"`
+
+	// Argon2 hash of the password needed to use the link, if any
+	Password string `json:"password,omitempty"`
+
+	// When the link stops working and how many downloads it allows, zero for no limit
+	Expires      int64 `json:"expires,omitempty"`
+	MaxDownloads int64 `json:"max_downloads,omitempty"`
+	Downloads    int64 `json:"downloads"`
+}
+
+// Links stores:
+//   key: token
+//   - value -> JSON encoded link
+
+// Create a new public link with an unguessable token
+func NewLink(path, owner string, directory bool) *Link {
+	b := make([]byte, 32)
+	_, _ = io.ReadFull(rand.Reader, b)
+
+	return &Link{
+		Token:     base64.RawURLEncoding.EncodeToString(b),
+		Path:      path,
+		Owner:     owner,
+		Directory: directory,
+		Created:   time.Now().Unix(),
+	}
+}
+
+// Find a public link by its token
+func FindLink(token string, db *bolt.DB) (*Link, error) {
+	var link *Link
+	err := db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(BucketLinks).Get([]byte(token))
+		if buf == nil {
+			return nil
+		}
+
+		link = &Link{Token: token}
+		return json.Unmarshal(buf, link)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// Get all of a user's public links, oldest first
+func FindLinks(owner string, db *bolt.DB) ([]*Link, error) {
+	links := []*Link{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketLinks).ForEach(func(k, v []byte) error {
+			link := &Link{Token: string(k)}
+			if err := json.Unmarshal(v, link); err != nil {
+				return err
+			} else if link.Owner == owner {
+				links = append(links, link)
+			}
+			return nil
+		})
+	})
+
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Created < links[j].Created
+	})
+	return links, err
+}
+
+// Check if the link has passed its expiry date
+func (l *Link) Expired(now time.Time) bool {
+	return l.Expires != 0 && now.Unix() >= l.Expires
+}
+
+// Check if the link has been downloaded as many times as it allows
+func (l *Link) Exhausted() bool {
+	return l.MaxDownloads != 0 && l.Downloads >= l.MaxDownloads
+}
+
+// Count a download of the link, returning false if it has none left
+func (l *Link) Download(db *bolt.DB) (bool, error) {
+	allowed := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketLinks)
+
+		// Use the stored count in case of concurrent downloads
+		buf := bucket.Get([]byte(l.Token))
+		if buf == nil {
+			return nil
+		} else if err := json.Unmarshal(buf, l); err != nil {
+			return err
+		} else if l.Exhausted() {
+			return nil
+		}
+
+		l.Downloads++
+		allowed = true
+		updated, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(l.Token), updated)
+	})
+	return allowed, err
+}
+
+// Save a link to the database
+func (l *Link) Save(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		buf, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(BucketLinks).Put([]byte(l.Token), buf)
+	})
+}
+
+// Delete a link from the database
+func (l *Link) Delete(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketLinks).Delete([]byte(l.Token))
+	})
+}
+
+// Delete the links to a path and everything beneath it
+func DeleteLinks(path string, db *bolt.DB) error {
+	return updateLinks(path, db, func(link *Link) bool {
+		return false
+	})
+}
+
+// Point the links to a path and everything beneath it at its new location
+func MoveLinks(from, to string, db *bolt.DB) error {
+	return updateLinks(from, db, func(link *Link) bool {
+		link.Path = to + strings.TrimPrefix(link.Path, from)
+		return true
+	})
+}
+
+// Change or remove the links to a path and everything beneath it, keeping those the function returns true for
+func updateLinks(path string, db *bolt.DB, update func(link *Link) bool) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketLinks)
+
+		var links []*Link
+		if err := bucket.ForEach(func(k, v []byte) error {
+			link := &Link{Token: string(k)}
+			if err := json.Unmarshal(v, link); err != nil {
+				return err
+			} else if link.Path == path || strings.HasPrefix(link.Path, path+"/") {
+				links = append(links, link)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, link := range links {
+			if !update(link) {
+				if err := bucket.Delete([]byte(link.Token)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			buf, err := json.Marshal(link)
+			if err != nil {
+				return err
+			} else if err := bucket.Put([]byte(link.Token), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
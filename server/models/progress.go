@@ -0,0 +1,90 @@
+package models
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Reading position in a document synced from KOReader
+type Progress struct {
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+	Device     string  `json:"device"`
+	DeviceId   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+// Progress stores:
+//   key: username
+//   - bucket of document hash -> progress
+
+// Find a user's progress in a document
+func FindProgress(username, document string, db *bolt.DB) (*Progress, error) {
+	var progress *Progress
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketProgress).Bucket([]byte(username))
+		if bucket == nil {
+			return nil
+		}
+
+		// Decode progress
+		buf := bucket.Get([]byte(document))
+		if buf == nil {
+			return nil
+		}
+		progress = &Progress{}
+		return json.Unmarshal(buf, progress)
+	})
+	return progress, err
+}
+
+// Get a user's progress in all their documents
+func ListProgress(username string, db *bolt.DB) ([]*Progress, error) {
+	found := []*Progress{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketProgress).Bucket([]byte(username))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(_, v []byte) error {
+			var progress Progress
+			if err := json.Unmarshal(v, &progress); err != nil {
+				return err
+			}
+			found = append(found, &progress)
+			return nil
+		})
+	})
+	return found, err
+}
+
+// Save a user's progress to the database
+func (p *Progress) Save(username string, db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(BucketProgress).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+
+		// Marshal progress data into bytes
+		buf, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(p.Document), buf)
+	})
+}
+
+// Delete a user's progress in a document from the database
+func DeleteProgress(username, document string, db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketProgress).Bucket([]byte(username))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(document))
+	})
+}
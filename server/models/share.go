@@ -1,6 +1,7 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
 	bolt "go.etcd.io/bbolt"
 )
@@ -8,6 +9,9 @@ import (
 type Share struct {
 	Path string   `json:"-"`
 	To   []string `json:"to"`
+
+	// Whether the shared file was removed or moved away
+	Missing bool `json:"missing,omitempty"`
 }
 
 // Create a new file share
@@ -77,3 +81,44 @@ func (s *Share) Delete(db *bolt.DB) error {
 		return bucket.Delete([]byte(s.Path))
 	})
 }
+
+// Mark the shares of a path and everything beneath it as missing or present
+func FlagShares(path string, missing bool, db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketShares)
+
+		keys := [][]byte{}
+		if bucket.Get([]byte(path)) != nil {
+			keys = append(keys, []byte(path))
+		}
+		prefix := []byte(path + "/")
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		updated := make(map[string][]byte)
+		for _, k := range keys {
+			var share Share
+			if err := json.Unmarshal(bucket.Get(k), &share); err != nil {
+				return err
+			} else if share.Missing == missing {
+				continue
+			}
+
+			share.Missing = missing
+			buf, err := json.Marshal(&share)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = buf
+		}
+
+		for k, buf := range updated {
+			if err := bucket.Put([]byte(k), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/encryption"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"time"
+)
+
+type Token struct {
+	Id       string `json:"-"`
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Created  int64  `json:"created"`
+
+	// Data key for the user's files wrapped by a key derived from the secret
+	Key string `json:"key,omitempty"`
+}
+
+// Create a new app token, returning the secret which is only known at creation
+func NewToken(name, username string) (*Token, string) {
+	// Generate secret
+	b := make([]byte, 32)
+	_, _ = io.ReadFull(rand.Reader, b)
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	return &Token{
+		Id:       TokenId(secret),
+		Name:     name,
+		Username: username,
+		Created:  time.Now().Unix(),
+	}, secret
+}
+
+// Get the id of a token from its secret
+func TokenId(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Derive the key wrapping the user's data key from a token's secret
+func tokenWrappingKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("bookpi file key"))
+	return mac.Sum(nil)
+}
+
+// Wrap the data key for the user's files with the token's secret
+func (t *Token) SetKey(key []byte, secret string) error {
+	wrapped, err := encryption.Wrap(key, tokenWrappingKey(secret))
+	if err != nil {
+		return err
+	}
+
+	t.Key = base64.StdEncoding.EncodeToString(wrapped)
+	return nil
+}
+
+// Get the data key for the user's files using the token's secret, if it has one
+func (t *Token) UnlockKey(secret string) ([]byte, error) {
+	if t.Key == "" {
+		return nil, nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(t.Key)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.Unwrap(wrapped, tokenWrappingKey(secret))
+}
+
+// Find a token by id
+func FindToken(id string, db *bolt.DB) (*Token, error) {
+	var token Token
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketTokens)
+
+		// Decode token
+		buf := bucket.Get([]byte(id))
+		return json.Unmarshal(buf, &token)
+	})
+
+	switch err.(type) {
+	case *json.SyntaxError:
+		return nil, nil
+	case nil:
+		token.Id = id
+		return &token, nil
+	default:
+		return nil, err
+	}
+}
+
+// Save a token to the database
+func (t *Token) Save(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketTokens)
+
+		// Marshal token data into bytes
+		buf, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(t.Id), buf)
+	})
+}
+
+// Delete a token from the database
+func (t *Token) Delete(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketTokens)
+		return bucket.Delete([]byte(t.Id))
+	})
+}
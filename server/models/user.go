@@ -1,9 +1,14 @@
 package models
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"github.com/akrantz01/bookpi/server/encryption"
 	"github.com/akrantz01/bookpi/server/hash"
 	bolt "go.etcd.io/bbolt"
+	"strings"
 )
 
 type User struct {
@@ -13,6 +18,14 @@ type User struct {
 	Sessions []string `json:"sessions"`
 	Chats    []string `json:"chats"`
 	Shares   []string `json:"shares"`
+	Tokens   []string `json:"tokens"`
+
+	// Data key for the user's files wrapped by a key derived from their password
+	Key       string `json:"key,omitempty"`
+	KeyParams string `json:"key_params,omitempty"`
+
+	// Hash of the MD5 digest of their password which KOReader sends in its place
+	SyncKey string `json:"sync_key,omitempty"`
 }
 
 // Shares stores:
@@ -34,6 +47,7 @@ func NewUser(name, username, password string) (*User, error) {
 		Sessions: []string{},
 		Chats:    []string{},
 		Shares:   []string{},
+		Tokens:   []string{},
 	}, nil
 }
 
@@ -82,6 +96,66 @@ func (u *User) Authenticate(username, password string) (bool, error) {
 	return hash.Verify(password, u.Password)
 }
 
+// Store the key KOReader will derive from the user's password
+func (u *User) SetSyncKey(password string) error {
+	sum := md5.Sum([]byte(password))
+	h, err := hash.DefaultHash(hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+
+	u.SyncKey = h
+	return nil
+}
+
+// Check if the key sent by KOReader matches the user's password
+func (u *User) AuthenticateSync(key string) (bool, error) {
+	if u.SyncKey == "" {
+		return false, nil
+	}
+
+	return hash.Verify(strings.ToLower(key), u.SyncKey)
+}
+
+// Wrap the data key for the user's files with their password
+func (u *User) SetKey(key []byte, password string) error {
+	params, err := hash.DefaultKeyParams()
+	if err != nil {
+		return err
+	}
+	wrapping, err := hash.DeriveKey(password, params)
+	if err != nil {
+		return err
+	}
+
+	wrapped, err := encryption.Wrap(key, wrapping)
+	if err != nil {
+		return err
+	}
+
+	u.Key = base64.StdEncoding.EncodeToString(wrapped)
+	u.KeyParams = params
+	return nil
+}
+
+// Get the data key for the user's files using their password, if they have one
+func (u *User) UnlockKey(password string) ([]byte, error) {
+	if u.Key == "" {
+		return nil, nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(u.Key)
+	if err != nil {
+		return nil, err
+	}
+	wrapping, err := hash.DeriveKey(password, u.KeyParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryption.Unwrap(wrapped, wrapping)
+}
+
 // Associate a chat with the user
 func (u *User) AddChat(id string) {
 	u.Chats = append(u.Chats, id)
@@ -112,6 +186,21 @@ func (u *User) RemoveShare(path string) {
 	}
 }
 
+// Associate an app token with the user
+func (u *User) AddToken(id string) {
+	u.Tokens = append(u.Tokens, id)
+}
+
+// Disassociate an app token from the user
+func (u *User) RemoveToken(id string) {
+	for i, token := range u.Tokens {
+		if token == id {
+			u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+			break
+		}
+	}
+}
+
 // Delete the user from the database
 func (u *User) Delete(db *bolt.DB) error {
 	return db.Update(func(tx *bolt.Tx) error {
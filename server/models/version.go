@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/json"
+	uuid "github.com/satori/go.uuid"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+type Version struct {
+	Id      string `json:"id"`
+	Size    int64  `json:"size"`
+	Created int64  `json:"created"`
+}
+
+type History struct {
+	Path     string    `json:"-"`
+	Versions []Version `json:"versions"`
+}
+
+// Create a new version of a file
+func NewVersion(size int64) Version {
+	return Version{
+		Id:      uuid.NewV4().String(),
+		Size:    size,
+		Created: time.Now().Unix(),
+	}
+}
+
+// Create a new version history for a file
+func NewHistory(file string) *History {
+	return &History{
+		Path:     file,
+		Versions: []Version{},
+	}
+}
+
+// Find a file's version history by path
+func FindHistory(path string, db *bolt.DB) (*History, error) {
+	var history History
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketVersions)
+
+		// Decode history
+		buf := bucket.Get([]byte(path))
+		return json.Unmarshal(buf, &history)
+	})
+
+	switch err.(type) {
+	case *json.SyntaxError:
+		return nil, nil
+	case nil:
+		history.Path = path
+		return &history, nil
+	default:
+		return nil, err
+	}
+}
+
+// Save a version history to the database
+func (h *History) Save(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketVersions)
+
+		// Marshal history data into bytes
+		buf, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(h.Path), buf)
+	})
+}
+
+// Add a version to the front of the history
+func (h *History) AddVersion(version Version) {
+	h.Versions = append([]Version{version}, h.Versions...)
+}
+
+// Find a version in the history by id
+func (h *History) FindVersion(id string) *Version {
+	for i := range h.Versions {
+		if h.Versions[i].Id == id {
+			return &h.Versions[i]
+		}
+	}
+	return nil
+}
+
+// Delete a version history from the database
+func (h *History) Delete(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BucketVersions)
+		return bucket.Delete([]byte(h.Path))
+	})
+}
@@ -0,0 +1,97 @@
+package music
+
+import (
+	"sort"
+	"strings"
+)
+
+// An artist and the albums filed under them
+type Artist struct {
+	Id     string
+	Name   string
+	Albums []*Album
+}
+
+// An album and its tracks in order
+type Album struct {
+	Id       string
+	Name     string
+	Artist   string
+	ArtistId string
+	Year     int
+	Genre    string
+	Tracks   []*Track
+
+	// Total length in seconds and the time of the newest track
+	Duration int
+	Modified int64
+}
+
+// Get the track whose cover represents the album, preferring embedded covers
+func (a *Album) CoverTrack() *Track {
+	for _, track := range a.Tracks {
+		if track.HasCover {
+			return track
+		}
+	}
+	return a.Tracks[0]
+}
+
+// Group tracks into artists and albums, keeping the order they were given in
+func Catalog(tracks []*Track) []*Artist {
+	artists := []*Artist{}
+	byArtist := make(map[string]*Artist)
+	byAlbum := make(map[string]*Album)
+
+	for _, track := range tracks {
+		artist, ok := byArtist[track.ArtistId()]
+		if !ok {
+			artist = &Artist{Id: track.ArtistId(), Name: track.AlbumArtist}
+			byArtist[artist.Id] = artist
+			artists = append(artists, artist)
+		}
+
+		album, ok := byAlbum[track.AlbumId()]
+		if !ok {
+			album = &Album{Id: track.AlbumId(), Name: track.Album, Artist: artist.Name, ArtistId: artist.Id}
+			byAlbum[album.Id] = album
+			artist.Albums = append(artist.Albums, album)
+		}
+
+		album.Tracks = append(album.Tracks, track)
+		album.Duration += track.Duration
+		if track.Modified > album.Modified {
+			album.Modified = track.Modified
+		}
+		if album.Year == 0 {
+			album.Year = track.Year
+		}
+		if album.Genre == "" {
+			album.Genre = track.Genre
+		}
+	}
+
+	sort.SliceStable(artists, func(i, j int) bool {
+		return SortName(artists[i].Name) < SortName(artists[j].Name)
+	})
+	return artists
+}
+
+// Articles ignored when sorting and indexing artists
+var ignoredArticles = []string{"The", "El", "La", "Los", "Las", "Le", "Les"}
+
+// Get the articles ignored when sorting artists as a space separated list
+func IgnoredArticles() string {
+	return strings.Join(ignoredArticles, " ")
+}
+
+// Get the name an artist is sorted by, without any leading article
+func SortName(name string) string {
+	lower := strings.ToLower(name)
+	for _, article := range ignoredArticles {
+		if prefix := strings.ToLower(article) + " "; strings.HasPrefix(lower, prefix) && len(lower) > len(prefix) {
+			return lower[len(prefix):]
+		}
+	}
+	return lower
+}
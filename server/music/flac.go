@@ -0,0 +1,188 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// Metadata block types within a FLAC stream
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+// Read the Vorbis comments and stream details of a FLAC file
+func readFLAC(in io.ReaderAt, size int64) (*Tags, error) {
+	tags := &Tags{}
+
+	// Some taggers put an ID3 tag before the stream as well
+	offset, err := readID3v2(in, size, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := make([]byte, 4)
+	if _, err := in.ReadAt(marker, offset); err != nil {
+		return nil, err
+	} else if string(marker) != "fLaC" {
+		return nil, errUnsupported
+	}
+	offset += 4
+
+	header := make([]byte, 4)
+	for {
+		if _, err := in.ReadAt(header, offset); err != nil {
+			return nil, err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4
+
+		// Only read the blocks which are needed since padding and seek tables can be large
+		if kind == flacStreamInfo || kind == flacVorbisComment || kind == flacPicture {
+			block, err := readSection(in, offset, length)
+			if err != nil {
+				return nil, err
+			}
+
+			switch kind {
+			case flacStreamInfo:
+				readFLACStreamInfo(block, size, tags)
+			case flacVorbisComment:
+				readVorbisComments(block, tags)
+			case flacPicture:
+				readFLACPicture(block, tags)
+			}
+		}
+
+		offset += length
+		if last || offset >= size {
+			break
+		}
+	}
+
+	return tags, nil
+}
+
+// Work out the duration and bit rate from the stream information
+func readFLACStreamInfo(block []byte, size int64, tags *Tags) {
+	if len(block) < 18 {
+		return
+	}
+
+	sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+	samples := int64(block[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+	if sampleRate == 0 || samples == 0 {
+		return
+	}
+
+	tags.Duration = float64(samples) / float64(sampleRate)
+	tags.BitRate = int(float64(size) * 8 / tags.Duration / 1000)
+}
+
+// Read Vorbis comments into the tags, keeping the first of any repeated values
+func readVorbisComments(block []byte, tags *Tags) {
+	reader := bytes.NewReader(block)
+	readString := func() (string, bool) {
+		var length uint32
+		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil || int64(length) > int64(reader.Len()) {
+			return "", false
+		}
+		buf := make([]byte, length)
+		_, _ = reader.Read(buf)
+		return string(buf), true
+	}
+
+	// Skip the vendor string
+	if _, ok := readString(); !ok {
+		return
+	}
+	var count uint32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return
+	}
+
+	for i := uint32(0); i < count; i++ {
+		comment, ok := readString()
+		if !ok {
+			return
+		}
+		parts := strings.SplitN(comment, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+
+		set := func(field *string) {
+			if *field == "" {
+				*field = value
+			}
+		}
+		switch strings.ToUpper(parts[0]) {
+		case "TITLE":
+			set(&tags.Title)
+		case "ARTIST":
+			set(&tags.Artist)
+		case "ALBUM":
+			set(&tags.Album)
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			set(&tags.AlbumArtist)
+		case "GENRE":
+			set(&tags.Genre)
+		case "DATE", "YEAR":
+			if tags.Year == 0 {
+				tags.Year = parseYear(value)
+			}
+		case "TRACKNUMBER":
+			if tags.Track == 0 {
+				tags.Track = parseNumber(value)
+			}
+		case "DISCNUMBER":
+			if tags.Disc == 0 {
+				tags.Disc = parseNumber(value)
+			}
+		}
+	}
+}
+
+// Read an embedded picture, preferring the front cover over any others
+func readFLACPicture(block []byte, tags *Tags) {
+	reader := bytes.NewReader(block)
+	readBytes := func() ([]byte, bool) {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil || int64(length) > int64(reader.Len()) {
+			return nil, false
+		}
+		buf := make([]byte, length)
+		_, _ = reader.Read(buf)
+		return buf, true
+	}
+
+	var kind uint32
+	if err := binary.Read(reader, binary.BigEndian, &kind); err != nil {
+		return
+	}
+	mime, ok := readBytes()
+	if !ok {
+		return
+	} else if _, ok := readBytes(); !ok {
+		return
+	}
+
+	// Skip the dimensions, depth and palette size
+	if _, err := reader.Seek(16, io.SeekCurrent); err != nil {
+		return
+	}
+	picture, ok := readBytes()
+	if !ok || len(picture) == 0 || (tags.Picture != nil && kind != 3) {
+		return
+	}
+
+	tags.Picture, tags.PictureType = picture, strings.ToLower(string(mime))
+	if !strings.HasPrefix(tags.PictureType, "image/") {
+		tags.PictureType = "image/jpeg"
+	}
+}
@@ -0,0 +1,402 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// How far past the tags to look for the first MPEG frame
+const frameSearchSize = 64 << 10
+
+var (
+	mp3Bitrates = map[int][]int{
+		// MPEG 1 by layer
+		11: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		12: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		13: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		// MPEG 2 and 2.5 by layer
+		21: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		22: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		23: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = []int{44100, 48000, 32000}
+)
+
+// Read the ID3 tags and stream details of an MP3
+func readMP3(in io.ReaderAt, size int64) (*Tags, error) {
+	tags := &Tags{}
+	audioStart, err := readID3v2(in, size, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Older files only have the fixed size tag at the end
+	audioEnd := size
+	if size >= 128 {
+		trailer := make([]byte, 128)
+		if _, err := in.ReadAt(trailer, size-128); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.HasPrefix(trailer, []byte("TAG")) {
+			readID3v1(trailer, tags)
+			audioEnd -= 128
+		}
+	}
+
+	readMPEGStream(in, audioStart, audioEnd, tags)
+	return tags, nil
+}
+
+// Read an ID3v2 tag at the start of a file, returning where the audio begins
+func readID3v2(in io.ReaderAt, size int64, tags *Tags) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := in.ReadAt(header, 0); err != nil && err != io.EOF {
+		return 0, err
+	} else if !bytes.HasPrefix(header, []byte("ID3")) || size < 10 {
+		return 0, nil
+	}
+
+	version, flags := header[3], header[5]
+	length := int64(syncsafe(header[6:10]))
+	end := 10 + length
+	if flags&0x10 != 0 {
+		end += 10
+	}
+	if version < 2 || version > 4 {
+		return end, nil
+	}
+
+	data, err := readSection(in, 10, length)
+	if err != nil {
+		// Tags too large to read are skipped rather than failing the whole track
+		return end, nil
+	}
+
+	// Versions before 2.4 unsynchronise the whole tag at once
+	if flags&0x80 != 0 && version < 4 {
+		data = bytes.Replace(data, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+	}
+
+	// Skip the extended header
+	if flags&0x40 != 0 && len(data) >= 4 {
+		skip := int(binary.BigEndian.Uint32(data)) + 4
+		if version == 4 {
+			skip = syncsafe(data[:4])
+		}
+		if skip > len(data) {
+			skip = len(data)
+		}
+		data = data[skip:]
+	}
+
+	idLength, headerLength := 4, 10
+	if version == 2 {
+		idLength, headerLength = 3, 6
+	}
+
+	for len(data) >= headerLength && data[0] != 0 {
+		id := string(data[:idLength])
+
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[4:8]))
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		case 4:
+			frameSize = syncsafe(data[4:8])
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		}
+		if frameSize < 0 || headerLength+frameSize > len(data) {
+			break
+		}
+		frame := data[headerLength : headerLength+frameSize]
+		data = data[headerLength+frameSize:]
+
+		// Compressed and encrypted frames are not worth supporting
+		if version == 3 && frameFlags&0x00C0 != 0 || version == 4 && frameFlags&0x000C != 0 {
+			continue
+		}
+		if version == 4 {
+			if frameFlags&0x0001 != 0 && len(frame) >= 4 {
+				frame = frame[4:]
+			}
+			if frameFlags&0x0002 != 0 {
+				frame = bytes.Replace(frame, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+			}
+		}
+
+		readID3Frame(id, frame, tags)
+	}
+
+	return end, nil
+}
+
+// Read a single ID3v2 frame into the tags
+func readID3Frame(id string, frame []byte, tags *Tags) {
+	switch id {
+	case "TIT2", "TT2":
+		tags.Title = id3Text(frame)
+	case "TPE1", "TP1":
+		tags.Artist = id3Text(frame)
+	case "TALB", "TAL":
+		tags.Album = id3Text(frame)
+	case "TPE2", "TP2":
+		tags.AlbumArtist = id3Text(frame)
+	case "TCON", "TCO":
+		tags.Genre = id3Genre(id3Text(frame))
+	case "TRCK", "TRK":
+		tags.Track = parseNumber(id3Text(frame))
+	case "TPOS", "TPA":
+		tags.Disc = parseNumber(id3Text(frame))
+	case "TYER", "TYE", "TDRC":
+		if year := parseYear(id3Text(frame)); year != 0 {
+			tags.Year = year
+		}
+	case "APIC", "PIC":
+		readID3Picture(id, frame, tags)
+	}
+}
+
+// Read an embedded picture, preferring the front cover over any others
+func readID3Picture(id string, frame []byte, tags *Tags) {
+	if len(frame) < 2 {
+		return
+	}
+	encoding, rest := frame[0], frame[1:]
+
+	var mime string
+	if id == "PIC" {
+		if len(rest) < 3 {
+			return
+		}
+		mime = "image/" + strings.ToLower(string(rest[:3]))
+		if mime == "image/jpg" {
+			mime = "image/jpeg"
+		}
+		rest = rest[3:]
+	} else {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return
+		}
+		mime = strings.ToLower(string(rest[:end]))
+		rest = rest[end+1:]
+	}
+
+	if len(rest) < 1 {
+		return
+	}
+	kind := rest[0]
+	_, picture := splitID3String(encoding, rest[1:])
+	if len(picture) == 0 || (tags.Picture != nil && kind != 3) {
+		return
+	}
+
+	if !strings.HasPrefix(mime, "image/") {
+		mime = "image/jpeg"
+	}
+	tags.Picture, tags.PictureType = picture, mime
+}
+
+// Read the fixed size tag from the end of older MP3s, keeping any values already found
+func readID3v1(trailer []byte, tags *Tags) {
+	field := func(raw []byte) string {
+		if end := bytes.IndexByte(raw, 0); end >= 0 {
+			raw = raw[:end]
+		}
+		return strings.TrimSpace(latin1(raw))
+	}
+
+	if tags.Title == "" {
+		tags.Title = field(trailer[3:33])
+	}
+	if tags.Artist == "" {
+		tags.Artist = field(trailer[33:63])
+	}
+	if tags.Album == "" {
+		tags.Album = field(trailer[63:93])
+	}
+	if tags.Year == 0 {
+		tags.Year = parseYear(field(trailer[93:97]))
+	}
+	if tags.Track == 0 && trailer[125] == 0 && trailer[126] != 0 {
+		tags.Track = int(trailer[126])
+	}
+	if tags.Genre == "" {
+		tags.Genre = genreName(int(trailer[127]))
+	}
+}
+
+// Work out the duration and bit rate from the first MPEG frame
+func readMPEGStream(in io.ReaderAt, start, end int64, tags *Tags) {
+	buf := make([]byte, frameSearchSize)
+	n, _ := in.ReadAt(buf, start)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+
+		version := (buf[i+1] >> 3) & 3
+		layer := (buf[i+1] >> 1) & 3
+		bitrateIndex := int(buf[i+2] >> 4)
+		rateIndex := int(buf[i+2]>>2) & 3
+		mono := buf[i+3]>>6 == 3
+		if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+			continue
+		}
+
+		// Layer bits count down from layer I
+		layerNumber := 4 - int(layer)
+		table := 20
+		sampleRate := mp3SampleRates[rateIndex]
+		switch version {
+		case 3:
+			table = 10
+		case 2:
+			sampleRate /= 2
+		case 0:
+			sampleRate /= 4
+		}
+		bitrate := mp3Bitrates[table+layerNumber][bitrateIndex]
+
+		samplesPerFrame := 1152
+		if layerNumber == 1 {
+			samplesPerFrame = 384
+		} else if layerNumber == 3 && version != 3 {
+			samplesPerFrame = 576
+		}
+
+		// Variable bit rate files count their frames in the first one
+		sideInfo := 32
+		if version == 3 && mono || version != 3 && !mono {
+			sideInfo = 17
+		} else if version != 3 && mono {
+			sideInfo = 9
+		}
+		frames := 0
+		if xing := i + 4 + sideInfo; xing+12 <= len(buf) && (string(buf[xing:xing+4]) == "Xing" || string(buf[xing:xing+4]) == "Info") {
+			if binary.BigEndian.Uint32(buf[xing+4:])&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(buf[xing+8:]))
+			}
+		} else if vbri := i + 4 + 32; vbri+18 <= len(buf) && string(buf[vbri:vbri+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(buf[vbri+14:]))
+		}
+
+		audioSize := end - start - int64(i)
+		if frames > 0 {
+			tags.Duration = float64(frames) * float64(samplesPerFrame) / float64(sampleRate)
+			if tags.Duration > 0 {
+				tags.BitRate = int(float64(audioSize) * 8 / tags.Duration / 1000)
+			}
+		} else {
+			tags.BitRate = bitrate
+			tags.Duration = float64(audioSize) * 8 / float64(bitrate*1000)
+		}
+		return
+	}
+}
+
+// Decode a text frame, keeping only the first of multiple values
+func id3Text(frame []byte) string {
+	if len(frame) < 1 {
+		return ""
+	}
+	value, _ := splitID3String(frame[0], frame[1:])
+	return strings.TrimSpace(value)
+}
+
+// Resolve genres given by number such as "(17)" or "17"
+func id3Genre(raw string) string {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(raw, "("), ")")
+	if n, err := strconv.Atoi(trimmed); err == nil {
+		return genreName(n)
+	} else if strings.HasPrefix(raw, "(") {
+		if end := strings.IndexByte(raw, ')'); end > 0 {
+			if n, err := strconv.Atoi(raw[1:end]); err == nil {
+				if rest := strings.TrimSpace(raw[end+1:]); rest != "" {
+					return rest
+				}
+				return genreName(n)
+			}
+		}
+	}
+	return raw
+}
+
+// Decode a terminated string in one of the ID3 encodings, returning it and everything after it
+func splitID3String(encoding byte, data []byte) (string, []byte) {
+	switch encoding {
+	case 1, 2:
+		// UTF-16 strings end on an aligned pair of zero bytes
+		end := -1
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return decodeUTF16(data, encoding == 2), nil
+		}
+		return decodeUTF16(data[:end], encoding == 2), data[end+2:]
+
+	default:
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			end = len(data)
+		}
+		value := data[:end]
+		rest := data[end:]
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+		if encoding == 3 {
+			return string(value), rest
+		}
+		return latin1(value), rest
+	}
+}
+
+// Decode UTF-16 text using its byte order mark if it has one
+func decodeUTF16(data []byte, bigEndian bool) string {
+	if len(data) >= 2 {
+		if data[0] == 0xFF && data[1] == 0xFE {
+			bigEndian, data = false, data[2:]
+		} else if data[0] == 0xFE && data[1] == 0xFF {
+			bigEndian, data = true, data[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// Decode ISO-8859-1 text
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Decode a 28 bit integer stored in the low 7 bits of each byte
+func syncsafe(data []byte) int {
+	return int(data[0]&0x7F)<<21 | int(data[1]&0x7F)<<14 | int(data[2]&0x7F)<<7 | int(data[3]&0x7F)
+}
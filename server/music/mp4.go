@@ -0,0 +1,172 @@
+package music
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+var errNoMovie = errors.New("mp4 has no movie box")
+
+// Data type of PNG images in MP4 metadata, others are assumed to be JPEGs
+const mp4TypePNG = 14
+
+// Read the iTunes metadata and stream details of an MP4
+func readMP4(in io.ReaderAt, size int64) (*Tags, error) {
+	// Find the movie box at the top level, it may be before or after the media data
+	header := make([]byte, 16)
+	var moov []byte
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := in.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		length, headerLength := int64(binary.BigEndian.Uint32(header)), int64(8)
+		kind := string(header[4:8])
+		if length == 1 {
+			if _, err := in.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			length, headerLength = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		} else if length == 0 {
+			length = size - offset
+		}
+		if length < headerLength {
+			return nil, errNoMovie
+		}
+
+		if kind == "moov" {
+			var err error
+			if moov, err = readSection(in, offset+headerLength, length-headerLength); err != nil {
+				return nil, err
+			}
+			break
+		}
+		offset += length
+	}
+	if moov == nil {
+		return nil, errNoMovie
+	}
+
+	tags := &Tags{}
+	for _, box := range mp4Boxes(moov) {
+		switch box.kind {
+		case "mvhd":
+			readMP4Header(box.data, tags)
+		case "udta":
+			for _, meta := range mp4Boxes(box.data) {
+				// The metadata box has a version and flags before its children
+				if meta.kind != "meta" || len(meta.data) < 4 {
+					continue
+				}
+				for _, list := range mp4Boxes(meta.data[4:]) {
+					if list.kind == "ilst" {
+						readMP4Items(list.data, tags)
+					}
+				}
+			}
+		}
+	}
+
+	if tags.Duration > 0 {
+		tags.BitRate = int(float64(size) * 8 / tags.Duration / 1000)
+	}
+	return tags, nil
+}
+
+// Work out the duration from the movie header
+func readMP4Header(data []byte, tags *Tags) {
+	if len(data) < 1 {
+		return
+	}
+
+	var timescale, duration uint64
+	if data[0] == 1 && len(data) >= 32 {
+		timescale = uint64(binary.BigEndian.Uint32(data[20:24]))
+		duration = binary.BigEndian.Uint64(data[24:32])
+	} else if len(data) >= 20 {
+		timescale = uint64(binary.BigEndian.Uint32(data[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
+	if timescale > 0 {
+		tags.Duration = float64(duration) / float64(timescale)
+	}
+}
+
+// Read the items in an iTunes metadata list
+func readMP4Items(data []byte, tags *Tags) {
+	for _, item := range mp4Boxes(data) {
+		// Each item holds its value in a data box after a type and locale
+		var value []byte
+		var kind uint32
+		for _, box := range mp4Boxes(item.data) {
+			if box.kind == "data" && len(box.data) >= 8 {
+				kind = binary.BigEndian.Uint32(box.data) & 0xFFFFFF
+				value = box.data[8:]
+				break
+			}
+		}
+		if value == nil {
+			continue
+		}
+		text := strings.TrimSpace(string(value))
+
+		switch item.kind {
+		case "\xa9nam":
+			tags.Title = text
+		case "\xa9ART":
+			tags.Artist = text
+		case "aART":
+			tags.AlbumArtist = text
+		case "\xa9alb":
+			tags.Album = text
+		case "\xa9gen":
+			tags.Genre = text
+		case "gnre":
+			if len(value) >= 2 && tags.Genre == "" {
+				tags.Genre = genreName(int(binary.BigEndian.Uint16(value)) - 1)
+			}
+		case "\xa9day":
+			tags.Year = parseYear(text)
+		case "trkn":
+			if len(value) >= 4 {
+				tags.Track = int(binary.BigEndian.Uint16(value[2:4]))
+			}
+		case "disk":
+			if len(value) >= 4 {
+				tags.Disc = int(binary.BigEndian.Uint16(value[2:4]))
+			}
+		case "covr":
+			if tags.Picture == nil && len(value) > 0 {
+				tags.Picture, tags.PictureType = value, "image/jpeg"
+				if kind == mp4TypePNG {
+					tags.PictureType = "image/png"
+				}
+			}
+		}
+	}
+}
+
+// A box within an MP4 file
+type mp4Box struct {
+	kind string
+	data []byte
+}
+
+// Split a box into its children
+func mp4Boxes(data []byte) []mp4Box {
+	boxes := []mp4Box{}
+	for len(data) >= 8 {
+		length := int(binary.BigEndian.Uint32(data))
+		if length == 0 {
+			length = len(data)
+		}
+		if length < 8 || length > len(data) {
+			break
+		}
+
+		boxes = append(boxes, mp4Box{kind: string(data[4:8]), data: data[8:length]})
+		data = data[length:]
+	}
+	return boxes
+}
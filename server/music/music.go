@@ -0,0 +1,438 @@
+package music
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UnknownArtist = "Unknown Artist"
+	UnknownAlbum  = "Unknown Album"
+)
+
+// Returned from queries when the music library is turned off because the files are encrypted
+var ErrDisabled = errors.New("the music library is unavailable while files are encrypted")
+
+var ErrNoCover = errors.New("track has no cover")
+
+// Images next to tracks which are used as the album's cover
+var coverNames = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png", "front.jpg", "front.png"}
+
+var contentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"flac": "audio/flac",
+	"m4a":  "audio/mp4",
+	"m4b":  "audio/mp4",
+	"mp4":  "audio/mp4",
+}
+
+// A piece of music found within a user's files
+type Track struct {
+	Path        string `json:"path"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	Album       string `json:"album"`
+	AlbumArtist string `json:"album_artist"`
+	Genre       string `json:"genre,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+	Duration    int    `json:"duration"`
+	BitRate     int    `json:"bit_rate"`
+	HasCover    bool   `json:"has_cover"`
+
+	// Used to determine if the indexed copy is stale
+	Size     int64 `json:"size"`
+	Modified int64 `json:"modified"`
+}
+
+// Get the track's path relative to its owner's files
+func (t *Track) RelativePath() string {
+	parts := strings.SplitN(t.Path, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Get the file extension of the track
+func (t *Track) Suffix() string {
+	return strings.TrimPrefix(strings.ToLower(path.Ext(t.Path)), ".")
+}
+
+// Get the content type of the track
+func (t *Track) ContentType() string {
+	return contentTypes[t.Suffix()]
+}
+
+// Get the stable identifier of the track
+func (t *Track) Id() string {
+	return "tr-" + digest(t.Path)
+}
+
+// Get the identifier of the artist the track's album is filed under
+func (t *Track) ArtistId() string {
+	return ArtistId(t.AlbumArtist)
+}
+
+// Get the identifier of the track's album
+func (t *Track) AlbumId() string {
+	return "al-" + digest(strings.ToLower(t.AlbumArtist)+"\x00"+strings.ToLower(t.Album))
+}
+
+// Get the identifier of an artist by name
+func ArtistId(name string) string {
+	return "ar-" + digest(strings.ToLower(name))
+}
+
+// Check if a file can be added to the music library
+func Supported(name string) bool {
+	_, ok := contentTypes[strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")]
+	return ok
+}
+
+// Index of the music in users' files, kept up to date in the background
+type Library struct {
+	files storage.Storage
+	db    *bolt.DB
+
+	// Nothing is cataloged when the files are encrypted since the tags would reveal their contents
+	disabled bool
+
+	pending map[string]bool
+	signal  chan struct{}
+	lock    sync.Mutex
+}
+
+// Create a music library for users' files
+func New(files storage.Storage, db *bolt.DB) (*Library, error) {
+	// Throw away anything cataloged before encryption was turned on
+	_, sealed := files.(storage.Sealer)
+	if sealed {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(models.BucketMusic); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err := tx.CreateBucket(models.BucketMusic)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Library{
+		files:    files,
+		db:       db,
+		disabled: sealed,
+		pending:  make(map[string]bool),
+		signal:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Queue changed tracks for indexing
+func (l *Library) Handle(event events.Event) {
+	if l.disabled {
+		return
+	}
+
+	switch event.Type {
+	case events.Created, events.Modified, events.Deleted:
+		l.queue(event.Path)
+	case events.Moved:
+		l.queue(event.From)
+		l.queue(event.Path)
+	}
+}
+
+// Add a path to be re-indexed
+func (l *Library) queue(namespacedPath string) {
+	l.lock.Lock()
+	l.pending[namespacedPath] = true
+	l.lock.Unlock()
+
+	// Wake the worker if it is idle
+	select {
+	case l.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Process queued paths one at a time
+func (l *Library) Run() {
+	for range l.signal {
+		for {
+			// Take the next pending path
+			l.lock.Lock()
+			var next string
+			for p := range l.pending {
+				next = p
+				break
+			}
+			delete(l.pending, next)
+			l.lock.Unlock()
+
+			if next == "" {
+				break
+			}
+
+			if err := l.sync(next); err != nil {
+				log.Printf("ERROR: failed to update music library for %s: %v\n", next, err)
+			}
+		}
+	}
+}
+
+// Periodically queue any tracks changed outside of the API
+func (l *Library) Walk(interval time.Duration) {
+	if l.disabled {
+		return
+	}
+
+	for {
+		if err := l.rescan(); err != nil {
+			log.Printf("ERROR: failed to scan for music library changes: %v\n", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Queue every track whose indexed modification time is out of date
+func (l *Library) rescan() error {
+	indexed := make(map[string]int64)
+	if err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketMusic).ForEach(func(k, v []byte) error {
+			var track Track
+			if err := json.Unmarshal(v, &track); err != nil {
+				return err
+			}
+			indexed[string(k)] = track.Modified
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	err := l.files.Walk("", func(namespacedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip internal storage directories
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && namespacedPath != "" {
+			return filepath.SkipDir
+		} else if info.IsDir() || !Supported(info.Name()) {
+			return nil
+		}
+
+		if modified, ok := indexed[namespacedPath]; !ok || modified != info.ModTime().UnixNano() {
+			l.queue(namespacedPath)
+		}
+		delete(indexed, namespacedPath)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Anything left over no longer exists
+	for missing := range indexed {
+		l.queue(missing)
+	}
+	return nil
+}
+
+// Bring the library up to date for a path and everything beneath it
+func (l *Library) sync(namespacedPath string) error {
+	info, err := l.files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		return l.removeUnder(namespacedPath)
+	} else if err != nil {
+		return err
+	}
+
+	// Directories which moved in bring their tracks with them
+	if info.IsDir() {
+		return l.files.Walk(namespacedPath, func(name string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && Supported(name) {
+				l.queue(name)
+			}
+			return err
+		})
+	} else if !Supported(namespacedPath) {
+		return nil
+	}
+
+	tags, err := l.read(namespacedPath, info.Size())
+	if err == storage.ErrLocked {
+		// Indexed on a later scan once the owner logs in
+		return nil
+	} else if err != nil {
+		// Untagged tracks are still listed by their file name
+		log.Printf("ERROR: failed to read tags for %s: %v\n", namespacedPath, err)
+		tags = &Tags{}
+	}
+
+	track := &Track{
+		Path:        namespacedPath,
+		Title:       tags.Title,
+		Artist:      tags.Artist,
+		Album:       tags.Album,
+		AlbumArtist: tags.AlbumArtist,
+		Genre:       tags.Genre,
+		Year:        tags.Year,
+		Track:       tags.Track,
+		Disc:        tags.Disc,
+		Duration:    int(tags.Duration + 0.5),
+		BitRate:     tags.BitRate,
+		HasCover:    tags.Picture != nil,
+		Size:        info.Size(),
+		Modified:    info.ModTime().UnixNano(),
+	}
+	if track.Title == "" {
+		track.Title = strings.TrimSuffix(path.Base(namespacedPath), path.Ext(namespacedPath))
+	}
+	if track.Artist == "" {
+		track.Artist = UnknownArtist
+	}
+	if track.AlbumArtist == "" {
+		track.AlbumArtist = track.Artist
+	}
+	if track.Album == "" {
+		track.Album = UnknownAlbum
+	}
+
+	buf, err := json.Marshal(track)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketMusic).Put([]byte(namespacedPath), buf)
+	})
+}
+
+// Read the tags of a track from its contents
+func (l *Library) read(namespacedPath string, size int64) (*Tags, error) {
+	in, err := l.files.Open(namespacedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return ReadTags(in, size, namespacedPath)
+}
+
+// Remove a path and everything beneath it from the library
+func (l *Library) removeUnder(namespacedPath string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketMusic)
+
+		keys := [][]byte{[]byte(namespacedPath)}
+		prefix := []byte(namespacedPath + "/")
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get all of a user's tracks ordered by artist, album, disc and track number
+func (l *Library) Tracks(username string) ([]*Track, error) {
+	if l.disabled {
+		return nil, ErrDisabled
+	}
+
+	tracks := []*Track{}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(username + "/")
+		cursor := tx.Bucket(models.BucketMusic).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var track Track
+			if err := json.Unmarshal(v, &track); err != nil {
+				return err
+			}
+			tracks = append(tracks, &track)
+		}
+		return nil
+	})
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if artistA, artistB := strings.ToLower(a.AlbumArtist), strings.ToLower(b.AlbumArtist); artistA != artistB {
+			return artistA < artistB
+		} else if albumA, albumB := strings.ToLower(a.Album), strings.ToLower(b.Album); albumA != albumB {
+			return albumA < albumB
+		} else if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		} else if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	return tracks, err
+}
+
+// Read the cover of a track from its tags or an image in the same directory
+func (l *Library) Cover(track *Track) ([]byte, string, error) {
+	if track.HasCover {
+		tags, err := l.read(track.Path, track.Size)
+		if err != nil {
+			return nil, "", err
+		} else if tags.Picture != nil {
+			return tags.Picture, tags.PictureType, nil
+		}
+	}
+
+	for _, name := range coverNames {
+		cover := path.Join(path.Dir(track.Path), name)
+		in, err := l.files.Open(cover)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		picture, err := ioutil.ReadAll(in)
+		in.Close()
+		if err != nil {
+			return nil, "", err
+		}
+
+		contentType := "image/jpeg"
+		if strings.HasSuffix(name, ".png") {
+			contentType = "image/png"
+		}
+		return picture, contentType, nil
+	}
+
+	return nil, "", ErrNoCover
+}
+
+// Get a short stable digest of a value for use in identifiers
+func digest(value string) string {
+	sum := md5.Sum([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,102 @@
+package music
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Largest block of metadata which will be read from a track, covers included
+const maxTagSize = 32 << 20
+
+var errUnsupported = errors.New("unsupported audio format")
+
+// Details read from the tags and stream of an audio file
+type Tags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Year        int
+	Track       int
+	Disc        int
+
+	// Length in seconds and average bit rate in kbps
+	Duration float64
+	BitRate  int
+
+	// Embedded front cover, if any
+	Picture     []byte
+	PictureType string
+}
+
+// Read the tags from an audio file based on its extension
+func ReadTags(in io.ReaderAt, size int64, name string) (*Tags, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mp3":
+		return readMP3(in, size)
+	case ".flac":
+		return readFLAC(in, size)
+	case ".m4a", ".m4b", ".mp4":
+		return readMP4(in, size)
+	default:
+		return nil, errUnsupported
+	}
+}
+
+// Parse numbers like "3" or "3/12", ignoring the total
+func parseNumber(raw string) int {
+	raw = strings.TrimSpace(raw)
+	if i := strings.IndexByte(raw, '/'); i >= 0 {
+		raw = raw[:i]
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(raw))
+	return n
+}
+
+// Parse the year from a date such as "2001" or "2001-05-12"
+func parseYear(raw string) int {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > 4 {
+		raw = raw[:4]
+	}
+	n, _ := strconv.Atoi(raw)
+	return n
+}
+
+// Read a section of a file, failing if it is larger than allowed
+func readSection(in io.ReaderAt, offset, length int64) ([]byte, error) {
+	if length < 0 || length > maxTagSize {
+		return nil, errors.New("metadata block is too large")
+	}
+
+	buf := make([]byte, length)
+	n, err := in.ReadAt(buf, offset)
+	if err == io.EOF && int64(n) == length {
+		err = nil
+	}
+	return buf, err
+}
+
+// Genres referred to by number from ID3v1 and some ID3v2 and MP4 tags
+var genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// Get the name of a numbered genre
+func genreName(n int) string {
+	if n < 0 || n >= len(genres) {
+		return ""
+	}
+	return genres[n]
+}
@@ -0,0 +1,507 @@
+package music
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Encode a 28 bit integer in the low 7 bits of each byte
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+// Build an ID3v2 tag of some version around its frames
+func id3v2(version, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	tag := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafeBytes(len(body))...)
+	return append(tag, body...)
+}
+
+// Build an ID3v2 frame with the header layout of a version
+func id3Frame(version byte, id string, payload []byte) []byte {
+	var frame []byte
+	switch version {
+	case 2:
+		frame = append([]byte(id), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	case 3:
+		frame = append([]byte(id), 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(frame[4:], uint32(len(payload)))
+	default:
+		frame = append(append([]byte(id), syncsafeBytes(len(payload))...), 0, 0)
+	}
+	return append(frame, payload...)
+}
+
+// Encode text as UTF-16 with a little endian byte order mark
+func utf16LE(text string) []byte {
+	encoded := []byte{0xFF, 0xFE}
+	for _, r := range text {
+		encoded = append(encoded, byte(r), byte(r>>8))
+	}
+	return encoded
+}
+
+// Build an ID3v1 tag from the end of a file
+func id3v1(title, artist string, track, genre byte) []byte {
+	trailer := make([]byte, 128)
+	copy(trailer, "TAG")
+	copy(trailer[3:33], title)
+	copy(trailer[33:63], artist)
+	trailer[126], trailer[127] = track, genre
+	return trailer
+}
+
+// Build a FLAC metadata block
+func flacBlock(kind byte, last bool, data []byte) []byte {
+	if last {
+		kind |= 0x80
+	}
+	return append([]byte{kind, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+// Build the stream information block of a FLAC file
+func streamInfo(sampleRate int, samples int64) []byte {
+	block := make([]byte, 34)
+	block[10], block[11], block[12] = byte(sampleRate>>12), byte(sampleRate>>4), byte(sampleRate<<4)
+	block[13] = byte(samples>>32) & 0x0F
+	binary.BigEndian.PutUint32(block[14:18], uint32(samples))
+	return block
+}
+
+// Build a Vorbis comment block, claiming a number of comments which may not match those given
+func vorbisComments(count uint32, comments ...string) []byte {
+	var block []byte
+	field := func(value string) {
+		block = append(block, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(block[len(block)-4:], uint32(len(value)))
+		block = append(block, value...)
+	}
+
+	field("vendor")
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], count)
+	for _, comment := range comments {
+		field(comment)
+	}
+	return block
+}
+
+// Build a FLAC picture block
+func flacPictureBlock(kind uint32, mime string, picture []byte) []byte {
+	var block []byte
+	number := func(n uint32) {
+		block = append(block, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(block[len(block)-4:], n)
+	}
+
+	number(kind)
+	number(uint32(len(mime)))
+	block = append(block, mime...)
+	number(0)
+	block = append(block, make([]byte, 16)...)
+	number(uint32(len(picture)))
+	return append(block, picture...)
+}
+
+// Build an MP4 box around its contents
+func box(kind string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], kind)
+	return append(box, body...)
+}
+
+// Build an iTunes metadata item holding a value of some type
+func mp4Item(kind string, dataType uint32, value []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, dataType)
+	return box(kind, box("data", header, value))
+}
+
+// Build a version 0 movie header
+func mvhd(timescale, duration uint32) []byte {
+	data := make([]byte, 100)
+	binary.BigEndian.PutUint32(data[12:16], timescale)
+	binary.BigEndian.PutUint32(data[16:20], duration)
+	return box("mvhd", data)
+}
+
+// Build a movie box with a header and metadata items
+func moov(header []byte, items ...[]byte) []byte {
+	return box("moov", header, box("udta", box("meta", []byte{0, 0, 0, 0}, box("ilst", items...))))
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// Pictures and text avoid 0xFF so no MPEG frame is ever found in them
+var picture = []byte("\x89PNG picture data")
+
+var tagCases = []struct {
+	name string
+	file string
+	data []byte
+	fail bool
+	want Tags
+}{
+	// ID3v2
+	{
+		name: "id3v2.3",
+		file: "track.mp3",
+		data: id3v2(3, 0,
+			id3Frame(3, "TIT2", []byte("\x00Title\x00")),
+			id3Frame(3, "TPE1", append([]byte{1}, utf16LE("Ärtist")...)),
+			id3Frame(3, "TALB", []byte("\x03Album")),
+			id3Frame(3, "TRCK", []byte("\x003/12")),
+			id3Frame(3, "TCON", []byte("\x00(17)")),
+			id3Frame(3, "TYER", []byte("\x001999")),
+			id3Frame(3, "APIC", join([]byte("\x00image/png\x00\x03desc\x00"), picture)),
+		),
+		want: Tags{Title: "Title", Artist: "Ärtist", Album: "Album", Track: 3, Genre: "Rock", Year: 1999, Picture: picture, PictureType: "image/png"},
+	},
+	{
+		name: "id3v2.4",
+		file: "track.mp3",
+		data: id3v2(4, 0,
+			id3Frame(4, "TIT2", []byte("\x03Tïtle")),
+			id3Frame(4, "TDRC", []byte("\x002001-05-12")),
+			id3Frame(4, "TPOS", []byte("\x002/2")),
+		),
+		want: Tags{Title: "Tïtle", Year: 2001, Disc: 2},
+	},
+	{
+		name: "id3v2.2",
+		file: "track.mp3",
+		data: id3v2(2, 0,
+			id3Frame(2, "TT2", []byte("\x00Old")),
+			id3Frame(2, "PIC", join([]byte("\x00JPG\x03\x00"), picture)),
+		),
+		want: Tags{Title: "Old", Picture: picture, PictureType: "image/jpeg"},
+	},
+	{
+		name: "frame larger than the tag",
+		file: "track.mp3",
+		data: func() []byte {
+			tag := id3v2(3, 0, id3Frame(3, "TIT2", []byte("\x00Kept")), id3Frame(3, "TPE1", []byte("\x00Lost")))
+			binary.BigEndian.PutUint32(tag[len(tag)-len("\x00Lost")-6:], 1<<20)
+			return tag
+		}(),
+		want: Tags{Title: "Kept"},
+	},
+	{
+		name: "tag larger than the file",
+		file: "track.mp3",
+		data: func() []byte {
+			tag := id3v2(3, 0, id3Frame(3, "TIT2", []byte("\x00Title")))
+			copy(tag[6:10], syncsafeBytes(1<<20))
+			return tag
+		}(),
+	},
+	{
+		name: "truncated header",
+		file: "track.mp3",
+		data: []byte("ID3\x03\x00"),
+	},
+	{
+		name: "extended header larger than the tag",
+		file: "track.mp3",
+		data: id3v2(3, 0x40, []byte{0xFF, 0xFF, 0xFF, 0x00}, id3Frame(3, "TIT2", []byte("\x00Title"))),
+	},
+	{
+		name: "extended header shorter than its size field",
+		file: "track.mp3",
+		data: id3v2(4, 0x40, []byte{0x00, 0x01}),
+	},
+	{
+		name: "empty frames",
+		file: "track.mp3",
+		data: id3v2(3, 0, id3Frame(3, "TIT2", nil), id3Frame(3, "APIC", nil), id3Frame(3, "TRCK", []byte{0})),
+	},
+	{
+		name: "picture without a terminated type",
+		file: "track.mp3",
+		data: id3v2(3, 0, id3Frame(3, "APIC", []byte("\x00image/png"))),
+	},
+	{
+		name: "picture without data",
+		file: "track.mp3",
+		data: id3v2(3, 0, id3Frame(3, "APIC", []byte("\x00image/png\x00\x03desc\x00"))),
+	},
+	{
+		name: "odd length UTF-16 without a terminator",
+		file: "track.mp3",
+		data: id3v2(3, 0, id3Frame(3, "TIT2", []byte{1, 0xFF, 0xFE, 'A', 0, 'B'})),
+		want: Tags{Title: "A"},
+	},
+	{
+		name: "compressed frame",
+		file: "track.mp3",
+		data: func() []byte {
+			frame := id3Frame(3, "TIT2", []byte("\x00Compressed"))
+			frame[9] = 0x80
+			return id3v2(3, 0, frame)
+		}(),
+	},
+	{
+		name: "unknown version",
+		file: "track.mp3",
+		data: id3v2(5, 0, id3Frame(4, "TIT2", []byte("\x00Future"))),
+	},
+	{
+		name: "unknown genre number",
+		file: "track.mp3",
+		data: id3v2(3, 0, id3Frame(3, "TCON", []byte("\x00(999)"))),
+	},
+	{
+		name: "id3v1 after an id3v2 tag",
+		file: "track.mp3",
+		data: join(id3v2(3, 0, id3Frame(3, "TIT2", []byte("\x00New"))), id3v1("Old", "Band", 7, 13)),
+		want: Tags{Title: "New", Artist: "Band", Track: 7, Genre: "Pop"},
+	},
+	{
+		name: "id3v1 genre out of range",
+		file: "track.mp3",
+		data: id3v1("Title", "", 0, 250),
+		want: Tags{Title: "Title"},
+	},
+
+	// FLAC
+	{
+		name: "flac",
+		file: "track.flac",
+		data: join([]byte("fLaC"),
+			flacBlock(flacStreamInfo, false, streamInfo(44100, 441000)),
+			flacBlock(flacVorbisComment, false, vorbisComments(6, "TITLE=Title", "artist=Artist", "ARTIST=Second", "TRACKNUMBER=4/9", "DATE=2010-01-01", "no separator")),
+			flacBlock(flacPicture, true, flacPictureBlock(3, "image/PNG", picture)),
+		),
+		want: Tags{Title: "Title", Artist: "Artist", Track: 4, Year: 2010, Duration: 10, Picture: picture, PictureType: "image/png"},
+	},
+	{
+		name: "flac after an id3v2 tag",
+		file: "track.flac",
+		data: join(id3v2(3, 0, id3Frame(3, "TALB", []byte("\x00Album"))), []byte("fLaC"), flacBlock(flacVorbisComment, true, vorbisComments(1, "TITLE=Title"))),
+		want: Tags{Title: "Title", Album: "Album"},
+	},
+	{
+		name: "flac without its marker",
+		file: "track.flac",
+		data: join([]byte("OggS"), flacBlock(flacStreamInfo, true, streamInfo(44100, 441000))),
+		fail: true,
+	},
+	{
+		name: "flac ending after its marker",
+		file: "track.flac",
+		data: []byte("fLaC"),
+		fail: true,
+	},
+	{
+		name: "flac block larger than the file",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacVorbisComment, true, vorbisComments(1, "TITLE=Title"))[:20]),
+		fail: true,
+	},
+	{
+		name: "flac padding running past the end",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacVorbisComment, false, vorbisComments(1, "TITLE=Title")), []byte{1, 0xFF, 0xFF, 0xFF}),
+		want: Tags{Title: "Title"},
+	},
+	{
+		name: "flac claiming more comments than it has",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacVorbisComment, true, vorbisComments(1000, "TITLE=Title"))),
+		want: Tags{Title: "Title"},
+	},
+	{
+		name: "flac comment longer than its block",
+		file: "track.flac",
+		data: func() []byte {
+			block := vorbisComments(2, "TITLE=Title", "ARTIST=Artist")
+			binary.LittleEndian.PutUint32(block[len(block)-len("ARTIST=Artist")-4:], 1<<30)
+			return join([]byte("fLaC"), flacBlock(flacVorbisComment, true, block))
+		}(),
+		want: Tags{Title: "Title"},
+	},
+	{
+		name: "flac comments without a count",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacVorbisComment, true, vorbisComments(0)[:12])),
+	},
+	{
+		name: "flac picture type longer than its block",
+		file: "track.flac",
+		data: func() []byte {
+			block := flacPictureBlock(3, "image/png", picture)
+			binary.BigEndian.PutUint32(block[4:8], 1<<30)
+			return join([]byte("fLaC"), flacBlock(flacPicture, true, block))
+		}(),
+	},
+	{
+		name: "flac picture cut short",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacPicture, true, flacPictureBlock(3, "image/png", picture)[:30])),
+	},
+	{
+		name: "flac stream information cut short",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacStreamInfo, true, streamInfo(44100, 441000)[:12])),
+	},
+	{
+		name: "flac without a sample rate",
+		file: "track.flac",
+		data: join([]byte("fLaC"), flacBlock(flacStreamInfo, true, streamInfo(0, 441000))),
+	},
+
+	// MP4
+	{
+		name: "mp4",
+		file: "track.m4a",
+		data: join(box("ftyp", []byte("M4A ")), moov(mvhd(1000, 90000),
+			mp4Item("\xa9nam", 1, []byte("Title")),
+			mp4Item("\xa9ART", 1, []byte("Artist")),
+			mp4Item("aART", 1, []byte("Band")),
+			mp4Item("gnre", 0, []byte{0, 18}),
+			mp4Item("\xa9day", 1, []byte("2005-03-01T00:00:00Z")),
+			mp4Item("trkn", 0, []byte{0, 0, 0, 5, 0, 10, 0, 0}),
+			mp4Item("disk", 0, []byte{0, 0, 0, 1, 0, 2}),
+			mp4Item("covr", mp4TypePNG, picture),
+		)),
+		want: Tags{Title: "Title", Artist: "Artist", AlbumArtist: "Band", Genre: "Rock", Year: 2005, Track: 5, Disc: 1, Duration: 90, Picture: picture, PictureType: "image/png"},
+	},
+	{
+		name: "mp4 movie after 64 bit media data",
+		file: "track.m4b",
+		data: func() []byte {
+			mdat := []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 20, 1, 2, 3, 4}
+			return join(mdat, moov(mvhd(10, 25), mp4Item("\xa9alb", 1, []byte("Album"))))
+		}(),
+		want: Tags{Album: "Album", Duration: 2.5},
+	},
+	{
+		name: "mp4 without a movie",
+		file: "track.m4a",
+		data: box("ftyp", []byte("M4A ")),
+		fail: true,
+	},
+	{
+		name: "mp4 box shorter than its header",
+		file: "track.m4a",
+		data: []byte{0, 0, 0, 4, 'f', 't', 'y', 'p'},
+		fail: true,
+	},
+	{
+		name: "mp4 64 bit size which is negative",
+		file: "track.m4a",
+		data: []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0xFF, 0, 0, 0, 0, 0, 0, 0},
+		fail: true,
+	},
+	{
+		name: "mp4 64 bit size cut short",
+		file: "track.m4a",
+		data: []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0},
+		fail: true,
+	},
+	{
+		name: "mp4 movie larger than the file",
+		file: "track.m4a",
+		data: moov(mvhd(1000, 1000))[:50],
+		fail: true,
+	},
+	{
+		name: "mp4 movie running to the end of the file",
+		file: "track.m4a",
+		data: func() []byte {
+			box := moov(nil, mp4Item("\xa9nam", 1, []byte("Title")))
+			binary.BigEndian.PutUint32(box, 0)
+			return box
+		}(),
+		want: Tags{Title: "Title"},
+	},
+	{
+		name: "mp4 item larger than its list",
+		file: "track.m4a",
+		data: func() []byte {
+			second := mp4Item("\xa9ART", 1, []byte("Artist"))
+			binary.BigEndian.PutUint32(second, 1<<20)
+			return moov(nil, mp4Item("\xa9nam", 1, []byte("Title")), second)
+		}(),
+		want: Tags{Title: "Title"},
+	},
+	{
+		name: "mp4 data box cut short",
+		file: "track.m4a",
+		data: moov(nil, box("\xa9nam", box("data", []byte{0, 0, 0, 1}))),
+	},
+	{
+		name: "mp4 numbers cut short",
+		file: "track.m4a",
+		data: moov(nil, mp4Item("trkn", 0, []byte{0, 0}), mp4Item("disk", 0, []byte{0}), mp4Item("gnre", 0, []byte{1})),
+	},
+	{
+		name: "mp4 genre out of range",
+		file: "track.m4a",
+		data: moov(nil, mp4Item("gnre", 0, []byte{0, 0})),
+	},
+	{
+		name: "mp4 metadata without its version",
+		file: "track.m4a",
+		data: box("moov", box("udta", box("meta", []byte{0, 0}))),
+	},
+	{
+		name: "mp4 movie header cut short",
+		file: "track.m4a",
+		data: moov(box("mvhd", []byte{1, 0, 0, 0, 0, 0, 0, 0})),
+	},
+
+	{
+		name: "unsupported extension",
+		file: "track.ogg",
+		data: []byte("OggS"),
+		fail: true,
+	},
+}
+
+func TestReadTags(t *testing.T) {
+	for _, c := range tagCases {
+		t.Run(c.name, func(t *testing.T) {
+			tags, err := ReadTags(bytes.NewReader(c.data), int64(len(c.data)), c.file)
+			if c.fail {
+				if err == nil {
+					t.Fatalf("read %+v instead of failing", tags)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// The bit rate depends on the size of the file so is not compared
+			got := *tags
+			got.BitRate = 0
+			if got.Title != c.want.Title || got.Artist != c.want.Artist || got.Album != c.want.Album ||
+				got.AlbumArtist != c.want.AlbumArtist || got.Genre != c.want.Genre || got.Year != c.want.Year ||
+				got.Track != c.want.Track || got.Disc != c.want.Disc || got.Duration != c.want.Duration ||
+				!bytes.Equal(got.Picture, c.want.Picture) || got.PictureType != c.want.PictureType {
+				t.Fatalf("read %+v instead of %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func FuzzReadTags(f *testing.F) {
+	for _, c := range tagCases {
+		f.Add(c.data, c.file)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, file string) {
+		// Malformed tags must only ever fail, never panic
+		tags, err := ReadTags(bytes.NewReader(data), int64(len(data)), file)
+		if err == nil && tags == nil {
+			t.Fatal("no tags and no error")
+		} else if err == nil && len(tags.Picture) > len(data) {
+			t.Fatal("picture larger than the file")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/russross/blackfriday/v2"
+	"html"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest file which is rendered
+const MaxSize = 8 << 20
+
+var (
+	ErrUnsupported = errors.New("file type cannot be rendered")
+	ErrTooLarge    = errors.New("file is too large to render")
+)
+
+// Where links to the owner's other files point
+type Links struct {
+	// URL of the owner's root directory
+	Root string
+
+	// Query added to links which download a file
+	Download string
+}
+
+// A rendered document and the version of the file it was rendered from
+type entry struct {
+	document []byte
+	size     int64
+	modified time.Time
+	used     time.Time
+}
+
+// Renders text documents to sanitized HTML, keeping recently rendered documents in memory
+type Cache struct {
+	files   storage.Storage
+	limit   int
+	entries map[string]*entry
+	lock    sync.Mutex
+}
+
+// Create a cache holding a limited number of rendered documents
+func New(files storage.Storage, limit int) *Cache {
+	return &Cache{
+		files:   files,
+		limit:   limit,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Check if a file can be rendered
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown", ".txt", ".html", ".htm":
+		return true
+	default:
+		return false
+	}
+}
+
+// Render a file as a sanitized HTML document along with when it was last modified
+func (c *Cache) Render(namespacedPath string, links Links) ([]byte, time.Time, error) {
+	if !Supported(namespacedPath) {
+		return nil, time.Time{}, ErrUnsupported
+	}
+
+	// Use the cached document if the file has not changed since it was rendered
+	info, err := c.files.Stat(namespacedPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	} else if info.IsDir() {
+		return nil, time.Time{}, ErrUnsupported
+	} else if info.Size() > MaxSize {
+		return nil, time.Time{}, ErrTooLarge
+	}
+
+	key := namespacedPath + "\x00" + links.Root + "\x00" + links.Download
+	c.lock.Lock()
+	if cached, ok := c.entries[key]; ok && cached.size == info.Size() && cached.modified.Equal(info.ModTime()) {
+		cached.used = time.Now()
+		c.lock.Unlock()
+		return cached.document, info.ModTime(), nil
+	}
+	c.lock.Unlock()
+
+	in, err := c.files.Open(namespacedPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer in.Close()
+	source, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	document := Document(namespacedPath, source, links)
+	c.store(key, &entry{document: document, size: info.Size(), modified: info.ModTime(), used: time.Now()})
+	return document, info.ModTime(), nil
+}
+
+// Add a document to the cache, making room by removing the least recently used
+func (c *Cache) store(key string, rendered *entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.limit {
+		oldest := ""
+		for k, e := range c.entries {
+			if oldest == "" || e.used.Before(c.entries[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = rendered
+}
+
+// Convert the contents of a file to a sanitized HTML document
+func Document(namespacedPath string, source []byte, links Links) []byte {
+	source = bytes.ToValidUTF8(source, []byte("�"))
+
+	var body []byte
+	switch strings.ToLower(filepath.Ext(namespacedPath)) {
+	case ".md", ".markdown":
+		body = blackfriday.Run(source)
+	case ".txt":
+		body = []byte("<pre>" + html.EscapeString(string(source)) + "</pre>")
+	default:
+		body = source
+	}
+
+	// Links are relative to the directory within the owner's files
+	directory := ""
+	if parts := strings.SplitN(path.Dir(namespacedPath), "/", 2); len(parts) == 2 {
+		directory = parts[1]
+	}
+
+	title := html.EscapeString(strings.TrimSuffix(path.Base(namespacedPath), path.Ext(namespacedPath)))
+	var out bytes.Buffer
+	out.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + title + "</title>\n</head>\n<body>\n")
+	out.Write(Sanitize(body, directory, links))
+	out.WriteString("\n</body>\n</html>\n")
+	return out.Bytes()
+}
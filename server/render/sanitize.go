@@ -0,0 +1,163 @@
+package render
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Elements kept along with the attributes allowed on them
+var allowedElements = map[string][]string{
+	"a": {"href", "name"}, "abbr": nil, "b": nil, "blockquote": nil, "br": nil, "caption": nil,
+	"code": {"class"}, "dd": nil, "del": nil, "details": nil, "div": nil, "dl": nil, "dt": nil,
+	"em": nil, "figcaption": nil, "figure": nil, "h1": nil, "h2": nil, "h3": nil, "h4": nil,
+	"h5": nil, "h6": nil, "hr": nil, "i": nil, "img": {"src", "alt", "width", "height"},
+	"ins": nil, "kbd": nil, "li": nil, "mark": nil, "ol": {"start"}, "p": nil, "pre": nil,
+	"q": nil, "s": nil, "small": nil, "span": nil, "strong": nil, "sub": nil, "summary": nil,
+	"sup": nil, "table": nil, "tbody": nil, "td": {"colspan", "rowspan", "align"}, "tfoot": nil,
+	"th": {"colspan", "rowspan", "align"}, "thead": nil, "tr": nil, "u": nil, "ul": nil,
+}
+
+// Attributes allowed on every kept element
+var globalAttributes = []string{"title", "lang", "dir"}
+
+// Elements removed along with everything inside them
+var removedElements = map[string]bool{
+	"script": true, "style": true, "head": true, "title": true, "iframe": true, "frame": true,
+	"frameset": true, "object": true, "embed": true, "applet": true, "noscript": true,
+	"noembed": true, "noframes": true, "template": true, "textarea": true, "select": true,
+	"svg": true, "math": true,
+}
+
+// Elements which never have contents
+var voidElements = map[string]bool{"br": true, "hr": true, "img": true}
+
+// Schemes links may point to outside of the owner's files
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// Remove anything which could run scripts or load content from elsewhere, pointing
+// relative links and images at the files they refer to
+func Sanitize(source []byte, directory string, links Links) []byte {
+	var out bytes.Buffer
+	tokenizer := html.NewTokenizer(bytes.NewReader(source))
+
+	// Name and depth of the element whose contents are being removed
+	skipping, depth := "", 0
+	for {
+		kind := tokenizer.Next()
+		if kind == html.ErrorToken {
+			break
+		}
+		token := tokenizer.Token()
+
+		if skipping != "" {
+			if token.Data == skipping {
+				switch kind {
+				case html.StartTagToken:
+					depth++
+				case html.EndTagToken:
+					if depth--; depth == 0 {
+						skipping = ""
+					}
+				}
+			}
+			continue
+		}
+
+		switch kind {
+		case html.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if removedElements[token.Data] {
+				if kind == html.StartTagToken {
+					skipping, depth = token.Data, 1
+				}
+				continue
+			}
+			allowed, ok := allowedElements[token.Data]
+			if !ok {
+				continue
+			}
+
+			out.WriteString("<" + token.Data)
+			for _, attribute := range token.Attr {
+				if attribute.Namespace != "" || (!contains(allowed, attribute.Key) && !contains(globalAttributes, attribute.Key)) {
+					continue
+				}
+
+				value := attribute.Val
+				if attribute.Key == "href" || attribute.Key == "src" {
+					if value = rewrite(value, directory, links, attribute.Key == "href"); value == "" {
+						continue
+					}
+				}
+				out.WriteString(" " + attribute.Key + `="` + html.EscapeString(value) + `"`)
+			}
+			if token.Data == "a" {
+				out.WriteString(` rel="noopener noreferrer nofollow"`)
+			}
+			out.WriteString(">")
+
+		case html.EndTagToken:
+			if _, ok := allowedElements[token.Data]; ok && !voidElements[token.Data] {
+				out.WriteString("</" + token.Data + ">")
+			}
+		}
+	}
+
+	return out.Bytes()
+}
+
+// Point a link at the file it refers to, or nothing if it cannot be followed safely
+func rewrite(raw, directory string, links Links, link bool) string {
+	target, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return ""
+	}
+
+	// Links elsewhere are only allowed for well known schemes and never for images
+	if target.Scheme != "" || target.Host != "" {
+		if link && allowedSchemes[strings.ToLower(target.Scheme)] {
+			return target.String()
+		}
+		return ""
+	}
+
+	// Links within the same document
+	if target.Path == "" {
+		if link && target.Fragment != "" {
+			return "#" + url.PathEscape(target.Fragment)
+		}
+		return ""
+	}
+
+	// Paths are relative to the document's directory, or the owner's root if absolute
+	resolved := path.Join("/", directory, target.Path)
+	if strings.HasPrefix(target.Path, "/") {
+		resolved = path.Clean(target.Path)
+	}
+
+	rewritten := links.Root + (&url.URL{Path: resolved}).EscapedPath()
+	if link && Supported(resolved) {
+		rewritten += "?render=html"
+	} else if links.Download != "" {
+		rewritten += "?" + links.Download
+	}
+	if link && target.Fragment != "" {
+		rewritten += "#" + url.PathEscape(target.Fragment)
+	}
+	return rewritten
+}
+
+// Check if a value is in a list
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
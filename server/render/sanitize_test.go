@@ -0,0 +1,121 @@
+package render
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var testLinks = Links{Root: "/api/files/alice", Download: "download=1"}
+
+var sanitizeCases = []struct {
+	name   string
+	source string
+	want   string
+}{
+	// Scripts hidden within links
+	{"script link", `<a href="javascript:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"uppercase scheme", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"leading whitespace", "<a href=\" \n\tjavascript:alert(1)\">x</a>", `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"tab within the scheme", "<a href=\"jav\tascript:alert(1)\">x</a>", `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"newline within the scheme", "<a href=\"java\nscript:alert(1)\">x</a>", `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"leading control character", "<a href=\"\x01javascript:alert(1)\">x</a>", `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"decimal entity", `<a href="&#106;avascript:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"hexadecimal entities", `<a href="&#x6A;&#x61;vascript&#x3A;alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"entity without a semicolon", `<a href="&#106avascript:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"padded entity", `<a href="&#0000106;avascript:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"tab entity within the scheme", `<a href="jav&#x09;ascript:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"newline entity within the scheme", `<a href="jav&NewLine;ascript:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"named colon entity", `<a href="javascript&colon;alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"null entity within the scheme", `<a href="java&#0;script:alert(1)">x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"unquoted", `<a href=javascript:alert(1)>x</a>`, `<a rel="noopener noreferrer nofollow">x</a>`},
+	{"other schemes", `<a href="vbscript:x">a</a><a href="data:text/html,x">b</a>`, `<a rel="noopener noreferrer nofollow">a</a><a rel="noopener noreferrer nofollow">b</a>`},
+	{"script image", `<img src="javascript:alert(1)">`, `<img>`},
+	{"data image", `<img src="data:image/png;base64,AAAA">`, `<img>`},
+	{"protocol relative image", `<img src="//example.com/a.png">`, `<img>`},
+
+	// Links which are kept
+	{"web link", `<a href=" https://example.com/a?b=c&amp;d ">x</a>`, `<a href="https://example.com/a?b=c&amp;d" rel="noopener noreferrer nofollow">x</a>`},
+	{"mail link", `<a href="mailto:bob@example.com">x</a>`, `<a href="mailto:bob@example.com" rel="noopener noreferrer nofollow">x</a>`},
+	{"fragment", `<a href="#top">x</a>`, `<a href="#top" rel="noopener noreferrer nofollow">x</a>`},
+	{"relative document", `<a href="../notes/a b.md#part">x</a>`, `<a href="/api/files/alice/notes/a%20b.md?render=html#part" rel="noopener noreferrer nofollow">x</a>`},
+	{"relative image", `<img src="pictures/cat.png" alt="cat">`, `<img src="/api/files/alice/docs/pictures/cat.png?download=1" alt="cat">`},
+	{"escaping the root", `<img src="../../../../etc/passwd">`, `<img src="/api/files/alice/etc/passwd?download=1">`},
+	{"encoded colon in a path", `<a href="javascript%3Aalert(1)">x</a>`, `<a href="/api/files/alice/docs/javascript:alert%281%29?download=1" rel="noopener noreferrer nofollow">x</a>`},
+
+	// Attributes
+	{"event handlers", `<p onclick="alert(1)" title="t">x</p><img src=a.png onerror=alert(1)>`, `<p title="t">x</p><img src="/api/files/alice/docs/a.png?download=1">`},
+	{"style attribute", `<span style="background:url(javascript:alert(1))">x</span>`, `<span>x</span>`},
+	{"quotes in values", `<p title='"><script>alert(1)</script>'>x</p>`, `<p title="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;">x</p>`},
+	{"namespaced attribute", `<svg><a xlink:href="javascript:alert(1)">x</a></svg><a xlink:href="javascript:alert(1)">y</a>`, `<a rel="noopener noreferrer nofollow">y</a>`},
+
+	// Removed elements and what is inside them
+	{"script", `a<script>alert(1)</script>b`, `ab`},
+	{"uppercase script", `a<SCRIPT>alert(1)</SCRIPT>b`, `ab`},
+	{"script inside svg", `a<svg><script>alert(1)</script><p>x</p></svg>b`, `ab`},
+	{"nested svg", `a<svg><svg><script>alert(1)</script></svg><image href="x"/></svg>b`, `ab`},
+	{"style inside math", `a<math><mi><style><img src=x onerror=alert(1)></style></mi></math>b`, `ab`},
+	{"script inside a template", `a<template><script>alert(1)</script></template>b`, `ab`},
+	{"end tag inside an attribute", `<noscript><p title="</noscript><img src=x onerror=alert(1)>"></noscript>`, `<img src="/api/files/alice/docs/x?download=1">&#34;&gt;`},
+	{"script start inside script", `<script><script>alert(1)</script>b`, `b`},
+	{"self closing script", `<script/>alert(1)</script>b`, `alert(1)b`},
+	{"unclosed removed element", `a<svg><p>never shown`, `a`},
+	{"unknown elements", `<blink><marquee>x</marquee></blink><xmp><script>alert(1)</script></xmp>`, `x&lt;script&gt;alert(1)&lt;/script&gt;`},
+	{"comments", `a<!-- <script>alert(1)</script> -->b<!--[if IE]><script>alert(1)</script><![endif]-->c`, `abc`},
+	{"cdata section", `a<![CDATA[<script>alert(1)</script>]]>b`, `aalert(1)]]&gt;b`},
+	{"void end tags", `a<br></br><img src="x.png"></img>b`, `a<br><img src="/api/files/alice/docs/x.png?download=1">b`},
+}
+
+func TestSanitize(t *testing.T) {
+	for _, c := range sanitizeCases {
+		if got := string(Sanitize([]byte(c.source), "docs", testLinks)); got != c.want {
+			t.Errorf("%s: sanitized %q into %q instead of %q", c.name, c.source, got, c.want)
+		}
+	}
+}
+
+func FuzzSanitize(f *testing.F) {
+	for _, c := range sanitizeCases {
+		f.Add([]byte(c.source))
+	}
+
+	f.Fuzz(func(t *testing.T, source []byte) {
+		// Whatever went in, only allowed elements and attributes come out, with links to safe places
+		sanitized := Sanitize(source, "docs", testLinks)
+		tokenizer := html.NewTokenizer(bytes.NewReader(sanitized))
+		for {
+			kind := tokenizer.Next()
+			if kind == html.ErrorToken {
+				break
+			} else if kind != html.StartTagToken && kind != html.SelfClosingTagToken {
+				continue
+			}
+
+			token := tokenizer.Token()
+			allowed, ok := allowedElements[token.Data]
+			if !ok {
+				t.Fatalf("kept %s from %q", token.Data, source)
+			}
+			for _, attribute := range token.Attr {
+				if token.Data == "a" && attribute.Key == "rel" {
+					continue
+				} else if !contains(allowed, attribute.Key) && !contains(globalAttributes, attribute.Key) {
+					t.Fatalf("kept %s on %s from %q", attribute.Key, token.Data, source)
+				} else if attribute.Key != "href" && attribute.Key != "src" {
+					continue
+				}
+
+				target, err := url.Parse(attribute.Val)
+				if err != nil {
+					t.Fatalf("kept invalid %s %q from %q", attribute.Key, attribute.Val, source)
+				} else if target.Scheme != "" && (attribute.Key == "src" || !allowedSchemes[strings.ToLower(target.Scheme)]) {
+					t.Fatalf("kept %s to %q from %q", attribute.Key, attribute.Val, source)
+				} else if target.Scheme == "" && !strings.HasPrefix(attribute.Val, testLinks.Root+"/") && !strings.HasPrefix(attribute.Val, "#") {
+					t.Fatalf("kept %s outside the owner's files to %q from %q", attribute.Key, attribute.Val, source)
+				}
+			}
+		}
+	})
+}
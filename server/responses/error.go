@@ -1,6 +1,7 @@
 package responses
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 )
@@ -13,3 +14,19 @@ func Error(w http.ResponseWriter, status int, reason string) {
 		log.Printf("ERROR: failed to write response: %v\n", err)
 	}
 }
+
+// Send an error response with some data describing it
+func ErrorWithData(w http.ResponseWriter, status int, reason string, data interface{}) {
+	// Encode body
+	encoded, err := json.Marshal(map[string]interface{}{"status": "error", "reason": reason, "data": data})
+	if err != nil {
+		log.Printf("ERROR: failed to encode response data: %v\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(encoded); err != nil {
+		log.Printf("ERROR: failed to write response: %v\n", err)
+	}
+}
@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/activity"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+	defaultRecentLimit   = 20
+	maxRecentLimit       = 100
+)
+
+// Routes for seeing what happened to a user's files, shares and chats
+func Activity(files storage.Storage, feed *activity.Feed, router *mux.Router) {
+	subrouter := router.PathPrefix("/activity").Subrouter()
+
+	subrouter.HandleFunc("", listActivity(feed))
+	subrouter.HandleFunc("/recent", recentFiles(files, feed))
+}
+
+// Get a page of the user's activity, newest first
+func listActivity(feed *activity.Feed) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		// Parse the paging and filtering options
+		query := r.URL.Query()
+		var limit, before int64 = defaultActivityLimit, 0
+		if !parseInt64(w, query.Get("limit"), "limit", &limit) || !parseInt64(w, query.Get("before"), "before", &before) {
+			return
+		} else if limit < 1 || limit > maxActivityLimit {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'limit' must be between 1 and 200")
+			return
+		}
+		types := splitList(query.Get("type"))
+		actor := query.Get("actor")
+
+		entries, err := feed.List(r.Header.Get("X-BPI-Username"), uint64(before), int(limit), func(entry *activity.Entry) bool {
+			return (len(types) == 0 || contains(types, entry.Type)) && (actor == "" || entry.Actor == actor)
+		})
+		if err != nil {
+			log.Printf("ERROR: failed to read activity: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		// Continue from the oldest entry on this page
+		var next interface{}
+		if len(entries) == int(limit) {
+			next = entries[len(entries)-1].Id
+		}
+
+		responses.SuccessWithData(w, map[string]interface{}{
+			"entries":     entries,
+			"next_cursor": next,
+		})
+	}
+}
+
+// Get the files the user most recently created, changed or moved which still exist
+func recentFiles(files storage.Storage, feed *activity.Feed) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var limit int64 = defaultRecentLimit
+		if !parseInt64(w, r.URL.Query().Get("limit"), "limit", &limit) {
+			return
+		} else if limit < 1 || limit > maxRecentLimit {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'limit' must be between 1 and 100")
+			return
+		}
+
+		entries, err := feed.Recent(r.Header.Get("X-BPI-Username"), int(limit), func(namespacedPath string) bool {
+			info, err := files.Stat(namespacedPath)
+			return err == nil && !info.IsDir()
+		})
+		if err != nil {
+			log.Printf("ERROR: failed to read activity: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		recent := []map[string]interface{}{}
+		for _, entry := range entries {
+			recent = append(recent, map[string]interface{}{
+				"path":    entry.Path,
+				"type":    entry.Type,
+				"touched": entry.Time,
+			})
+		}
+
+		responses.SuccessWithData(w, recent)
+	}
+}
+
+// Check if a value is within a list
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
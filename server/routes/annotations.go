@@ -0,0 +1,175 @@
+package routes
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/annotations"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Routes for finding files by their annotations
+func Annotations(files storage.Storage, notes *annotations.Store, router *mux.Router) {
+	router.HandleFunc("/starred", listStarred(files, notes))
+	router.HandleFunc("/tags", listTags(notes))
+}
+
+// Set the tags, starred flag or description of a file
+func annotateFile(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, notes *annotations.Store) {
+	// Don't allow annotating the user root
+	if namespacedPath == r.Header.Get("X-BPI-Username") {
+		responses.Error(w, http.StatusForbidden, "not allowed to annotate user root")
+		return
+	}
+
+	// Validate initial request on headers and body existence
+	if r.Header.Get("Content-Type") != "application/json" {
+		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		responses.Error(w, http.StatusBadRequest, "request body must be present")
+		return
+	}
+
+	// Parse and validate body fields
+	var body annotations.Update
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+		return
+	} else if err := body.Validate(); err != nil {
+		responses.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Ensure the file exists
+	if _, err := files.Stat(namespacedPath); os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	}
+
+	annotation, err := notes.Set(namespacedPath, body)
+	if err != nil {
+		log.Printf("ERROR: failed to save annotations: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+		return
+	}
+
+	responses.SuccessWithData(w, map[string]interface{}{
+		"tags":        annotation.Tags,
+		"starred":     annotation.Starred,
+		"description": annotation.Description,
+	})
+}
+
+// Add a file's annotations to its details
+func annotateDetails(details map[string]interface{}, namespacedPath string, notes *annotations.Store) map[string]interface{} {
+	details["tags"] = []string{}
+	details["starred"] = false
+	details["description"] = ""
+
+	annotation, err := notes.Get(namespacedPath)
+	if err != nil {
+		log.Printf("ERROR: failed to read annotations for %s: %v\n", namespacedPath, err)
+	} else if annotation != nil {
+		details["tags"] = annotation.Tags
+		details["starred"] = annotation.Starred
+		details["description"] = annotation.Description
+	}
+	return details
+}
+
+// Keep only the listing entries with a tag
+func filterByTag(entries []listing, namespacedDirectory, tag string, notes *annotations.Store) ([]listing, error) {
+	var filtered []listing
+	for _, entry := range entries {
+		annotation, err := notes.Get(path.Join(namespacedDirectory, entry.path))
+		if err != nil {
+			return nil, err
+		} else if annotation != nil && annotation.HasTag(tag) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+// Get all of the user's starred files and directories
+func listStarred(files storage.Storage, notes *annotations.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		starred, err := notes.Find(r.Header.Get("X-BPI-Username"), func(annotation *annotations.Annotation) bool {
+			return annotation.Starred
+		})
+		if err != nil {
+			log.Printf("ERROR: failed to read annotations: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to read annotations")
+			return
+		}
+
+		items := []map[string]interface{}{}
+		for _, annotation := range starred {
+			// Skip anything changed outside of the API which has not been cleaned up yet
+			info, err := files.Stat(annotation.Path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				log.Printf("ERROR: failed to stat file: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+				return
+			}
+
+			items = append(items, map[string]interface{}{
+				"name":          info.Name(),
+				"path":          strings.SplitN(annotation.Path, "/", 2)[1],
+				"size":          info.Size(),
+				"last_modified": info.ModTime().Unix(),
+				"directory":     info.IsDir(),
+				"tags":          annotation.Tags,
+				"starred":       annotation.Starred,
+				"description":   annotation.Description,
+			})
+		}
+
+		responses.SuccessWithData(w, items)
+	}
+}
+
+// Get every tag the user has used with how many files have it
+func listTags(notes *annotations.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		counts, err := notes.Tags(r.Header.Get("X-BPI-Username"))
+		if err != nil {
+			log.Printf("ERROR: failed to read annotations: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to read annotations")
+			return
+		}
+
+		tags := []map[string]interface{}{}
+		for tag, count := range counts {
+			tags = append(tags, map[string]interface{}{"tag": tag, "count": count})
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i]["tag"].(string) < tags[j]["tag"].(string)
+		})
+
+		responses.SuccessWithData(w, tags)
+	}
+}
@@ -3,13 +3,14 @@ package routes
 import (
 	"encoding/base64"
 	"encoding/json"
+	"github.com/akrantz01/bookpi/server/encryption"
 	"github.com/akrantz01/bookpi/server/models"
 	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
 	"github.com/gorilla/mux"
 	bolt "go.etcd.io/bbolt"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"time"
 )
@@ -22,17 +23,17 @@ var (
 	regexSpecial   = regexp.MustCompile("[!-/:-@[-_]+")
 )
 
-// Handle user authentication
-func Authentication(filesDirectory string, db *bolt.DB, router *mux.Router) {
+// Handle user authentication, holding users' keys while they are logged in if files are encrypted
+func Authentication(files storage.Storage, keys *encryption.Keyring, db *bolt.DB, router *mux.Router) {
 	subrouter := router.PathPrefix("/auth").Subrouter()
 
-	subrouter.HandleFunc("/register", register(filesDirectory, db))
-	subrouter.HandleFunc("/login", login(db))
-	subrouter.HandleFunc("/logout", logout(db))
+	subrouter.HandleFunc("/register", register(files, keys, db))
+	subrouter.HandleFunc("/login", login(keys, db))
+	subrouter.HandleFunc("/logout", logout(keys, db))
 }
 
 // Handle user registration
-func register(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func register(files storage.Storage, keys *encryption.Keyring, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Validate initial request on method, headers, and body existence
 		if r.Method != http.MethodPost {
@@ -99,9 +100,29 @@ func register(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r
 			responses.Error(w, http.StatusInternalServerError, "failed to hash password")
 			return
 		}
+		if err := u.SetSyncKey(body.Password); err != nil {
+			log.Printf("ERROR: failed to hash user sync key: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to hash password")
+			return
+		}
+
+		// Generate the key for the user's files
+		if keys != nil {
+			key, err := encryption.GenerateKey()
+			if err != nil {
+				log.Printf("ERROR: failed to generate user file key: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to generate key")
+				return
+			}
+			if err := u.SetKey(key, body.Password); err != nil {
+				log.Printf("ERROR: failed to wrap user file key: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to generate key")
+				return
+			}
+		}
 
 		// Create user file directory
-		if err := os.Mkdir(filesDirectory+"/"+u.Username, os.ModeDir|0755); err != nil {
+		if err := files.Mkdir(u.Username); err != nil {
 			log.Printf("ERROR: failed to create user directory for file storage: %v\n", err)
 			responses.Error(w, http.StatusInternalServerError, "failed to create directory")
 			return
@@ -119,7 +140,7 @@ func register(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r
 }
 
 // Handle user login
-func login(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func login(keys *encryption.Keyring, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Validate initial request on method, headers, and body existence
 		if r.Method != http.MethodPost {
@@ -167,6 +188,29 @@ func login(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Let accounts created before syncing was supported sync reading progress
+		if user.SyncKey == "" {
+			if err := user.SetSyncKey(body.Password); err != nil {
+				log.Printf("ERROR: failed to hash user sync key: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to hash password")
+				return
+			} else if err := user.Save(db); err != nil {
+				log.Printf("ERROR: failed to write user sync key to database: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+				return
+			}
+		}
+
+		// Unlock the user's files
+		var key []byte
+		if keys != nil {
+			if key, err = unlockKey(user, body.Password, db); err != nil {
+				log.Printf("ERROR: failed to unlock user file key: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to unlock files")
+				return
+			}
+		}
+
 		// Create new session
 		session := models.NewSession(*user)
 		if err := session.Save(db); err != nil {
@@ -175,6 +219,11 @@ func login(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Hold the key for as long as the session
+		if key != nil {
+			keys.Acquire(user.Username, key)
+		}
+
 		// Set session cookie
 		http.SetCookie(w, &http.Cookie{
 			Name:     "bp-id",
@@ -190,7 +239,7 @@ func login(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handle user logout
-func logout(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func logout(keys *encryption.Keyring, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Validate initial request on method, headers, and body existence
 		if r.Method != http.MethodGet {
@@ -214,6 +263,11 @@ func logout(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Stop holding the key once the user has no other sessions
+		if keys != nil {
+			keys.Release(session.User.Username)
+		}
+
 		// Set empty cookie
 		http.SetCookie(w, &http.Cookie{
 			Name:     "bp-id",
@@ -227,3 +281,18 @@ func logout(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 		responses.Success(w)
 	}
 }
+
+// Get a user's file key using their password, creating it if they do not have one yet
+func unlockKey(user *models.User, password string, db *bolt.DB) ([]byte, error) {
+	key, err := user.UnlockKey(password)
+	if err != nil || key != nil {
+		return key, err
+	}
+
+	if key, err = encryption.GenerateKey(); err != nil {
+		return nil, err
+	} else if err := user.SetKey(key, password); err != nil {
+		return nil, err
+	}
+	return key, user.Save(db)
+}
@@ -0,0 +1,518 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	uuid "github.com/satori/go.uuid"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	batchMove   = "move"
+	batchCopy   = "copy"
+	batchRename = "rename"
+	batchDelete = "delete"
+
+	batchDone       = "done"
+	batchFailed     = "failed"
+	batchSkipped    = "skipped"
+	batchRolledBack = "rolled_back"
+	batchUndoFailed = "rollback_failed"
+
+	// Operations allowed in a single batch
+	maxBatchOperations = 1000
+)
+
+// A single operation within a batch
+type batchOperation struct {
+	Op          string `json:"op"`
+	Path        string `json:"path"`
+	Destination string `json:"destination"`
+	Filename    string `json:"filename"`
+	Conflict    string `json:"conflict"`
+}
+
+// The outcome of an operation within a batch
+type batchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// How to undo a completed operation and the changes to announce once the batch is kept
+type batchChange struct {
+	undo   func() error
+	commit func() error
+	events []events.Event
+}
+
+// Run many move, copy, rename and delete operations in one request, optionally undoing
+// all of them if any fails
+func batchFiles(files storage.Storage, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validate initial request on method and body existence
+		if r.Method != http.MethodPost {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if r.Body == nil {
+			responses.Error(w, http.StatusBadRequest, "request body must be present")
+			return
+		}
+
+		// Parse and validate body fields
+		var body struct {
+			Atomic     bool             `json:"atomic"`
+			Operations []batchOperation `json:"operations"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+			return
+		} else if len(body.Operations) == 0 {
+			responses.Error(w, http.StatusBadRequest, "field 'operations' must contain at least one operation")
+			return
+		} else if len(body.Operations) > maxBatchOperations {
+			responses.Error(w, http.StatusBadRequest, "field 'operations' must contain at most 1000 operations")
+			return
+		}
+		for _, operation := range body.Operations {
+			if err := operation.validate(body.Atomic); err != nil {
+				responses.Error(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		batch := &batchRun{
+			files:    files,
+			quota:    quota,
+			store:    store,
+			locks:    fileLocks,
+			token:    lockToken(r),
+			username: r.Header.Get("X-BPI-Username"),
+			atomic:   body.Atomic,
+		}
+		results, completed := batch.run(body.Operations)
+
+		// Only announce the changes which were kept
+		for _, change := range batch.changes {
+			for _, event := range change.events {
+				bus.Publish(event)
+			}
+		}
+		for _, event := range batch.partial {
+			bus.Publish(event)
+		}
+
+		responses.SuccessWithData(w, map[string]interface{}{
+			"completed": completed,
+			"results":   results,
+		})
+	}
+}
+
+// Check if a request to the batch path holds operations rather than copying a file named batch,
+// leaving the body to be read again
+func batchRequest(r *http.Request, namespacedPath string) bool {
+	if namespacedPath != path.Join(r.Header.Get("X-BPI-Username"), "batch") || r.Body == nil {
+		return false
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	if err != nil {
+		return false
+	}
+
+	var body struct {
+		Operations json.RawMessage `json:"operations"`
+	}
+	return json.Unmarshal(buf, &body) == nil && body.Operations != nil
+}
+
+// Check an operation has the fields it needs
+func (o batchOperation) validate(atomic bool) error {
+	switch o.Op {
+	case batchMove:
+		if o.Destination == "" {
+			return errors.New("field 'destination' must be present for move operations")
+		}
+	case batchCopy:
+		if o.Destination == "" {
+			return errors.New("field 'destination' must be present for copy operations")
+		} else if o.Conflict != "" && o.Conflict != conflictFail && o.Conflict != conflictRename && o.Conflict != conflictOverwrite {
+			return errors.New("field 'conflict' must be one of 'fail', 'rename', or 'overwrite'")
+		} else if o.Conflict == conflictOverwrite && atomic {
+			return errors.New("copies which overwrite cannot be rolled back in an atomic batch")
+		}
+	case batchRename:
+		if o.Filename == "" {
+			return errors.New("field 'filename' must be present for rename operations")
+		}
+	case batchDelete:
+	default:
+		return errors.New("field 'op' must be one of 'move', 'copy', 'rename', or 'delete'")
+	}
+
+	if o.Path == "" {
+		return errors.New("field 'path' must be present for every operation")
+	}
+	return nil
+}
+
+// The state of a batch as its operations are run
+type batchRun struct {
+	files    storage.Storage
+	quota    int64
+	store    *versions.Store
+	locks    *locks.Store
+	token    string
+	username string
+	atomic   bool
+
+	// Deleted entries are kept here until an atomic batch completes
+	staging string
+
+	changes []*batchChange
+
+	// Changes left behind by operations which failed part way through
+	partial []events.Event
+}
+
+// Run each operation in order, stopping and undoing the completed operations
+// at the first failure if atomic
+func (b *batchRun) run(operations []batchOperation) ([]batchResult, bool) {
+	results := make([]batchResult, len(operations))
+	completed := make([]int, 0, len(operations))
+	for i, operation := range operations {
+		results[i] = batchResult{Index: i, Op: operation.Op, Path: operation.Path, Status: batchSkipped}
+	}
+
+	failed := false
+	for i, operation := range operations {
+		target, change, err := b.apply(operation)
+		if err != nil {
+			results[i].Status = batchFailed
+			results[i].Error = err.Error()
+			failed = true
+
+			if b.atomic {
+				break
+			}
+			continue
+		}
+
+		results[i].Status = batchDone
+		results[i].Target = target
+		completed = append(completed, i)
+		b.changes = append(b.changes, change)
+	}
+
+	if failed && b.atomic {
+		// Undo in reverse order so each entry is back where the previous operations expect it
+		for j := len(b.changes) - 1; j >= 0; j-- {
+			if err := b.changes[j].undo(); err != nil {
+				log.Printf("ERROR: failed to roll back batch operation: %v\n", err)
+				results[completed[j]].Status = batchUndoFailed
+				results[completed[j]].Error = "failed to roll back"
+			} else {
+				results[completed[j]].Status = batchRolledBack
+			}
+		}
+		b.changes = nil
+	} else {
+		for _, change := range b.changes {
+			if change.commit == nil {
+				continue
+			} else if err := change.commit(); err != nil {
+				log.Printf("ERROR: failed to finish batch operation: %v\n", err)
+			}
+		}
+	}
+
+	// Remove anything left over from staging deletions
+	if b.staging != "" {
+		if err := b.files.Remove(b.staging); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: failed to remove batch staging directory: %v\n", err)
+		}
+	}
+
+	return results, !failed
+}
+
+// Run a single operation, returning the relative path it produced
+func (b *batchRun) apply(operation batchOperation) (string, *batchChange, error) {
+	source, err := b.resolve(operation.Path)
+	if err != nil {
+		return "", nil, err
+	} else if source == b.username {
+		return "", nil, errors.New("not allowed to change user root")
+	}
+
+	info, err := b.files.Stat(source)
+	if os.IsNotExist(err) {
+		return "", nil, errors.New("specified file/directory does not exist")
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		return "", nil, errors.New("failed to stat file")
+	} else if operation.Op != batchCopy {
+		if err := b.unlocked(source, true); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var target string
+	var change *batchChange
+	switch operation.Op {
+	case batchMove:
+		destination, err := b.directory(operation.Destination)
+		if err != nil {
+			return "", nil, err
+		} else if info.IsDir() && strings.HasPrefix(destination+"/", source+"/") {
+			return "", nil, errors.New("cannot move directory into itself")
+		}
+		target = path.Join(destination, path.Base(source))
+		if err := b.unlocked(target, true); err != nil {
+			return "", nil, err
+		}
+		change, err = b.move(source, target)
+		if err != nil {
+			return "", nil, err
+		}
+
+	case batchRename:
+		if operation.Filename == "" || operation.Filename == "." || operation.Filename == ".." || strings.ContainsAny(operation.Filename, "/\\") {
+			return "", nil, errors.New("file name must not contain path separators")
+		}
+		if target, err = b.resolve(path.Join(strings.TrimPrefix(path.Dir(source), b.username), operation.Filename)); err != nil {
+			return "", nil, err
+		} else if err := b.unlocked(target, true); err != nil {
+			return "", nil, err
+		}
+		change, err = b.move(source, target)
+		if err != nil {
+			return "", nil, err
+		}
+
+	case batchCopy:
+		destination, err := b.directory(operation.Destination)
+		if err != nil {
+			return "", nil, err
+		} else if err := b.unlocked(path.Join(destination, path.Base(source)), true); err != nil {
+			return "", nil, err
+		}
+		target, change, err = b.copy(source, destination, info, operation.Conflict)
+		if err != nil {
+			return "", nil, err
+		}
+
+	case batchDelete:
+		change, err = b.remove(source)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(target, b.username), "/"), change, nil
+}
+
+// Ensure a path is not locked by another client, optionally including anything beneath it
+func (b *batchRun) unlocked(namespacedPath string, descendants bool) error {
+	lock, err := b.locks.Conflicting(namespacedPath, []string{b.token}, descendants)
+	if err != nil {
+		log.Printf("ERROR: failed to read locks: %v\n", err)
+		return errors.New("failed to query database")
+	} else if lock != nil {
+		return errors.New("file is locked")
+	}
+	return nil
+}
+
+// Get the namespaced path for a path within the user's files
+func (b *batchRun) resolve(name string) (string, error) {
+	namespacedPath, err := cleanPath(b.files, b.username, name)
+	switch err {
+	case nil:
+		return namespacedPath, nil
+	case sandbox.ErrSymlink:
+		return "", errors.New("path must not contain symbolic links")
+	default:
+		return "", errors.New("path must be within the user's files")
+	}
+}
+
+// Get the namespaced path for an existing directory within the user's files
+func (b *batchRun) directory(name string) (string, error) {
+	namespacedPath, err := b.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	if info, err := b.files.Stat(namespacedPath); os.IsNotExist(err) {
+		return "", errors.New("specified destination does not exist")
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat destination: %v\n", err)
+		return "", errors.New("failed to stat file")
+	} else if !info.IsDir() {
+		return "", errors.New("specified destination is not a directory")
+	}
+	return namespacedPath, nil
+}
+
+// Move an entry without replacing anything, keeping its version history with it
+func (b *batchRun) move(source, target string) (*batchChange, error) {
+	if _, err := b.files.Stat(target); err == nil {
+		return nil, errors.New("file already exists")
+	} else if !os.IsNotExist(err) {
+		log.Printf("ERROR: failed to stat output file: %v\n", err)
+		return nil, errors.New("failed to check output file")
+	}
+
+	if err := b.rename(source, target); err != nil {
+		log.Printf("ERROR: failed to move file: %v\n", err)
+		return nil, errors.New("failed to move file")
+	}
+
+	return &batchChange{
+		undo: func() error {
+			return b.rename(target, source)
+		},
+		events: []events.Event{events.NewMove(source, target)},
+	}, nil
+}
+
+// Rename an entry along with its version history
+func (b *batchRun) rename(source, target string) error {
+	if err := b.files.Rename(source, target); err != nil {
+		return err
+	}
+	return b.store.Move(source, target)
+}
+
+// Copy an entry into a directory, resolving any name conflict
+func (b *batchRun) copy(source, destination string, info os.FileInfo, conflict string) (string, *batchChange, error) {
+	if strings.HasPrefix(destination+"/", source+"/") && info.IsDir() {
+		return "", nil, errors.New("cannot copy directory into itself")
+	}
+
+	// Resolve any name conflict
+	name := path.Base(source)
+	replacing := false
+	if existing, err := b.files.Stat(path.Join(destination, name)); err == nil {
+		switch conflict {
+		case conflictRename:
+			name = availableName(b.files, destination, name)
+		case conflictOverwrite:
+			if existing.IsDir() != info.IsDir() {
+				return "", nil, errors.New("cannot overwrite file with directory or directory with file")
+			} else if strings.HasPrefix(source+"/", path.Join(destination, name)+"/") {
+				return "", nil, errors.New("cannot overwrite file with itself")
+			}
+			replacing = existing.IsDir()
+		default:
+			return "", nil, errors.New("file already exists")
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("ERROR: failed to stat output file: %v\n", err)
+		return "", nil, errors.New("failed to check output file")
+	}
+	target := path.Join(destination, name)
+
+	// Ensure the copy fits in the user's quota
+	_, size, err := measureTree(b.files, source)
+	if err != nil {
+		log.Printf("ERROR: failed to measure directory tree: %v\n", err)
+		return "", nil, errors.New("failed to stat file")
+	}
+	var replaced int64
+	if replacing {
+		if _, replaced, err = measureTree(b.files, target); err != nil {
+			log.Printf("ERROR: failed to measure directory tree: %v\n", err)
+			return "", nil, errors.New("failed to stat file")
+		}
+	}
+	if ok, err := withinQuota(b.files, b.username, b.quota, size-replaced, b.store); err != nil {
+		log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+		return "", nil, errors.New("failed to calculate storage usage")
+	} else if !ok {
+		return "", nil, errors.New("storage quota exceeded")
+	}
+
+	// Directories are replaced rather than merged into
+	copyFn := copyTree
+	if replacing {
+		copyFn = replaceTree
+	}
+
+	changed, err := copyFn(b.files, source, target, b.store, func(int64) {})
+	if err != nil {
+		log.Printf("ERROR: failed to copy files: %v\n", err)
+		b.partial = append(b.partial, changed...)
+		return "", nil, errors.New("failed to copy file")
+	}
+
+	return target, &batchChange{
+		undo: func() error {
+			return b.files.Remove(target)
+		},
+		events: changed,
+	}, nil
+}
+
+// Delete an entry, only setting it aside until the batch completes if atomic
+func (b *batchRun) remove(source string) (*batchChange, error) {
+	deleted := events.New(events.Deleted, source)
+
+	if !b.atomic {
+		if err := b.files.Remove(source); err != nil {
+			log.Printf("ERROR: failed to delete file: %v\n", err)
+			return nil, errors.New("failed to remove file")
+		}
+		if err := b.store.Remove(source); err != nil {
+			log.Printf("ERROR: failed to delete file versions: %v\n", err)
+			b.partial = append(b.partial, deleted)
+			return nil, errors.New("failed to delete from database")
+		}
+		return &batchChange{events: []events.Event{deleted}}, nil
+	}
+
+	// Keep deleted entries within the user's files so they can be moved straight back
+	if b.staging == "" {
+		staging := path.Join(b.username, ".batch-"+uuid.NewV4().String())
+		if err := b.files.Mkdir(staging); err != nil {
+			log.Printf("ERROR: failed to create batch staging directory: %v\n", err)
+			return nil, errors.New("failed to remove file")
+		}
+		b.staging = staging
+	}
+	staged := path.Join(b.staging, uuid.NewV4().String())
+
+	if err := b.files.Rename(source, staged); err != nil {
+		log.Printf("ERROR: failed to stage file for deletion: %v\n", err)
+		return nil, errors.New("failed to remove file")
+	}
+
+	return &batchChange{
+		undo: func() error {
+			return b.files.Rename(staged, source)
+		},
+		commit: func() error {
+			// Versions were left at the original path while staged
+			return b.store.Remove(source)
+		},
+		events: []events.Event{deleted},
+	}, nil
+}
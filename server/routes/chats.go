@@ -2,6 +2,7 @@ package routes
 
 import (
 	"encoding/json"
+	"github.com/akrantz01/bookpi/server/activity"
 	"github.com/akrantz01/bookpi/server/models"
 	"github.com/akrantz01/bookpi/server/responses"
 	"github.com/gorilla/mux"
@@ -12,22 +13,22 @@ import (
 )
 
 // Routes for chat management
-func Chats(db *bolt.DB, router *mux.Router) {
+func Chats(feed *activity.Feed, db *bolt.DB, router *mux.Router) {
 	subrouter := router.PathPrefix("/chats").Subrouter()
 
-	subrouter.HandleFunc("", allChats(db))
+	subrouter.HandleFunc("", allChats(feed, db))
 	subrouter.HandleFunc("/{chat}", specificChat(db))
 }
 
 // Operate on all a user's chats
-func allChats(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func allChats(feed *activity.Feed, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			listChats(w, r, db)
 
 		case http.MethodPost:
-			createChat(w, r, db)
+			createChat(w, r, feed, db)
 
 		default:
 			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -86,7 +87,7 @@ func listChats(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 }
 
 // Create a chat between two users
-func createChat(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
+func createChat(w http.ResponseWriter, r *http.Request, feed *activity.Feed, db *bolt.DB) {
 	// Validate initial request headers, and body existence
 	if r.Header.Get("Content-Type") != "application/json" {
 		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
@@ -152,6 +153,7 @@ func createChat(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 		return
 	}
 
+	feed.Record(activity.ChatCreated, self.Username, []string{recipient.Username}, activity.Entry{Chat: chat.Id.String()})
 	responses.Success(w)
 }
 
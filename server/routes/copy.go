@@ -0,0 +1,335 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/jobs"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	conflictFail      = "fail"
+	conflictRename    = "rename"
+	conflictOverwrite = "overwrite"
+
+	// Copies larger than these limits are run in the background
+	backgroundCopyFiles = 100
+	backgroundCopyBytes = 64 << 20
+)
+
+// Copy a file or directory tree to another directory
+func copyFiles(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, quota int64, store *versions.Store, fileLocks *locks.Store, manager *jobs.Manager, bus *events.Bus) {
+	// Validate initial request on body existence
+	if r.Body == nil {
+		responses.Error(w, http.StatusBadRequest, "request body must be present")
+		return
+	}
+
+	// Parse and validate body fields
+	var body struct {
+		Destination string `json:"destination"`
+		Conflict    string `json:"conflict"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+		return
+	} else if body.Destination == "" {
+		responses.Error(w, http.StatusBadRequest, "field 'destination' must be present")
+		return
+	} else if body.Conflict == "" {
+		body.Conflict = conflictFail
+	} else if body.Conflict != conflictFail && body.Conflict != conflictRename && body.Conflict != conflictOverwrite {
+		responses.Error(w, http.StatusBadRequest, "field 'conflict' must be one of 'fail', 'rename', or 'overwrite'")
+		return
+	}
+
+	// Get source statistics and ensure exists
+	info, err := files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	}
+
+	// Ensure destination exists
+	namespacedDestination, ok := resolvePath(w, files, r.Header.Get("X-BPI-Username"), body.Destination)
+	if !ok {
+		return
+	}
+	if destinationInfo, err := files.Stat(namespacedDestination); os.IsNotExist(err) {
+		responses.Error(w, http.StatusBadRequest, "specified destination does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat destination: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	} else if !destinationInfo.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "specified destination is not a directory")
+		return
+	}
+
+	// Don't allow copying a directory into itself
+	if strings.HasPrefix(namespacedDestination+"/", namespacedPath+"/") && info.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "cannot copy directory into itself")
+		return
+	}
+
+	// Resolve any name conflict
+	name := path.Base(namespacedPath)
+	replacing := false
+	if existing, err := files.Stat(path.Join(namespacedDestination, name)); err == nil {
+		switch body.Conflict {
+		case conflictFail:
+			responses.Error(w, http.StatusConflict, "file already exists")
+			return
+		case conflictRename:
+			name = availableName(files, namespacedDestination, name)
+		case conflictOverwrite:
+			if existing.IsDir() != info.IsDir() {
+				responses.Error(w, http.StatusConflict, "cannot overwrite file with directory or directory with file")
+				return
+			} else if strings.HasPrefix(namespacedPath+"/", path.Join(namespacedDestination, name)+"/") {
+				responses.Error(w, http.StatusBadRequest, "cannot overwrite file with itself")
+				return
+			}
+			replacing = existing.IsDir()
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("ERROR: failed to stat output file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to check output file")
+		return
+	}
+
+	namespacedTarget := path.Join(namespacedDestination, name)
+
+	// Measure the tree to be copied
+	count, size, err := measureTree(files, namespacedPath)
+	if err != nil {
+		log.Printf("ERROR: failed to measure directory tree: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	}
+
+	// A replaced directory frees its contents, while a replaced file moves into its versions
+	var replaced int64
+	if replacing {
+		if _, replaced, err = measureTree(files, namespacedTarget); err != nil {
+			log.Printf("ERROR: failed to measure directory tree: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+			return
+		}
+	}
+
+	// Ensure the copy fits in the user's quota
+	if ok, err := withinQuota(files, r.Header.Get("X-BPI-Username"), quota, size-replaced, store); err != nil {
+		log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to calculate storage usage")
+		return
+	} else if !ok {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	}
+
+	if !unlocked(w, r, fileLocks, true, namespacedTarget) {
+		return
+	}
+
+	// Directories are replaced rather than merged into
+	copyFn := copyTree
+	if replacing {
+		copyFn = replaceTree
+	}
+
+	// Run large copies in the background
+	if count > backgroundCopyFiles || size > backgroundCopyBytes {
+		job := manager.Start(r.Header.Get("X-BPI-Username"), "copy", func(job *jobs.Job) error {
+			created, err := copyFn(files, namespacedPath, namespacedTarget, store, job.Advance)
+			for _, event := range created {
+				bus.Publish(event)
+			}
+			return err
+		})
+		job.SetTotal(size)
+
+		responses.SuccessWithData(w, map[string]interface{}{"job": job.Describe()})
+		return
+	}
+
+	created, err := copyFn(files, namespacedPath, namespacedTarget, store, func(int64) {})
+	for _, event := range created {
+		bus.Publish(event)
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to copy files: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to copy file")
+		return
+	}
+
+	responses.Success(w)
+}
+
+// Remove a file or directory along with its previous versions
+func removeTree(files storage.Storage, namespacedPath string, store *versions.Store) error {
+	if err := files.Remove(namespacedPath); err != nil {
+		return err
+	}
+	return store.Remove(namespacedPath)
+}
+
+// Find a name not yet used in a directory by adding a numeric suffix
+func availableName(files storage.Storage, directory, name string) string {
+	extension := path.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, extension)
+		if _, err := files.Stat(path.Join(directory, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// Count the number of files and bytes in a tree
+func measureTree(files storage.Storage, root string) (count, size int64, err error) {
+	err = files.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			count++
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// Recursively copy a file or directory, replacing any existing files. Events are returned for
+// the top-most entries which were created, even if the copy fails part way through.
+func copyTree(files storage.Storage, source, destination string, store *versions.Store, progress func(int64)) ([]events.Event, error) {
+	var created []events.Event
+	copied := make(map[string]bool)
+	record := func(target string) {
+		if !copied[path.Dir(target)] {
+			created = append(created, events.New(events.Created, target))
+		}
+		copied[target] = true
+	}
+
+	err := files.Walk(source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := destination + strings.TrimPrefix(name, source)
+
+		// Only directories and regular files are copied
+		if info.IsDir() {
+			if err := files.Mkdir(target); os.IsExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			record(target)
+			return nil
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if err := copyContents(files, name, target, store); err != nil {
+			return err
+		}
+		record(target)
+
+		progress(info.Size())
+		return nil
+	})
+	return created, err
+}
+
+// Copy a directory beside the one it replaces and swap it in once complete, so the existing
+// directory is kept if the copy fails part way through
+func replaceTree(files storage.Storage, source, destination string, store *versions.Store, progress func(int64)) ([]events.Event, error) {
+	staged := stagedName(destination, "copy")
+	if _, err := copyTree(files, source, staged, store, progress); err != nil {
+		discardTree(files, staged, store)
+		return nil, err
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	// Move the existing directory aside first so it can be put back
+	previous := stagedName(destination, "replaced")
+	if err := files.Rename(destination, previous); err != nil {
+		discardTree(files, staged, store)
+		return nil, err
+	} else if err := files.Rename(staged, destination); err != nil {
+		if err := files.Rename(previous, destination); err != nil {
+			log.Printf("ERROR: failed to restore replaced directory %s: %v\n", destination, err)
+		}
+		discardTree(files, staged, store)
+		return nil, err
+	}
+
+	// The versions of the replaced files go with them
+	if err := store.Remove(destination); err != nil {
+		log.Printf("ERROR: failed to remove versions of replaced directory %s: %v\n", destination, err)
+	}
+	discardTree(files, previous, store)
+
+	return []events.Event{events.New(events.Deleted, destination), events.New(events.Created, destination)}, nil
+}
+
+// Get a hidden name beside a path for staging a tree
+func stagedName(namespacedPath, purpose string) string {
+	return path.Join(path.Dir(namespacedPath), fmt.Sprintf(".%s.%s-%d", path.Base(namespacedPath), purpose, time.Now().UnixNano()))
+}
+
+// Remove a staged tree, logging rather than returning failures
+func discardTree(files storage.Storage, namespacedPath string, store *versions.Store) {
+	if err := removeTree(files, namespacedPath, store); err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: failed to remove staged directory %s: %v\n", namespacedPath, err)
+	}
+}
+
+// Copy a single file, keeping the contents of any file being replaced. The contents are staged
+// before taking the write lock so large files don't hold up other writes.
+func copyContents(files storage.Storage, source, destination string, store *versions.Store) error {
+	in, err := files.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := files.Create(destination)
+	if err != nil {
+		return err
+	} else if _, err := io.Copy(out, in); err != nil {
+		_ = out.Abort()
+		return err
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	if err := store.Snapshot(destination); err != nil {
+		_ = out.Abort()
+		return err
+	}
+	return out.Commit()
+}
@@ -0,0 +1,326 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/integrity"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/merge"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Records the status written by another handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Check if contents can be edited as text
+func editableText(w http.ResponseWriter, contents []byte, maxSize int64) bool {
+	if int64(len(contents)) > maxSize {
+		responses.Error(w, http.StatusRequestEntityTooLarge, "file must be at most "+strconv.FormatInt(maxSize, 10)+" bytes to edit")
+		return false
+	} else if !utf8.Valid(contents) || bytes.IndexByte(contents, 0) != -1 {
+		responses.Error(w, http.StatusUnsupportedMediaType, "file must be utf-8 encoded text to edit")
+		return false
+	}
+	return true
+}
+
+// Read the current contents of a text file for editing
+func readText(w http.ResponseWriter, files storage.Storage, namespacedPath string, maxSize int64) (string, os.FileInfo, bool) {
+	file, err := files.Open(namespacedPath)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return "", nil, false
+	} else if err == sandbox.ErrSymlink {
+		responses.Error(w, http.StatusForbidden, "path must not contain symbolic links")
+		return "", nil, false
+	} else if err == storage.ErrLocked {
+		responses.Error(w, http.StatusLocked, "files are locked until their owner logs in")
+		return "", nil, false
+	} else if err != nil {
+		log.Printf("ERROR: failed to open file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to open file")
+		return "", nil, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return "", nil, false
+	} else if info.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "cannot edit directory")
+		return "", nil, false
+	} else if info.Size() > maxSize {
+		responses.Error(w, http.StatusRequestEntityTooLarge, "file must be at most "+strconv.FormatInt(maxSize, 10)+" bytes to edit")
+		return "", nil, false
+	}
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.Printf("ERROR: failed to read file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to read file")
+		return "", nil, false
+	} else if !editableText(w, contents, maxSize) {
+		return "", nil, false
+	}
+	return string(contents), info, true
+}
+
+// Get the contents of a text file and any unsaved draft of it
+func editFile(w http.ResponseWriter, namespacedPath string, files storage.Storage, maxSize int64, db *bolt.DB) {
+	contents, info, ok := readText(w, files, namespacedPath, maxSize)
+	if !ok {
+		return
+	}
+
+	draft, err := findDraft(namespacedPath, files, db)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for draft: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	}
+
+	var unsaved interface{}
+	if draft != nil {
+		unsaved = map[string]interface{}{
+			"content":   draft.Content,
+			"saved":     draft.Saved,
+			"base_etag": draft.BaseTag,
+		}
+	}
+
+	w.Header().Set("ETag", entityTag(info))
+	responses.SuccessWithData(w, map[string]interface{}{
+		"content":  contents,
+		"etag":     entityTag(info),
+		"size":     info.Size(),
+		"encoding": "utf-8",
+		"draft":    unsaved,
+	})
+}
+
+// Save edited contents of a text file, merging them with any changes made since editing started
+func saveText(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, quota int64, maxSize int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus, sums *integrity.Store, db *bolt.DB) {
+	// Validate initial request on headers and body existence
+	if r.Header.Get("Content-Type") != "application/json" {
+		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		responses.Error(w, http.StatusBadRequest, "request body must be present")
+		return
+	} else if r.Header.Get("If-Match") == "" {
+		responses.Error(w, http.StatusPreconditionRequired, "header 'If-Match' must be present")
+		return
+	}
+
+	// Parse and validate body fields
+	var body struct {
+		Content string  `json:"content"`
+		Base    *string `json:"base"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+		return
+	} else if !editableText(w, []byte(body.Content), maxSize) {
+		return
+	}
+
+	// Send back both sets of changes merged if the file changed since editing started
+	info, err := files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	} else if !preconditionsMet(r, info) {
+		conflictingText(w, r, namespacedPath, body.Content, body.Base, files, maxSize, db)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	writeContents(recorder, r, strings.NewReader(body.Content), int64(len(body.Content)), namespacedPath, files, quota, store, fileLocks, bus, sums)
+
+	// The draft is no longer needed once its changes are saved
+	if recorder.status != http.StatusOK {
+		return
+	} else if draft, err := findDraft(namespacedPath, files, db); err != nil {
+		log.Printf("ERROR: failed to query database for draft: %v\n", err)
+	} else if draft != nil && draft.Content == body.Content {
+		if err := models.DeleteDrafts(namespacedPath, db); err != nil {
+			log.Printf("ERROR: failed to delete saved draft: %v\n", err)
+		}
+	}
+}
+
+// Describe a conflicting save with the current contents and the result of merging
+func conflictingText(w http.ResponseWriter, r *http.Request, namespacedPath, mine string, base *string, files storage.Storage, maxSize int64, db *bolt.DB) {
+	theirs, info, ok := readText(w, files, namespacedPath, maxSize)
+	if !ok {
+		return
+	}
+
+	// Fall back to the contents recorded with the draft when the editor has no base
+	ancestor := ""
+	if base != nil {
+		ancestor = *base
+	} else if draft, err := findDraft(namespacedPath, files, db); err != nil {
+		log.Printf("ERROR: failed to query database for draft: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	} else if draft != nil && strings.TrimPrefix(strings.TrimSpace(r.Header.Get("If-Match")), "W/") == draft.BaseTag {
+		ancestor = draft.BaseContent
+	}
+
+	w.Header().Set("ETag", entityTag(info))
+	responses.ErrorWithData(w, http.StatusConflict, "file has been modified", map[string]interface{}{
+		"etag":    entityTag(info),
+		"content": theirs,
+		"merge":   merge.ThreeWay(ancestor, mine, theirs),
+	})
+}
+
+// Autosave unsaved changes to a text file
+func saveDraft(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, maxSize int64, db *bolt.DB) {
+	// Validate initial request on headers and body existence
+	if r.Header.Get("Content-Type") != "application/json" {
+		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		responses.Error(w, http.StatusBadRequest, "request body must be present")
+		return
+	}
+
+	// Parse and validate body fields
+	var body struct {
+		Content string `json:"content"`
+		BaseTag string `json:"base_etag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+		return
+	} else if body.BaseTag == "" {
+		responses.Error(w, http.StatusBadRequest, "field 'base_etag' is required")
+		return
+	} else if !editableText(w, []byte(body.Content), maxSize) {
+		return
+	}
+
+	current, info, ok := readText(w, files, namespacedPath, maxSize)
+	if !ok {
+		return
+	}
+
+	// Remember what the file looked like when editing started so the draft can be merged later
+	existing, err := findDraft(namespacedPath, files, db)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for draft: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	}
+	base := ""
+	if entityTag(info) == body.BaseTag {
+		base = current
+	} else if existing != nil && existing.BaseTag == body.BaseTag {
+		base = existing.BaseContent
+	}
+
+	draft := models.NewDraft(namespacedPath, body.Content, body.BaseTag, base)
+	if err := sealDraft(draft, files); err == storage.ErrLocked {
+		responses.Error(w, http.StatusLocked, "files are locked until their owner logs in")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to encrypt draft: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to encrypt draft")
+		return
+	} else if err := draft.Save(db); err != nil {
+		log.Printf("ERROR: failed to write draft to database: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+		return
+	}
+
+	responses.SuccessWithData(w, map[string]interface{}{
+		"saved": draft.Saved,
+	})
+}
+
+// Throw away the unsaved changes to a text file
+func discardDraft(w http.ResponseWriter, namespacedPath string, db *bolt.DB) {
+	if err := models.DeleteDrafts(namespacedPath, db); err != nil {
+		log.Printf("ERROR: failed to delete draft from database: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to delete from database")
+		return
+	}
+
+	responses.Success(w)
+}
+
+// Encrypt the contents of a draft with its owner's key when files are encrypted
+func sealDraft(draft *models.Draft, files storage.Storage) error {
+	sealer, ok := files.(storage.Sealer)
+	if !ok {
+		return nil
+	}
+
+	for _, contents := range []*string{&draft.Content, &draft.BaseContent} {
+		sealed, err := storage.SealBytes(sealer, draft.Path, []byte(*contents))
+		if err != nil {
+			return err
+		}
+		*contents = base64.StdEncoding.EncodeToString(sealed)
+	}
+	draft.Sealed = true
+	return nil
+}
+
+// Find the draft of a file, decrypting its contents if needed
+func findDraft(namespacedPath string, files storage.Storage, db *bolt.DB) (*models.Draft, error) {
+	draft, err := models.FindDraft(namespacedPath, db)
+	if err != nil || draft == nil || !draft.Sealed {
+		return draft, err
+	}
+
+	// Drafts can't be read once encryption is turned off
+	sealer, ok := files.(storage.Sealer)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, contents := range []*string{&draft.Content, &draft.BaseContent} {
+		sealed, err := base64.StdEncoding.DecodeString(*contents)
+		if err != nil {
+			return nil, err
+		}
+		unsealed, err := storage.UnsealBytes(sealer, namespacedPath, sealed)
+		if err != nil {
+			return nil, err
+		}
+		*contents = string(unsealed)
+	}
+	draft.Sealed = false
+	return draft, nil
+}
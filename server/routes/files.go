@@ -1,42 +1,94 @@
 package routes
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"github.com/akrantz01/bookpi/server/annotations"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/integrity"
+	"github.com/akrantz01/bookpi/server/jobs"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/metadata"
+	"github.com/akrantz01/bookpi/server/render"
 	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/thumbnails"
+	"github.com/akrantz01/bookpi/server/versions"
 	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 // Routes for file management
-func Files(filesDirectory string, router *mux.Router) {
-	router.PathPrefix("/files").HandlerFunc(fileRouter(filesDirectory))
+func Files(files storage.Storage, quota int64, editMaxSize int64, store *versions.Store, fileLocks *locks.Store, manager *jobs.Manager, bus *events.Bus, thumbs *thumbnails.Cache, meta *metadata.Cache, sums *integrity.Store, notes *annotations.Store, renderer *render.Cache, db *bolt.DB, router *mux.Router) {
+	router.PathPrefix("/files").HandlerFunc(fileRouter(files, quota, editMaxSize, store, fileLocks, manager, bus, thumbs, meta, sums, notes, renderer, db))
 }
 
 // Handle routing based on methods for files
-func fileRouter(filesDirectory string) func(w http.ResponseWriter, r *http.Request) {
+func fileRouter(files storage.Storage, quota int64, editMaxSize int64, store *versions.Store, fileLocks *locks.Store, manager *jobs.Manager, bus *events.Bus, thumbs *thumbnails.Cache, meta *metadata.Cache, sums *integrity.Store, notes *annotations.Store, renderer *render.Cache, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	batch := batchFiles(files, quota, store, fileLocks, bus)
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Assemble full path
-		p := path.Join(filesDirectory, r.Header.Get("X-BPI-Username"), strings.TrimPrefix(r.URL.Path, "/api/files"))
+		// Assemble namespaced path
+		namespacedPath, ok := resolvePath(w, files, r.Header.Get("X-BPI-Username"), strings.TrimPrefix(r.URL.Path, "/api/files"))
+		if !ok {
+			return
+		}
 
 		switch r.Method {
 		case http.MethodGet:
-			listFiles(w, r, p)
+			if r.URL.Query().Get("versions") != "" {
+				listVersions(w, r, namespacedPath, files, store)
+			} else if r.URL.Query().Get("version") != "" {
+				downloadVersion(w, r, namespacedPath, store)
+			} else if r.URL.Query().Get("thumbnail") != "" {
+				serveThumbnail(w, r, namespacedPath, thumbs)
+			} else if r.URL.Query().Get("render") != "" {
+				serveRendered(w, r, namespacedPath, renderer, render.Links{Root: "/api/files", Download: "download=1"})
+			} else if r.URL.Query().Get("edit") != "" {
+				editFile(w, namespacedPath, files, editMaxSize, db)
+			} else {
+				listFiles(w, r, namespacedPath, files, fileLocks, meta, sums, notes)
+			}
 
 		case http.MethodPost:
-			createFile(w, r, p)
+			if r.Header.Get("Content-Type") == "application/json" && batchRequest(r, namespacedPath) {
+				batch(w, r)
+			} else if r.Header.Get("Content-Type") == "application/json" {
+				copyFiles(w, r, namespacedPath, files, quota, store, fileLocks, manager, bus)
+			} else {
+				createFile(w, r, namespacedPath, files, quota, store, fileLocks, bus, sums)
+			}
 
 		case http.MethodPut:
-			updateFile(w, r, p, filesDirectory)
+			if r.URL.Query().Get("annotations") != "" {
+				annotateFile(w, r, namespacedPath, files, notes)
+			} else if r.URL.Query().Get("edit") != "" {
+				saveText(w, r, namespacedPath, files, quota, editMaxSize, store, fileLocks, bus, sums, db)
+			} else if r.URL.Query().Get("draft") != "" {
+				saveDraft(w, r, namespacedPath, files, editMaxSize, db)
+			} else if r.URL.Query().Get("restore") != "" {
+				restoreVersion(w, r, namespacedPath, files, quota, store, fileLocks, bus)
+			} else if r.Header.Get("Content-Type") == "application/json" {
+				updateFile(w, r, namespacedPath, files, store, fileLocks, bus)
+			} else {
+				overwriteFile(w, r, namespacedPath, files, quota, store, fileLocks, bus, sums)
+			}
 
 		case http.MethodDelete:
-			deleteFile(w, r, p)
+			if r.URL.Query().Get("draft") != "" {
+				discardDraft(w, namespacedPath, db)
+			} else {
+				deleteFile(w, r, namespacedPath, files, store, fileLocks, bus)
+			}
 
 		default:
 			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -45,9 +97,9 @@ func fileRouter(filesDirectory string) func(w http.ResponseWriter, r *http.Reque
 }
 
 // List all files in a directory or a file's information, or download a file
-func listFiles(w http.ResponseWriter, r *http.Request, path string) {
+func listFiles(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, fileLocks *locks.Store, meta *metadata.Cache, sums *integrity.Store, notes *annotations.Store) {
 	// Get file statistics
-	info, err := os.Stat(path)
+	info, err := files.Stat(namespacedPath)
 	if os.IsNotExist(err) {
 		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
 		return
@@ -59,38 +111,83 @@ func listFiles(w http.ResponseWriter, r *http.Request, path string) {
 
 	// Return file info if file
 	if !info.IsDir() {
+		w.Header().Set("ETag", entityTag(info))
+		sum := sums.Get(namespacedPath, info)
+		if sum != nil {
+			if digest, err := hex.DecodeString(sum.Sum); err == nil {
+				w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest))
+			}
+		}
+
 		// Download file if query param
 		if r.URL.Query().Get("download") != "" {
-			http.ServeFile(w, r, path)
+			serveFile(w, r, files, namespacedPath)
 			return
 		}
 
-		responses.SuccessWithData(w, map[string]interface{}{
+		responses.SuccessWithData(w, lockDetails(annotateDetails(describeFile(map[string]interface{}{
 			"name":          info.Name(),
 			"size":          info.Size(),
 			"last_modified": info.ModTime().Unix(),
 			"directory":     info.IsDir(),
-		})
+			"permissions":   info.Mode().Perm().String(),
+		}, namespacedPath, info, meta, sum), namespacedPath, notes), namespacedPath, fileLocks))
+		return
+	}
+
+	// Parse the listing options
+	query := r.URL.Query()
+	var depth, limit, cursor int64 = 1, 0, 0
+	if !parseInt64(w, query.Get("depth"), "depth", &depth) || !parseInt64(w, query.Get("limit"), "limit", &limit) || !parseInt64(w, query.Get("cursor"), "cursor", &cursor) {
+		return
+	} else if depth < 1 || depth > maxListingDepth {
+		responses.Error(w, http.StatusBadRequest, "query parameter 'depth' must be between 1 and "+strconv.Itoa(maxListingDepth))
 		return
 	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	} else if !validListingSort(sortBy) {
+		responses.Error(w, http.StatusBadRequest, "query parameter 'sort' must be one of 'name', 'size', 'modified', or 'type'")
+		return
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		responses.Error(w, http.StatusBadRequest, "query parameter 'order' must be one of 'asc' or 'desc'")
+		return
+	}
+	hidden := query.Get("hidden") != "false"
+	tag := query.Get("tag")
 
-	// Get all files in directory
-	files, err := ioutil.ReadDir(path)
+	// Get all files in directory and below to the requested depth
+	entries, err := collectListing(files, namespacedPath, "", int(depth), hidden, nil)
 	if err != nil {
 		log.Printf("ERROR: failed to list files in directory: %v\n", err)
 		responses.Error(w, http.StatusInternalServerError, "failed to list files")
 		return
 	}
+	if tag != "" {
+		if entries, err = filterByTag(entries, namespacedPath, tag, notes); err != nil {
+			log.Printf("ERROR: failed to read annotations: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to read annotations")
+			return
+		}
+	}
+	sortListing(entries, sortBy, order == "desc")
+	page, next := paginateListing(entries, int(cursor), int(limit))
 
 	// Format file info objects
 	var children []map[string]interface{}
-	for _, file := range files {
-		children = append(children, map[string]interface{}{
-			"name":          file.Name(),
-			"size":          file.Size(),
-			"last_modified": file.ModTime().Unix(),
-			"directory":     file.IsDir(),
-		})
+	for _, entry := range page {
+		children = append(children, lockDetails(annotateDetails(describeFile(map[string]interface{}{
+			"name":          entry.info.Name(),
+			"path":          entry.path,
+			"size":          entry.info.Size(),
+			"last_modified": entry.info.ModTime().Unix(),
+			"directory":     entry.info.IsDir(),
+			"permissions":   entry.info.Mode().Perm().String(),
+			"thumbnail":     thumbnailURL(r.URL.Path, entry.path),
+		}, path.Join(namespacedPath, entry.path), entry.info, meta, sums.Get(path.Join(namespacedPath, entry.path), entry.info)), path.Join(namespacedPath, entry.path), notes), path.Join(namespacedPath, entry.path), fileLocks))
 	}
 
 	// Set to empty array if length zero
@@ -98,7 +195,7 @@ func listFiles(w http.ResponseWriter, r *http.Request, path string) {
 		children = []map[string]interface{}{}
 	}
 
-	rawPath := filepath.Clean(strings.TrimPrefix(r.URL.Path, "/api/files"))
+	rawPath := path.Clean(strings.TrimPrefix(r.URL.Path, "/api/files"))
 
 	responses.SuccessWithData(w, map[string]interface{}{
 		"name":          info.Name(),
@@ -107,11 +204,48 @@ func listFiles(w http.ResponseWriter, r *http.Request, path string) {
 		"directory":     info.IsDir(),
 		"root":          rawPath == "/" || rawPath == ".",
 		"children":      children,
+		"total":         len(entries),
+		"next_cursor":   next,
 	})
 }
 
+// Add the content type, any media information and the checksum if known to a file's details
+func describeFile(details map[string]interface{}, namespacedPath string, info os.FileInfo, meta *metadata.Cache, sum *integrity.Checksum) map[string]interface{} {
+	if info.IsDir() {
+		details["mime_type"] = "inode/directory"
+		details["class"] = "directory"
+		return details
+	}
+
+	if sum != nil {
+		details["sha256"] = sum.Sum
+	}
+
+	described, err := meta.Describe(namespacedPath, info)
+	if err != nil {
+		log.Printf("ERROR: failed to describe file %s: %v\n", namespacedPath, err)
+		details["mime_type"] = "application/octet-stream"
+		details["class"] = metadata.ClassOther
+		return details
+	}
+
+	details["mime_type"] = described.MimeType
+	details["class"] = described.Class
+	if described.Width != 0 && described.Height != 0 {
+		details["width"] = described.Width
+		details["height"] = described.Height
+	}
+	if described.Duration != 0 {
+		details["duration"] = described.Duration
+	}
+	if described.Captured != 0 {
+		details["captured"] = described.Captured
+	}
+	return details
+}
+
 // Upload a new file
-func createFile(w http.ResponseWriter, r *http.Request, path string) {
+func createFile(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus, sums *integrity.Store) {
 	// Validate initial headers
 	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
 		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'multipart/form-data'")
@@ -122,7 +256,7 @@ func createFile(w http.ResponseWriter, r *http.Request, path string) {
 	directory := r.URL.Query().Get("directory") != ""
 
 	// Get file statistics
-	info, err := os.Stat(path)
+	info, err := files.Stat(namespacedPath)
 	if os.IsNotExist(err) && !directory {
 		responses.Error(w, http.StatusNotFound, "specified directory does not exist")
 		return
@@ -143,18 +277,39 @@ func createFile(w http.ResponseWriter, r *http.Request, path string) {
 
 	// Check if uploading directory
 	if directory {
-		if err := os.Mkdir(path, os.ModeDir|0755); err != nil {
+		if err := files.Mkdir(namespacedPath); err != nil {
 			log.Printf("ERROR: fialed to create new directory under user: %v\n", err)
 			responses.Error(w, http.StatusInternalServerError, "failed to create directory")
 			return
 		}
 
+		bus.Publish(events.New(events.Created, namespacedPath))
 		responses.Success(w)
 		return
 	}
 
+	// Don't buffer uploads larger than the user has room for
+	remaining, err := remainingQuota(files, r.Header.Get("X-BPI-Username"), quota, store)
+	if err != nil {
+		log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to calculate storage usage")
+		return
+	} else if remaining >= 0 && r.ContentLength > remaining+multipartOverhead {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	}
+	exceeded := func() bool { return false }
+	if remaining >= 0 {
+		var body io.Reader
+		body, exceeded = capBody(w, r.Body, remaining+multipartOverhead)
+		r.Body = ioutil.NopCloser(body)
+	}
+
 	// Allow 32Mb internal buffer for upload
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && exceeded() {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	} else if err != nil {
 		log.Printf("ERROR: failed to parse multipart form for file upload: %v\n", err)
 		responses.Error(w, http.StatusInternalServerError, "failed to parse form")
 		return
@@ -176,43 +331,30 @@ func createFile(w http.ResponseWriter, r *http.Request, path string) {
 		}
 	}()
 
-	// Check file doesn't already exist
-	if _, err := os.Stat(path + "/" + handler.Filename); err == nil {
-		responses.Error(w, http.StatusConflict, "file already exists")
-		return
-	} else if !os.IsNotExist(err) {
-		log.Printf("ERROR: failed to stat output file: %v\n", err)
-		responses.Error(w, http.StatusInternalServerError, "failed to check output file")
+	// Ensure the file stays within the directory
+	namespacedTarget, ok := childPath(w, files, namespacedPath, handler.Filename)
+	if !ok {
 		return
 	}
 
-	// Open output file
-	out, err := os.OpenFile(path+"/"+handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		log.Printf("ERROR: failed to open output file: %v\n", err)
-		responses.Error(w, http.StatusInternalServerError, "failed to open file")
+	// Check file doesn't already exist unless overwriting
+	overwrite := r.URL.Query().Get("overwrite") != ""
+	if _, err := files.Stat(namespacedTarget); err == nil && !overwrite {
+		responses.Error(w, http.StatusConflict, "file already exists")
 		return
-	}
-	defer func() {
-		if err := out.Close(); err != nil {
-			log.Printf("ERROR: failed to close output file: %v\n", err)
-		}
-	}()
-
-	// Copy uploaded to output
-	if _, err := io.Copy(out, in); err != nil {
-		log.Printf("ERROR: failed to copy uploaded file to output file: %v\n", err)
-		responses.Error(w, http.StatusInternalServerError, "failed to copy file")
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: failed to stat output file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to check output file")
 		return
 	}
 
-	responses.Success(w)
+	writeContents(w, r, in, handler.Size, namespacedTarget, files, quota, store, fileLocks, bus, sums)
 }
 
 // Change a file's name on disk
-func updateFile(w http.ResponseWriter, r *http.Request, path, filesDirectory string) {
+func updateFile(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, store *versions.Store, fileLocks *locks.Store, bus *events.Bus) {
 	// Don't allow changes to user root
-	rawPath := filepath.Clean(strings.TrimPrefix(r.RequestURI, "/api/files"))
+	rawPath := path.Clean(strings.TrimPrefix(r.RequestURI, "/api/files"))
 	if rawPath == "." || rawPath == "/" {
 		responses.Error(w, http.StatusForbidden, "not allowed to move user root")
 		return
@@ -241,7 +383,7 @@ func updateFile(w http.ResponseWriter, r *http.Request, path, filesDirectory str
 	}
 
 	// Get file statistics and ensure exists
-	_, err := os.Stat(path)
+	_, err := files.Stat(namespacedPath)
 	if os.IsNotExist(err) {
 		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
 		return
@@ -249,47 +391,75 @@ func updateFile(w http.ResponseWriter, r *http.Request, path, filesDirectory str
 		log.Printf("ERROR: failed to stat file: %v\n", err)
 		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
 		return
+	} else if !unlocked(w, r, fileLocks, true, namespacedPath) {
+		return
 	}
 
 	// Rename file if passed
 	if body.Filename != "" {
-		newName := filepath.Base(filepath.Clean(body.Filename))
-		directory := filepath.Dir(path)
+		renamed, ok := childPath(w, files, path.Dir(namespacedPath), body.Filename)
+		if !ok || !unlocked(w, r, fileLocks, true, renamed) {
+			return
+		}
 
 		// Rename file
-		if err := os.Rename(path, directory+"/"+newName); err != nil {
+		if err := files.Rename(namespacedPath, renamed); err != nil {
 			log.Printf("ERROR: failed to rename file: %v\n", err)
 			responses.Error(w, http.StatusInternalServerError, "failed to rename file")
 			return
 		}
+
+		// Keep version history with the file
+		if err := store.Move(namespacedPath, renamed); err != nil {
+			log.Printf("ERROR: failed to move file versions: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		bus.Publish(events.NewMove(namespacedPath, renamed))
 	}
 
 	// Move file if passed
 	if body.Path != "" {
-		newPath := filepath.Join(filesDirectory, r.Header.Get("X-BPI-Username"), strings.Replace(body.Path, "../", "", -1))
-		filename := filepath.Base(path)
+		namespacedNewPath, ok := resolvePath(w, files, r.Header.Get("X-BPI-Username"), body.Path)
+		if !ok {
+			return
+		}
+		moved := path.Join(namespacedNewPath, path.Base(namespacedPath))
+		if !unlocked(w, r, fileLocks, true, moved) {
+			return
+		}
 
 		// Ensure new path exists
-		if _, err := os.Stat(newPath); os.IsNotExist(err) {
+		if _, err := files.Stat(namespacedNewPath); os.IsNotExist(err) {
 			responses.Error(w, http.StatusBadRequest, "specified path does not exist")
 			return
 		}
 
 		// Move file
-		if err := os.Rename(path, newPath+"/"+filename); err != nil {
+		if err := files.Rename(namespacedPath, moved); err != nil {
 			log.Printf("ERROR: failed to move file to specified directory: %v\n", err)
 			responses.Error(w, http.StatusInternalServerError, "failed to move file")
 			return
 		}
+
+		// Keep version history with the file
+		if err := store.Move(namespacedPath, moved); err != nil {
+			log.Printf("ERROR: failed to move file versions: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		bus.Publish(events.NewMove(namespacedPath, moved))
 	}
 
 	responses.Success(w)
 }
 
 // Delete a file
-func deleteFile(w http.ResponseWriter, _ *http.Request, path string) {
+func deleteFile(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, store *versions.Store, fileLocks *locks.Store, bus *events.Bus) {
 	// Ensure file exists
-	info, err := os.Stat(path)
+	info, err := files.Stat(namespacedPath)
 	if os.IsNotExist(err) {
 		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
 		return
@@ -297,24 +467,27 @@ func deleteFile(w http.ResponseWriter, _ *http.Request, path string) {
 		log.Printf("ERROR: failed to stat file: %v\n", err)
 		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
 		return
+	} else if !unlocked(w, r, fileLocks, true, namespacedPath) {
+		return
 	}
 
-	// Remove all under if directory
-	if info.IsDir() {
-		if err := os.RemoveAll(path); err != nil {
+	// Remove the file, or all under it if a directory
+	if err := files.Remove(namespacedPath); err != nil {
+		if info.IsDir() {
 			log.Printf("ERROR: failed to delete directory: %v\n", err)
 			responses.Error(w, http.StatusInternalServerError, "failed to delete directory")
-			return
+		} else {
+			log.Printf("ERROR: failed to delete file: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to remove file")
 		}
-
-		responses.Success(w)
 		return
 	}
+	bus.Publish(events.New(events.Deleted, namespacedPath))
 
-	// Remove file
-	if err := os.Remove(path); err != nil {
-		log.Printf("ERROR: failed to delete file: %v\n", err)
-		responses.Error(w, http.StatusInternalServerError, "failed to remove file")
+	// Previous versions are only dropped once the file is gone so a failed delete keeps them
+	if err := store.Remove(namespacedPath); err != nil {
+		log.Printf("ERROR: failed to delete file versions: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to delete from database")
 		return
 	}
 
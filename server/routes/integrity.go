@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/integrity"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+// Routes for reviewing problems found while scrubbing users' files
+func Integrity(sums *integrity.Store, admins []string, router *mux.Router) {
+	subrouter := router.PathPrefix("/integrity").Subrouter()
+
+	subrouter.HandleFunc("", selfIntegrity(sums))
+	subrouter.HandleFunc("/all", allIntegrity(sums, admins))
+}
+
+// Get or clear the problems with the current user's files
+func selfIntegrity(sums *integrity.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("X-BPI-Username")
+
+		switch r.Method {
+		case http.MethodGet:
+			report, err := sums.Report(username)
+			if err != nil {
+				log.Printf("ERROR: failed to read integrity report: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to read integrity report")
+				return
+			}
+			responses.SuccessWithData(w, report)
+
+		case http.MethodDelete:
+			if err := sums.Clear(username); err != nil {
+				log.Printf("ERROR: failed to clear integrity report: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to clear integrity report")
+				return
+			}
+			responses.Success(w)
+
+		default:
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Get the problems with every user's files, only allowed for admins
+func allIntegrity(sums *integrity.Store, admins []string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if !isAdmin(r.Header.Get("X-BPI-Username"), admins) {
+			responses.Error(w, http.StatusForbidden, "only admins can view all integrity reports")
+			return
+		}
+
+		reports, err := sums.Reports()
+		if err != nil {
+			log.Printf("ERROR: failed to read integrity reports: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to read integrity reports")
+			return
+		}
+		responses.SuccessWithData(w, reports)
+	}
+}
+
+// Check if a user is one of the configured admins
+func isAdmin(username string, admins []string) bool {
+	for _, admin := range admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/jobs"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+)
+
+// Routes for checking on background jobs
+func Jobs(manager *jobs.Manager, router *mux.Router) {
+	subrouter := router.PathPrefix("/jobs").Subrouter()
+
+	subrouter.HandleFunc("", listJobs(manager))
+	subrouter.HandleFunc("/{id}", readJob(manager))
+}
+
+// Get all of a user's jobs
+func listJobs(manager *jobs.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		descriptions := []map[string]interface{}{}
+		for _, job := range manager.List(r.Header.Get("X-BPI-Username")) {
+			descriptions = append(descriptions, job.Describe())
+		}
+
+		// Newest first
+		sort.Slice(descriptions, func(i, j int) bool {
+			return descriptions[i]["started"].(int64) > descriptions[j]["started"].(int64)
+		})
+
+		responses.SuccessWithData(w, descriptions)
+	}
+}
+
+// Get the status of a specific job
+func readJob(manager *jobs.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validate initial request on method and path parameters
+		vars := mux.Vars(r)
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if _, ok := vars["id"]; !ok {
+			responses.Error(w, http.StatusBadRequest, "path parameter 'id' must be present")
+			return
+		}
+
+		// Only allow the owner to view the job
+		job := manager.Find(vars["id"])
+		if job == nil || job.Owner != r.Header.Get("X-BPI-Username") {
+			responses.Error(w, http.StatusNotFound, "specified job does not exist")
+			return
+		}
+
+		responses.SuccessWithData(w, job.Describe())
+	}
+}
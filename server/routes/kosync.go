@@ -0,0 +1,160 @@
+package routes
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Error codes understood by KOReader
+const (
+	kosyncUnknownError     = 2000
+	kosyncUnauthorized     = 2001
+	kosyncUserExists       = 2002
+	kosyncInvalidRequest   = 2003
+	kosyncDocumentRequired = 2004
+)
+
+// Implement the KOReader sync server so reading progress follows users between devices
+func KOSync(db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/kosync").Subrouter()
+
+	subrouter.HandleFunc("/healthcheck", kosyncHealthcheck).Methods(http.MethodGet)
+	subrouter.HandleFunc("/users/create", kosyncCreateUser(db)).Methods(http.MethodPost)
+	subrouter.HandleFunc("/users/auth", kosyncHandler(db, kosyncAuthorize)).Methods(http.MethodGet)
+	subrouter.HandleFunc("/syncs/progress", kosyncHandler(db, kosyncUpdateProgress(db))).Methods(http.MethodPut)
+	subrouter.HandleFunc("/syncs/progress/{document}", kosyncHandler(db, kosyncGetProgress(db))).Methods(http.MethodGet)
+}
+
+// Authenticate the request with the user's name and the MD5 digest of their password
+func kosyncHandler(db *bolt.DB, handler func(w http.ResponseWriter, r *http.Request, username string)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, key := r.Header.Get("X-Auth-User"), r.Header.Get("X-Auth-Key")
+		if username == "" || key == "" {
+			kosyncError(w, http.StatusUnauthorized, kosyncUnauthorized, "Unauthorized")
+			return
+		}
+
+		user, err := models.FindUser(username, db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for user: %v\n", err)
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+			return
+		} else if user == nil {
+			kosyncError(w, http.StatusUnauthorized, kosyncUnauthorized, "Unauthorized")
+			return
+		}
+
+		if valid, err := user.AuthenticateSync(key); err != nil {
+			log.Printf("ERROR: failed to verify sync key against hash: %v\n", err)
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+			return
+		} else if !valid {
+			kosyncError(w, http.StatusUnauthorized, kosyncUnauthorized, "Unauthorized")
+			return
+		}
+
+		handler(w, r, user.Username)
+	}
+}
+
+// Report that the sync server is available
+func kosyncHealthcheck(w http.ResponseWriter, _ *http.Request) {
+	kosyncJSON(w, http.StatusOK, map[string]string{"state": "OK"})
+}
+
+// Refuse to register users since accounts are created through BookPi
+func kosyncCreateUser(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" {
+			kosyncError(w, http.StatusForbidden, kosyncInvalidRequest, "Invalid request")
+			return
+		}
+
+		if user, err := models.FindUser(body.Username, db); err != nil {
+			log.Printf("ERROR: failed to query database for user: %v\n", err)
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+		} else if user != nil {
+			kosyncError(w, http.StatusPaymentRequired, kosyncUserExists, "Username is already registered.")
+		} else {
+			kosyncError(w, http.StatusForbidden, kosyncInvalidRequest, "Registration is disabled, create an account on the BookPi first.")
+		}
+	}
+}
+
+// Confirm the user's credentials
+func kosyncAuthorize(w http.ResponseWriter, _ *http.Request, _ string) {
+	kosyncJSON(w, http.StatusOK, map[string]string{"authorized": "OK"})
+}
+
+// Record the user's position in a document
+func kosyncUpdateProgress(db *bolt.DB) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		var progress models.Progress
+		if err := json.NewDecoder(r.Body).Decode(&progress); err != nil {
+			kosyncError(w, http.StatusForbidden, kosyncInvalidRequest, "Invalid request")
+			return
+		} else if progress.Document == "" {
+			kosyncError(w, http.StatusForbidden, kosyncDocumentRequired, "Field 'document' not provided.")
+			return
+		} else if progress.Progress == "" || progress.Device == "" {
+			kosyncError(w, http.StatusForbidden, kosyncInvalidRequest, "Invalid request")
+			return
+		}
+		progress.Timestamp = time.Now().Unix()
+
+		if err := progress.Save(username, db); err != nil {
+			log.Printf("ERROR: failed to write reading progress to database: %v\n", err)
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+			return
+		}
+
+		kosyncJSON(w, http.StatusOK, map[string]interface{}{
+			"document":  progress.Document,
+			"timestamp": progress.Timestamp,
+		})
+	}
+}
+
+// Get the user's latest position in a document
+func kosyncGetProgress(db *bolt.DB) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		progress, err := models.FindProgress(username, mux.Vars(r)["document"], db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for reading progress: %v\n", err)
+			kosyncError(w, http.StatusInternalServerError, kosyncUnknownError, "Unknown server error")
+			return
+		}
+
+		// KOReader expects an empty object for documents it has not synced
+		if progress == nil {
+			kosyncJSON(w, http.StatusOK, struct{}{})
+			return
+		}
+		kosyncJSON(w, http.StatusOK, progress)
+	}
+}
+
+// Send an error in the format KOReader expects
+func kosyncError(w http.ResponseWriter, status, code int, message string) {
+	kosyncJSON(w, status, map[string]interface{}{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// Send a JSON response without the usual status wrapper
+func kosyncJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("ERROR: failed to encode sync response: %v\n", err)
+	}
+}
@@ -0,0 +1,407 @@
+package routes
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/activity"
+	"github.com/akrantz01/bookpi/server/hash"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a link's password is remembered once it is entered correctly
+	linkPasswordLifetime = 30 * time.Minute
+
+	// How many wrong passwords a link accepts within a window before refusing to check more
+	linkAttempts      = 5
+	linkAttemptWindow = time.Minute
+)
+
+// Wrong passwords entered for a link since the window started
+type linkFailures struct {
+	count   int
+	started time.Time
+}
+
+var (
+	// Signs the cookies remembering link passwords, which are forgotten when restarting
+	linkSecret = make([]byte, 32)
+
+	failedLinks     = make(map[string]*linkFailures)
+	failedLinksLock sync.Mutex
+)
+
+func init() {
+	if _, err := rand.Read(linkSecret); err != nil {
+		panic(err)
+	}
+}
+
+// Create, list and revoke a user's public links
+func Links(files storage.Storage, feed *activity.Feed, db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/links").Subrouter()
+
+	subrouter.HandleFunc("", listLinks(db)).Methods(http.MethodGet)
+	subrouter.HandleFunc("", createLink(files, feed, db)).Methods(http.MethodPost)
+	subrouter.HandleFunc("/{token}", revokeLink(feed, db)).Methods(http.MethodDelete)
+}
+
+// Serve files through public links to anyone who has them, without requiring a session
+func PublicLinks(files storage.Storage, db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/public").Subrouter()
+
+	subrouter.HandleFunc("/{token}", publicLink(files, db)).Methods(http.MethodGet, http.MethodHead)
+	subrouter.PathPrefix("/{token}/").HandlerFunc(publicLink(files, db)).Methods(http.MethodGet, http.MethodHead)
+}
+
+// Get the path a link points to relative to its owner's files
+func linkPath(link *models.Link) string {
+	if parts := strings.SplitN(link.Path, "/", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return ""
+}
+
+// Describe a link to its owner
+func describeLink(link *models.Link) map[string]interface{} {
+	return map[string]interface{}{
+		"token":         link.Token,
+		"url":           "/public/" + link.Token,
+		"path":          "/" + linkPath(link),
+		"directory":     link.Directory,
+		"protected":     link.Password != "",
+		"created":       link.Created,
+		"expires":       link.Expires,
+		"max_downloads": link.MaxDownloads,
+		"downloads":     link.Downloads,
+		"expired":       link.Expired(time.Now()) || link.Exhausted(),
+	}
+}
+
+// Get all of the requester's public links
+func listLinks(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		links, err := models.FindLinks(r.Header.Get("X-BPI-Username"), db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for links: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		described := []map[string]interface{}{}
+		for _, link := range links {
+			described = append(described, describeLink(link))
+		}
+		responses.SuccessWithData(w, described)
+	}
+}
+
+// Create a public link to one of the requester's files or directories
+func createLink(files storage.Storage, feed *activity.Feed, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validate initial request on headers and body existence
+		if r.Header.Get("Content-Type") != "application/json" {
+			responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+			return
+		} else if r.Body == nil {
+			responses.Error(w, http.StatusBadRequest, "request body must be present")
+			return
+		}
+
+		// Parse and validate body fields
+		var body struct {
+			File         string `json:"file"`
+			Password     string `json:"password"`
+			Expires      int64  `json:"expires"`
+			MaxDownloads int64  `json:"max_downloads"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+			return
+		} else if body.File == "" {
+			responses.Error(w, http.StatusBadRequest, "field 'file' must be present")
+			return
+		} else if body.Expires < 0 || (body.Expires != 0 && body.Expires <= time.Now().Unix()) {
+			responses.Error(w, http.StatusBadRequest, "field 'expires' must be in the future")
+			return
+		} else if body.MaxDownloads < 0 {
+			responses.Error(w, http.StatusBadRequest, "field 'max_downloads' must not be negative")
+			return
+		}
+
+		username := r.Header.Get("X-BPI-Username")
+		namespacedPath, ok := resolvePath(w, files, username, body.File)
+		if !ok {
+			return
+		}
+
+		// Ensure requested file exists
+		info, err := files.Stat(namespacedPath)
+		if os.IsNotExist(err) {
+			responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to check file existence: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+			return
+		}
+
+		link := models.NewLink(namespacedPath, username, info.IsDir())
+		link.Expires = body.Expires
+		link.MaxDownloads = body.MaxDownloads
+		if body.Password != "" {
+			if link.Password, err = hash.DefaultHash(body.Password); err != nil {
+				log.Printf("ERROR: failed to hash link password: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to hash password")
+				return
+			}
+		}
+
+		if err := link.Save(db); err != nil {
+			log.Printf("ERROR: failed to write link to database: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		feed.Record(activity.LinkCreated, username, nil, activity.Entry{Path: linkPath(link)})
+		responses.SuccessWithData(w, describeLink(link))
+	}
+}
+
+// Revoke one of the requester's public links
+func revokeLink(feed *activity.Feed, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := models.FindLink(mux.Vars(r)["token"], db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for link: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if link == nil || link.Owner != r.Header.Get("X-BPI-Username") {
+			responses.Error(w, http.StatusNotFound, "specified link does not exist")
+			return
+		}
+
+		if err := link.Delete(db); err != nil {
+			log.Printf("ERROR: failed to delete link from database: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		feed.Record(activity.LinkRevoked, link.Owner, nil, activity.Entry{Path: linkPath(link)})
+		responses.Success(w)
+	}
+}
+
+// Download a linked file, or list and download files within a linked directory
+func publicLink(files storage.Storage, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := mux.Vars(r)["token"]
+		link, err := models.FindLink(token, db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for link: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if link == nil {
+			responses.Error(w, http.StatusNotFound, "specified link does not exist")
+			return
+		} else if link.Expired(time.Now()) {
+			responses.Error(w, http.StatusGone, "link has expired")
+			return
+		} else if link.Exhausted() {
+			responses.Error(w, http.StatusGone, "link has reached its download limit")
+			return
+		}
+
+		if link.Password != "" && !linkUnlocked(w, r, link) {
+			return
+		}
+
+		// Only files within a linked directory can be reached through it
+		relative, err := sandbox.Clean(strings.TrimPrefix(r.URL.Path, "/public/"+token))
+		if err != nil {
+			responses.Error(w, http.StatusBadRequest, "path must be within the linked directory")
+			return
+		} else if (relative != "" && !link.Directory) || hiddenPath(relative) {
+			responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+			return
+		}
+		namespacedPath, ok := resolvePath(w, files, link.Owner, path.Join(linkPath(link), relative))
+		if !ok {
+			return
+		}
+
+		info, err := files.Stat(namespacedPath)
+		if os.IsNotExist(err) {
+			responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to stat file: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+			return
+		}
+
+		if info.IsDir() {
+			listLinkedDirectory(w, namespacedPath, info, files)
+			return
+		}
+
+		// Resumed downloads are only counted once
+		if rangeHeader := r.Header.Get("Range"); r.Method == http.MethodGet && (rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")) {
+			if allowed, err := link.Download(db); err != nil {
+				log.Printf("ERROR: failed to count link download: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+				return
+			} else if !allowed {
+				responses.Error(w, http.StatusGone, "link has reached its download limit")
+				return
+			}
+		}
+
+		w.Header().Set("Cache-Control", "private, no-cache")
+		serveFile(w, r, files, namespacedPath)
+	}
+}
+
+// Check the password of a protected link, which is taken through basic auth with any username.
+// A correct password is remembered with a signed cookie so it doesn't need hashing on every request.
+func linkUnlocked(w http.ResponseWriter, r *http.Request, link *models.Link) bool {
+	now := time.Now()
+	if cookie, err := r.Cookie("bp-link"); err == nil && validLinkCookie(cookie.Value, link, now) {
+		return true
+	}
+
+	_, password, _ := r.BasicAuth()
+	if password == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="BookPi shared link"`)
+		responses.Error(w, http.StatusUnauthorized, "password required")
+		return false
+	} else if wait := linkThrottled(link.Token, now); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second)/time.Second)+1))
+		responses.Error(w, http.StatusTooManyRequests, "too many incorrect passwords")
+		return false
+	}
+
+	if valid, err := hash.Verify(password, link.Password); err != nil {
+		log.Printf("ERROR: failed to verify link password: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to verify password")
+		return false
+	} else if !valid {
+		linkFailed(link.Token, now)
+		w.Header().Set("WWW-Authenticate", `Basic realm="BookPi shared link"`)
+		responses.Error(w, http.StatusUnauthorized, "invalid password")
+		return false
+	}
+
+	expires := now.Add(linkPasswordLifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "bp-link",
+		Value:    signLink(link, expires.Unix()),
+		Path:     "/public/" + link.Token,
+		Expires:  expires,
+		Secure:   false,
+		HttpOnly: true,
+	})
+	return true
+}
+
+// Sign a link's token and password until an expiry time, giving the value of its cookie
+func signLink(link *models.Link, expires int64) string {
+	mac := hmac.New(sha256.New, linkSecret)
+	mac.Write([]byte(link.Token + "\x00" + link.Password + "\x00" + strconv.FormatInt(expires, 10)))
+	return strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a cookie remembering a link's password was signed for it and hasn't expired
+func validLinkCookie(value string, link *models.Link, now time.Time) bool {
+	parts := strings.SplitN(value, ".", 2)
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(value), []byte(signLink(link, expires)))
+}
+
+// Get how long until a link can be tried again after too many wrong passwords, zero if it can be now
+func linkThrottled(token string, now time.Time) time.Duration {
+	failedLinksLock.Lock()
+	defer failedLinksLock.Unlock()
+
+	failures, ok := failedLinks[token]
+	if !ok || failures.count < linkAttempts {
+		return 0
+	}
+	return failures.started.Add(linkAttemptWindow).Sub(now)
+}
+
+// Count a wrong password for a link
+func linkFailed(token string, now time.Time) {
+	failedLinksLock.Lock()
+	defer failedLinksLock.Unlock()
+
+	// Forget windows which have passed
+	for other, failures := range failedLinks {
+		if now.Sub(failures.started) >= linkAttemptWindow {
+			delete(failedLinks, other)
+		}
+	}
+
+	if failures, ok := failedLinks[token]; ok {
+		failures.count++
+	} else {
+		failedLinks[token] = &linkFailures{count: 1, started: now}
+	}
+}
+
+// List the contents of a directory within a link
+func listLinkedDirectory(w http.ResponseWriter, namespacedPath string, info os.FileInfo, files storage.Storage) {
+	entries, err := collectListing(files, namespacedPath, "", 1, false, nil)
+	if err != nil {
+		log.Printf("ERROR: failed to list files in directory: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to list files")
+		return
+	}
+	sortListing(entries, "name", false)
+
+	children := []map[string]interface{}{}
+	for _, entry := range entries {
+		children = append(children, map[string]interface{}{
+			"name":          entry.info.Name(),
+			"size":          entry.info.Size(),
+			"last_modified": entry.info.ModTime().Unix(),
+			"directory":     entry.info.IsDir(),
+		})
+	}
+
+	responses.SuccessWithData(w, map[string]interface{}{
+		"name":          info.Name(),
+		"last_modified": info.ModTime().Unix(),
+		"directory":     true,
+		"children":      children,
+	})
+}
+
+// Check if any part of a path is hidden, which are left out of linked directories
+func hiddenPath(relative string) bool {
+	for _, part := range strings.Split(relative, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
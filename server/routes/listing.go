@@ -0,0 +1,112 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/storage"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Deepest a recursive listing may go
+const maxListingDepth = 16
+
+// A file found while listing a directory
+type listing struct {
+	path string
+	info os.FileInfo
+}
+
+// Collect the entries of a directory down to some depth, with paths relative to the directory
+func collectListing(files storage.Storage, directory, relative string, depth int, hidden bool, entries []listing) ([]listing, error) {
+	children, err := files.List(path.Join(directory, relative))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range children {
+		if !hidden && strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		p := path.Join(relative, file.Name())
+		entries = append(entries, listing{path: p, info: file})
+
+		// Symbolic links are not followed since they are never reported as directories
+		if file.IsDir() && depth > 1 {
+			if entries, err = collectListing(files, directory, p, depth-1, hidden, entries); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// Check if a listing can be sorted by a field
+func validListingSort(field string) bool {
+	switch field {
+	case "name", "size", "modified", "type":
+		return true
+	default:
+		return false
+	}
+}
+
+// Order listing entries by a field, falling back to their paths for ties
+func sortListing(entries []listing, field string, descending bool) {
+	compare := func(a, b listing) int {
+		switch field {
+		case "size":
+			return compareInt64(a.info.Size(), b.info.Size())
+		case "modified":
+			return compareInt64(a.info.ModTime().UnixNano(), b.info.ModTime().UnixNano())
+		case "type":
+			// Directories come before files which are grouped by extension
+			if a.info.IsDir() != b.info.IsDir() {
+				if a.info.IsDir() {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(strings.ToLower(path.Ext(a.path)), strings.ToLower(path.Ext(b.path)))
+		default:
+			return strings.Compare(strings.ToLower(a.path), strings.ToLower(b.path))
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if descending {
+			a, b = b, a
+		}
+
+		if result := compare(a, b); result != 0 {
+			return result < 0
+		}
+		return a.path < b.path
+	})
+}
+
+// Get a page of entries and the cursor for the next page, if any
+func paginateListing(entries []listing, cursor, limit int) ([]listing, interface{}) {
+	if cursor >= len(entries) {
+		return []listing{}, nil
+	} else if limit <= 0 || cursor+limit >= len(entries) {
+		return entries[cursor:], nil
+	}
+
+	return entries[cursor : cursor+limit], strconv.Itoa(cursor + limit)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,284 @@
+package routes
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Take, refresh and release advisory locks on users' files
+func Locks(files storage.Storage, fileLocks *locks.Store, admins []string, db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/locks").Subrouter()
+
+	subrouter.HandleFunc("", listLocks(fileLocks, admins)).Methods(http.MethodGet)
+	subrouter.PathPrefix("/{user}/").HandlerFunc(specificLock(files, fileLocks, admins, db))
+}
+
+// Get the token a request claims locks with
+func lockToken(r *http.Request) string {
+	return strings.Trim(strings.TrimSpace(r.Header.Get("Lock-Token")), "<>")
+}
+
+// Describe a lock without revealing its token
+func describeLock(lock *locks.Lock) map[string]interface{} {
+	depth := "infinity"
+	if lock.ZeroDepth {
+		depth = "0"
+	}
+
+	return map[string]interface{}{
+		"path":    lock.RelativePath(),
+		"owner":   lock.Owner,
+		"info":    lock.Info,
+		"depth":   depth,
+		"created": lock.Created,
+		"expires": lock.Expires,
+	}
+}
+
+// Add the lock protecting a file, if any, to its details
+func lockDetails(details map[string]interface{}, namespacedPath string, fileLocks *locks.Store) map[string]interface{} {
+	details["lock"] = nil
+
+	lock, err := fileLocks.Covering(namespacedPath)
+	if err != nil {
+		log.Printf("ERROR: failed to read locks for %s: %v\n", namespacedPath, err)
+	} else if lock != nil {
+		details["lock"] = describeLock(lock)
+	}
+	return details
+}
+
+// Ensure none of the paths are locked by someone other than the requester, optionally including
+// anything beneath them
+func unlocked(w http.ResponseWriter, r *http.Request, fileLocks *locks.Store, descendants bool, namespacedPaths ...string) bool {
+	for _, namespacedPath := range namespacedPaths {
+		lock, err := fileLocks.Conflicting(namespacedPath, []string{lockToken(r)}, descendants)
+		if err != nil {
+			log.Printf("ERROR: failed to read locks: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return false
+		} else if lock != nil {
+			responses.ErrorWithData(w, http.StatusLocked, "file is locked", describeLock(lock))
+			return false
+		}
+	}
+	return true
+}
+
+// Get the current locks on the requester's files, or everyone's for admins
+func listLocks(fileLocks *locks.Store, admins []string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("X-BPI-Username")
+		if r.URL.Query().Get("all") != "" {
+			if !isAdmin(username, admins) {
+				responses.Error(w, http.StatusForbidden, "only admins can view all locks")
+				return
+			}
+			username = ""
+		}
+
+		current, err := fileLocks.List(username)
+		if err != nil {
+			log.Printf("ERROR: failed to list locks: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		described := []map[string]interface{}{}
+		for _, lock := range current {
+			details := describeLock(lock)
+			if username == "" {
+				details["user"] = strings.SplitN(lock.Path, "/", 2)[0]
+			}
+			described = append(described, details)
+		}
+		responses.SuccessWithData(w, described)
+	}
+}
+
+// Operate on the lock of a specific user's file
+func specificLock(files storage.Storage, fileLocks *locks.Store, admins []string, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		username := r.Header.Get("X-BPI-Username")
+
+		namespacedPath, ok := resolvePath(w, files, vars["user"], strings.TrimPrefix(r.URL.Path, "/api/locks/"+vars["user"]))
+		if !ok {
+			return
+		}
+
+		// Owners and those a file is shared with can lock it, but only owners and admins can break locks
+		if vars["user"] != username && !(r.Method == http.MethodDelete && isAdmin(username, admins)) {
+			share, err := models.FindShare(namespacedPath, db)
+			if err != nil {
+				log.Printf("ERROR: failed to query database for share existence: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to query database")
+				return
+			} else if share == nil || !contains(share.To, username) {
+				responses.Error(w, http.StatusForbidden, "cannot lock another user's files")
+				return
+			} else if r.URL.Query().Get("force") != "" {
+				responses.Error(w, http.StatusForbidden, "only the owner can break locks")
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			lockFile(w, r, namespacedPath, files, fileLocks)
+
+		case http.MethodDelete:
+			unlockFile(w, r, namespacedPath, fileLocks)
+
+		default:
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Take a lock on a file, or refresh it if the requester holds it
+func lockFile(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, fileLocks *locks.Store) {
+	// Parse and validate body fields
+	var body struct {
+		Timeout int64  `json:"timeout"`
+		Info    string `json:"info"`
+		Depth   string `json:"depth"`
+	}
+	if r.Header.Get("Content-Type") == "application/json" && r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+			return
+		}
+	}
+	if body.Timeout < 0 || body.Timeout > int64(locks.MaxDuration/time.Second) {
+		responses.Error(w, http.StatusBadRequest, "field 'timeout' must be between 0 and 3600 seconds")
+		return
+	} else if body.Depth != "" && body.Depth != "0" && body.Depth != "infinity" {
+		responses.Error(w, http.StatusBadRequest, "field 'depth' must be one of '0' or 'infinity'")
+		return
+	}
+	duration := time.Duration(body.Timeout) * time.Second
+	if duration == 0 {
+		duration = locks.DefaultDuration
+	}
+
+	// Extend the requester's own lock, but only when it is the lock on this path
+	if token := lockToken(r); token != "" {
+		lock, err := fileLocks.Find(token)
+		if err == nil && lock.Path == namespacedPath {
+			lock, err = fileLocks.Refresh(token, r.Header.Get("X-BPI-Username"), duration)
+		} else if err == nil {
+			err = locks.ErrNoSuchLock
+		}
+
+		if err == locks.ErrNoSuchLock {
+			responses.Error(w, http.StatusPreconditionFailed, "lock does not exist")
+			return
+		} else if err == locks.ErrNotOwner {
+			responses.Error(w, http.StatusForbidden, "lock is owned by another user")
+			return
+		} else if err == locks.ErrHeld {
+			responses.Error(w, http.StatusLocked, "lock is in use")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to refresh lock: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		w.Header().Set("Lock-Token", "<"+lock.Token+">")
+		responses.SuccessWithData(w, describeLock(lock))
+		return
+	}
+
+	// Ensure file exists
+	if _, err := files.Stat(namespacedPath); os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	}
+
+	lock, err := fileLocks.Acquire(namespacedPath, r.Header.Get("X-BPI-Username"), strings.TrimSpace(body.Info), body.Depth == "0", duration)
+	if err == locks.ErrLocked {
+		current, _ := fileLocks.Conflicting(namespacedPath, nil, body.Depth != "0")
+		if current != nil {
+			responses.ErrorWithData(w, http.StatusLocked, "file is locked", describeLock(current))
+		} else {
+			responses.Error(w, http.StatusLocked, "file is locked")
+		}
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to acquire lock: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+		return
+	}
+
+	details := describeLock(lock)
+	details["token"] = lock.Token
+	w.Header().Set("Lock-Token", "<"+lock.Token+">")
+	responses.SuccessWithData(w, details)
+}
+
+// Release a lock with its token, or break it if forced by the file's owner or an admin
+func unlockFile(w http.ResponseWriter, r *http.Request, namespacedPath string, fileLocks *locks.Store) {
+	if r.URL.Query().Get("force") != "" {
+		if _, err := fileLocks.Break(namespacedPath); err == locks.ErrNoSuchLock {
+			responses.Error(w, http.StatusNotFound, "specified lock does not exist")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to break lock: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		responses.Success(w)
+		return
+	}
+
+	token := lockToken(r)
+	if token == "" {
+		responses.Error(w, http.StatusBadRequest, "header 'Lock-Token' must be present")
+		return
+	}
+
+	// Only release the lock on this path
+	current, err := fileLocks.Covering(namespacedPath)
+	if err != nil {
+		log.Printf("ERROR: failed to read locks: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	} else if current == nil || current.Path != namespacedPath || current.Token != token {
+		responses.Error(w, http.StatusConflict, "lock token does not match the lock on the file")
+		return
+	}
+
+	if _, err := fileLocks.Release(token, r.Header.Get("X-BPI-Username")); err == locks.ErrNoSuchLock {
+		responses.Error(w, http.StatusConflict, "lock token does not match the lock on the file")
+		return
+	} else if err == locks.ErrNotOwner {
+		responses.Error(w, http.StatusForbidden, "lock is owned by another user")
+		return
+	} else if err == locks.ErrHeld {
+		responses.Error(w, http.StatusLocked, "lock is in use")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to release lock: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+		return
+	}
+
+	responses.Success(w)
+}
@@ -0,0 +1,551 @@
+package routes
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"github.com/akrantz01/bookpi/server/library"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsOpenSearch  = "application/opensearchdescription+xml"
+	opdsPageSize    = 50
+)
+
+var opdsBookTypes = map[string]string{
+	library.FormatEPUB: "application/epub+zip",
+	library.FormatPDF:  "application/pdf",
+}
+
+// An OPDS catalog feed
+type opdsFeed struct {
+	XMLName         xml.Name    `xml:"feed"`
+	Xmlns           string      `xml:"xmlns,attr"`
+	XmlnsDC         string      `xml:"xmlns:dc,attr"`
+	XmlnsOPDS       string      `xml:"xmlns:opds,attr"`
+	XmlnsOpenSearch string      `xml:"xmlns:opensearch,attr"`
+	Id              string      `xml:"id"`
+	Title           string      `xml:"title"`
+	Updated         string      `xml:"updated"`
+	TotalResults    int         `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage    int         `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex      int         `xml:"opensearch:startIndex,omitempty"`
+	Links           []opdsLink  `xml:"link"`
+	Entries         []opdsEntry `xml:"entry"`
+}
+
+// An entry within an OPDS feed, either a book or a link to another feed
+type opdsEntry struct {
+	Title      string         `xml:"title"`
+	Id         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []opdsAuthor   `xml:"author"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Publisher  string         `xml:"dc:publisher,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Identifier string         `xml:"dc:identifier,omitempty"`
+	Categories []opdsCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+	Content    *opdsContent   `xml:"content"`
+	Links      []opdsLink     `xml:"link"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type opdsContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type opdsLink struct {
+	Rel   string `xml:"rel,attr"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+// Serve each user's books as an OPDS catalog for e-readers
+func OPDS(files storage.Storage, keys *encryption.Keyring, books *library.Library, db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/opds").Subrouter()
+
+	subrouter.HandleFunc("", opdsHandler(keys, db, opdsRoot))
+	subrouter.HandleFunc("/books", opdsHandler(keys, db, opdsAllBooks(books)))
+	subrouter.HandleFunc("/recent", opdsHandler(keys, db, opdsRecentBooks(books)))
+	subrouter.HandleFunc("/authors", opdsHandler(keys, db, opdsAuthors(books)))
+	subrouter.HandleFunc("/authors/books", opdsHandler(keys, db, opdsAuthorBooks(books)))
+	subrouter.HandleFunc("/series", opdsHandler(keys, db, opdsSeries(books)))
+	subrouter.HandleFunc("/series/books", opdsHandler(keys, db, opdsSeriesBooks(books)))
+	subrouter.HandleFunc("/search", opdsHandler(keys, db, opdsSearch(books)))
+	subrouter.HandleFunc("/search.xml", opdsHandler(keys, db, opdsSearchDescription))
+	subrouter.PathPrefix("/cover/").HandlerFunc(opdsHandler(keys, db, opdsCover(files, books)))
+	subrouter.PathPrefix("/download/").HandlerFunc(opdsHandler(keys, db, opdsDownload(files, books)))
+}
+
+// Authenticate the request with basic auth since e-readers cannot log in through the API
+func opdsHandler(keys *encryption.Keyring, db *bolt.DB, handler func(w http.ResponseWriter, r *http.Request, username string)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		username, release, ok := basicAuthenticate(w, r, keys, db)
+		if !ok {
+			return
+		}
+		defer release()
+
+		handler(w, r, username)
+	}
+}
+
+// Get the navigation feed linking to each way of browsing the library
+func opdsRoot(w http.ResponseWriter, r *http.Request, _ string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	feed := newOPDSFeed("urn:bookpi:opds", "BookPi Library", opdsNavigation, "/opds")
+
+	sections := []struct{ id, title, description, href string }{
+		{"books", "All Books", "Every book in your library by title", "/opds/books"},
+		{"recent", "Recently Added", "Books most recently added or changed", "/opds/recent"},
+		{"authors", "Authors", "Books grouped by author", "/opds/authors"},
+		{"series", "Series", "Books grouped by series", "/opds/series"},
+	}
+	for _, section := range sections {
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   section.title,
+			Id:      "urn:bookpi:opds:" + section.id,
+			Updated: now,
+			Content: &opdsContent{Type: "text", Text: section.description},
+			Links:   []opdsLink{{Rel: "subsection", Href: section.href, Type: opdsAcquisitionOrNavigation(section.id)}},
+		})
+	}
+
+	writeOPDS(w, opdsNavigation, feed)
+}
+
+// Get every book in the library by title
+func opdsAllBooks(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		found, ok := opdsBooks(w, books, username, nil)
+		if !ok {
+			return
+		}
+		writeBooks(w, r, "urn:bookpi:opds:books", "All Books", found)
+	}
+}
+
+// Get the library with the most recently changed books first
+func opdsRecentBooks(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		found, ok := opdsBooks(w, books, username, nil)
+		if !ok {
+			return
+		}
+		sort.SliceStable(found, func(i, j int) bool {
+			return found[i].Modified > found[j].Modified
+		})
+		writeBooks(w, r, "urn:bookpi:opds:recent", "Recently Added", found)
+	}
+}
+
+// Get a navigation feed of the authors in the library
+func opdsAuthors(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		found, ok := opdsBooks(w, books, username, nil)
+		if !ok {
+			return
+		}
+
+		counts := make(map[string]int)
+		for _, book := range found {
+			for _, author := range book.Authors {
+				counts[author]++
+			}
+		}
+		writeGroups(w, "urn:bookpi:opds:authors", "Authors", "/opds/authors/books", counts)
+	}
+}
+
+// Get the books written by an author
+func opdsAuthorBooks(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'name' is required")
+			return
+		}
+
+		found, ok := opdsBooks(w, books, username, func(book *library.Book) bool {
+			return contains(book.Authors, name)
+		})
+		if !ok {
+			return
+		}
+		writeBooks(w, r, "urn:bookpi:opds:authors:"+url.PathEscape(name), name, found)
+	}
+}
+
+// Get a navigation feed of the series in the library
+func opdsSeries(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		found, ok := opdsBooks(w, books, username, nil)
+		if !ok {
+			return
+		}
+
+		counts := make(map[string]int)
+		for _, book := range found {
+			if book.Series != "" {
+				counts[book.Series]++
+			}
+		}
+		writeGroups(w, "urn:bookpi:opds:series", "Series", "/opds/series/books", counts)
+	}
+}
+
+// Get the books in a series in reading order
+func opdsSeriesBooks(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'name' is required")
+			return
+		}
+
+		found, ok := opdsBooks(w, books, username, func(book *library.Book) bool {
+			return book.Series == name
+		})
+		if !ok {
+			return
+		}
+		sort.SliceStable(found, func(i, j int) bool {
+			return found[i].SeriesIndex < found[j].SeriesIndex
+		})
+		writeBooks(w, r, "urn:bookpi:opds:series:"+url.PathEscape(name), name, found)
+	}
+}
+
+// Get the books matching a search of their titles, authors, series and subjects
+func opdsSearch(books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'q' is required")
+			return
+		}
+
+		found, ok := opdsBooks(w, books, username, func(book *library.Book) bool {
+			return book.Matches(query)
+		})
+		if !ok {
+			return
+		}
+		writeBooks(w, r, "urn:bookpi:opds:search:"+url.QueryEscape(query), fmt.Sprintf("Search for \"%s\"", query), found)
+	}
+}
+
+// Describe how to search the library so readers can show a search box
+func opdsSearchDescription(w http.ResponseWriter, _ *http.Request, _ string) {
+	description := struct {
+		XMLName        xml.Name `xml:"OpenSearchDescription"`
+		Xmlns          string   `xml:"xmlns,attr"`
+		ShortName      string   `xml:"ShortName"`
+		Description    string   `xml:"Description"`
+		InputEncoding  string   `xml:"InputEncoding"`
+		OutputEncoding string   `xml:"OutputEncoding"`
+		Url            struct {
+			Type     string `xml:"type,attr"`
+			Template string `xml:"template,attr"`
+		} `xml:"Url"`
+	}{
+		Xmlns:          "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:      "BookPi",
+		Description:    "Search your books by title, author, series or subject",
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+	}
+	description.Url.Type = opdsAcquisition
+	description.Url.Template = "/opds/search?q={searchTerms}"
+
+	writeOPDS(w, opdsOpenSearch, description)
+}
+
+// Get the cover image of a book
+func opdsCover(files storage.Storage, books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		namespacedPath, ok := resolvePath(w, files, username, strings.TrimPrefix(r.URL.Path, "/opds/cover"))
+		if !ok {
+			return
+		}
+
+		book, err := books.Find(namespacedPath)
+		if err == library.ErrDisabled {
+			responses.Error(w, http.StatusNotImplemented, "the library is unavailable while files are encrypted")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to query library: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if book == nil {
+			responses.Error(w, http.StatusNotFound, "specified book does not exist")
+			return
+		}
+
+		cover, err := books.Cover(book)
+		if err == library.ErrNoCover {
+			responses.Error(w, http.StatusNotFound, "book has no cover")
+			return
+		} else if err == storage.ErrLocked {
+			responses.Error(w, http.StatusLocked, "files are locked until their owner logs in")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to read book cover: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to read cover")
+			return
+		}
+
+		w.Header().Set("Content-Type", book.CoverType)
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		if _, err := w.Write(cover); err != nil {
+			log.Printf("ERROR: failed to write cover: %v\n", err)
+		}
+	}
+}
+
+// Download a book from the user's files
+func opdsDownload(files storage.Storage, books *library.Library) func(w http.ResponseWriter, r *http.Request, username string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		namespacedPath, ok := resolvePath(w, files, username, strings.TrimPrefix(r.URL.Path, "/opds/download"))
+		if !ok {
+			return
+		}
+
+		// Only books in the library are served so the catalog cannot be used to read other files
+		book, err := books.Find(namespacedPath)
+		if err == library.ErrDisabled {
+			responses.Error(w, http.StatusNotImplemented, "the library is unavailable while files are encrypted")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to query library: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if book == nil {
+			responses.Error(w, http.StatusNotFound, "specified book does not exist")
+			return
+		}
+
+		w.Header().Set("Content-Type", opdsBookTypes[book.Format])
+		serveFile(w, r, files, namespacedPath)
+	}
+}
+
+// Get the user's books which pass a filter, responding with an error if the library cannot be read
+func opdsBooks(w http.ResponseWriter, books *library.Library, username string, filter func(book *library.Book) bool) ([]*library.Book, bool) {
+	all, err := books.Books(username)
+	if err == library.ErrDisabled {
+		responses.Error(w, http.StatusNotImplemented, "the library is unavailable while files are encrypted")
+		return nil, false
+	} else if err != nil {
+		log.Printf("ERROR: failed to query library: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return nil, false
+	} else if filter == nil {
+		return all, true
+	}
+
+	found := []*library.Book{}
+	for _, book := range all {
+		if filter(book) {
+			found = append(found, book)
+		}
+	}
+	return found, true
+}
+
+// Write a page of books as an acquisition feed
+func writeBooks(w http.ResponseWriter, r *http.Request, id, title string, books []*library.Book) {
+	page := int64(1)
+	if raw := r.URL.Query().Get("page"); raw != "" {
+		if !parseInt64(w, raw, "page", &page) {
+			return
+		} else if page < 1 {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'page' must be at least 1")
+			return
+		}
+	}
+
+	// Every page past the end is empty, so they are treated as the first of them to keep offsets from overflowing
+	if empty := int64((len(books)+opdsPageSize-1)/opdsPageSize) + 1; page > empty {
+		page = empty
+	}
+
+	feed := newOPDSFeed(id, title, opdsAcquisition, r.URL.RequestURI())
+	feed.TotalResults = len(books)
+	feed.ItemsPerPage = opdsPageSize
+	feed.StartIndex = int(page-1)*opdsPageSize + 1
+
+	// Link to the neighbouring pages keeping the rest of the query
+	pageLink := func(rel string, page int64) opdsLink {
+		query := r.URL.Query()
+		query.Set("page", strconv.FormatInt(page, 10))
+		return opdsLink{Rel: rel, Href: r.URL.Path + "?" + query.Encode(), Type: opdsAcquisition}
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, pageLink("previous", page-1))
+	}
+	if int(page)*opdsPageSize < len(books) {
+		feed.Links = append(feed.Links, pageLink("next", page+1))
+	}
+
+	start := feed.StartIndex - 1
+	if start > len(books) {
+		start = len(books)
+	}
+	end := start + opdsPageSize
+	if end > len(books) {
+		end = len(books)
+	}
+	for _, book := range books[start:end] {
+		feed.Entries = append(feed.Entries, bookEntry(book))
+	}
+
+	writeOPDS(w, opdsAcquisition, feed)
+}
+
+// Write a navigation feed linking to the books for each group, such as an author or series
+func writeGroups(w http.ResponseWriter, id, title, href string, counts map[string]int) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	feed := newOPDSFeed(id, title, opdsNavigation, strings.TrimSuffix(href, "/books"))
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	for _, name := range names {
+		description := "1 book"
+		if counts[name] != 1 {
+			description = fmt.Sprintf("%d books", counts[name])
+		}
+
+		feed.Entries = append(feed.Entries, opdsEntry{
+			Title:   name,
+			Id:      id + ":" + url.PathEscape(name),
+			Updated: now,
+			Content: &opdsContent{Type: "text", Text: description},
+			Links:   []opdsLink{{Rel: "subsection", Href: href + "?name=" + url.QueryEscape(name), Type: opdsAcquisition}},
+		})
+	}
+
+	writeOPDS(w, opdsNavigation, feed)
+}
+
+// Create a feed with the links shared by every page of the catalog
+func newOPDSFeed(id, title, kind, self string) *opdsFeed {
+	return &opdsFeed{
+		Xmlns:           "http://www.w3.org/2005/Atom",
+		XmlnsDC:         "http://purl.org/dc/terms/",
+		XmlnsOPDS:       "http://opds-spec.org/2010/catalog",
+		XmlnsOpenSearch: "http://a9.com/-/spec/opensearch/1.1/",
+		Id:              id,
+		Title:           title,
+		Updated:         time.Now().UTC().Format(time.RFC3339),
+		Links: []opdsLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigation, Title: "BookPi Library"},
+			{Rel: "search", Href: "/opds/search.xml", Type: opdsOpenSearch, Title: "Search"},
+		},
+	}
+}
+
+// Describe a book with links to download it and its cover
+func bookEntry(book *library.Book) opdsEntry {
+	relative := book.RelativePath()
+	entry := opdsEntry{
+		Title:      book.Title,
+		Id:         "urn:bookpi:book:" + url.PathEscape(relative),
+		Updated:    time.Unix(0, book.Modified).UTC().Format(time.RFC3339),
+		Language:   book.Language,
+		Publisher:  book.Publisher,
+		Issued:     book.Published,
+		Identifier: book.Identifier,
+		Summary:    book.Description,
+		Links: []opdsLink{{
+			Rel:  "http://opds-spec.org/acquisition",
+			Href: escapedPath("/opds/download/" + relative),
+			Type: opdsBookTypes[book.Format],
+		}},
+	}
+
+	for _, author := range book.Authors {
+		entry.Authors = append(entry.Authors, opdsAuthor{Name: author})
+	}
+	for _, subject := range book.Subjects {
+		entry.Categories = append(entry.Categories, opdsCategory{Term: subject, Label: subject})
+	}
+	if book.Series != "" {
+		series := book.Series
+		if book.SeriesIndex != 0 {
+			series += " #" + strconv.FormatFloat(book.SeriesIndex, 'f', -1, 64)
+		}
+		entry.Content = &opdsContent{Type: "text", Text: series}
+	}
+
+	if book.Cover != "" {
+		cover := escapedPath("/opds/cover/" + relative)
+		entry.Links = append(entry.Links,
+			opdsLink{Rel: "http://opds-spec.org/image", Href: cover, Type: book.CoverType},
+			opdsLink{Rel: "http://opds-spec.org/image/thumbnail", Href: cover, Type: book.CoverType},
+		)
+	}
+
+	return entry
+}
+
+// Get the type of feed linked to from the root of the catalog
+func opdsAcquisitionOrNavigation(section string) string {
+	if section == "authors" || section == "series" {
+		return opdsNavigation
+	}
+	return opdsAcquisition
+}
+
+// Escape a path for use within a link
+func escapedPath(raw string) string {
+	return (&url.URL{Path: raw}).EscapedPath()
+}
+
+// Write an XML document with its content type
+func writeOPDS(w http.ResponseWriter, contentType string, document interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		log.Printf("ERROR: failed to write catalog: %v\n", err)
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(document); err != nil {
+		log.Printf("ERROR: failed to encode catalog: %v\n", err)
+	}
+}
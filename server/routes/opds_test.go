@@ -0,0 +1,195 @@
+package routes
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/akrantz01/bookpi/server/library"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The parts of a written feed which are checked
+type testFeed struct {
+	Title        string     `xml:"title"`
+	TotalResults int        `xml:"totalResults"`
+	StartIndex   int        `xml:"startIndex"`
+	Links        []opdsLink `xml:"link"`
+	Entries      []struct {
+		Title   string     `xml:"title"`
+		Id      string     `xml:"id"`
+		Content string     `xml:"content"`
+		Links   []opdsLink `xml:"link"`
+	} `xml:"entry"`
+}
+
+// Read back a feed written to a recorder
+func readFeed(t *testing.T, w *httptest.ResponseRecorder) testFeed {
+	var feed testFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("invalid feed: %v\n%s", err, w.Body)
+	}
+	return feed
+}
+
+// Get the link with a relation, if any
+func findLink(links []opdsLink, rel string) *opdsLink {
+	for i := range links {
+		if links[i].Rel == rel {
+			return &links[i]
+		}
+	}
+	return nil
+}
+
+func TestBookEntry(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		book     library.Book
+		id       string
+		download string
+		content  string
+		cover    string
+	}{
+		{
+			name:     "plain",
+			book:     library.Book{Path: "alice/book.epub", Format: library.FormatEPUB, Title: "Book"},
+			id:       "urn:bookpi:book:book.epub",
+			download: "/opds/download/book.epub",
+		},
+		{
+			name:     "escaped path",
+			book:     library.Book{Path: "alice/My Books/a#b?c%d.pdf", Format: library.FormatPDF},
+			id:       "urn:bookpi:book:My%20Books%2Fa%23b%3Fc%25d.pdf",
+			download: "/opds/download/My%20Books/a%23b%3Fc%25d.pdf",
+		},
+		{
+			name:     "series with a fractional index",
+			book:     library.Book{Path: "alice/saga.epub", Format: library.FormatEPUB, Series: "Saga", SeriesIndex: 2.5},
+			id:       "urn:bookpi:book:saga.epub",
+			download: "/opds/download/saga.epub",
+			content:  "Saga #2.5",
+		},
+		{
+			name:     "series without an index",
+			book:     library.Book{Path: "alice/saga.epub", Format: library.FormatEPUB, Series: "Saga"},
+			id:       "urn:bookpi:book:saga.epub",
+			download: "/opds/download/saga.epub",
+			content:  "Saga",
+		},
+		{
+			name:     "cover",
+			book:     library.Book{Path: "alice/covers/a b.epub", Format: library.FormatEPUB, Cover: "cover.jpg", CoverType: "image/jpeg"},
+			id:       "urn:bookpi:book:covers%2Fa%20b.epub",
+			download: "/opds/download/covers/a%20b.epub",
+			cover:    "/opds/cover/covers/a%20b.epub",
+		},
+	} {
+		entry := bookEntry(&c.book)
+		if entry.Id != c.id {
+			t.Errorf("%s: id is %q instead of %q", c.name, entry.Id, c.id)
+		}
+
+		if download := findLink(entry.Links, "http://opds-spec.org/acquisition"); download == nil || download.Href != c.download {
+			t.Errorf("%s: download link is %+v instead of %q", c.name, download, c.download)
+		} else if download.Type != opdsBookTypes[c.book.Format] {
+			t.Errorf("%s: download type is %q", c.name, download.Type)
+		}
+
+		if (entry.Content == nil) != (c.content == "") || (entry.Content != nil && entry.Content.Text != c.content) {
+			t.Errorf("%s: content is %+v instead of %q", c.name, entry.Content, c.content)
+		}
+
+		for _, rel := range []string{"http://opds-spec.org/image", "http://opds-spec.org/image/thumbnail"} {
+			cover := findLink(entry.Links, rel)
+			if c.cover == "" && cover != nil {
+				t.Errorf("%s: linked to a missing cover with %+v", c.name, cover)
+			} else if c.cover != "" && (cover == nil || cover.Href != c.cover || cover.Type != c.book.CoverType) {
+				t.Errorf("%s: %s link is %+v instead of %q", c.name, rel, cover, c.cover)
+			}
+		}
+	}
+}
+
+func TestWriteBooks(t *testing.T) {
+	books := make([]*library.Book, 2*opdsPageSize+5)
+	for i := range books {
+		books[i] = &library.Book{Path: fmt.Sprintf("alice/%03d.epub", i), Format: library.FormatEPUB, Title: fmt.Sprint(i)}
+	}
+
+	for _, c := range []struct {
+		query    string
+		status   int
+		start    int
+		first    string
+		entries  int
+		previous string
+		next     string
+	}{
+		{"", http.StatusOK, 1, "0", opdsPageSize, "", "/opds/books?page=2"},
+		{"?page=2", http.StatusOK, opdsPageSize + 1, "50", opdsPageSize, "/opds/books?page=1", "/opds/books?page=3"},
+		{"?page=3&sort=x", http.StatusOK, 2*opdsPageSize + 1, "100", 5, "/opds/books?page=2&sort=x", ""},
+		{"?page=4", http.StatusOK, 3*opdsPageSize + 1, "", 0, "/opds/books?page=3", ""},
+		{"?page=9223372036854775807", http.StatusOK, 3*opdsPageSize + 1, "", 0, "/opds/books?page=3", ""},
+		{"?page=0", http.StatusBadRequest, 0, "", 0, "", ""},
+		{"?page=-1", http.StatusBadRequest, 0, "", 0, "", ""},
+		{"?page=two", http.StatusBadRequest, 0, "", 0, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		writeBooks(w, httptest.NewRequest(http.MethodGet, "/opds/books"+c.query, nil), "urn:test", "Books", books)
+		if w.Code != c.status {
+			t.Errorf("%q: responded with %d instead of %d", c.query, w.Code, c.status)
+			continue
+		} else if c.status != http.StatusOK {
+			continue
+		}
+
+		feed := readFeed(t, w)
+		if feed.TotalResults != len(books) || feed.StartIndex != c.start || len(feed.Entries) != c.entries {
+			t.Errorf("%q: %d of %d entries starting at %d", c.query, len(feed.Entries), feed.TotalResults, feed.StartIndex)
+		} else if c.entries > 0 && feed.Entries[0].Title != c.first {
+			t.Errorf("%q: first entry is %q instead of %q", c.query, feed.Entries[0].Title, c.first)
+		}
+
+		for rel, want := range map[string]string{"previous": c.previous, "next": c.next} {
+			link := findLink(feed.Links, rel)
+			if want == "" && link != nil {
+				t.Errorf("%q: unexpected %s link to %s", c.query, rel, link.Href)
+			} else if want != "" && (link == nil || link.Href != want) {
+				t.Errorf("%q: %s link is %+v instead of %q", c.query, rel, link, want)
+			}
+		}
+	}
+}
+
+func TestWriteGroups(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeGroups(w, "urn:bookpi:opds:authors", "Authors", "/opds/authors/books", map[string]int{
+		"bob":        1,
+		"Alice":      2,
+		"Carol & Co": 3,
+	})
+	if w.Header().Get("Content-Type") != opdsNavigation {
+		t.Fatalf("content type is %q", w.Header().Get("Content-Type"))
+	}
+
+	feed := readFeed(t, w)
+	if self := findLink(feed.Links, "self"); self == nil || self.Href != "/opds/authors" {
+		t.Errorf("self link is %+v", self)
+	}
+
+	want := []struct{ title, id, content, href string }{
+		{"Alice", "urn:bookpi:opds:authors:Alice", "2 books", "/opds/authors/books?name=Alice"},
+		{"bob", "urn:bookpi:opds:authors:bob", "1 book", "/opds/authors/books?name=bob"},
+		{"Carol & Co", "urn:bookpi:opds:authors:Carol%20&%20Co", "3 books", "/opds/authors/books?name=Carol+%26+Co"},
+	}
+	if len(feed.Entries) != len(want) {
+		t.Fatalf("wrote %d entries instead of %d", len(feed.Entries), len(want))
+	}
+	for i, entry := range feed.Entries {
+		link := findLink(entry.Links, "subsection")
+		if entry.Title != want[i].title || entry.Id != want[i].id || entry.Content != want[i].content || link == nil || link.Href != want[i].href {
+			t.Errorf("entry %d is %+v instead of %+v", i, entry, want[i])
+		}
+	}
+}
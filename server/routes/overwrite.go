@@ -0,0 +1,207 @@
+package routes
+
+import (
+	"fmt"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/integrity"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Serializes the precondition check and replacement of file contents
+var writeLock sync.Mutex
+
+// Generate an entity tag from a file's size and modification time
+func entityTag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// Check the conditional request headers against the current state of a file
+func preconditionsMet(r *http.Request, info os.FileInfo) bool {
+	// Any listed tag must match the current file
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if info == nil {
+			return false
+		} else if strings.TrimSpace(ifMatch) == "*" {
+			return true
+		}
+
+		current := entityTag(info)
+		for _, tag := range strings.Split(ifMatch, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == current {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only allow creating a file that does not exist
+	if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		return info == nil
+	}
+
+	return true
+}
+
+// Replace the contents of an existing file with the raw request body
+func overwriteFile(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus, sums *integrity.Store) {
+	// Ensure parent directory exists
+	if info, err := files.Stat(path.Dir(namespacedPath)); os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified directory does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat directory: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	} else if !info.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "cannot upload to file")
+		return
+	} else if r.Body == nil {
+		responses.Error(w, http.StatusBadRequest, "request body must be present")
+		return
+	}
+
+	writeContents(w, r, r.Body, r.ContentLength, namespacedPath, files, quota, store, fileLocks, bus, sums)
+}
+
+// Get the file being written to, nil if it does not exist yet
+func writeTarget(w http.ResponseWriter, files storage.Storage, namespacedPath string) (os.FileInfo, bool) {
+	info, err := files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		return nil, true
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat output file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to check output file")
+		return nil, false
+	} else if info.IsDir() {
+		responses.Error(w, http.StatusConflict, "directory already exists")
+		return nil, false
+	}
+	return info, true
+}
+
+// Write new contents for a file, keeping the previous contents as a version and recording their checksum.
+// The size of the contents is -1 if it is not known ahead of time.
+func writeContents(w http.ResponseWriter, r *http.Request, in io.Reader, size int64, namespacedPath string, files storage.Storage, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus, sums *integrity.Store) {
+	// Reject what can be rejected before any of the contents reach storage
+	if info, ok := writeTarget(w, files, namespacedPath); !ok {
+		return
+	} else if !preconditionsMet(r, info) {
+		responses.Error(w, http.StatusPreconditionFailed, "file has been modified")
+		return
+	} else if !unlocked(w, r, fileLocks, false, namespacedPath) {
+		return
+	}
+
+	// Never accept more than the user has room for, even when the size is not given
+	remaining, err := remainingQuota(files, r.Header.Get("X-BPI-Username"), quota, store)
+	if err != nil {
+		log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to calculate storage usage")
+		return
+	} else if remaining >= 0 && size > remaining {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	}
+	exceeded := func() bool { return false }
+	if remaining >= 0 {
+		in, exceeded = capBody(w, in, remaining)
+	}
+
+	// Stream the new contents into storage without replacing the file yet
+	out, err := files.Create(namespacedPath)
+	if err != nil {
+		log.Printf("ERROR: failed to open output file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to open file")
+		return
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if err := out.Abort(); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: failed to remove temporary output file: %v\n", err)
+		}
+	}()
+
+	hashed, sum := integrity.NewHasher(out)
+	written, err := io.Copy(hashed, in)
+	if err != nil && exceeded() {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to copy uploaded file to output file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to copy file")
+		return
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	// Check again in case the file changed while the contents were uploaded
+	info, ok := writeTarget(w, files, namespacedPath)
+	if !ok {
+		return
+	} else if !preconditionsMet(r, info) {
+		responses.Error(w, http.StatusPreconditionFailed, "file has been modified")
+		return
+	}
+
+	// Leave files locked by other clients alone
+	if !unlocked(w, r, fileLocks, false, namespacedPath) {
+		return
+	}
+
+	// The previous contents move into the user's versions so only the new contents are added
+	if ok, err := withinQuota(files, r.Header.Get("X-BPI-Username"), quota, written, store); err != nil {
+		log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to calculate storage usage")
+		return
+	} else if !ok {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	}
+
+	// Keep the previous contents
+	if err := store.Snapshot(namespacedPath); err != nil {
+		log.Printf("ERROR: failed to save previous file version: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to save previous version")
+		return
+	}
+
+	// Swap in the new contents
+	committed = true
+	if err := out.Commit(); err != nil {
+		log.Printf("ERROR: failed to replace file contents: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write file")
+		return
+	}
+
+	// Remember the checksum so the contents can be verified later
+	if err := sums.Record(namespacedPath, sum()); err != nil {
+		log.Printf("ERROR: failed to record file checksum: %v\n", err)
+	}
+
+	// Send back the new tag
+	if info, err := files.Stat(namespacedPath); err == nil {
+		w.Header().Set("ETag", entityTag(info))
+	}
+
+	if info == nil {
+		bus.Publish(events.New(events.Created, namespacedPath))
+	} else {
+		bus.Publish(events.New(events.Modified, namespacedPath))
+	}
+
+	responses.Success(w)
+}
@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"github.com/akrantz01/bookpi/server/storage"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Get the namespaced path for a user supplied path within a user's files,
+// responding with an error if the path is not allowed
+func resolvePath(w http.ResponseWriter, files storage.Storage, username, name string) (string, bool) {
+	if !regexUsername.MatchString(username) {
+		responses.Error(w, http.StatusBadRequest, "invalid username")
+		return "", false
+	}
+
+	namespacedPath, err := cleanPath(files, username, name)
+	switch err {
+	case nil:
+		return namespacedPath, true
+
+	case sandbox.ErrInvalid, sandbox.ErrOutside:
+		responses.Error(w, http.StatusBadRequest, "path must be within the user's files")
+	case sandbox.ErrSymlink:
+		responses.Error(w, http.StatusForbidden, "path must not contain symbolic links")
+	default:
+		log.Printf("ERROR: failed to resolve path: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to resolve path")
+	}
+	return "", false
+}
+
+// Get the namespaced path for a user supplied path within a user's files,
+// failing with a sandbox error if the path is not allowed
+func cleanPath(files storage.Storage, username, name string) (string, error) {
+	relative, err := sandbox.Clean(name)
+	if err != nil {
+		return "", err
+	}
+
+	// Let the storage refuse anything it cannot safely reach, other errors are left to the handlers
+	if _, err := files.Stat(path.Join(username, relative)); err == sandbox.ErrSymlink || err == sandbox.ErrOutside {
+		return "", err
+	}
+	return path.Join(username, relative), nil
+}
+
+// Get the namespaced path for a new entry directly within a directory of the user's files
+func childPath(w http.ResponseWriter, files storage.Storage, namespacedDirectory, name string) (string, bool) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		responses.Error(w, http.StatusBadRequest, "file name must not contain path separators")
+		return "", false
+	}
+
+	parts := strings.SplitN(namespacedDirectory, "/", 2)
+	relative := name
+	if len(parts) == 2 {
+		relative = path.Join(parts[1], name)
+	}
+	return resolvePath(w, files, parts[0], relative)
+}
+
+// Send a file within the users' files
+func serveFile(w http.ResponseWriter, r *http.Request, files storage.Storage, namespacedPath string) {
+	file, err := files.Open(namespacedPath)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return
+	} else if err == sandbox.ErrSymlink {
+		responses.Error(w, http.StatusForbidden, "path must not contain symbolic links")
+		return
+	} else if err == storage.ErrLocked {
+		responses.Error(w, http.StatusLocked, "files are locked until their owner logs in")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to open file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to open file")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	} else if info.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "cannot download directory")
+		return
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/library"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Routes for seeing and forgetting reading progress synced from e-readers
+func Progress(books *library.Library, db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/progress").Subrouter()
+
+	subrouter.HandleFunc("", listProgress(books, db)).Methods(http.MethodGet)
+	subrouter.HandleFunc("/{document}", deleteProgress(db)).Methods(http.MethodDelete)
+}
+
+// Get the user's progress in each document, most recently read first, linked to the books in their files
+func listProgress(books *library.Library, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("X-BPI-Username")
+		found, err := models.ListProgress(username, db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for reading progress: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+		sort.Slice(found, func(i, j int) bool {
+			return found[i].Timestamp > found[j].Timestamp
+		})
+
+		progress := []map[string]interface{}{}
+		for _, p := range found {
+			book, err := books.FindDocument(username, p.Document)
+			if err != nil && err != library.ErrDisabled {
+				log.Printf("ERROR: failed to query library: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to query database")
+				return
+			}
+
+			// Documents which are not in the user's files are still listed without a book
+			entry := map[string]interface{}{
+				"document":   p.Document,
+				"progress":   p.Progress,
+				"percentage": p.Percentage,
+				"device":     p.Device,
+				"device_id":  p.DeviceId,
+				"timestamp":  p.Timestamp,
+				"path":       nil,
+				"title":      nil,
+			}
+			if book != nil {
+				entry["path"] = book.RelativePath()
+				entry["title"] = book.Title
+			}
+			progress = append(progress, entry)
+		}
+
+		responses.SuccessWithData(w, progress)
+	}
+}
+
+// Forget the user's progress in a document
+func deleteProgress(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, document := r.Header.Get("X-BPI-Username"), mux.Vars(r)["document"]
+		if progress, err := models.FindProgress(username, document, db); err != nil {
+			log.Printf("ERROR: failed to query database for reading progress: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if progress == nil {
+			responses.Error(w, http.StatusNotFound, "specified document does not exist")
+			return
+		}
+
+		if err := models.DeleteProgress(username, document, db); err != nil {
+			log.Printf("ERROR: failed to delete reading progress from database: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to delete from database")
+			return
+		}
+
+		responses.Success(w)
+	}
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// Room left in a multipart upload for the form around the file
+const multipartOverhead = 64 << 10
+
+// Get the number of bytes used by a user's files and their previous versions
+func usage(files storage.Storage, username string, store *versions.Store) (int64, error) {
+	var total int64
+	if usager, ok := files.(storage.Usager); ok {
+		used, err := usager.Usage(username)
+		if err != nil {
+			return 0, err
+		}
+		total = used
+	} else if err := files.Walk(username, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	stored, err := store.Usage(username)
+	if err != nil {
+		return 0, err
+	}
+
+	return total + stored, nil
+}
+
+// Check if a user has room to store some number of additional bytes
+func withinQuota(files storage.Storage, username string, quota, additional int64, store *versions.Store) (bool, error) {
+	if quota <= 0 {
+		return true, nil
+	}
+
+	used, err := usage(files, username, store)
+	if err != nil {
+		return false, err
+	}
+
+	return used+additional <= quota, nil
+}
+
+// Get how many more bytes a user can store, or -1 if there is no quota
+func remainingQuota(files storage.Storage, username string, quota int64, store *versions.Store) (int64, error) {
+	if quota <= 0 {
+		return -1, nil
+	}
+
+	used, err := usage(files, username, store)
+	if err != nil {
+		return 0, err
+	} else if used >= quota {
+		return 0, nil
+	}
+	return quota - used, nil
+}
+
+// Counts the bytes read through a reader along with the last error
+type countingReader struct {
+	in   io.Reader
+	read int64
+	err  error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.in.Read(p)
+	c.read += int64(n)
+	c.err = err
+	return n, err
+}
+
+// Cap a request body at a number of bytes, along with a check for whether it went past the cap
+func capBody(w http.ResponseWriter, body io.Reader, limit int64) (io.Reader, func() bool) {
+	counted := &countingReader{in: http.MaxBytesReader(w, ioutil.NopCloser(body), limit)}
+	return counted, func() bool {
+		return counted.read >= limit && counted.err != nil && counted.err != io.EOF
+	}
+}
@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"bytes"
+	"github.com/akrantz01/bookpi/server/render"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"github.com/akrantz01/bookpi/server/storage"
+	"log"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Send a text document rendered as sanitized HTML
+func serveRendered(w http.ResponseWriter, r *http.Request, namespacedPath string, renderer *render.Cache, links render.Links) {
+	if r.URL.Query().Get("render") != "html" {
+		responses.Error(w, http.StatusBadRequest, "query parameter 'render' must be 'html'")
+		return
+	}
+
+	document, modified, err := renderer.Render(namespacedPath, links)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		return
+	} else if err == sandbox.ErrSymlink {
+		responses.Error(w, http.StatusForbidden, "path must not contain symbolic links")
+		return
+	} else if err == storage.ErrLocked {
+		responses.Error(w, http.StatusLocked, "files are locked until their owner logs in")
+		return
+	} else if err == render.ErrUnsupported {
+		responses.Error(w, http.StatusUnsupportedMediaType, "only markdown, text and html files can be rendered")
+		return
+	} else if err == render.ErrTooLarge {
+		responses.Error(w, http.StatusRequestEntityTooLarge, "file is too large to render")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to render file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to render file")
+		return
+	}
+
+	// Nothing in the document is allowed to run even if something slips through
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, path.Base(namespacedPath)+".html", modified, bytes.NewReader(document))
+}
@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/fulltext"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/search"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Routes for searching a user's files
+// Must be registered before the file routes so it takes precedence. Searches are only picked when
+// given their own parameters, so a file named search can still be reached without them.
+func Search(index *search.Index, contents *fulltext.Index, router *mux.Router) {
+	router.HandleFunc("/files/search", searchFiles(index)).Methods(http.MethodGet).MatcherFunc(hasParameter("name", "path", "extension", "type", "min_size", "max_size", "modified_after", "modified_before"))
+	router.HandleFunc("/files/search/content", searchContents(contents)).Methods(http.MethodGet).MatcherFunc(hasParameter("q"))
+}
+
+// Match requests with any of the query parameters, even if empty
+func hasParameter(names ...string) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		values := r.URL.Query()
+		for _, name := range names {
+			if _, ok := values[name]; ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Find files by name and metadata
+func searchFiles(index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		// Parse query parameters
+		values := r.URL.Query()
+		query := search.Query{
+			User:       r.Header.Get("X-BPI-Username"),
+			Name:       values.Get("name"),
+			Scope:      values.Get("path"),
+			Extensions: splitList(values.Get("extension")),
+			Types:      splitList(values.Get("type")),
+			Sort:       values.Get("sort"),
+			Descending: values.Get("order") == "desc",
+		}
+		for _, param := range []struct {
+			name  string
+			value *int64
+		}{
+			{"min_size", &query.MinSize},
+			{"max_size", &query.MaxSize},
+			{"modified_after", &query.ModifiedAfter},
+			{"modified_before", &query.ModifiedBefore},
+		} {
+			if !parseInt64(w, values.Get(param.name), param.name, param.value) {
+				return
+			}
+		}
+		for _, param := range []struct {
+			name  string
+			value *int
+		}{
+			{"limit", &query.Limit},
+			{"offset", &query.Offset},
+		} {
+			var value int64
+			if !parseInt64(w, values.Get(param.name), param.name, &value) {
+				return
+			}
+			*param.value = int(value)
+		}
+
+		// Validate sorting
+		if query.Sort != "" && query.Sort != "name" && query.Sort != "size" && query.Sort != "modified" && query.Sort != "path" {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'sort' must be one of 'name', 'size', 'modified', or 'path'")
+			return
+		}
+
+		results, total, err := index.Search(query)
+		if err == search.ErrDisabled {
+			responses.Error(w, http.StatusNotImplemented, "search is unavailable while files are encrypted")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to query search index: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		// Send empty array instead of null
+		if results == nil {
+			results = []search.Entry{}
+		}
+
+		responses.SuccessWithData(w, map[string]interface{}{
+			"total":   total,
+			"results": results,
+		})
+	}
+}
+
+// Find files containing text
+func searchContents(contents *fulltext.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validate initial request on method and query parameters
+		values := r.URL.Query()
+		if r.Method != http.MethodGet {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if values.Get("q") == "" {
+			responses.Error(w, http.StatusBadRequest, "query parameter 'q' must be present")
+			return
+		}
+
+		// Parse pagination
+		var limit, offset int64 = 20, 0
+		if !parseInt64(w, values.Get("limit"), "limit", &limit) || !parseInt64(w, values.Get("offset"), "offset", &offset) {
+			return
+		}
+
+		hits, total, err := contents.Search(r.Header.Get("X-BPI-Username"), values.Get("path"), values.Get("q"), int(limit), int(offset))
+		if err == fulltext.ErrDisabled {
+			responses.Error(w, http.StatusNotImplemented, "full-text search is unavailable while files are encrypted")
+			return
+		} else if err != nil {
+			log.Printf("ERROR: failed to query full-text index: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		responses.SuccessWithData(w, map[string]interface{}{
+			"total":   total,
+			"results": hits,
+		})
+	}
+}
+
+// Parse an optional non-negative integer query parameter
+func parseInt64(w http.ResponseWriter, raw, name string, value *int64) bool {
+	if raw == "" {
+		return true
+	}
+
+	parsed, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || parsed < 0 {
+		responses.Error(w, http.StatusBadRequest, "query parameter '"+name+"' must be a non-negative integer")
+		return false
+	}
+
+	*value = parsed
+	return true
+}
+
+// Split a comma-separated query parameter
+func splitList(raw string) []string {
+	var values []string
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
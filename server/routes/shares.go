@@ -2,33 +2,36 @@ package routes
 
 import (
 	"encoding/json"
+	"github.com/akrantz01/bookpi/server/activity"
 	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/render"
 	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
 	"github.com/gorilla/mux"
 	bolt "go.etcd.io/bbolt"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
 )
 
-func Shares(filesDirectory string, db *bolt.DB, router *mux.Router) {
+func Shares(files storage.Storage, feed *activity.Feed, renderer *render.Cache, db *bolt.DB, router *mux.Router) {
 	subrouter := router.PathPrefix("/shares").Subrouter()
 
-	subrouter.HandleFunc("", allShares(filesDirectory, db))
-	subrouter.PathPrefix("/{user}/").HandlerFunc(specificShare(filesDirectory, db))
+	subrouter.HandleFunc("", allShares(files, feed, db))
+	subrouter.PathPrefix("/{user}/").HandlerFunc(specificShare(files, feed, renderer, db))
 }
 
 // Operate on all a user's shares
-func allShares(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func allShares(files storage.Storage, feed *activity.Feed, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			listShares(w, r, db)
 
 		case http.MethodPost:
-			createShare(w, r, filesDirectory, db)
+			createShare(w, r, files, feed, db)
 
 		default:
 			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -37,14 +40,14 @@ func allShares(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r
 }
 
 // Operate on a specific user's share
-func specificShare(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func specificShare(files storage.Storage, feed *activity.Feed, renderer *render.Cache, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			downloadShare(w, r, filesDirectory, db)
+			downloadShare(w, r, files, renderer, db)
 
 		case http.MethodDelete:
-			deleteShare(w, r, db)
+			deleteShare(w, r, feed, db)
 
 		default:
 			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -53,7 +56,7 @@ func specificShare(filesDirectory string, db *bolt.DB) func(w http.ResponseWrite
 }
 
 // Create a link shared file
-func createShare(w http.ResponseWriter, r *http.Request, filesDirectory string, db *bolt.DB) {
+func createShare(w http.ResponseWriter, r *http.Request, files storage.Storage, feed *activity.Feed, db *bolt.DB) {
 	// Validate initial request on headers and body existence
 	if r.Header.Get("Content-Type") != "application/json" {
 		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
@@ -77,11 +80,13 @@ func createShare(w http.ResponseWriter, r *http.Request, filesDirectory string,
 	}
 
 	// Create the path
-	namespacedPath := filepath.Join(r.Header.Get("X-BPI-Username"), strings.Replace(body.File, "../", "", -1))
-	path := filepath.Join(filesDirectory, namespacedPath)
+	namespacedPath, ok := resolvePath(w, files, r.Header.Get("X-BPI-Username"), body.File)
+	if !ok {
+		return
+	}
 
 	// Ensure requested file exists
-	if info, err := os.Stat(path); os.IsNotExist(err) {
+	if info, err := files.Stat(namespacedPath); os.IsNotExist(err) {
 		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
 		return
 	} else if info.IsDir() {
@@ -141,6 +146,7 @@ func createShare(w http.ResponseWriter, r *http.Request, filesDirectory string,
 		return
 	}
 
+	feed.Record(activity.ShareCreated, r.Header.Get("X-BPI-Username"), []string{body.To}, activity.Entry{Path: strings.SplitN(namespacedPath, "/", 2)[1]})
 	responses.Success(w)
 }
 
@@ -164,7 +170,7 @@ func listShares(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 }
 
 // Download a shared file
-func downloadShare(w http.ResponseWriter, r *http.Request, filesDirectory string, db *bolt.DB) {
+func downloadShare(w http.ResponseWriter, r *http.Request, files storage.Storage, renderer *render.Cache, db *bolt.DB) {
 	// Validate initial request on method and path parameters
 	vars := mux.Vars(r)
 	if r.Method != http.MethodGet {
@@ -176,16 +182,8 @@ func downloadShare(w http.ResponseWriter, r *http.Request, filesDirectory string
 	}
 
 	// Assemble paths
-	namespacedPath := filepath.Join(vars["user"], strings.TrimPrefix(r.URL.Path, "/api/shares/"+vars["user"]))
-	path := filepath.Join(filesDirectory, namespacedPath)
-
-	// Ensure path exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
-		return
-	} else if err != nil {
-		log.Printf("ERROR: failed to check for file existence: %v\n", err)
-		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+	namespacedPath, ok := resolvePath(w, files, vars["user"], strings.TrimPrefix(r.URL.Path, "/api/shares/"+vars["user"]))
+	if !ok {
 		return
 	}
 
@@ -195,6 +193,20 @@ func downloadShare(w http.ResponseWriter, r *http.Request, filesDirectory string
 		log.Printf("ERROR: failed to query database for share existence: %v\n", err)
 		responses.Error(w, http.StatusInternalServerError, "failed to query database")
 		return
+	}
+
+	// Ensure path exists
+	if _, err := files.Stat(namespacedPath); os.IsNotExist(err) {
+		if share != nil && share.Missing {
+			responses.Error(w, http.StatusGone, "shared file no longer exists")
+		} else {
+			responses.Error(w, http.StatusNotFound, "specified file/directory does not exist")
+		}
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to check for file existence: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
 	} else if share == nil {
 		responses.Error(w, http.StatusNotFound, "specified share does not exist")
 		return
@@ -225,11 +237,17 @@ func downloadShare(w http.ResponseWriter, r *http.Request, filesDirectory string
 		return
 	}
 
-	http.ServeFile(w, r, path)
+	// Render documents if query param
+	if r.URL.Query().Get("render") != "" {
+		serveRendered(w, r, namespacedPath, renderer, render.Links{Root: "/api/shares/" + vars["user"]})
+		return
+	}
+
+	serveFile(w, r, files, namespacedPath)
 }
 
 // Delete the entire share or a specific user from a share
-func deleteShare(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
+func deleteShare(w http.ResponseWriter, r *http.Request, feed *activity.Feed, db *bolt.DB) {
 	// Validate initial request on path parameters
 	vars := mux.Vars(r)
 	if _, ok := vars["user"]; !ok {
@@ -244,7 +262,8 @@ func deleteShare(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 	}
 
 	// Assemble paths
-	namespacedPath := filepath.Join(vars["user"], strings.TrimPrefix(r.URL.Path, "/api/shares/"+vars["user"]))
+	relativePath := strings.TrimPrefix(r.URL.Path, "/api/shares/"+vars["user"]+"/")
+	namespacedPath := path.Join(vars["user"], relativePath)
 
 	// Ensure share exists
 	share, err := models.FindShare(namespacedPath, db)
@@ -268,6 +287,7 @@ func deleteShare(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 			return
 		}
 
+		feed.Record(activity.ShareRevoked, vars["user"], []string{user}, activity.Entry{Path: relativePath})
 		responses.Success(w)
 		return
 	}
@@ -279,5 +299,6 @@ func deleteShare(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 		return
 	}
 
+	feed.Record(activity.ShareRevoked, vars["user"], share.To, activity.Entry{Path: relativePath})
 	responses.Success(w)
 }
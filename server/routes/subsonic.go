@@ -0,0 +1,570 @@
+package routes
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"github.com/akrantz01/bookpi/server/music"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const subsonicVersion = "1.16.1"
+
+// Error codes understood by Subsonic clients
+const (
+	subsonicGeneric          = 0
+	subsonicMissingParameter = 10
+	subsonicWrongCredentials = 40
+	subsonicTokenUnsupported = 41
+	subsonicNotFound         = 70
+)
+
+// The envelope of every Subsonic response, holding only the part for the called method
+type subsonicResponse struct {
+	XMLName xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns   string   `xml:"xmlns,attr" json:"-"`
+	Status  string   `xml:"status,attr" json:"status"`
+	Version string   `xml:"version,attr" json:"version"`
+	Type    string   `xml:"type,attr" json:"type"`
+
+	Error         *subsonicError        `xml:"error" json:"error,omitempty"`
+	License       *subsonicLicense      `xml:"license" json:"license,omitempty"`
+	MusicFolders  *subsonicMusicFolders `xml:"musicFolders" json:"musicFolders,omitempty"`
+	Indexes       *subsonicIndexes      `xml:"indexes" json:"indexes,omitempty"`
+	Artists       *subsonicIndexes      `xml:"artists" json:"artists,omitempty"`
+	Artist        *subsonicArtist       `xml:"artist" json:"artist,omitempty"`
+	Album         *subsonicAlbum        `xml:"album" json:"album,omitempty"`
+	SearchResult3 *subsonicSearchResult `xml:"searchResult3" json:"searchResult3,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicMusicFolders struct {
+	Folders []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	Id   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicIndexes struct {
+	LastModified    int64           `xml:"lastModified,attr,omitempty" json:"lastModified,omitempty"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Indexes         []subsonicIndex `xml:"index" json:"index"`
+}
+
+type subsonicIndex struct {
+	Name    string           `xml:"name,attr" json:"name"`
+	Artists []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtist struct {
+	Id         string          `xml:"id,attr" json:"id"`
+	Name       string          `xml:"name,attr" json:"name"`
+	CoverArt   string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int             `xml:"albumCount,attr" json:"albumCount"`
+	Albums     []subsonicAlbum `xml:"album" json:"album,omitempty"`
+}
+
+type subsonicAlbum struct {
+	Id        string         `xml:"id,attr" json:"id"`
+	Name      string         `xml:"name,attr" json:"name"`
+	Artist    string         `xml:"artist,attr" json:"artist"`
+	ArtistId  string         `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string         `xml:"coverArt,attr" json:"coverArt"`
+	SongCount int            `xml:"songCount,attr" json:"songCount"`
+	Duration  int            `xml:"duration,attr" json:"duration"`
+	Created   string         `xml:"created,attr" json:"created"`
+	Year      int            `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string         `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Songs     []subsonicSong `xml:"song" json:"song,omitempty"`
+}
+
+type subsonicSong struct {
+	Id          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr" json:"parent"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr" json:"album"`
+	Artist      string `xml:"artist,attr" json:"artist"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string `xml:"coverArt,attr" json:"coverArt"`
+	Size        int64  `xml:"size,attr" json:"size"`
+	ContentType string `xml:"contentType,attr" json:"contentType"`
+	Suffix      string `xml:"suffix,attr" json:"suffix"`
+	Duration    int    `xml:"duration,attr" json:"duration"`
+	BitRate     int    `xml:"bitRate,attr" json:"bitRate"`
+	Path        string `xml:"path,attr" json:"path"`
+	Created     string `xml:"created,attr" json:"created"`
+	AlbumId     string `xml:"albumId,attr" json:"albumId"`
+	ArtistId    string `xml:"artistId,attr" json:"artistId"`
+	Type        string `xml:"type,attr" json:"type"`
+}
+
+type subsonicSearchResult struct {
+	Artists []subsonicArtist `xml:"artist" json:"artist,omitempty"`
+	Albums  []subsonicAlbum  `xml:"album" json:"album,omitempty"`
+	Songs   []subsonicSong   `xml:"song" json:"song,omitempty"`
+}
+
+// Expose each user's music through a subset of the Subsonic API for mobile players
+func Subsonic(files storage.Storage, keys *encryption.Keyring, tracks *music.Library, db *bolt.DB, router *mux.Router) {
+	router.PathPrefix("/rest/").HandlerFunc(subsonicRouter(files, keys, tracks, db))
+}
+
+// Authenticate the request and dispatch it to the called method
+func subsonicRouter(files storage.Storage, keys *encryption.Keyring, tracks *music.Library, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, release, ok := subsonicAuthenticate(w, r, keys, db)
+		if !ok {
+			return
+		}
+		defer release()
+
+		switch strings.TrimSuffix(path.Base(r.URL.Path), ".view") {
+		case "ping":
+			writeSubsonic(w, r, &subsonicResponse{})
+		case "getLicense":
+			writeSubsonic(w, r, &subsonicResponse{License: &subsonicLicense{Valid: true}})
+		case "getMusicFolders":
+			writeSubsonic(w, r, &subsonicResponse{MusicFolders: &subsonicMusicFolders{
+				Folders: []subsonicMusicFolder{{Id: 1, Name: "Music"}},
+			}})
+		case "getIndexes":
+			subsonicGetIndexes(w, r, tracks, username, false)
+		case "getArtists":
+			subsonicGetIndexes(w, r, tracks, username, true)
+		case "getArtist":
+			subsonicGetArtist(w, r, tracks, username)
+		case "getAlbum":
+			subsonicGetAlbum(w, r, tracks, username)
+		case "search3":
+			subsonicSearch(w, r, tracks, username)
+		case "stream", "download":
+			subsonicStream(w, r, files, tracks, username)
+		case "getCoverArt":
+			subsonicGetCoverArt(w, r, tracks, username)
+		default:
+			writeSubsonicError(w, r, subsonicNotFound, "method not supported")
+		}
+	}
+}
+
+// Authenticate with the username and password from the query or basic auth, holding the
+// user's key until released
+func subsonicAuthenticate(w http.ResponseWriter, r *http.Request, keys *encryption.Keyring, db *bolt.DB) (string, func(), bool) {
+	username, password := r.FormValue("u"), r.FormValue("p")
+	if username == "" && password == "" {
+		username, password, _ = r.BasicAuth()
+	}
+
+	// Salted tokens need the password in plain text which is never stored
+	if password == "" && r.FormValue("t") != "" {
+		writeSubsonicError(w, r, subsonicTokenUnsupported, "token authentication is not supported, use a password or app token")
+		return "", nil, false
+	} else if username == "" || password == "" {
+		writeSubsonicError(w, r, subsonicMissingParameter, "parameters 'u' and 'p' are required")
+		return "", nil, false
+	}
+
+	if strings.HasPrefix(password, "enc:") {
+		decoded, err := hex.DecodeString(strings.TrimPrefix(password, "enc:"))
+		if err != nil {
+			writeSubsonicError(w, r, subsonicWrongCredentials, "wrong username or password")
+			return "", nil, false
+		}
+		password = string(decoded)
+	}
+
+	username, key, err := checkCredentials(username, password, keys != nil, db)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for credentials: %v\n", err)
+		writeSubsonicError(w, r, subsonicGeneric, "failed to query database")
+		return "", nil, false
+	} else if username == "" {
+		writeSubsonicError(w, r, subsonicWrongCredentials, "wrong username or password")
+		return "", nil, false
+	}
+	r.Header.Set("X-BPI-Username", username)
+
+	// Hold the user's key for the duration of the request
+	if key == nil {
+		return username, func() {}, true
+	}
+	keys.Acquire(username, key)
+	return username, func() { keys.Release(username) }, true
+}
+
+// Get the user's artists grouped by their first letter
+func subsonicGetIndexes(w http.ResponseWriter, r *http.Request, tracks *music.Library, username string, id3 bool) {
+	artists, ok := subsonicCatalog(w, r, tracks, username)
+	if !ok {
+		return
+	}
+
+	indexes := &subsonicIndexes{IgnoredArticles: music.IgnoredArticles(), Indexes: []subsonicIndex{}}
+	if !id3 {
+		// Clients only refresh the index when something changed since they last fetched it
+		for _, artist := range artists {
+			for _, album := range artist.Albums {
+				if modified := album.Modified / int64(time.Millisecond); modified > indexes.LastModified {
+					indexes.LastModified = modified
+				}
+			}
+		}
+
+		var since int64
+		if raw := r.FormValue("ifModifiedSince"); raw != "" {
+			since, _ = strconv.ParseInt(raw, 10, 64)
+		}
+		if since > 0 && indexes.LastModified <= since {
+			writeSubsonic(w, r, &subsonicResponse{Indexes: indexes})
+			return
+		}
+	}
+
+	for _, artist := range artists {
+		name := "#"
+		if sortName := []rune(music.SortName(artist.Name)); len(sortName) > 0 && unicode.IsLetter(sortName[0]) {
+			name = string(unicode.ToUpper(sortName[0]))
+		}
+
+		if len(indexes.Indexes) == 0 || indexes.Indexes[len(indexes.Indexes)-1].Name != name {
+			indexes.Indexes = append(indexes.Indexes, subsonicIndex{Name: name})
+		}
+		last := &indexes.Indexes[len(indexes.Indexes)-1]
+		last.Artists = append(last.Artists, subsonicArtistEntry(artist, false))
+	}
+
+	if id3 {
+		writeSubsonic(w, r, &subsonicResponse{Artists: indexes})
+	} else {
+		writeSubsonic(w, r, &subsonicResponse{Indexes: indexes})
+	}
+}
+
+// Get an artist with their albums
+func subsonicGetArtist(w http.ResponseWriter, r *http.Request, tracks *music.Library, username string) {
+	artists, ok := subsonicCatalog(w, r, tracks, username)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	for _, artist := range artists {
+		if artist.Id == id {
+			entry := subsonicArtistEntry(artist, true)
+			writeSubsonic(w, r, &subsonicResponse{Artist: &entry})
+			return
+		}
+	}
+	writeSubsonicError(w, r, subsonicNotFound, "artist not found")
+}
+
+// Get an album with its songs
+func subsonicGetAlbum(w http.ResponseWriter, r *http.Request, tracks *music.Library, username string) {
+	artists, ok := subsonicCatalog(w, r, tracks, username)
+	if !ok {
+		return
+	}
+
+	if album := findAlbum(artists, r.FormValue("id")); album != nil {
+		entry := subsonicAlbumEntry(album, true)
+		writeSubsonic(w, r, &subsonicResponse{Album: &entry})
+		return
+	}
+	writeSubsonicError(w, r, subsonicNotFound, "album not found")
+}
+
+// Search artists, albums and songs by name, returning everything for an empty query
+func subsonicSearch(w http.ResponseWriter, r *http.Request, tracks *music.Library, username string) {
+	artists, ok := subsonicCatalog(w, r, tracks, username)
+	if !ok {
+		return
+	}
+
+	query := strings.ToLower(strings.Trim(strings.TrimSpace(r.FormValue("query")), `"`))
+	matches := func(values ...string) bool {
+		for _, value := range values {
+			if strings.Contains(strings.ToLower(value), query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Each kind of result is paged separately
+	page := func(kind string, total int) (int, int) {
+		count, offset := 20, 0
+		if raw, err := strconv.Atoi(r.FormValue(kind + "Count")); err == nil && raw >= 0 {
+			count = raw
+		}
+		if raw, err := strconv.Atoi(r.FormValue(kind + "Offset")); err == nil && raw >= 0 {
+			offset = raw
+		}
+		if offset > total {
+			offset = total
+		}
+		if offset+count > total {
+			count = total - offset
+		}
+		return offset, offset + count
+	}
+
+	result := &subsonicSearchResult{}
+	var albums []*music.Album
+	var songs []*music.Track
+	for _, artist := range artists {
+		if matches(artist.Name) {
+			result.Artists = append(result.Artists, subsonicArtistEntry(artist, false))
+		}
+		for _, album := range artist.Albums {
+			if matches(album.Name, album.Artist) {
+				albums = append(albums, album)
+			}
+			for _, track := range album.Tracks {
+				if matches(track.Title, track.Artist, track.Album) {
+					songs = append(songs, track)
+				}
+			}
+		}
+	}
+
+	start, end := page("artist", len(result.Artists))
+	result.Artists = result.Artists[start:end]
+
+	start, end = page("album", len(albums))
+	for _, album := range albums[start:end] {
+		result.Albums = append(result.Albums, subsonicAlbumEntry(album, false))
+	}
+
+	start, end = page("song", len(songs))
+	for _, track := range songs[start:end] {
+		result.Songs = append(result.Songs, subsonicSongEntry(track))
+	}
+
+	writeSubsonic(w, r, &subsonicResponse{SearchResult3: result})
+}
+
+// Stream a song without transcoding, supporting range requests for seeking
+func subsonicStream(w http.ResponseWriter, r *http.Request, files storage.Storage, tracks *music.Library, username string) {
+	artists, ok := subsonicCatalog(w, r, tracks, username)
+	if !ok {
+		return
+	}
+
+	track := findTrack(artists, r.FormValue("id"))
+	if track == nil {
+		writeSubsonicError(w, r, subsonicNotFound, "song not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", track.ContentType())
+	serveFile(w, r, files, track.Path)
+}
+
+// Get the cover of an album, song or artist
+func subsonicGetCoverArt(w http.ResponseWriter, r *http.Request, tracks *music.Library, username string) {
+	artists, ok := subsonicCatalog(w, r, tracks, username)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	track := findTrack(artists, id)
+	if album := findAlbum(artists, id); album != nil {
+		track = album.CoverTrack()
+	}
+	for _, artist := range artists {
+		if artist.Id == id {
+			track = artist.Albums[0].CoverTrack()
+		}
+	}
+	if track == nil {
+		writeSubsonicError(w, r, subsonicNotFound, "cover art not found")
+		return
+	}
+
+	picture, contentType, err := tracks.Cover(track)
+	if err == music.ErrNoCover {
+		writeSubsonicError(w, r, subsonicNotFound, "cover art not found")
+		return
+	} else if err == storage.ErrLocked {
+		writeSubsonicError(w, r, subsonicGeneric, "files are locked until their owner logs in")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to read cover art: %v\n", err)
+		writeSubsonicError(w, r, subsonicGeneric, "failed to read cover art")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if _, err := w.Write(picture); err != nil {
+		log.Printf("ERROR: failed to write cover art: %v\n", err)
+	}
+}
+
+// Get the user's music grouped by artist and album, responding with an error if it cannot be read
+func subsonicCatalog(w http.ResponseWriter, r *http.Request, tracks *music.Library, username string) ([]*music.Artist, bool) {
+	found, err := tracks.Tracks(username)
+	if err == music.ErrDisabled {
+		writeSubsonicError(w, r, subsonicGeneric, "the music library is unavailable while files are encrypted")
+		return nil, false
+	} else if err != nil {
+		log.Printf("ERROR: failed to query music library: %v\n", err)
+		writeSubsonicError(w, r, subsonicGeneric, "failed to query database")
+		return nil, false
+	}
+	return music.Catalog(found), true
+}
+
+// Find an album by its id
+func findAlbum(artists []*music.Artist, id string) *music.Album {
+	for _, artist := range artists {
+		for _, album := range artist.Albums {
+			if album.Id == id {
+				return album
+			}
+		}
+	}
+	return nil
+}
+
+// Find a track by its id
+func findTrack(artists []*music.Artist, id string) *music.Track {
+	for _, artist := range artists {
+		for _, album := range artist.Albums {
+			for _, track := range album.Tracks {
+				if track.Id() == id {
+					return track
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Describe an artist, optionally with their albums
+func subsonicArtistEntry(artist *music.Artist, withAlbums bool) subsonicArtist {
+	entry := subsonicArtist{
+		Id:         artist.Id,
+		Name:       artist.Name,
+		CoverArt:   artist.Albums[0].Id,
+		AlbumCount: len(artist.Albums),
+	}
+	if withAlbums {
+		for _, album := range artist.Albums {
+			entry.Albums = append(entry.Albums, subsonicAlbumEntry(album, false))
+		}
+	}
+	return entry
+}
+
+// Describe an album, optionally with its songs
+func subsonicAlbumEntry(album *music.Album, withSongs bool) subsonicAlbum {
+	entry := subsonicAlbum{
+		Id:        album.Id,
+		Name:      album.Name,
+		Artist:    album.Artist,
+		ArtistId:  album.ArtistId,
+		CoverArt:  album.Id,
+		SongCount: len(album.Tracks),
+		Duration:  album.Duration,
+		Created:   subsonicTime(album.Modified),
+		Year:      album.Year,
+		Genre:     album.Genre,
+	}
+	if withSongs {
+		for _, track := range album.Tracks {
+			entry.Songs = append(entry.Songs, subsonicSongEntry(track))
+		}
+	}
+	return entry
+}
+
+// Describe a song
+func subsonicSongEntry(track *music.Track) subsonicSong {
+	coverArt := track.AlbumId()
+	if track.HasCover {
+		coverArt = track.Id()
+	}
+
+	return subsonicSong{
+		Id:          track.Id(),
+		Parent:      track.AlbumId(),
+		Title:       track.Title,
+		Album:       track.Album,
+		Artist:      track.Artist,
+		Track:       track.Track,
+		DiscNumber:  track.Disc,
+		Year:        track.Year,
+		Genre:       track.Genre,
+		CoverArt:    coverArt,
+		Size:        track.Size,
+		ContentType: track.ContentType(),
+		Suffix:      track.Suffix(),
+		Duration:    track.Duration,
+		BitRate:     track.BitRate,
+		Path:        track.RelativePath(),
+		Created:     subsonicTime(track.Modified),
+		AlbumId:     track.AlbumId(),
+		ArtistId:    track.ArtistId(),
+		Type:        "music",
+	}
+}
+
+// Format a modification time the way Subsonic clients expect
+func subsonicTime(modified int64) string {
+	return time.Unix(0, modified).UTC().Format(time.RFC3339)
+}
+
+// Send a Subsonic error, which is always a successful HTTP response
+func writeSubsonicError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	writeSubsonic(w, r, &subsonicResponse{Status: "failed", Error: &subsonicError{Code: code, Message: message}})
+}
+
+// Send a Subsonic response in the format the client asked for
+func writeSubsonic(w http.ResponseWriter, r *http.Request, response *subsonicResponse) {
+	response.Xmlns = "http://subsonic.org/restapi"
+	response.Version = subsonicVersion
+	response.Type = "bookpi"
+	if response.Status == "" {
+		response.Status = "ok"
+	}
+
+	var err error
+	if r.FormValue("f") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]interface{}{"subsonic-response": response})
+	} else {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		if _, err = w.Write([]byte(xml.Header)); err == nil {
+			err = xml.NewEncoder(w).Encode(response)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to encode subsonic response: %v\n", err)
+	}
+}
@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/thumbnails"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Send a scaled down preview of an image
+func serveThumbnail(w http.ResponseWriter, r *http.Request, namespacedPath string, thumbs *thumbnails.Cache) {
+	// Validate the requested size
+	size, err := strconv.Atoi(r.URL.Query().Get("thumbnail"))
+	if err != nil || !thumbnails.ValidSize(size) {
+		responses.Error(w, http.StatusBadRequest, "query parameter 'thumbnail' must be one of 64, 128, 256, or 512")
+		return
+	}
+
+	thumbnail, err := thumbs.Open(namespacedPath, size)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file does not exist")
+		return
+	} else if err == thumbnails.ErrUnsupported || err == image.ErrFormat {
+		responses.Error(w, http.StatusUnsupportedMediaType, "cannot generate thumbnail for file")
+		return
+	} else if err == thumbnails.ErrBusy {
+		w.Header().Set("Retry-After", "5")
+		responses.Error(w, http.StatusServiceUnavailable, "too many thumbnails being generated")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to generate thumbnail: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to generate thumbnail")
+		return
+	}
+
+	defer thumbnail.Close()
+
+	info, err := thumbnail.Stat()
+	if err != nil {
+		log.Printf("ERROR: failed to stat thumbnail: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to generate thumbnail")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, path.Base(namespacedPath)+".jpg", info.ModTime(), thumbnail)
+}
+
+// Get the URL of a file's listing thumbnail if it has one
+func thumbnailURL(directoryURL, name string) interface{} {
+	if !thumbnails.Supported(name) {
+		return nil
+	}
+
+	return path.Join(directoryURL, name) + "?thumbnail=" + strconv.Itoa(thumbnails.DefaultSize)
+}
@@ -0,0 +1,178 @@
+package routes
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+)
+
+// Routes for managing app tokens used by WebDAV clients
+func Tokens(keys *encryption.Keyring, db *bolt.DB, router *mux.Router) {
+	subrouter := router.PathPrefix("/tokens").Subrouter()
+
+	subrouter.HandleFunc("", allTokens(keys, db))
+	subrouter.HandleFunc("/{id}", deleteToken(db))
+}
+
+// Operate on all a user's tokens
+func allTokens(keys *encryption.Keyring, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listTokens(w, r, db)
+
+		case http.MethodPost:
+			createToken(w, r, keys, db)
+
+		default:
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Get a description of all a user's tokens
+func listTokens(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
+	user, err := models.FindUser(r.Header.Get("X-BPI-Username"), db)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for user: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	}
+
+	tokens := []map[string]interface{}{}
+	for _, id := range user.Tokens {
+		token, err := models.FindToken(id, db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for token: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if token == nil {
+			continue
+		}
+
+		tokens = append(tokens, map[string]interface{}{
+			"id":      token.Id,
+			"name":    token.Name,
+			"created": token.Created,
+		})
+	}
+
+	responses.SuccessWithData(w, tokens)
+}
+
+// Create a new token, returning its secret
+func createToken(w http.ResponseWriter, r *http.Request, keys *encryption.Keyring, db *bolt.DB) {
+	// Validate initial request on headers and body existence
+	if r.Header.Get("Content-Type") != "application/json" {
+		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
+		return
+	} else if r.Body == nil {
+		responses.Error(w, http.StatusBadRequest, "request body must be present")
+		return
+	}
+
+	// Parse and validate body fields
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		responses.Error(w, http.StatusBadRequest, "invalid json format for request body")
+		return
+	} else if body.Name == "" {
+		responses.Error(w, http.StatusBadRequest, "field 'name' is required")
+		return
+	}
+
+	user, err := models.FindUser(r.Header.Get("X-BPI-Username"), db)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for user: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	}
+
+	// Save the token and associate it with the user
+	token, secret := models.NewToken(body.Name, user.Username)
+
+	// Allow the token to unlock the user's files
+	if keys != nil {
+		if key := keys.Key(user.Username); key != nil {
+			if err := token.SetKey(key, secret); err != nil {
+				log.Printf("ERROR: failed to wrap user file key for token: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to wrap key")
+				return
+			}
+		}
+	}
+
+	if err := token.Save(db); err != nil {
+		log.Printf("ERROR: failed to write token to database: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+		return
+	}
+	user.AddToken(token.Id)
+	if err := user.Save(db); err != nil {
+		log.Printf("ERROR: failed to write user updates to database: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+		return
+	}
+
+	responses.SuccessWithData(w, map[string]interface{}{
+		"id":      token.Id,
+		"name":    token.Name,
+		"created": token.Created,
+		"token":   secret,
+	})
+}
+
+// Revoke a token
+func deleteToken(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validate initial request on method and path parameters
+		vars := mux.Vars(r)
+		if r.Method != http.MethodDelete {
+			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		} else if _, ok := vars["id"]; !ok {
+			responses.Error(w, http.StatusBadRequest, "path parameter 'id' must be present")
+			return
+		}
+
+		// Only allow the owner to revoke the token
+		token, err := models.FindToken(vars["id"], db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for token: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		} else if token == nil || token.Username != r.Header.Get("X-BPI-Username") {
+			responses.Error(w, http.StatusNotFound, "specified token does not exist")
+			return
+		}
+
+		user, err := models.FindUser(token.Username, db)
+		if err != nil {
+			log.Printf("ERROR: failed to query database for user: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to query database")
+			return
+		}
+
+		if err := token.Delete(db); err != nil {
+			log.Printf("ERROR: failed to delete token from database: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to delete from database")
+			return
+		}
+		forgetCredentials(token.Username)
+		user.RemoveToken(token.Id)
+		if err := user.Save(db); err != nil {
+			log.Printf("ERROR: failed to write user updates to database: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to write to database")
+			return
+		}
+
+		responses.Success(w)
+	}
+}
@@ -3,9 +3,13 @@ package routes
 import (
 	"encoding/base64"
 	"encoding/json"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"github.com/akrantz01/bookpi/server/events"
 	"github.com/akrantz01/bookpi/server/hash"
 	"github.com/akrantz01/bookpi/server/models"
 	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
 	"github.com/gorilla/mux"
 	bolt "go.etcd.io/bbolt"
 	"log"
@@ -15,15 +19,15 @@ import (
 )
 
 // Routes for user management
-func Users(filesDirectory string, db *bolt.DB, router *mux.Router) {
+func Users(files storage.Storage, keys *encryption.Keyring, store *versions.Store, bus *events.Bus, db *bolt.DB, router *mux.Router) {
 	subrouter := router.PathPrefix("/user").Subrouter()
 
-	subrouter.HandleFunc("", selfUser(filesDirectory, db))
+	subrouter.HandleFunc("", selfUser(files, keys, store, bus, db))
 	subrouter.HandleFunc("/{username}", readUser("", db))
 }
 
 // Operate on the user in the session
-func selfUser(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func selfUser(files storage.Storage, keys *encryption.Keyring, store *versions.Store, bus *events.Bus, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve user from session
 		id, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-BPI-Session-Id"))
@@ -39,10 +43,10 @@ func selfUser(filesDirectory string, db *bolt.DB) func(w http.ResponseWriter, r
 			readUser(session.User.Username, db)(w, r)
 
 		case http.MethodPut:
-			updateUser(w, r, session, db)
+			updateUser(w, r, session, keys, db)
 
 		case http.MethodDelete:
-			deleteUser(w, r, session, filesDirectory, db)
+			deleteUser(w, r, session, files, keys, store, bus, db)
 
 		default:
 			responses.Error(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -80,7 +84,7 @@ func readUser(user string, db *bolt.DB) func(w http.ResponseWriter, r *http.Requ
 }
 
 // Update a user's name or password
-func updateUser(w http.ResponseWriter, r *http.Request, session *models.Session, db *bolt.DB) {
+func updateUser(w http.ResponseWriter, r *http.Request, session *models.Session, keys *encryption.Keyring, db *bolt.DB) {
 	if r.Header.Get("Content-Type") != "application/json" {
 		responses.Error(w, http.StatusBadRequest, "header 'Content-Type' must be 'application/json'")
 		return
@@ -132,6 +136,22 @@ func updateUser(w http.ResponseWriter, r *http.Request, session *models.Session,
 		}
 
 		session.User.Password = h
+		if err := session.User.SetSyncKey(body.Password); err != nil {
+			log.Printf("ERROR: failed to hash user sync key: %v\n", err)
+			responses.Error(w, http.StatusInternalServerError, "failed to hash password")
+			return
+		}
+
+		// Rewrap the key for the user's files with the new password
+		if keys != nil {
+			if key := keys.Key(session.User.Username); key != nil {
+				if err := session.User.SetKey(key, body.Password); err != nil {
+					log.Printf("ERROR: failed to rewrap user file key: %v\n", err)
+					responses.Error(w, http.StatusInternalServerError, "failed to rewrap key")
+					return
+				}
+			}
+		}
 	}
 
 	// Save user to database
@@ -140,12 +160,13 @@ func updateUser(w http.ResponseWriter, r *http.Request, session *models.Session,
 		responses.Error(w, http.StatusInternalServerError, "failed to write to database")
 		return
 	}
+	forgetCredentials(session.User.Username)
 
 	responses.Success(w)
 }
 
 // Delete a user and invalidate their sessions
-func deleteUser(w http.ResponseWriter, r *http.Request, _ *models.Session, filesDirectory string, db *bolt.DB) {
+func deleteUser(w http.ResponseWriter, r *http.Request, _ *models.Session, files storage.Storage, keys *encryption.Keyring, store *versions.Store, bus *events.Bus, db *bolt.DB) {
 	// Get user from database
 	user, err := models.FindUser(r.Header.Get("X-BPI-Username"), db)
 	if err != nil {
@@ -166,6 +187,21 @@ func deleteUser(w http.ResponseWriter, r *http.Request, _ *models.Session, files
 			}
 		}
 
+		// Delete all user's app tokens
+		tokens := tx.Bucket(models.BucketTokens)
+		for _, id := range user.Tokens {
+			if err := tokens.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+
+		// Delete the user's reading progress
+		if progress := tx.Bucket(models.BucketProgress); progress.Bucket([]byte(user.Username)) != nil {
+			if err := progress.DeleteBucket([]byte(user.Username)); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	}); err != nil {
 		log.Printf("ERROR: failed to delete sessions for user from database: %v\n", err)
@@ -174,11 +210,22 @@ func deleteUser(w http.ResponseWriter, r *http.Request, _ *models.Session, files
 	}
 
 	// Delete the user's files
-	if err := os.RemoveAll(filesDirectory + "/" + user.Username); err != nil {
+	if err := files.Remove(user.Username); err != nil && !os.IsNotExist(err) {
 		log.Printf("ERROR: failed to delete user file storage directory: %v\n", err)
 		responses.Error(w, http.StatusInternalServerError, "failed to delete directory")
 		return
 	}
+	bus.Publish(events.New(events.Deleted, user.Username))
+	if keys != nil {
+		keys.Forget(user.Username)
+	}
+
+	// Delete the previous versions of the user's files
+	if err := store.RemoveUser(user.Username); err != nil {
+		log.Printf("ERROR: failed to delete user file versions: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to delete versions")
+		return
+	}
 
 	// Delete the user
 	if err := user.Delete(db); err != nil {
@@ -186,6 +233,7 @@ func deleteUser(w http.ResponseWriter, r *http.Request, _ *models.Session, files
 		responses.Error(w, http.StatusInternalServerError, "failed to delete from database")
 		return
 	}
+	forgetCredentials(user.Username)
 
 	// Set empty cookie
 	http.SetCookie(w, &http.Cookie{
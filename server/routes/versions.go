@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// List the previous versions of a file
+func listVersions(w http.ResponseWriter, _ *http.Request, namespacedPath string, files storage.Storage, store *versions.Store) {
+	// Ensure file exists
+	if info, err := files.Stat(namespacedPath); os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	} else if info.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "directories do not have versions")
+		return
+	}
+
+	history, err := store.List(namespacedPath)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for file versions: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return
+	}
+
+	responses.SuccessWithData(w, history)
+}
+
+// Download a previous version of a file
+func downloadVersion(w http.ResponseWriter, r *http.Request, namespacedPath string, store *versions.Store) {
+	file, version, err := store.Open(namespacedPath, r.URL.Query().Get("version"))
+	if err != nil {
+		log.Printf("ERROR: failed to open file version: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to open version")
+		return
+	} else if file == nil {
+		responses.Error(w, http.StatusNotFound, "specified version does not exist")
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("ERROR: failed to close file version: %v\n", err)
+		}
+	}()
+
+	http.ServeContent(w, r, path.Base(namespacedPath), time.Unix(version.Created, 0), file)
+}
+
+// Replace the current contents of a file with a previous version
+func restoreVersion(w http.ResponseWriter, r *http.Request, namespacedPath string, files storage.Storage, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus) {
+	// Ensure file exists
+	info, err := files.Stat(namespacedPath)
+	if os.IsNotExist(err) {
+		responses.Error(w, http.StatusNotFound, "specified file does not exist")
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to stat file: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	} else if info.IsDir() {
+		responses.Error(w, http.StatusBadRequest, "directories do not have versions")
+		return
+	} else if !unlocked(w, r, fileLocks, false, namespacedPath) {
+		return
+	}
+
+	// Current contents are kept as a new version
+	if ok, err := withinQuota(files, r.Header.Get("X-BPI-Username"), quota, info.Size(), store); err != nil {
+		log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to calculate storage usage")
+		return
+	} else if !ok {
+		responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+		return
+	}
+
+	if found, err := store.Restore(namespacedPath, r.URL.Query().Get("restore")); err != nil {
+		log.Printf("ERROR: failed to restore file version: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to restore version")
+		return
+	} else if !found {
+		responses.Error(w, http.StatusNotFound, "specified version does not exist")
+		return
+	}
+
+	bus.Publish(events.New(events.Modified, namespacedPath))
+	responses.Success(w)
+}
@@ -0,0 +1,632 @@
+package routes
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/integrity"
+	"github.com/akrantz01/bookpi/server/locks"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/responses"
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"github.com/akrantz01/bookpi/server/storage"
+	"github.com/akrantz01/bookpi/server/versions"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errPreconditionFailed = errors.New("file has been modified")
+	errQuotaExceeded      = errors.New("storage quota exceeded")
+)
+
+// Expose each user's files over WebDAV
+func WebDAV(files storage.Storage, keys *encryption.Keyring, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus, sums *integrity.Store, db *bolt.DB, router *mux.Router) {
+	router.PathPrefix("/dav").HandlerFunc(davRouter(files, keys, quota, store, fileLocks, bus, sums, db))
+}
+
+// Authenticate the request and serve it from the user's files
+func davRouter(files storage.Storage, keys *encryption.Keyring, quota int64, store *versions.Store, fileLocks *locks.Store, bus *events.Bus, sums *integrity.Store, db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, release, ok := basicAuthenticate(w, r, keys, db)
+		if !ok {
+			return
+		}
+		defer release()
+
+		fs := &davFileSystem{
+			files:    files,
+			username: username,
+			quota:    quota,
+			store:    store,
+			bus:      bus,
+			sums:     sums,
+			request:  r,
+		}
+
+		// Check uploads up front so clients get the same errors as the file API
+		if r.Method == http.MethodPut {
+			namespacedPath, ok := resolvePath(w, files, username, strings.TrimPrefix(r.URL.Path, "/dav"))
+			if !ok {
+				return
+			}
+			info, err := files.Stat(namespacedPath)
+			if os.IsNotExist(err) {
+				info = nil
+			} else if err != nil {
+				log.Printf("ERROR: failed to stat file: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to stat file")
+				return
+			}
+
+			if !preconditionsMet(r, info) {
+				responses.Error(w, http.StatusPreconditionFailed, "file has been modified")
+				return
+			}
+
+			remaining, err := remainingQuota(files, username, quota, store)
+			if err != nil {
+				log.Printf("ERROR: failed to calculate storage usage: %v\n", err)
+				responses.Error(w, http.StatusInternalServerError, "failed to calculate storage usage")
+				return
+			} else if remaining >= 0 && r.ContentLength > remaining {
+				responses.Error(w, http.StatusInsufficientStorage, "storage quota exceeded")
+				return
+			}
+
+			// Bodies without a length are cut off once they pass the quota
+			if remaining >= 0 {
+				var body io.Reader
+				body, fs.exceeded = capBody(w, r.Body, remaining)
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{body, r.Body}
+			}
+		}
+
+		handler := &webdav.Handler{
+			Prefix:     "/dav",
+			FileSystem: fs,
+			LockSystem: fileLocks.LockSystem(username),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && err != os.ErrInvalid && err != sandbox.ErrSymlink && !os.IsNotExist(err) && !os.IsExist(err) {
+					log.Printf("ERROR: failed to handle webdav %s request for %s: %v\n", r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		handler.ServeHTTP(&davResponse{ResponseWriter: w, fs: fs}, r)
+	}
+}
+
+// Replaces the response to an upload which failed for a reason the WebDAV handler doesn't know
+// about, since it answers any failure to close the file with 405 Method Not Allowed
+type davResponse struct {
+	http.ResponseWriter
+	fs       *davFileSystem
+	replaced bool
+}
+
+func (d *davResponse) WriteHeader(status int) {
+	if d.fs.failure != 0 && status == http.StatusMethodNotAllowed {
+		d.replaced = true
+		responses.Error(d.ResponseWriter, d.fs.failure, d.fs.failureReason.Error())
+		return
+	}
+	d.ResponseWriter.WriteHeader(status)
+}
+
+func (d *davResponse) Write(p []byte) (int, error) {
+	if d.replaced {
+		return len(p), nil
+	}
+	return d.ResponseWriter.Write(p)
+}
+
+// Authenticate a request from a client using basic auth, holding the user's key until released
+func basicAuthenticate(w http.ResponseWriter, r *http.Request, keys *encryption.Keyring, db *bolt.DB) (string, func(), bool) {
+	username, key, err := davAuthenticate(r, keys != nil, db)
+	if err != nil {
+		log.Printf("ERROR: failed to query database for credentials: %v\n", err)
+		responses.Error(w, http.StatusInternalServerError, "failed to query database")
+		return "", nil, false
+	} else if username == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="BookPi"`)
+		responses.Error(w, http.StatusUnauthorized, "invalid credentials")
+		return "", nil, false
+	}
+	r.Header.Set("X-BPI-Username", username)
+
+	// Hold the user's key for the duration of the request
+	if key == nil {
+		return username, func() {}, true
+	}
+	keys.Acquire(username, key)
+	return username, func() { keys.Release(username) }, true
+}
+
+// Get the user from basic auth, accepting either their password or an app token,
+// along with the key for their files if it is needed
+func davAuthenticate(r *http.Request, unlock bool, db *bolt.DB) (string, []byte, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, nil
+	}
+	return checkCredentials(username, password, unlock, db)
+}
+
+// How long a successful credential check is remembered, so clients which authenticate every
+// request don't have the password hashed each time
+const credentialLifetime = time.Minute
+
+// A credential check which succeeded recently
+type checkedCredentials struct {
+	username string
+	key      []byte
+	expires  time.Time
+}
+
+var (
+	credentialCache = make(map[[sha256.Size]byte]*checkedCredentials)
+	credentialLock  sync.Mutex
+)
+
+// Check a username with either their password or an app token, returning the key for their
+// files if it is needed
+func checkCredentials(username, password string, unlock bool, db *bolt.DB) (string, []byte, error) {
+	if username == "" || password == "" {
+		return "", nil, nil
+	}
+
+	// Only the digest of the credentials is kept
+	id := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+	credentialLock.Lock()
+	cached, ok := credentialCache[id]
+	credentialLock.Unlock()
+	if ok && now.Before(cached.expires) && (!unlock || cached.key != nil) {
+		return cached.username, cached.key, nil
+	}
+
+	found, key, err := verifyCredentials(username, password, unlock, db)
+	if err != nil || found == "" {
+		return found, key, err
+	}
+
+	credentialLock.Lock()
+	for other, entry := range credentialCache {
+		if !now.Before(entry.expires) {
+			delete(credentialCache, other)
+		}
+	}
+	credentialCache[id] = &checkedCredentials{username: found, key: key, expires: now.Add(credentialLifetime)}
+	credentialLock.Unlock()
+	return found, key, nil
+}
+
+// Forget the remembered credential checks for a user after their password or tokens change
+func forgetCredentials(username string) {
+	credentialLock.Lock()
+	defer credentialLock.Unlock()
+	for id, entry := range credentialCache {
+		if entry.username == username {
+			delete(credentialCache, id)
+		}
+	}
+}
+
+// Check a username with either their password or an app token without using remembered checks
+func verifyCredentials(username, password string, unlock bool, db *bolt.DB) (string, []byte, error) {
+
+	// Tokens are cheap to check so try them first
+	token, err := models.FindToken(models.TokenId(password), db)
+	if err != nil {
+		return "", nil, err
+	} else if token != nil && token.Username == username {
+		if !unlock {
+			return username, nil, nil
+		}
+		key, err := token.UnlockKey(password)
+		return username, key, err
+	}
+
+	user, err := models.FindUser(username, db)
+	if err != nil || user == nil {
+		return "", nil, err
+	}
+
+	valid, err := user.Authenticate(username, password)
+	if err != nil || !valid {
+		return "", nil, err
+	} else if !unlock {
+		return username, nil, nil
+	}
+
+	key, err := unlockKey(user, password, db)
+	return username, key, err
+}
+
+// A user's files with the same versioning, quota and events as the file API
+type davFileSystem struct {
+	files    storage.Storage
+	username string
+	quota    int64
+	store    *versions.Store
+	bus      *events.Bus
+	sums     *integrity.Store
+	request  *http.Request
+
+	// Whether the request body went past the user's quota, if it is capped
+	exceeded func() bool
+
+	// The status and reason to respond with when an upload fails
+	failure       int
+	failureReason error
+}
+
+// Fail an upload with a status the client should see
+func (fs *davFileSystem) fail(status int, reason error) error {
+	fs.failure = status
+	fs.failureReason = reason
+	return reason
+}
+
+// Get the namespaced path for a name within the user's files
+func (fs *davFileSystem) resolve(name string) (string, error) {
+	relative, err := sandbox.Clean(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(fs.username, relative), nil
+}
+
+func (fs *davFileSystem) Mkdir(_ context.Context, name string, _ os.FileMode) error {
+	namespacedPath, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := fs.files.Mkdir(namespacedPath); err != nil {
+		return err
+	}
+
+	fs.bus.Publish(events.New(events.Created, namespacedPath))
+	return nil
+}
+
+func (fs *davFileSystem) OpenFile(_ context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	namespacedPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fs.files.Stat(namespacedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	exists := err == nil
+
+	// Reads go straight to storage
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		if !exists {
+			return nil, os.ErrNotExist
+		} else if info.IsDir() {
+			return &davDirectory{files: fs.files, namespacedPath: namespacedPath, info: info}, nil
+		}
+
+		file, err := fs.files.Open(namespacedPath)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{File: file}, nil
+	}
+
+	if exists && info.IsDir() {
+		return nil, os.ErrInvalid
+	} else if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	} else if !exists && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Writes are staged by storage and replace the original when closed
+	out, err := fs.files.Create(namespacedPath)
+	if err != nil {
+		return nil, err
+	}
+	upload := &davUpload{Writer: out, fs: fs, namespacedPath: namespacedPath}
+	upload.hashed, upload.sum = integrity.NewHasher(out)
+
+	// Keep the existing contents unless truncating
+	if exists && flag&os.O_TRUNC == 0 {
+		if err := upload.fill(); err != nil {
+			_ = out.Abort()
+			return nil, err
+		}
+	}
+
+	return upload, nil
+}
+
+func (fs *davFileSystem) RemoveAll(_ context.Context, name string) error {
+	namespacedPath, err := fs.resolve(name)
+	if err != nil {
+		return err
+	} else if namespacedPath == fs.username {
+		return os.ErrInvalid
+	}
+
+	if err := fs.files.Remove(namespacedPath); err != nil {
+		return err
+	}
+	fs.bus.Publish(events.New(events.Deleted, namespacedPath))
+
+	// Previous versions are only dropped once the file is gone
+	return fs.store.Remove(namespacedPath)
+}
+
+func (fs *davFileSystem) Rename(_ context.Context, oldName, newName string) error {
+	oldNamespacedPath, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newNamespacedPath, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+	if oldNamespacedPath == fs.username || newNamespacedPath == fs.username {
+		return os.ErrInvalid
+	}
+
+	if err := fs.files.Rename(oldNamespacedPath, newNamespacedPath); err != nil {
+		return err
+	}
+
+	// Keep the previous versions
+	if err := fs.store.Move(oldNamespacedPath, newNamespacedPath); err != nil {
+		return err
+	}
+
+	fs.bus.Publish(events.NewMove(oldNamespacedPath, newNamespacedPath))
+	return nil
+}
+
+func (fs *davFileSystem) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	namespacedPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.files.Stat(namespacedPath)
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info}, nil
+}
+
+// A file which reports the same entity tags as the file API
+type davFile struct {
+	storage.File
+}
+
+func (f *davFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *davFile) Write([]byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{info}, nil
+}
+
+// A directory whose entries are read from storage when listed
+type davDirectory struct {
+	files          storage.Storage
+	namespacedPath string
+	info           os.FileInfo
+	entries        []os.FileInfo
+	listed         bool
+}
+
+func (d *davDirectory) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.files.List(d.namespacedPath)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			entries[i] = davInfo{entries[i]}
+		}
+		d.entries, d.listed = entries, true
+	}
+
+	// Return everything remaining when no count is given
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	} else if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+func (d *davDirectory) Stat() (os.FileInfo, error) {
+	return davInfo{d.info}, nil
+}
+
+func (d *davDirectory) Read([]byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDirectory) Seek(int64, int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDirectory) Write([]byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDirectory) Close() error {
+	return nil
+}
+
+type davInfo struct {
+	os.FileInfo
+}
+
+func (i davInfo) ETag(_ context.Context) (string, error) {
+	return entityTag(i.FileInfo), nil
+}
+
+// Description of an upload which has not replaced the file yet
+type davPendingInfo struct {
+	upload *davUpload
+}
+
+func (i davPendingInfo) Name() string       { return path.Base(i.upload.namespacedPath) }
+func (i davPendingInfo) Size() int64        { return i.upload.written }
+func (i davPendingInfo) Mode() os.FileMode  { return 0644 }
+func (i davPendingInfo) ModTime() time.Time { return time.Now() }
+func (i davPendingInfo) IsDir() bool        { return false }
+func (i davPendingInfo) Sys() interface{}   { return nil }
+
+func (i davPendingInfo) ETag(_ context.Context) (string, error) {
+	info, err := i.upload.fs.files.Stat(i.upload.namespacedPath)
+	if err != nil {
+		return "", err
+	}
+	return entityTag(info), nil
+}
+
+// New contents for a file, written in place of the original once closed
+type davUpload struct {
+	storage.Writer
+	fs             *davFileSystem
+	namespacedPath string
+	written        int64
+
+	// Everything written also goes through the hash so its checksum can be recorded
+	hashed io.Writer
+	sum    func() string
+}
+
+// Copy the original contents into the staged file
+func (u *davUpload) fill() error {
+	original, err := u.fs.files.Open(u.namespacedPath)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+
+	_, err = io.Copy(u, original)
+	return err
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	n, err := u.hashed.Write(p)
+	u.written += int64(n)
+	return n, err
+}
+
+func (u *davUpload) Read([]byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (u *davUpload) Seek(int64, int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (u *davUpload) Readdir(int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Only called before closing, so the entity tag is found once the contents are in place
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return davPendingInfo{u}, nil
+}
+
+func (u *davUpload) Close() error {
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if err := u.Writer.Abort(); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: failed to remove temporary output file: %v\n", err)
+		}
+	}()
+
+	if u.fs.exceeded != nil && u.fs.exceeded() {
+		return u.fs.fail(http.StatusInsufficientStorage, errQuotaExceeded)
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	// Get current file statistics
+	info, err := u.fs.files.Stat(u.namespacedPath)
+	if os.IsNotExist(err) {
+		info = nil
+	} else if err != nil {
+		return err
+	} else if info.IsDir() {
+		return os.ErrExist
+	}
+
+	// Reject stale writers
+	if u.fs.request.Method == http.MethodPut && !preconditionsMet(u.fs.request, info) {
+		return u.fs.fail(http.StatusPreconditionFailed, errPreconditionFailed)
+	}
+
+	// The previous contents move into the user's versions so only the new contents are added
+	if ok, err := withinQuota(u.fs.files, u.fs.username, u.fs.quota, u.written, u.fs.store); err != nil {
+		return err
+	} else if !ok {
+		return u.fs.fail(http.StatusInsufficientStorage, errQuotaExceeded)
+	}
+
+	// Keep the previous contents
+	if err := u.fs.store.Snapshot(u.namespacedPath); err != nil {
+		return err
+	}
+
+	// Swap in the new contents
+	committed = true
+	if err := u.Writer.Commit(); err != nil {
+		return err
+	}
+
+	// Remember the checksum so the contents can be verified later
+	if err := u.fs.sums.Record(u.namespacedPath, u.sum()); err != nil {
+		log.Printf("ERROR: failed to record file checksum: %v\n", err)
+	}
+
+	if info == nil {
+		u.fs.bus.Publish(events.New(events.Created, u.namespacedPath))
+	} else {
+		u.fs.bus.Publish(events.New(events.Modified, u.namespacedPath))
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+//go:build linux
+// +build linux
+
+package sandbox
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	pathOnly = unix.O_PATH
+
+	resolveNoSymlinks = 0x04
+	resolveBeneath    = 0x08
+)
+
+// Arguments to openat2(2)
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// Open a path relative to a root, falling back to checking each component from the root if the
+// kernel cannot do it
+func open(root, relative string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := openBeneath(root, relative, flag, perm)
+	if err == errUnsupported {
+		fd, err = openWalk(root, relative, flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), join(root, relative)), nil
+}
+
+// Open a path relative to a root, having the kernel reject symbolic links and escapes
+func openBeneath(root, relative string, flag int, perm os.FileMode) (int, error) {
+	if atomic.LoadInt32(&unsupported) == 1 {
+		return -1, errUnsupported
+	}
+
+	dir, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(dir)
+
+	name := relative
+	if name == "" {
+		name = "."
+	}
+	pointer, err := unix.BytePtrFromString(name)
+	if err != nil {
+		return -1, ErrInvalid
+	}
+
+	how := openHow{
+		flags:   uint64(flag | unix.O_CLOEXEC),
+		mode:    uint64(perm.Perm()),
+		resolve: resolveBeneath | resolveNoSymlinks,
+	}
+	for {
+		fd, _, errno := unix.Syscall6(unix.SYS_OPENAT2, uintptr(dir), uintptr(unsafe.Pointer(pointer)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		switch errno {
+		case 0:
+			return int(fd), nil
+		case unix.EINTR, unix.EAGAIN:
+			continue
+		case unix.ENOSYS, unix.EPERM:
+			// Seccomp filters which don't know about openat2 commonly deny it with EPERM
+			atomic.StoreInt32(&unsupported, 1)
+			return -1, errUnsupported
+		case unix.EXDEV:
+			return -1, ErrOutside
+		case unix.ELOOP:
+			return -1, ErrSymlink
+		default:
+			return -1, &os.PathError{Op: "openat2", Path: join(root, relative), Err: errno}
+		}
+	}
+}
+
+// Open a path relative to a root by opening each directory from the one before it, so none
+// of them can be swapped for a symbolic link in between
+func openWalk(root, relative string, flag int, perm os.FileMode) (int, error) {
+	dir, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+
+	name := "."
+	if relative != "" {
+		parts := strings.Split(relative, "/")
+		for _, part := range parts[:len(parts)-1] {
+			next, err := openAt(dir, part, unix.O_PATH|unix.O_DIRECTORY, 0)
+			unix.Close(dir)
+			if err != nil {
+				return -1, pathError("open", root, relative, err)
+			}
+			dir = next
+		}
+		name = parts[len(parts)-1]
+	}
+	defer unix.Close(dir)
+
+	fd, err := openAt(dir, name, flag, perm)
+	if err != nil {
+		return -1, pathError("open", root, relative, err)
+	}
+	return fd, nil
+}
+
+// Open a single component within a directory without following it if it is a symbolic link
+func openAt(dir int, name string, flag int, perm os.FileMode) (int, error) {
+	for {
+		fd, err := unix.Openat(dir, name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+		if err == unix.EINTR {
+			continue
+		} else if err == unix.ELOOP || err == unix.ENOTDIR {
+			// Symbolic links show up as loops, or as not being directories when one is expected
+			var stat unix.Stat_t
+			if unix.Fstatat(dir, name, &stat, unix.AT_SYMLINK_NOFOLLOW) == nil && stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+				return -1, ErrSymlink
+			}
+			return -1, err
+		} else if err != nil {
+			return -1, err
+		}
+
+		// Paths can open the link itself, which is never wanted
+		if flag&unix.O_PATH != 0 {
+			var stat unix.Stat_t
+			if err := unix.Fstat(fd, &stat); err != nil {
+				unix.Close(fd)
+				return -1, err
+			} else if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+				unix.Close(fd)
+				return -1, ErrSymlink
+			}
+		}
+		return fd, nil
+	}
+}
+
+// Open the directory containing a path relative to a root, returning its descriptor and the
+// final component of the path
+func openParent(root, relative string) (int, string, error) {
+	fd, err := openBeneath(root, parent(relative), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err == errUnsupported {
+		fd, err = openWalk(root, parent(relative), unix.O_PATH|unix.O_DIRECTORY, 0)
+	}
+	if err != nil {
+		return -1, "", err
+	}
+	return fd, path.Base(relative), nil
+}
+
+// Create a directory from its parent's descriptor
+func mkdir(root, relative string, perm os.FileMode) error {
+	dir, name, err := openParent(root, relative)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+
+	if err := unix.Mkdirat(dir, name, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdir", Path: join(root, relative), Err: err}
+	}
+	return nil
+}
+
+// Move a path from and to its parents' descriptors
+func rename(root, oldRelative, newRelative string) error {
+	oldDir, oldName, err := openParent(root, oldRelative)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(oldDir)
+
+	newDir, newName, err := openParent(root, newRelative)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newDir)
+
+	if err := unix.Renameat(oldDir, oldName, newDir, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: join(root, oldRelative), New: join(root, newRelative), Err: err}
+	}
+	return nil
+}
+
+// Remove a path and everything beneath it from its parent's descriptor
+func removeAll(root, relative string) error {
+	dir, name, err := openParent(root, relative)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+
+	if err := removeAt(dir, name); err != nil {
+		return &os.PathError{Op: "remove", Path: join(root, relative), Err: err}
+	}
+	return nil
+}
+
+// Remove an entry of a directory, emptying it first through its own descriptor if it is one
+func removeAt(dir int, name string) error {
+	err := unix.Unlinkat(dir, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	} else if err != unix.EISDIR {
+		return err
+	}
+
+	fd, err := openAt(dir, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	child := os.NewFile(uintptr(fd), name)
+	names, err := child.Readdirnames(-1)
+	if err == nil {
+		for _, entry := range names {
+			if err = removeAt(fd, entry); err != nil {
+				break
+			}
+		}
+	}
+	_ = child.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Unlinkat(dir, name, unix.AT_REMOVEDIR); err != nil && err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// Describe a failure to open a path, keeping the sandbox's own errors as they are
+func pathError(op, root, relative string, err error) error {
+	if err == ErrSymlink {
+		return err
+	}
+	return &os.PathError{Op: op, Path: join(root, relative), Err: err}
+}
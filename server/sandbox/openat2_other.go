@@ -0,0 +1,65 @@
+//go:build !linux
+// +build !linux
+
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Each component is checked before opening instead
+const pathOnly = os.O_RDONLY
+
+// Only Linux can resolve beneath a directory, so each component is checked before using the path
+func open(root, relative string, flag int, perm os.FileMode) (*os.File, error) {
+	if err := walk(root, relative); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(join(root, relative), flag, perm)
+}
+
+func mkdir(root, relative string, perm os.FileMode) error {
+	if err := walk(root, relative); err != nil {
+		return err
+	}
+	return os.Mkdir(join(root, relative), perm)
+}
+
+func rename(root, oldRelative, newRelative string) error {
+	if err := walk(root, oldRelative); err != nil {
+		return err
+	} else if err := walk(root, newRelative); err != nil {
+		return err
+	}
+	return os.Rename(join(root, oldRelative), join(root, newRelative))
+}
+
+func removeAll(root, relative string) error {
+	if err := walk(root, relative); err != nil {
+		return err
+	}
+	return os.RemoveAll(join(root, relative))
+}
+
+// Check each component of a path for symbolic links, stopping at the first which does not exist
+func walk(root, relative string) error {
+	current := root
+	for _, part := range strings.Split(relative, "/") {
+		if part == "" {
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return ErrSymlink
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalid = errors.New("path contains invalid characters")
+	ErrOutside = errors.New("path is outside of the root")
+	ErrSymlink = errors.New("path contains a symbolic link")
+
+	// The kernel is unable to resolve paths beneath a directory
+	errUnsupported = errors.New("kernel does not support resolving beneath a directory")
+)
+
+// Set once the kernel is found to be unable to resolve paths beneath a directory, after which
+// each component is checked instead
+var unsupported int32
+
+// Clean a user supplied path into one relative to a root, rejecting any that would leave it.
+// Absolute paths are treated as relative to the root.
+func Clean(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", ErrInvalid
+	}
+
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrOutside
+	} else if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// Check that a user supplied path within a root does not pass through any symbolic links,
+// returning it relative to the root. Components that do not exist yet are allowed so the path
+// can be created. The path may change afterwards, so anything done with it should go through
+// the other functions here.
+func Resolve(root, name string) (string, error) {
+	relative, err := Clean(name)
+	if err != nil {
+		return "", err
+	}
+
+	// Find the deepest part of the path which exists and check it
+	for existing := relative; ; existing = parent(existing) {
+		file, err := open(root, existing, pathOnly, 0)
+		if os.IsNotExist(err) && existing != "" {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		return relative, file.Close()
+	}
+}
+
+// Open a user supplied path within a root without following any symbolic links
+func Open(root, name string, flag int, perm os.FileMode) (*os.File, error) {
+	relative, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	return open(root, relative, flag, perm)
+}
+
+// Describe a user supplied path within a root without following any symbolic links
+func Stat(root, name string) (os.FileInfo, error) {
+	file, err := Open(root, name, pathOnly, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// Create a directory at a user supplied path within a root
+func Mkdir(root, name string, perm os.FileMode) error {
+	relative, err := Clean(name)
+	if err != nil {
+		return err
+	} else if relative == "" {
+		return &os.PathError{Op: "mkdir", Path: root, Err: os.ErrExist}
+	}
+	return mkdir(root, relative, perm)
+}
+
+// Move a user supplied path to another within a root
+func Rename(root, oldName, newName string) error {
+	oldRelative, err := Clean(oldName)
+	if err != nil {
+		return err
+	}
+	newRelative, err := Clean(newName)
+	if err != nil {
+		return err
+	}
+
+	if oldRelative == "" || newRelative == "" {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	return rename(root, oldRelative, newRelative)
+}
+
+// Remove a user supplied path within a root and everything beneath it, succeeding if it does not exist
+func RemoveAll(root, name string) error {
+	relative, err := Clean(name)
+	if err != nil {
+		return err
+	} else if relative == "" {
+		return &os.PathError{Op: "remove", Path: root, Err: os.ErrInvalid}
+	}
+	return removeAll(root, relative)
+}
+
+// Get the parent of a relative path, with the root being empty
+func parent(relative string) string {
+	if parent := path.Dir(relative); parent != "." {
+		return parent
+	}
+	return ""
+}
+
+// Get the location of a relative path on disk for errors
+func join(root, relative string) string {
+	return filepath.Join(root, filepath.FromSlash(relative))
+}
@@ -0,0 +1,233 @@
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Paths which try to leave the root or pass through its symbolic links
+var seeds = []string{
+	"",
+	"/",
+	"dir",
+	"dir/file",
+	"/dir/./sub/../file",
+	"missing/child",
+	"dir/file/child",
+	"..",
+	"../outside/secret",
+	"/../../outside/secret",
+	"dir/../../outside",
+	"inside",
+	"inside/file",
+	"dir/escape",
+	"dir/escape/secret",
+	"dir/escape/../root/dir",
+	"dangling/child",
+	"a\x00b",
+}
+
+// Build a root containing a directory, a file and symbolic links within and out of it, next
+// to a directory which must never be reached
+func fixture(t testing.TB) string {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for _, directory := range []string{"root/dir/sub", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, directory), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"root/dir/file", "outside/secret"} {
+		if err := ioutil.WriteFile(filepath.Join(base, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"root/inside":     "dir",
+		"root/dir/escape": "../../outside",
+		"root/dangling":   "/nonexistent",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// Run a check with the kernel resolving paths, then with each component checked in userspace
+func bothWays(t *testing.T, check func(t *testing.T)) {
+	previous := atomic.LoadInt32(&unsupported)
+	defer atomic.StoreInt32(&unsupported, previous)
+
+	t.Run("openat2", func(t *testing.T) {
+		atomic.StoreInt32(&unsupported, 0)
+		check(t)
+	})
+	t.Run("walk", func(t *testing.T) {
+		atomic.StoreInt32(&unsupported, 1)
+		check(t)
+	})
+}
+
+// Find what resolving a cleaned path should do by looking at each component without following it
+func expected(root, relative string) (exists bool, err error) {
+	current := root
+	for _, part := range strings.Split(relative, "/") {
+		if part == "" {
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return false, ErrSymlink
+		}
+	}
+	return true, nil
+}
+
+// Check that a path on disk is the root or beneath it
+func beneath(t *testing.T, root, relative string) {
+	full := filepath.Join(root, filepath.FromSlash(relative))
+	if full != root && !strings.HasPrefix(full, root+string(filepath.Separator)) {
+		t.Fatalf("%q resolved to %q outside of %q", relative, full, root)
+	}
+}
+
+func FuzzClean(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		relative, err := Clean(name)
+		if strings.ContainsRune(name, 0) {
+			if err != ErrInvalid {
+				t.Fatalf("%q with a null byte gave %v", name, err)
+			}
+			return
+		} else if err != nil {
+			if err != ErrOutside {
+				t.Fatalf("%q gave unexpected error %v", name, err)
+			} else if escaped := path.Clean(strings.TrimLeft(name, "/")); escaped != ".." && !strings.HasPrefix(escaped, "../") {
+				t.Fatalf("%q was rejected without leaving the root", name)
+			}
+			return
+		}
+
+		if path.IsAbs(relative) || relative == ".." || strings.HasPrefix(relative, "../") || relative == "." {
+			t.Fatalf("%q cleaned to %q which is not beneath the root", name, relative)
+		} else if again, err := Clean(relative); err != nil || again != relative {
+			t.Fatalf("%q cleaned to %q which cleans again to %q, %v", name, relative, again, err)
+		} else if joined := path.Join("/root", relative); joined != "/root" && !strings.HasPrefix(joined, "/root/") {
+			t.Fatalf("%q cleaned to %q which leaves the root as %q", name, relative, joined)
+		}
+	})
+}
+
+func FuzzResolve(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	root := fixture(f)
+
+	f.Fuzz(func(t *testing.T, name string) {
+		cleaned, cleanErr := Clean(name)
+
+		bothWays(t, func(t *testing.T) {
+			relative, err := Resolve(root, name)
+			if cleanErr != nil {
+				if err != cleanErr {
+					t.Fatalf("%q resolved with %v instead of %v", name, err, cleanErr)
+				}
+				return
+			}
+
+			exists, want := expected(root, cleaned)
+			switch {
+			case want == ErrSymlink && err != ErrSymlink:
+				t.Fatalf("%q passes through a symbolic link but resolved with %v", name, err)
+			case want == nil && err != nil:
+				t.Fatalf("%q failed to resolve: %v", name, err)
+			case want != nil && want != ErrSymlink && (err == nil || err == ErrSymlink):
+				t.Fatalf("%q resolved with %v instead of an error like %v", name, err, want)
+			case err == nil && relative != cleaned:
+				t.Fatalf("%q resolved to %q instead of %q", name, relative, cleaned)
+			}
+			if err == nil {
+				beneath(t, root, relative)
+			}
+
+			// Opening must agree and give the file on disk beneath the root
+			file, err := Open(root, name, os.O_RDONLY, 0)
+			if want == ErrSymlink {
+				if err != ErrSymlink {
+					t.Fatalf("%q passes through a symbolic link but opened with %v", name, err)
+				}
+				return
+			} else if err != nil {
+				if exists && want == nil {
+					t.Fatalf("%q exists but failed to open: %v", name, err)
+				}
+				return
+			}
+			defer file.Close()
+
+			opened, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			onDisk, err := os.Lstat(filepath.Join(root, filepath.FromSlash(cleaned)))
+			if err != nil {
+				t.Fatalf("%q opened something which is not at %q: %v", name, cleaned, err)
+			} else if !os.SameFile(opened, onDisk) {
+				t.Fatalf("%q opened a different file than %q", name, cleaned)
+			}
+		})
+	})
+}
+
+func TestRemoveAllKeepsLinkTargets(t *testing.T) {
+	bothWays(t, func(t *testing.T) {
+		root := fixture(t)
+		if err := RemoveAll(root, "dir"); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Lstat(filepath.Join(root, "dir")); !os.IsNotExist(err) {
+			t.Fatalf("directory still exists: %v", err)
+		} else if _, err := os.Stat(filepath.Join(root, "..", "outside", "secret")); err != nil {
+			t.Fatalf("removed through a symbolic link: %v", err)
+		}
+
+		if err := RemoveAll(root, "inside/file"); err != ErrSymlink {
+			t.Fatalf("removed through a symbolic link with %v", err)
+		} else if err := RemoveAll(root, ""); err == nil {
+			t.Fatal("removed the root")
+		}
+	})
+}
+
+func TestRenameThroughSymlink(t *testing.T) {
+	bothWays(t, func(t *testing.T) {
+		root := fixture(t)
+		if err := Rename(root, "dir/file", "dir/escape/stolen"); err != ErrSymlink {
+			t.Fatalf("renamed through a symbolic link with %v", err)
+		} else if err := Rename(root, "dir/file", "../stolen"); err != ErrOutside {
+			t.Fatalf("renamed out of the root with %v", err)
+		} else if err := Rename(root, "dir/file", "dir/sub/file"); err != nil {
+			t.Fatal(err)
+		} else if err := Mkdir(root, "inside/new", 0755); err != ErrSymlink {
+			t.Fatalf("created a directory through a symbolic link with %v", err)
+		}
+	})
+}
@@ -0,0 +1,381 @@
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned from searches when the index is turned off because the files are encrypted
+var ErrDisabled = errors.New("search is unavailable while files are encrypted")
+
+// Metadata about a file or directory in a user's storage
+type Entry struct {
+	Path         string `json:"path"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	LastModified int64  `json:"last_modified"`
+	Directory    bool   `json:"directory"`
+	Extension    string `json:"extension"`
+	MimeType     string `json:"mime_type"`
+}
+
+// Filters and ordering for a search
+type Query struct {
+	User           string
+	Name           string
+	Scope          string
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  int64
+	ModifiedBefore int64
+	Extensions     []string
+	Types          []string
+	Sort           string
+	Descending     bool
+	Limit          int
+	Offset         int
+}
+
+// Index of file metadata stored in the database
+type Index struct {
+	files storage.Storage
+	db    *bolt.DB
+
+	// Nothing is indexed when the files are encrypted so their metadata stays with them
+	disabled bool
+}
+
+// Create an index over all users' files
+func New(files storage.Storage, db *bolt.DB) (*Index, error) {
+	// Throw away anything indexed before encryption was turned on
+	_, sealed := files.(storage.Sealer)
+	if sealed {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(models.BucketIndex); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err := tx.CreateBucket(models.BucketIndex)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Index{
+		files:    files,
+		db:       db,
+		disabled: sealed,
+	}, nil
+}
+
+// Keep the index up to date with changes made through the API
+func (i *Index) Handle(event events.Event) {
+	if i.disabled {
+		return
+	}
+
+	var err error
+	switch event.Type {
+	case events.Created, events.Modified:
+		err = i.update(event.Path)
+	case events.Moved:
+		if err = i.remove(event.From); err == nil {
+			err = i.update(event.Path)
+		}
+	case events.Deleted:
+		err = i.remove(event.Path)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to update search index for %s: %v\n", event.Path, err)
+	}
+}
+
+// Periodically rebuild the entire index to catch any changes made outside of the API
+func (i *Index) Walk(interval time.Duration) {
+	if i.disabled {
+		return
+	}
+
+	for {
+		start := time.Now()
+		if err := i.RebuildAll(); err != nil {
+			log.Printf("ERROR: failed to rebuild search index: %v\n", err)
+		} else {
+			log.Printf("Rebuilt search index in %s\n", time.Since(start))
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Rebuild the index for every user
+func (i *Index) RebuildAll() error {
+	homes, err := i.files.List("")
+	if err != nil {
+		return err
+	}
+
+	for _, home := range homes {
+		// Skip internal storage directories
+		if !home.IsDir() || strings.HasPrefix(home.Name(), ".") {
+			continue
+		}
+
+		if err := i.Rebuild(home.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuild the index for all of a user's files
+func (i *Index) Rebuild(username string) error {
+	entries, err := i.collect(username)
+	if err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketIndex)
+
+		if err := deleteUnder(bucket, username); err != nil {
+			return err
+		}
+		return putAll(bucket, entries)
+	})
+}
+
+// Index a path and everything beneath it
+func (i *Index) update(namespacedPath string) error {
+	entries, err := i.collect(namespacedPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketIndex)
+
+		if err := deleteUnder(bucket, namespacedPath); err != nil {
+			return err
+		}
+		return putAll(bucket, entries)
+	})
+}
+
+// Remove a path and everything beneath it from the index
+func (i *Index) remove(namespacedPath string) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return deleteUnder(tx.Bucket(models.BucketIndex), namespacedPath)
+	})
+}
+
+// Gather entries for a path and everything beneath it
+func (i *Index) collect(namespacedPath string) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+
+	err := i.files.Walk(namespacedPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// The user's root directory is not itself searchable
+		if !strings.Contains(name, "/") {
+			return nil
+		}
+
+		entries[name] = newEntry(info)
+		return nil
+	})
+
+	return entries, err
+}
+
+// Find entries in the index matching a query
+func (i *Index) Search(query Query) ([]Entry, int, error) {
+	if i.disabled {
+		return nil, 0, ErrDisabled
+	}
+
+	var results []Entry
+	err := i.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketIndex)
+
+		prefix := []byte(path.Join(query.User, path.Join("/", query.Scope)) + "/")
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entry.Path = strings.TrimPrefix(string(k), query.User)
+
+			if query.matches(entry) {
+				results = append(results, entry)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query.order(results)
+
+	// Paginate the results
+	total := len(results)
+	if query.Offset >= total {
+		return []Entry{}, total, nil
+	}
+	results = results[query.Offset:]
+	if query.Limit > 0 && query.Limit < len(results) {
+		results = results[:query.Limit]
+	}
+
+	return results, total, nil
+}
+
+// Check if an entry satisfies all of the query's filters
+func (q Query) matches(entry Entry) bool {
+	// Match name by glob if it contains any pattern characters, otherwise by substring
+	if q.Name != "" {
+		name, pattern := strings.ToLower(entry.Name), strings.ToLower(q.Name)
+		if strings.ContainsAny(pattern, "*?[") {
+			if matched, err := path.Match(pattern, name); err != nil || !matched {
+				return false
+			}
+		} else if !strings.Contains(name, pattern) {
+			return false
+		}
+	}
+
+	if q.MinSize > 0 && entry.Size < q.MinSize {
+		return false
+	} else if q.MaxSize > 0 && entry.Size > q.MaxSize {
+		return false
+	} else if q.ModifiedAfter > 0 && entry.LastModified < q.ModifiedAfter {
+		return false
+	} else if q.ModifiedBefore > 0 && entry.LastModified > q.ModifiedBefore {
+		return false
+	}
+
+	if len(q.Extensions) > 0 && !matchesAny(entry.Extension, q.Extensions, func(value, filter string) bool {
+		return value == strings.ToLower(strings.TrimPrefix(filter, "."))
+	}) {
+		return false
+	}
+
+	if len(q.Types) > 0 && !matchesAny(entry.MimeType, q.Types, func(value, filter string) bool {
+		return value != "" && strings.HasPrefix(value, strings.ToLower(filter))
+	}) {
+		return false
+	}
+
+	return true
+}
+
+// Sort results by the requested field
+func (q Query) order(results []Entry) {
+	less := func(a, b Entry) bool {
+		switch q.Sort {
+		case "size":
+			return a.Size < b.Size
+		case "modified":
+			return a.LastModified < b.LastModified
+		case "path":
+			return a.Path < b.Path
+		default:
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if q.Descending {
+			return less(results[j], results[i])
+		}
+		return less(results[i], results[j])
+	})
+}
+
+// Create an entry from a file's information
+func newEntry(info os.FileInfo) Entry {
+	entry := Entry{
+		Name:         info.Name(),
+		Size:         info.Size(),
+		LastModified: info.ModTime().Unix(),
+		Directory:    info.IsDir(),
+	}
+
+	if !info.IsDir() {
+		extension := filepath.Ext(info.Name())
+		entry.Extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+		entry.MimeType = strings.SplitN(mime.TypeByExtension(extension), ";", 2)[0]
+	}
+
+	return entry
+}
+
+// Check if a value matches any of the filters
+func matchesAny(value string, filters []string, match func(value, filter string) bool) bool {
+	for _, filter := range filters {
+		if match(value, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete a key and all keys nested beneath it
+func deleteUnder(bucket *bolt.Bucket, namespacedPath string) error {
+	if err := bucket.Delete([]byte(namespacedPath)); err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	prefix := []byte(namespacedPath + "/")
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write all entries to the index
+func putAll(bucket *bolt.Bucket, entries map[string]Entry) error {
+	for key, entry := range entries {
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put([]byte(key), buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
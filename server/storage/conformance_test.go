@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every driver must behave the same way through the interface
+func TestConformance(t *testing.T) {
+	drivers := map[string]func(t *testing.T) Storage{
+		"local": func(t *testing.T) Storage {
+			local, err := NewLocal(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return local
+		},
+		"memory": func(t *testing.T) Storage {
+			return NewMemory()
+		},
+		"s3": func(t *testing.T) Storage {
+			server := newFakeS3(t)
+			s3, err := NewS3(server.URL, fakeRegion, fakeBucket, fakeAccessKey, fakeSecretKey, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s3
+		},
+		"dedup": func(t *testing.T) Storage {
+			directory := t.TempDir()
+			db, err := bolt.Open(filepath.Join(directory, "database.db"), 0600, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+
+			dedup, err := NewDedup(filepath.Join(directory, "files"), []byte("files"), false, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return dedup
+		},
+		"encrypted": func(t *testing.T) Storage {
+			return NewEncrypted(NewMemory(), heldKeys{"alice": testKey(t)})
+		},
+	}
+
+	for name, driver := range drivers {
+		driver := driver
+		t.Run(name, func(t *testing.T) {
+			conformance(t, driver)
+		})
+	}
+}
+
+func conformance(t *testing.T, driver func(t *testing.T) Storage) {
+	t.Run("Mkdir", func(t *testing.T) {
+		files := populated(t, driver)
+		if info, err := files.Stat("alice/docs"); err != nil || !info.IsDir() || info.Name() != "docs" {
+			t.Fatalf("stat of created directory gave %v, %v", info, err)
+		} else if err := files.Mkdir("alice/docs"); !os.IsExist(err) {
+			t.Fatalf("creating an existing directory gave %v", err)
+		} else if err := files.Mkdir("alice/missing/child"); err == nil {
+			t.Fatal("created a directory without a parent")
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		files := populated(t, driver)
+		if info, err := files.Stat("alice/docs/a.txt"); err != nil {
+			t.Fatal(err)
+		} else if info.IsDir() || info.Size() != int64(len("first")) || info.Name() != "a.txt" {
+			t.Fatalf("unexpected description %q, %d bytes, directory %v", info.Name(), info.Size(), info.IsDir())
+		} else if _, err := files.Stat("alice/nothing"); !os.IsNotExist(err) {
+			t.Fatalf("stat of a missing file gave %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		files := populated(t, driver)
+		entries, err := files.List("alice/docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNames(t, entries, []string{"a & b+c.txt", "a.txt", "nested"})
+		if !entries[2].IsDir() || entries[1].IsDir() {
+			t.Fatal("directories were not described as directories")
+		}
+
+		if _, err := files.List("alice/docs/a.txt"); err == nil {
+			t.Fatal("listed a file")
+		} else if _, err := files.List("alice/nothing"); !os.IsNotExist(err) {
+			t.Fatalf("listing a missing directory gave %v", err)
+		}
+	})
+
+	t.Run("ListPages", func(t *testing.T) {
+		files := populated(t, driver)
+		if err := files.Mkdir("alice/many"); err != nil {
+			t.Fatal(err)
+		}
+
+		// More than the fake object store returns in a single page
+		var expected []string
+		for _, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			write(t, files, "alice/many/"+name, name)
+			expected = append(expected, name)
+		}
+		if err := files.Mkdir("alice/many/h"); err != nil {
+			t.Fatal(err)
+		}
+		write(t, files, "alice/many/h/inner", "inner")
+		expected = append(expected, "h")
+
+		entries, err := files.List("alice/many")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNames(t, entries, expected)
+
+		var walked []string
+		if err := files.Walk("alice/many", func(name string, info os.FileInfo, err error) error {
+			walked = append(walked, name)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expectStrings(t, walked, []string{"alice/many", "alice/many/a", "alice/many/b", "alice/many/c", "alice/many/d",
+			"alice/many/e", "alice/many/f", "alice/many/g", "alice/many/h", "alice/many/h/inner"})
+	})
+
+	t.Run("Walk", func(t *testing.T) {
+		files := populated(t, driver)
+		var walked []string
+		if err := files.Walk("alice", func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			walked = append(walked, name)
+			if name == "alice/docs/nested" {
+				return filepath.SkipDir
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expectStrings(t, walked, []string{"alice", "alice/docs", "alice/docs/a & b+c.txt", "alice/docs/a.txt",
+			"alice/docs/nested", "alice/top.txt"})
+
+		// Walking a single file visits only it
+		walked = nil
+		if err := files.Walk("alice/top.txt", func(name string, info os.FileInfo, err error) error {
+			walked = append(walked, name)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expectStrings(t, walked, []string{"alice/top.txt"})
+
+		var missing error
+		_ = files.Walk("alice/nothing", func(name string, info os.FileInfo, err error) error {
+			missing = err
+			return nil
+		})
+		if !os.IsNotExist(missing) {
+			t.Fatalf("walking a missing directory gave %v", missing)
+		}
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		files := populated(t, driver)
+		write(t, files, "alice/long.txt", "0123456789")
+
+		file, err := files.Open("alice/long.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		if info, err := file.Stat(); err != nil || info.Size() != 10 {
+			t.Fatalf("stat of open file gave %v, %v", info, err)
+		}
+
+		buf := make([]byte, 3)
+		if n, err := file.ReadAt(buf, 4); err != nil || string(buf[:n]) != "456" {
+			t.Fatalf("read %q at an offset with %v", buf[:n], err)
+		} else if offset, err := file.Seek(-2, io.SeekEnd); err != nil || offset != 8 {
+			t.Fatalf("seeked to %d with %v", offset, err)
+		} else if rest, err := ioutil.ReadAll(file); err != nil || string(rest) != "89" {
+			t.Fatalf("read %q after seeking with %v", rest, err)
+		} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		} else if all, err := ioutil.ReadAll(file); err != nil || string(all) != "0123456789" {
+			t.Fatalf("read %q from the start with %v", all, err)
+		}
+
+		if _, err := files.Open("alice/nothing"); !os.IsNotExist(err) {
+			t.Fatalf("opening a missing file gave %v", err)
+		}
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		files := populated(t, driver)
+
+		// Nothing changes until the new contents are committed
+		out, err := files.Create("alice/docs/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := io.WriteString(out, "second"); err != nil {
+			t.Fatal(err)
+		}
+		expectContents(t, files, "alice/docs/a.txt", "first")
+		if err := out.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		expectContents(t, files, "alice/docs/a.txt", "second")
+
+		// Aborting leaves nothing behind
+		out, err = files.Create("alice/aborted.txt")
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := io.WriteString(out, "thrown away"); err != nil {
+			t.Fatal(err)
+		} else if err := out.Abort(); err != nil {
+			t.Fatal(err)
+		} else if _, err := files.Stat("alice/aborted.txt"); !os.IsNotExist(err) {
+			t.Fatalf("aborted file exists with %v", err)
+		}
+
+		if out, err := files.Create("alice/missing/file.txt"); err == nil {
+			if err := out.Commit(); err == nil {
+				t.Fatal("created a file without a parent")
+			}
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		files := populated(t, driver)
+		if err := files.Rename("alice/top.txt", "alice/docs/moved.txt"); err != nil {
+			t.Fatal(err)
+		} else if _, err := files.Stat("alice/top.txt"); !os.IsNotExist(err) {
+			t.Fatalf("renamed file still exists with %v", err)
+		}
+		expectContents(t, files, "alice/docs/moved.txt", "top")
+
+		if err := files.Rename("alice/docs", "alice/renamed"); err != nil {
+			t.Fatal(err)
+		} else if _, err := files.Stat("alice/docs"); !os.IsNotExist(err) {
+			t.Fatalf("renamed directory still exists with %v", err)
+		}
+		expectContents(t, files, "alice/renamed/a & b+c.txt", "escaped")
+		expectContents(t, files, "alice/renamed/nested/deep.txt", "deep")
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		files := populated(t, driver)
+		if err := files.Remove("alice/top.txt"); err != nil {
+			t.Fatal(err)
+		} else if _, err := files.Stat("alice/top.txt"); !os.IsNotExist(err) {
+			t.Fatalf("removed file still exists with %v", err)
+		}
+
+		if err := files.Remove("alice/docs"); err != nil {
+			t.Fatal(err)
+		} else if _, err := files.Stat("alice/docs/nested/deep.txt"); !os.IsNotExist(err) {
+			t.Fatalf("file in removed directory still exists with %v", err)
+		}
+
+		entries, err := files.List("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNames(t, entries, nil)
+
+		if err := files.Remove(""); err == nil {
+			t.Fatal("removed the root")
+		}
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		files := populated(t, driver)
+		if err := files.Copy("alice/docs/a & b+c.txt", "alice/copied.txt"); err != nil {
+			t.Fatal(err)
+		}
+		expectContents(t, files, "alice/copied.txt", "escaped")
+		expectContents(t, files, "alice/docs/a & b+c.txt", "escaped")
+
+		// Existing files are replaced
+		if err := files.Copy("alice/top.txt", "alice/copied.txt"); err != nil {
+			t.Fatal(err)
+		}
+		expectContents(t, files, "alice/copied.txt", "top")
+
+		if err := files.Copy("alice/nothing", "alice/copied.txt"); !os.IsNotExist(err) {
+			t.Fatalf("copying a missing file gave %v", err)
+		}
+	})
+}
+
+// Create a fresh storage with a few files and directories in it
+func populated(t *testing.T, driver func(t *testing.T) Storage) Storage {
+	files := driver(t)
+	for _, directory := range []string{"alice", "alice/docs", "alice/docs/nested"} {
+		if err := files.Mkdir(directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(t, files, "alice/top.txt", "top")
+	write(t, files, "alice/docs/a.txt", "first")
+	write(t, files, "alice/docs/a & b+c.txt", "escaped")
+	write(t, files, "alice/docs/nested/deep.txt", "deep")
+	return files
+}
+
+// Replace the contents of a file
+func write(t *testing.T, files Storage, name, contents string) {
+	t.Helper()
+	out, err := files.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := io.WriteString(out, contents); err != nil {
+		_ = out.Abort()
+		t.Fatal(err)
+	} else if err := out.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectContents(t *testing.T, files Storage, name, contents string) {
+	t.Helper()
+	file, err := files.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if read, err := ioutil.ReadAll(file); err != nil {
+		t.Fatal(err)
+	} else if string(read) != contents {
+		t.Fatalf("%s contains %q instead of %q", name, read, contents)
+	}
+}
+
+func expectNames(t *testing.T, entries []os.FileInfo, names []string) {
+	t.Helper()
+	var found []string
+	for _, entry := range entries {
+		found = append(found, entry.Name())
+	}
+	expectStrings(t, found, names)
+}
+
+func expectStrings(t *testing.T, found, expected []string) {
+	t.Helper()
+	if len(found) != 0 || len(expected) != 0 {
+		if !reflect.DeepEqual(found, expected) {
+			t.Fatalf("got\n\t%s\ninstead of\n\t%s", strings.Join(found, "\n\t"), strings.Join(expected, "\n\t"))
+		}
+	}
+}
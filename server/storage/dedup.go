@@ -0,0 +1,591 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	bucketTree  = []byte("tree")
+	bucketBlobs = []byte("blobs")
+)
+
+// Blobs written less than this long ago may not be referenced yet
+const orphanAge = time.Hour
+
+// Files whose contents are stored once by their SHA-256 hash, with the tree of names
+// kept in the database and shared contents reference counted
+type Dedup struct {
+	blobs    string
+	staging  string
+	bucket   []byte
+	physical bool
+	db       *bolt.DB
+
+	// Serializes adding blobs with collecting them
+	lock sync.Mutex
+}
+
+// A file or directory in the tree
+type dedupEntry struct {
+	Blob      string `json:"blob,omitempty"`
+	Size      int64  `json:"size"`
+	Modified  int64  `json:"modified"`
+	Directory bool   `json:"directory"`
+}
+
+// Create deduplicated storage with blobs kept under a directory and the tree kept in a
+// bucket. Usage is either the logical size of a user's files or the size of their unique contents.
+func NewDedup(root string, bucket []byte, physical bool, db *bolt.DB) (*Dedup, error) {
+	d := &Dedup{
+		blobs:    filepath.Join(root, ".blobs"),
+		staging:  filepath.Join(root, ".uploads"),
+		bucket:   bucket,
+		physical: physical,
+		db:       db,
+	}
+	for _, directory := range []string{d.blobs, d.staging} {
+		if err := os.MkdirAll(directory, os.ModeDir|0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketTree, bucketBlobs} {
+			if _, err := root.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Get the location of a blob on disk
+func (d *Dedup) location(blob string) string {
+	return filepath.Join(d.blobs, blob[:2], blob)
+}
+
+// Get the tree and reference count buckets
+func (d *Dedup) buckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket) {
+	root := tx.Bucket(d.bucket)
+	return root.Bucket(bucketTree), root.Bucket(bucketBlobs)
+}
+
+// Get an entry from the tree, the root always exists
+func getEntry(tree *bolt.Bucket, name string) (*dedupEntry, bool) {
+	if name == "" {
+		return &dedupEntry{Directory: true}, true
+	}
+
+	raw := tree.Get([]byte(name))
+	if raw == nil {
+		return nil, false
+	}
+
+	var entry dedupEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Write an entry to the tree
+func putEntry(tree *bolt.Bucket, name string, entry *dedupEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return tree.Put([]byte(name), raw)
+}
+
+// Get the names beneath a directory in lexical order
+func namesBeneath(tree *bolt.Bucket, name string) []string {
+	prefix := []byte(name + "/")
+	if name == "" {
+		prefix = nil
+	}
+
+	var names []string
+	cursor := tree.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		names = append(names, string(k))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Ensure the parent of a name is a directory
+func checkEntryParent(tree *bolt.Bucket, op, name string) error {
+	if name == "" {
+		return errInvalid(op, name)
+	}
+
+	entry, ok := getEntry(tree, parent(name))
+	if !ok {
+		return errNotExist(op, name)
+	} else if !entry.Directory {
+		return errInvalid(op, name)
+	}
+	return nil
+}
+
+// Change the number of references to a blob
+func addReference(blobs *bolt.Bucket, blob string, delta int64) error {
+	if blob == "" {
+		return nil
+	}
+
+	var count int64
+	if raw := blobs.Get([]byte(blob)); raw != nil {
+		count = int64(binary.BigEndian.Uint64(raw))
+	}
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+
+	// Unreferenced blobs are kept until collected
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(count))
+	return blobs.Put([]byte(blob), buf)
+}
+
+func (e *dedupEntry) info(name string) os.FileInfo {
+	return newFileInfo(name, e.Size, time.Unix(0, e.Modified), e.Directory)
+}
+
+func (d *Dedup) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+
+	var info os.FileInfo
+	err := d.db.View(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		entry, ok := getEntry(tree, name)
+		if !ok {
+			return errNotExist("stat", name)
+		}
+		info = entry.info(name)
+		return nil
+	})
+	return info, err
+}
+
+func (d *Dedup) List(name string) ([]os.FileInfo, error) {
+	name = clean(name)
+
+	var infos []os.FileInfo
+	err := d.db.View(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		if entry, ok := getEntry(tree, name); !ok {
+			return errNotExist("open", name)
+		} else if !entry.Directory {
+			return errInvalid("readdirent", name)
+		}
+
+		for _, child := range namesBeneath(tree, name) {
+			if parent(child) != name {
+				continue
+			}
+			entry, _ := getEntry(tree, child)
+			infos = append(infos, entry.info(child))
+		}
+		return nil
+	})
+	return infos, err
+}
+
+func (d *Dedup) Walk(name string, fn WalkFunc) error {
+	// Collect everything up front so the callback may modify the storage
+	name = clean(name)
+	var root os.FileInfo
+	var names []string
+	var infos []os.FileInfo
+	err := d.db.View(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		entry, ok := getEntry(tree, name)
+		if !ok {
+			return errNotExist("lstat", name)
+		}
+		root = entry.info(name)
+
+		if entry.Directory {
+			for _, child := range namesBeneath(tree, name) {
+				entry, _ := getEntry(tree, child)
+				names = append(names, child)
+				infos = append(infos, entry.info(child))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fn(name, nil, err)
+	}
+
+	if err := fn(name, root, nil); err == skipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var skipped []string
+	for i, child := range names {
+		if isSkipped(child, skipped) {
+			continue
+		}
+
+		// Skipping from a file skips the rest of its directory
+		if err := fn(child, infos[i], nil); err == skipDir {
+			if infos[i].IsDir() {
+				skipped = append(skipped, child)
+			} else {
+				skipped = append(skipped, parent(child))
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dedup) Open(name string) (File, error) {
+	name = clean(name)
+
+	var entry *dedupEntry
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		var ok bool
+		if entry, ok = getEntry(tree, name); !ok {
+			return errNotExist("open", name)
+		} else if entry.Directory {
+			return errInvalid("open", name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Empty files have no blob
+	if entry.Blob == "" {
+		return &memoryFile{Reader: bytes.NewReader(nil), info: entry.info(name)}, nil
+	}
+
+	file, err := os.Open(d.location(entry.Blob))
+	if err != nil {
+		return nil, err
+	}
+	return &dedupFile{File: file, info: entry.info(name)}, nil
+}
+
+func (d *Dedup) Create(name string) (Writer, error) {
+	name = clean(name)
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		if err := checkEntryParent(tree, "open", name); err != nil {
+			return err
+		} else if entry, ok := getEntry(tree, name); ok && entry.Directory {
+			return errInvalid("open", name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	temporary, err := ioutil.TempFile(d.staging, "blob-")
+	if err != nil {
+		return nil, err
+	}
+	if err := temporary.Chmod(0644); err != nil {
+		_ = temporary.Close()
+		_ = os.Remove(temporary.Name())
+		return nil, err
+	}
+
+	return &dedupWriter{storage: d, name: name, file: temporary, hash: sha256.New()}, nil
+}
+
+func (d *Dedup) Mkdir(name string) error {
+	name = clean(name)
+	return d.db.Update(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		if err := checkEntryParent(tree, "mkdir", name); err != nil {
+			return err
+		} else if _, ok := getEntry(tree, name); ok {
+			return errExist("mkdir", name)
+		}
+
+		return putEntry(tree, name, &dedupEntry{Modified: time.Now().UnixNano(), Directory: true})
+	})
+}
+
+func (d *Dedup) Rename(oldName, newName string) error {
+	oldName, newName = clean(oldName), clean(newName)
+	return d.db.Update(func(tx *bolt.Tx) error {
+		tree, blobs := d.buckets(tx)
+		entry, ok := getEntry(tree, oldName)
+		if !ok {
+			return errNotExist("rename", oldName)
+		} else if oldName == "" || within(newName, oldName) && newName != oldName {
+			return errInvalid("rename", oldName)
+		} else if err := checkEntryParent(tree, "rename", newName); err != nil {
+			return err
+		} else if newName == oldName {
+			return nil
+		}
+
+		// Only empty directories and files of the same kind may be replaced
+		if existing, ok := getEntry(tree, newName); ok {
+			if existing.Directory != entry.Directory || existing.Directory && len(namesBeneath(tree, newName)) > 0 {
+				return errExist("rename", newName)
+			} else if err := addReference(blobs, existing.Blob, -1); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range append([]string{oldName}, namesBeneath(tree, oldName)...) {
+			raw := append([]byte{}, tree.Get([]byte(name))...)
+			if err := tree.Delete([]byte(name)); err != nil {
+				return err
+			}
+			if err := tree.Put([]byte(newName+strings.TrimPrefix(name, oldName)), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Dedup) Remove(name string) error {
+	name = clean(name)
+	if name == "" {
+		return errInvalid("remove", name)
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		tree, blobs := d.buckets(tx)
+		if _, ok := getEntry(tree, name); !ok {
+			return nil
+		}
+
+		for _, candidate := range append([]string{name}, namesBeneath(tree, name)...) {
+			entry, _ := getEntry(tree, candidate)
+			if err := addReference(blobs, entry.Blob, -1); err != nil {
+				return err
+			}
+			if err := tree.Delete([]byte(candidate)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Copies only add a reference to the existing contents
+func (d *Dedup) Copy(source, destination string) error {
+	source, destination = clean(source), clean(destination)
+	return d.db.Update(func(tx *bolt.Tx) error {
+		tree, blobs := d.buckets(tx)
+		entry, ok := getEntry(tree, source)
+		if !ok {
+			return errNotExist("open", source)
+		} else if entry.Directory {
+			return errInvalid("open", source)
+		}
+
+		return d.replace(tree, blobs, destination, entry.Blob, entry.Size)
+	})
+}
+
+// Point a name at a blob, releasing the contents it previously referenced
+func (d *Dedup) replace(tree, blobs *bolt.Bucket, name, blob string, size int64) error {
+	if err := checkEntryParent(tree, "open", name); err != nil {
+		return err
+	}
+	if existing, ok := getEntry(tree, name); ok {
+		if existing.Directory {
+			return errInvalid("open", name)
+		} else if err := addReference(blobs, existing.Blob, -1); err != nil {
+			return err
+		}
+	}
+
+	if err := addReference(blobs, blob, 1); err != nil {
+		return err
+	}
+	return putEntry(tree, name, &dedupEntry{Blob: blob, Size: size, Modified: time.Now().UnixNano()})
+}
+
+// Get the bytes used beneath a name, counting shared contents once when physical
+func (d *Dedup) Usage(name string) (int64, error) {
+	name = clean(name)
+
+	var total int64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		tree, _ := d.buckets(tx)
+		seen := make(map[string]bool)
+		for _, candidate := range append([]string{name}, namesBeneath(tree, name)...) {
+			entry, ok := getEntry(tree, candidate)
+			if !ok || entry.Directory {
+				continue
+			} else if d.physical && seen[entry.Blob] {
+				continue
+			}
+
+			seen[entry.Blob] = true
+			total += entry.Size
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Periodically remove blobs which are no longer referenced
+func (d *Dedup) Collect(interval time.Duration) {
+	for {
+		if count, size, err := d.collect(); err != nil {
+			log.Printf("ERROR: failed to collect unreferenced blobs: %v\n", err)
+		} else if count > 0 {
+			log.Printf("Collected %d unreferenced blobs totalling %d bytes\n", count, size)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Remove unreferenced blobs along with any left behind by interrupted writes
+func (d *Dedup) collect() (int, int64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	counts := make(map[string]uint64)
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		_, blobs := d.buckets(tx)
+		return blobs.ForEach(func(k, v []byte) error {
+			counts[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	var removed []string
+	var count int
+	var size int64
+	err := filepath.Walk(d.blobs, func(full string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		blob := info.Name()
+		references, known := counts[blob]
+		if known && references > 0 || !known && time.Since(info.ModTime()) < orphanAge {
+			return nil
+		}
+
+		if err := os.Remove(full); err != nil {
+			return err
+		}
+		removed = append(removed, blob)
+		count++
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return count, size, err
+	}
+
+	// Drop the reference counts of removed blobs
+	return count, size, d.db.Update(func(tx *bolt.Tx) error {
+		_, blobs := d.buckets(tx)
+		for _, blob := range removed {
+			if raw := blobs.Get([]byte(blob)); raw != nil && binary.BigEndian.Uint64(raw) == 0 {
+				if err := blobs.Delete([]byte(blob)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// A blob opened under the name of the file referencing it
+type dedupFile struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (f *dedupFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Hashes new contents while staging them, adding them as a blob on commit
+type dedupWriter struct {
+	storage *Dedup
+	name    string
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *dedupWriter) Commit() error {
+	defer os.Remove(w.file.Name())
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	d := w.storage
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Only keep the contents if they are not already stored
+	blob := ""
+	if w.size > 0 {
+		blob = hex.EncodeToString(w.hash.Sum(nil))
+		if _, err := os.Stat(d.location(blob)); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(d.location(blob)), os.ModeDir|0755); err != nil {
+				return err
+			} else if err := os.Rename(w.file.Name(), d.location(blob)); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		tree, blobs := d.buckets(tx)
+		return d.replace(tree, blobs, w.name, blob, w.size)
+	})
+}
+
+func (w *dedupWriter) Abort() error {
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
+}
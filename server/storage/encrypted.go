@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Returned when a file cannot be read or written because its owner's key is not held
+var ErrLocked = errors.New("files are locked until their owner logs in")
+
+// Provides the data keys for users who are logged in
+type Keys interface {
+	Key(username string) []byte
+}
+
+// Implemented by storage which encrypts contents, so that copies kept elsewhere
+// such as previous versions can be protected with the same keys
+type Sealer interface {
+	// Encrypt contents belonging to the owner of a name
+	Seal(name string, out io.Writer) (io.WriteCloser, error)
+
+	// Decrypt contents belonging to the owner of a name, passing through unencrypted contents
+	Unseal(name string, in File) (File, error)
+}
+
+// Encrypts the contents of each user's files with their own key. Files written before
+// encryption was enabled are read as they are and encrypted when next written.
+type Encrypted struct {
+	Storage
+	keys Keys
+}
+
+// Encrypt the contents of files kept in another storage
+func NewEncrypted(files Storage, keys Keys) *Encrypted {
+	return &Encrypted{
+		Storage: files,
+		keys:    keys,
+	}
+}
+
+// Get the user owning a name
+func owner(name string) string {
+	return strings.SplitN(clean(name), "/", 2)[0]
+}
+
+// Get a user's key or fail if it is not held
+func (e *Encrypted) key(name string) ([]byte, error) {
+	if key := e.keys.Key(owner(name)); key != nil {
+		return key, nil
+	}
+	return nil, ErrLocked
+}
+
+// Check if a file's contents are encrypted
+func encrypted(in io.ReaderAt) (bool, error) {
+	header := make([]byte, encryption.HeaderSize)
+	if _, err := in.ReadAt(header, 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return encryption.IsEncrypted(header), nil
+}
+
+// Describe a file by the size of its plaintext
+func (e *Encrypted) describe(name string, info os.FileInfo) (os.FileInfo, error) {
+	if info.IsDir() || info.Size() < int64(encryption.HeaderSize) {
+		return info, nil
+	}
+
+	in, err := e.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	if ok, err := encrypted(in); err != nil {
+		return nil, err
+	} else if !ok {
+		return info, nil
+	}
+	return &sizedInfo{FileInfo: info, size: encryption.PlaintextSize(info.Size())}, nil
+}
+
+func (e *Encrypted) Stat(name string) (os.FileInfo, error) {
+	info, err := e.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.describe(name, info)
+}
+
+func (e *Encrypted) List(name string) ([]os.FileInfo, error) {
+	infos, err := e.Storage.List(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range infos {
+		if infos[i], err = e.describe(clean(name+"/"+info.Name()), info); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+func (e *Encrypted) Walk(name string, fn WalkFunc) error {
+	return e.Storage.Walk(name, func(name string, info os.FileInfo, err error) error {
+		if err == nil {
+			info, err = e.describe(name, info)
+		}
+		return fn(name, info, err)
+	})
+}
+
+func (e *Encrypted) Open(name string) (File, error) {
+	in, err := e.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := e.Unseal(name, in)
+	if err != nil {
+		_ = in.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (e *Encrypted) Create(name string) (Writer, error) {
+	if _, err := e.key(name); err != nil {
+		return nil, err
+	}
+
+	out, err := e.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := e.Seal(name, out)
+	if err != nil {
+		_ = out.Abort()
+		return nil, err
+	}
+	return &encryptedWriter{Writer: out, sealed: sealed}, nil
+}
+
+// Copies within a user's files keep their encrypted contents
+func (e *Encrypted) Copy(source, destination string) error {
+	if owner(source) == owner(destination) {
+		return e.Storage.Copy(source, destination)
+	}
+
+	in, err := e.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := e.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// Get the bytes stored beneath a name, including the encryption overhead
+func (e *Encrypted) Usage(name string) (int64, error) {
+	if usager, ok := e.Storage.(Usager); ok {
+		return usager.Usage(name)
+	}
+
+	var total int64
+	err := e.Storage.Walk(name, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (e *Encrypted) Seal(name string, out io.Writer) (io.WriteCloser, error) {
+	key, err := e.key(name)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewWriter(out, key)
+}
+
+func (e *Encrypted) Unseal(name string, in File) (File, error) {
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Contents from before encryption was enabled are read as they are
+	if ok, err := encrypted(in); err != nil {
+		return nil, err
+	} else if !ok {
+		return in, nil
+	}
+
+	key, err := e.key(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := encryption.NewReader(in, info.Size(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedFile{
+		Reader: reader,
+		file:   in,
+		info:   &sizedInfo{FileInfo: info, size: reader.Size()},
+	}, nil
+}
+
+// Encrypt a value belonging to the owner of a name which is kept outside of the storage
+func SealBytes(sealer Sealer, name string, plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	out, err := sealer.Seal(name, &buf)
+	if err != nil {
+		return nil, err
+	} else if _, err := out.Write(plaintext); err != nil {
+		_ = out.Close()
+		return nil, err
+	} else if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt a value encrypted with SealBytes
+func UnsealBytes(sealer Sealer, name string, sealed []byte) ([]byte, error) {
+	in := &memoryFile{Reader: bytes.NewReader(sealed), info: newFileInfo(name, int64(len(sealed)), time.Now(), false)}
+	unsealed, err := sealer.Unseal(name, in)
+	if err != nil {
+		return nil, err
+	}
+	defer unsealed.Close()
+	return ioutil.ReadAll(unsealed)
+}
+
+// A description of a file reporting the size of its plaintext
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *sizedInfo) Size() int64 {
+	return i.size
+}
+
+// Decrypts a file as it is read
+type encryptedFile struct {
+	*encryption.Reader
+	file File
+	info os.FileInfo
+}
+
+func (f *encryptedFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Encrypts contents before they are staged
+type encryptedWriter struct {
+	Writer
+	sealed io.WriteCloser
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	return w.sealed.Write(p)
+}
+
+func (w *encryptedWriter) Commit() error {
+	if err := w.sealed.Close(); err != nil {
+		_ = w.Writer.Abort()
+		return err
+	}
+	return w.Writer.Commit()
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/akrantz01/bookpi/server/encryption"
+	"io/ioutil"
+	"testing"
+)
+
+// Keys for the users who are logged in
+type heldKeys map[string][]byte
+
+func (k heldKeys) Key(username string) []byte {
+	return k[username]
+}
+
+func testKey(t *testing.T) []byte {
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Read a file as it is kept in the underlying storage
+func raw(t *testing.T, files Storage, name string) []byte {
+	t.Helper()
+	file, err := files.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestEncryptedContents(t *testing.T) {
+	underlying, keys := NewMemory(), heldKeys{"alice": testKey(t)}
+	files := NewEncrypted(underlying, keys)
+	if err := files.Mkdir("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, files, "alice/secret.txt", "attack at dawn")
+	if sealed := raw(t, underlying, "alice/secret.txt"); !encryption.IsEncrypted(sealed) || bytes.Contains(sealed, []byte("attack")) {
+		t.Fatalf("contents were stored as %q", sealed)
+	} else if info, err := files.Stat("alice/secret.txt"); err != nil || info.Size() != int64(len("attack at dawn")) {
+		t.Fatalf("size of the plaintext was not reported: %v", err)
+	}
+	expectContents(t, files, "alice/secret.txt", "attack at dawn")
+
+	// Copies keep the same key since they stay with the same owner
+	if err := files.Copy("alice/secret.txt", "alice/copy.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, files, "alice/copy.txt", "attack at dawn")
+
+	// Nothing can be read or written once the key is gone
+	delete(keys, "alice")
+	if _, err := files.Open("alice/secret.txt"); err != ErrLocked {
+		t.Fatalf("opened without a key with %v", err)
+	} else if _, err := files.Create("alice/new.txt"); err != ErrLocked {
+		t.Fatalf("created without a key with %v", err)
+	}
+}
+
+func TestEncryptedPassthrough(t *testing.T) {
+	underlying := NewMemory()
+	files := NewEncrypted(underlying, heldKeys{})
+	if err := underlying.Mkdir("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files from before encryption was turned on are read as they are, even without a key
+	for name, contents := range map[string]string{
+		"alice/empty.txt": "",
+		"alice/short.txt": "BPE",
+		"alice/plain.txt": "written before encryption was turned on",
+	} {
+		write(t, underlying, name, contents)
+		expectContents(t, files, name, contents)
+		if info, err := files.Stat(name); err != nil || info.Size() != int64(len(contents)) {
+			t.Fatalf("%s has the wrong size: %v", name, err)
+		}
+	}
+}
+
+func TestSealBytes(t *testing.T) {
+	keys := heldKeys{"alice": testKey(t), "bob": testKey(t)}
+	files := NewEncrypted(NewMemory(), keys)
+
+	sealed, err := SealBytes(files, "alice/draft.txt", []byte("unsaved changes"))
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(sealed, []byte("unsaved")) {
+		t.Fatal("plaintext is visible")
+	}
+
+	if unsealed, err := UnsealBytes(files, "alice/draft.txt", sealed); err != nil || string(unsealed) != "unsaved changes" {
+		t.Fatalf("unsealed %q with %v", unsealed, err)
+	} else if _, err := UnsealBytes(files, "bob/draft.txt", sealed); err != encryption.ErrCorrupt {
+		t.Fatalf("unsealed with another user's key with %v", err)
+	} else if unsealed, err := UnsealBytes(files, "alice/draft.txt", []byte("plain")); err != nil || string(unsealed) != "plain" {
+		t.Fatalf("plaintext unsealed as %q with %v", unsealed, err)
+	}
+
+	delete(keys, "alice")
+	if _, err := SealBytes(files, "alice/draft.txt", []byte("more")); err != ErrLocked {
+		t.Fatalf("sealed without a key with %v", err)
+	} else if _, err := UnsealBytes(files, "alice/draft.txt", sealed); err != ErrLocked {
+		t.Fatalf("unsealed without a key with %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"github.com/akrantz01/bookpi/server/sandbox"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Directory within the root where uploads are written before being committed
+const stagingName = ".uploads"
+
+// Files kept in a directory on the local disk
+type Local struct {
+	root    string
+	staging string
+}
+
+// Create storage within a local directory, staging uploads alongside it
+func NewLocal(root string) (*Local, error) {
+	staging := filepath.Join(root, stagingName)
+	if err := os.MkdirAll(staging, os.ModeDir|0755); err != nil {
+		return nil, err
+	}
+
+	return &Local{
+		root:    root,
+		staging: staging,
+	}, nil
+}
+
+func (l *Local) Stat(name string) (os.FileInfo, error) {
+	return sandbox.Stat(l.root, name)
+}
+
+func (l *Local) List(name string) ([]os.FileInfo, error) {
+	dir, err := sandbox.Open(l.root, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (l *Local) Walk(name string, fn WalkFunc) error {
+	name = clean(name)
+	info, err := l.Stat(name)
+	if err != nil {
+		err = fn(name, nil, err)
+	} else {
+		err = l.walk(name, info, fn)
+	}
+
+	if err == skipDir {
+		return nil
+	}
+	return err
+}
+
+// Visit a file or directory and everything beneath it, going through the sandbox for each directory
+func (l *Local) walk(name string, info os.FileInfo, fn WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+
+	entries, err := l.List(name)
+	if err := fn(name, info, err); err != nil || entries == nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := l.walk(path.Join(name, entry.Name()), entry, fn); err != nil && (err != skipDir || !entry.IsDir()) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Local) Open(name string) (File, error) {
+	file, err := sandbox.Open(l.root, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (l *Local) Create(name string) (Writer, error) {
+	// Fail early on names which could never be committed
+	if _, err := sandbox.Resolve(l.root, name); err != nil {
+		return nil, err
+	}
+
+	temporary, err := ioutil.TempFile(l.staging, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	if err := temporary.Chmod(0644); err != nil {
+		_ = temporary.Close()
+		_ = os.Remove(temporary.Name())
+		return nil, err
+	}
+
+	return &localWriter{file: temporary, root: l.root, destination: name}, nil
+}
+
+func (l *Local) Mkdir(name string) error {
+	return sandbox.Mkdir(l.root, name, os.ModeDir|0755)
+}
+
+func (l *Local) Rename(oldName, newName string) error {
+	return sandbox.Rename(l.root, oldName, newName)
+}
+
+func (l *Local) Remove(name string) error {
+	if clean(name) == "" {
+		return errInvalid("remove", name)
+	}
+	return sandbox.RemoveAll(l.root, name)
+}
+
+func (l *Local) Copy(source, destination string) error {
+	in, err := l.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := l.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// Writes to a staging file which is moved into place on commit
+type localWriter struct {
+	file        *os.File
+	root        string
+	destination string
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *localWriter) Commit() error {
+	if err := w.file.Close(); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+
+	// The destination is only resolved now so nothing can be swapped in after it was checked
+	if err := sandbox.Rename(w.root, path.Join(stagingName, filepath.Base(w.file.Name())), w.destination); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files kept in memory, mostly useful for development and testing
+type Memory struct {
+	entries map[string]*memoryEntry
+	lock    sync.RWMutex
+}
+
+type memoryEntry struct {
+	contents []byte
+	modified time.Time
+	dir      bool
+}
+
+// Create empty in-memory storage
+func NewMemory() *Memory {
+	return &Memory{
+		entries: map[string]*memoryEntry{
+			"": {modified: time.Now(), dir: true},
+		},
+	}
+}
+
+// Get an entry and its description, the lock must be held
+func (m *Memory) find(op, name string) (*memoryEntry, os.FileInfo, error) {
+	entry, ok := m.entries[name]
+	if !ok {
+		return nil, nil, errNotExist(op, name)
+	}
+	return entry, newFileInfo(name, int64(len(entry.contents)), entry.modified, entry.dir), nil
+}
+
+// Ensure the parent of a name is a directory, the lock must be held
+func (m *Memory) checkParent(op, name string) error {
+	if name == "" {
+		return errInvalid(op, name)
+	}
+
+	entry, ok := m.entries[parent(name)]
+	if !ok {
+		return errNotExist(op, name)
+	} else if !entry.dir {
+		return errInvalid(op, name)
+	}
+	return nil
+}
+
+// Get the names at or beneath a name, the lock must be held
+func (m *Memory) namesWithin(name string) []string {
+	var names []string
+	for candidate := range m.entries {
+		if within(candidate, name) {
+			names = append(names, candidate)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, info, err := m.find("stat", clean(name))
+	return info, err
+}
+
+func (m *Memory) List(name string) ([]os.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	name = clean(name)
+	if entry, _, err := m.find("readdir", name); err != nil {
+		return nil, err
+	} else if !entry.dir {
+		return nil, errInvalid("readdir", name)
+	}
+
+	infos := []os.FileInfo{}
+	for candidate, entry := range m.entries {
+		if candidate != name && parent(candidate) == name {
+			infos = append(infos, newFileInfo(candidate, int64(len(entry.contents)), entry.modified, entry.dir))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (m *Memory) Walk(name string, fn WalkFunc) error {
+	// Collect everything up front so the callback may modify the storage
+	m.lock.RLock()
+	name = clean(name)
+	_, root, err := m.find("lstat", name)
+	type visit struct {
+		name string
+		info os.FileInfo
+	}
+	var visits []visit
+	if err == nil {
+		for _, candidate := range m.namesWithin(name) {
+			_, info, _ := m.find("lstat", candidate)
+			visits = append(visits, visit{candidate, info})
+		}
+	}
+	m.lock.RUnlock()
+
+	if err != nil {
+		return fn(name, root, err)
+	}
+
+	var skipped []string
+	for _, v := range visits {
+		if isSkipped(v.name, skipped) {
+			continue
+		}
+
+		// Skipping from a file skips the rest of its directory
+		if err := fn(v.name, v.info, nil); err == skipDir {
+			if v.info.IsDir() {
+				skipped = append(skipped, v.name)
+			} else {
+				skipped = append(skipped, parent(v.name))
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Open(name string) (File, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entry, info, err := m.find("open", clean(name))
+	if err != nil {
+		return nil, err
+	}
+	return &memoryFile{Reader: bytes.NewReader(entry.contents), info: info}, nil
+}
+
+func (m *Memory) Create(name string) (Writer, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	name = clean(name)
+	if err := m.checkParent("open", name); err != nil {
+		return nil, err
+	} else if entry, ok := m.entries[name]; ok && entry.dir {
+		return nil, errInvalid("open", name)
+	}
+	return &memoryWriter{storage: m, name: name}, nil
+}
+
+func (m *Memory) Mkdir(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = clean(name)
+	if err := m.checkParent("mkdir", name); err != nil {
+		return err
+	} else if _, ok := m.entries[name]; ok {
+		return errExist("mkdir", name)
+	}
+
+	m.entries[name] = &memoryEntry{modified: time.Now(), dir: true}
+	return nil
+}
+
+func (m *Memory) Rename(oldName, newName string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	oldName, newName = clean(oldName), clean(newName)
+	entry, _, err := m.find("rename", oldName)
+	if err != nil {
+		return err
+	} else if oldName == "" || within(newName, oldName) && newName != oldName {
+		return errInvalid("rename", oldName)
+	} else if err := m.checkParent("rename", newName); err != nil {
+		return err
+	}
+
+	// Only empty directories and files of the same kind may be replaced
+	if existing, ok := m.entries[newName]; ok {
+		if existing.dir != entry.dir || existing.dir && len(m.namesWithin(newName)) > 1 {
+			return errExist("rename", newName)
+		}
+	}
+
+	for _, name := range m.namesWithin(oldName) {
+		moved := newName + strings.TrimPrefix(name, oldName)
+		m.entries[moved] = m.entries[name]
+		delete(m.entries, name)
+	}
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = clean(name)
+	if name == "" {
+		return errInvalid("remove", name)
+	}
+
+	for _, candidate := range m.namesWithin(name) {
+		delete(m.entries, candidate)
+	}
+	return nil
+}
+
+func (m *Memory) Copy(source, destination string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	source, destination = clean(source), clean(destination)
+	entry, _, err := m.find("open", source)
+	if err != nil {
+		return err
+	} else if entry.dir {
+		return errInvalid("open", source)
+	} else if err := m.checkParent("open", destination); err != nil {
+		return err
+	} else if existing, ok := m.entries[destination]; ok && existing.dir {
+		return errInvalid("open", destination)
+	}
+
+	// Contents are never modified in place so they can be shared
+	m.entries[destination] = &memoryEntry{contents: entry.contents, modified: time.Now()}
+	return nil
+}
+
+// A file's contents at the time it was opened
+type memoryFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Buffers new contents until committed
+type memoryWriter struct {
+	storage *Memory
+	name    string
+	buffer  bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+func (w *memoryWriter) Commit() error {
+	w.storage.lock.Lock()
+	defer w.storage.lock.Unlock()
+
+	if err := w.storage.checkParent("open", w.name); err != nil {
+		return err
+	} else if existing, ok := w.storage.entries[w.name]; ok && existing.dir {
+		return errInvalid("open", w.name)
+	}
+
+	w.storage.entries[w.name] = &memoryEntry{contents: w.buffer.Bytes(), modified: time.Now()}
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.buffer.Reset()
+	return nil
+}
@@ -0,0 +1,686 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files kept in a bucket of an S3-compatible object store. Directories are stored as empty
+// objects with a trailing slash so that they exist while empty.
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	staging   string
+	client    *http.Client
+}
+
+// An object from a bucket listing
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+}
+
+// A page of a bucket listing
+type s3Listing struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// Create storage backed by a bucket, staging uploads in a local directory
+func NewS3(endpoint, region, bucket, accessKey, secretKey, staging string) (*S3, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	} else if parsed.Scheme == "" || parsed.Host == "" {
+		return nil, fmt.Errorf("s3: endpoint must be an absolute url")
+	}
+	if err := os.MkdirAll(staging, os.ModeDir|0755); err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		endpoint:  parsed,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		staging:   staging,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (s *S3) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+	if name == "" {
+		return newFileInfo(name, 0, time.Unix(0, 0), true), nil
+	}
+
+	// Files are stored under their name and directories beneath it
+	info, err := s.head(name)
+	if err == nil || !os.IsNotExist(err) {
+		return info, err
+	}
+
+	found := false
+	if err := s.list(name+"/", "", 1, func(page *s3Listing) bool {
+		found = len(page.Contents) > 0
+		return false
+	}); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, errNotExist("stat", name)
+	}
+	return newFileInfo(name, 0, time.Unix(0, 0), true), nil
+}
+
+func (s *S3) List(name string) ([]os.FileInfo, error) {
+	name = clean(name)
+	if info, err := s.Stat(name); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, errInvalid("readdir", name)
+	}
+
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+
+	infos := []os.FileInfo{}
+	if err := s.list(prefix, "/", 1000, func(page *s3Listing) bool {
+		for _, object := range page.Contents {
+			if object.Key != prefix {
+				infos = append(infos, s.objectInfo(object))
+			}
+		}
+		for _, common := range page.CommonPrefixes {
+			infos = append(infos, newFileInfo(strings.TrimSuffix(common.Prefix, "/"), 0, time.Unix(0, 0), true))
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (s *S3) Walk(name string, fn WalkFunc) error {
+	name = clean(name)
+	root, err := s.Stat(name)
+	if err != nil {
+		return fn(name, nil, err)
+	} else if !root.IsDir() {
+		if err := fn(name, root, nil); err != nil && err != skipDir {
+			return err
+		}
+		return nil
+	}
+
+	// Collect every object beneath the directory along with the directories implied by their keys
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+	infos := map[string]os.FileInfo{name: root}
+	if err := s.list(prefix, "", 1000, func(page *s3Listing) bool {
+		for _, object := range page.Contents {
+			key := strings.TrimSuffix(object.Key, "/")
+			if strings.HasSuffix(object.Key, "/") {
+				infos[key] = newFileInfo(key, 0, s.objectInfo(object).ModTime(), true)
+			} else {
+				infos[key] = s.objectInfo(object)
+			}
+
+			for directory := parent(key); directory != "" && within(directory, name) && directory != name; directory = parent(directory) {
+				if _, ok := infos[directory]; !ok {
+					infos[directory] = newFileInfo(directory, 0, time.Unix(0, 0), true)
+				}
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(infos))
+	for key := range infos {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	var skipped []string
+	for _, key := range names {
+		if isSkipped(key, skipped) {
+			continue
+		}
+
+		// Skipping from a file skips the rest of its directory
+		if err := fn(key, infos[key], nil); err == skipDir {
+			if infos[key].IsDir() {
+				skipped = append(skipped, key)
+			} else {
+				skipped = append(skipped, parent(key))
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) Open(name string) (File, error) {
+	name = clean(name)
+	info, err := s.head(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{storage: s, key: name, info: info}, nil
+}
+
+func (s *S3) Create(name string) (Writer, error) {
+	name = clean(name)
+	if name == "" {
+		return nil, errInvalid("open", name)
+	} else if info, err := s.Stat(parent(name)); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, errInvalid("open", name)
+	}
+
+	// Buffer to disk so the length is known when uploading
+	temporary, err := ioutil.TempFile(s.staging, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{storage: s, key: name, file: temporary}, nil
+}
+
+func (s *S3) Mkdir(name string) error {
+	name = clean(name)
+	if name == "" {
+		return errExist("mkdir", name)
+	} else if _, err := s.Stat(name); err == nil {
+		return errExist("mkdir", name)
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if info, err := s.Stat(parent(name)); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return errInvalid("mkdir", name)
+	}
+
+	return s.put(name+"/", bytes.NewReader(nil), 0)
+}
+
+func (s *S3) Rename(oldName, newName string) error {
+	oldName, newName = clean(oldName), clean(newName)
+	info, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	} else if oldName == "" || newName == "" || within(newName, oldName) && newName != oldName {
+		return errInvalid("rename", oldName)
+	} else if oldName == newName {
+		return nil
+	}
+
+	if !info.IsDir() {
+		if err := s.copyObject(oldName, newName); err != nil {
+			return err
+		}
+		return s.delete(oldName)
+	}
+
+	// Move everything beneath the directory, keeping it around while empty
+	var keys []string
+	if err := s.list(oldName+"/", "", 1000, func(page *s3Listing) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, object.Key)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if err := s.put(newName+"/", bytes.NewReader(nil), 0); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		moved := newName + strings.TrimPrefix(key, oldName)
+		if moved != newName+"/" {
+			if err := s.copyObject(key, moved); err != nil {
+				return err
+			}
+		}
+		if err := s.delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) Remove(name string) error {
+	name = clean(name)
+	if name == "" {
+		return errInvalid("remove", name)
+	}
+
+	if err := s.delete(name); err != nil {
+		return err
+	}
+
+	var keys []string
+	if err := s.list(name+"/", "", 1000, func(page *s3Listing) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, object.Key)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) Copy(source, destination string) error {
+	source, destination = clean(source), clean(destination)
+	if info, err := s.head(source); err != nil {
+		return err
+	} else if info.IsDir() {
+		return errInvalid("open", source)
+	}
+	return s.copyObject(source, destination)
+}
+
+// Describe an object from a listing
+func (s *S3) objectInfo(object s3Object) os.FileInfo {
+	modified, err := time.Parse(time.RFC3339, object.LastModified)
+	if err != nil {
+		modified = time.Unix(0, 0)
+	}
+	return newFileInfo(object.Key, object.Size, modified, false)
+}
+
+// Get the description of a single object
+func (s *S3) head(key string) (os.FileInfo, error) {
+	res, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errNotExist("stat", key)
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3: failed to stat %s: %s", key, res.Status)
+	}
+
+	modified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil {
+		modified = time.Unix(0, 0)
+	}
+	return newFileInfo(key, res.ContentLength, modified, false), nil
+}
+
+// Page through the objects with a prefix until the callback returns false
+func (s *S3) list(prefix, delimiter string, limit int, fn func(page *s3Listing) bool) error {
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"max-keys":  {strconv.Itoa(limit)},
+		}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("s3: failed to list %s: %s", prefix, res.Status)
+		}
+
+		var page s3Listing
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if !fn(&page) || !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Upload an object
+func (s *S3) put(key string, body io.Reader, length int64) error {
+	res, err := s.do(http.MethodPut, key, nil, nil, body, length)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: failed to write %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+// Copy an object within the bucket
+func (s *S3) copyObject(source, destination string) error {
+	headers := http.Header{"X-Amz-Copy-Source": {"/" + s.bucket + "/" + uriEncode(source, false)}}
+	res, err := s.do(http.MethodPut, destination, nil, headers, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Copies can fail after the response has started
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	} else if res.StatusCode == http.StatusNotFound {
+		return errNotExist("copy", source)
+	} else if res.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("s3: failed to copy %s to %s: %s", source, destination, res.Status)
+	}
+	return nil
+}
+
+// Delete an object, which succeeds even if it does not exist
+func (s *S3) delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3: failed to delete %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+// Send a signed request for an object, or the bucket if no key is given
+func (s *S3) do(method, key string, query url.Values, headers http.Header, body io.Reader, length int64) (*http.Response, error) {
+	// Objects are addressed by path so any endpoint works
+	canonicalPath := "/" + uriEncode(s.bucket, false)
+	if key != "" {
+		canonicalPath += "/" + uriEncode(key, false)
+	}
+	target := *s.endpoint
+	target.Path = strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	target.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + canonicalPath
+	target.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	s.sign(req, target.RawPath)
+
+	return s.client.Do(req)
+}
+
+// Sign a request with AWS signature version 4
+func (s *S3) sign(req *http.Request, canonicalPath string) {
+	now := time.Now().UTC()
+	timestamp := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	// Sign the host and all amazon headers
+	signed := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encode a query in the sorted form used for signing
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent encode everything but unreserved characters, optionally keeping slashes
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// An object read with range requests so it can be seeked
+type s3File struct {
+	storage *S3
+	key     string
+	info    os.FileInfo
+	offset  int64
+	body    io.ReadCloser
+}
+
+// Request the contents of an object from an offset
+func (f *s3File) get(offset, length int64) (io.ReadCloser, error) {
+	rangeHeader := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	if length > 0 {
+		rangeHeader += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	res, err := f.storage.do(http.MethodGet, f.key, nil, http.Header{"Range": {rangeHeader}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errNotExist("read", f.key)
+	} else if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("s3: failed to read %s: %s", f.key, res.Status)
+	}
+	return res.Body, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		body, err := f.get(f.offset, 0)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if offset+length > f.info.Size() {
+		length = f.info.Size() - offset
+	}
+	body, err := f.get(offset, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && int64(n) < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, errInvalid("seek", f.key)
+	}
+
+	// Start a new request from the new offset when next read
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Buffers new contents on disk until committed
+type s3Writer struct {
+	storage *S3
+	key     string
+	file    *os.File
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *s3Writer) Commit() error {
+	defer w.Abort()
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.storage.put(w.key, w.file, info.Size())
+}
+
+func (w *s3Writer) Abort() error {
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeRegion    = "test-region"
+	fakeBucket    = "bucket"
+	fakeAccessKey = "access"
+	fakeSecretKey = "secret"
+
+	// Kept small so listings always need several pages
+	fakePageSize = 2
+)
+
+// An object store which checks signatures and keeps objects in memory
+type fakeS3 struct {
+	t       *testing.T
+	objects map[string]fakeObject
+	lock    sync.Mutex
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+}
+
+// Start an object store which is shut down once the test finishes
+func newFakeS3(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(&fakeS3{t: t, objects: make(map[string]fakeObject)})
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if problem := f.verify(r); problem != "" {
+		f.t.Errorf("rejected %s %s: %s", r.Method, r.URL, problem)
+		http.Error(w, problem, http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+fakeBucket)
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	} else if !strings.HasPrefix(key, "/") || key == "/" {
+		http.Error(w, "unknown bucket", http.StatusNotFound)
+		return
+	}
+	key = key[1:]
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, object.modified, bytes.NewReader(object.data))
+
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			sourceKey, err := url.PathUnescape(strings.TrimPrefix(source, "/"+fakeBucket+"/"))
+			if err != nil {
+				http.Error(w, "invalid copy source", http.StatusBadRequest)
+				return
+			}
+			object, ok := f.objects[sourceKey]
+			if !ok {
+				http.Error(w, "no such key", http.StatusNotFound)
+				return
+			}
+			f.objects[key] = fakeObject{data: object.data, modified: time.Now()}
+			_, _ = w.Write([]byte("<CopyObjectResult></CopyObjectResult>"))
+			return
+		}
+
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if r.ContentLength != int64(len(data)) {
+			http.Error(w, "body does not match its length", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = fakeObject{data: data, modified: time.Now()}
+
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// Answer a ListObjectsV2 request a page at a time
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		http.Error(w, "only version 2 listings are supported", http.StatusBadRequest)
+		return
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	limit, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || limit <= 0 {
+		http.Error(w, "invalid max-keys", http.StatusBadRequest)
+		return
+	} else if limit > fakePageSize {
+		limit = fakePageSize
+	}
+
+	// Gather objects and the prefixes they are grouped into
+	f.lock.Lock()
+	entries := map[string]bool{}
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if index := strings.Index(rest, delimiter); delimiter != "" && index >= 0 {
+			entries[prefix+rest[:index+len(delimiter)]] = true
+		} else {
+			entries[key] = false
+		}
+	}
+	f.lock.Unlock()
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Tokens are the last name returned so far
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start = sort.SearchStrings(names, token)
+		if start < len(names) && names[start] == token {
+			start++
+		}
+	}
+
+	type content struct {
+		Key          string
+		LastModified string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}
+
+	f.lock.Lock()
+	for _, name := range names[start:] {
+		if len(result.Contents)+len(result.CommonPrefixes) == limit {
+			result.IsTruncated = true
+			break
+		}
+
+		if entries[name] {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{name})
+		} else if object, ok := f.objects[name]; ok {
+			result.Contents = append(result.Contents, content{name, object.modified.UTC().Format(time.RFC3339), len(object.data)})
+		}
+		result.NextContinuationToken = name
+	}
+	f.lock.Unlock()
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(&result)
+}
+
+// Check a request's signature version 4, returning what is wrong with it
+func (f *fakeS3) verify(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return "missing signature"
+	}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ", ") {
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+
+	timestamp := r.Header.Get("X-Amz-Date")
+	if len(timestamp) < 8 {
+		return "missing date"
+	}
+	scope := timestamp[:8] + "/" + fakeRegion + "/s3/aws4_request"
+	if fields["Credential"] != fakeAccessKey+"/"+scope {
+		return "unexpected credential " + fields["Credential"]
+	}
+
+	// Rebuild the canonical request from what was received
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signedHeaders) {
+		return "signed headers are not sorted"
+	}
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") && !contains(signedHeaders, lower) {
+			return "unsigned header " + lower
+		}
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		segments = append(segments, awsEscape(segment))
+	}
+
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parameters []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parameters = append(parameters, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		strings.Join(parameters, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + fakeSecretKey)
+	for _, part := range []string{timestamp[:8], fakeRegion, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(fields["Signature"])) {
+		return "signature does not match for\n" + canonical
+	}
+	return ""
+}
+
+// Escape a path segment or query component the way signatures expect
+func awsEscape(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
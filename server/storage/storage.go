@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where users' files are kept. Names are slash separated and relative to the root of the
+// storage, with the root itself being the empty name.
+type Storage interface {
+	// Get a description of a file or directory
+	Stat(name string) (os.FileInfo, error)
+
+	// Get the entries of a directory sorted by name
+	List(name string) ([]os.FileInfo, error)
+
+	// Visit a file or every file and directory beneath a directory in lexical order,
+	// directories can be skipped by returning filepath.SkipDir
+	Walk(name string, fn WalkFunc) error
+
+	// Open a file for reading
+	Open(name string) (File, error)
+
+	// Start writing a file, which is only replaced once committed
+	Create(name string) (Writer, error)
+
+	// Create a directory whose parent exists
+	Mkdir(name string) error
+
+	// Move a file or directory
+	Rename(oldName, newName string) error
+
+	// Remove a file or directory and everything beneath it
+	Remove(name string) error
+
+	// Copy the contents of a file, replacing any existing file
+	Copy(source, destination string) error
+}
+
+// Implemented by storage which can report how many bytes are used beneath a name
+// without walking every file
+type Usager interface {
+	Usage(name string) (int64, error)
+}
+
+// Called for each file and directory while walking
+type WalkFunc func(name string, info os.FileInfo, err error) error
+
+// A file opened for reading
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// New contents for a file
+type Writer interface {
+	io.Writer
+
+	// Replace the file with what was written
+	Commit() error
+
+	// Throw away what was written
+	Abort() error
+}
+
+// Description of a file or directory for drivers without a real filesystem
+type fileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modified }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() interface{}   { return nil }
+
+func (i *fileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// Create a description of a file or directory
+func newFileInfo(name string, size int64, modified time.Time, dir bool) *fileInfo {
+	return &fileInfo{
+		name:     path.Base("/" + name),
+		size:     size,
+		modified: modified,
+		dir:      dir,
+	}
+}
+
+// Clean a name so that it is relative to the root
+func clean(name string) string {
+	cleaned := path.Clean("/" + name)
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+// Get the parent of a name, with the root being empty
+func parent(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// Check if a name is at or beneath another
+func within(name, directory string) bool {
+	return directory == "" || name == directory || strings.HasPrefix(name, directory+"/")
+}
+
+// Errors matching those from the os package
+func errNotExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func errExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+}
+
+func errInvalid(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+}
+
+// Returned from a walk function to skip a directory
+var skipDir = filepath.SkipDir
+
+// Check if a name is beneath any skipped directory
+func isSkipped(name string, skipped []string) bool {
+	for _, directory := range skipped {
+		if within(name, directory) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package thumbnails
+
+import (
+	"errors"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/storage"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Thumbnail is generated for listings
+const DefaultSize = 256
+
+// Images with more pixels than this are not decoded
+const maxPixels = 50 * 1000 * 1000
+
+var (
+	ErrUnsupported = errors.New("file type does not support thumbnails")
+	ErrBusy        = errors.New("too many thumbnails are being generated")
+
+	// Allowed thumbnail sizes to keep the cache bounded
+	Sizes = []int{64, 128, DefaultSize, 512}
+)
+
+// A thumbnail to be generated by the worker pool
+type request struct {
+	namespacedPath string
+	size           int
+	done           []chan error
+}
+
+// Generates and caches thumbnails of users' images
+type Cache struct {
+	files     storage.Storage
+	directory string
+
+	queue    chan *request
+	inflight map[string]*request
+	lock     sync.Mutex
+}
+
+// Create a thumbnail cache under the files directory with a bounded number of workers
+func New(filesDirectory string, files storage.Storage, workers, backlog int) (*Cache, error) {
+	directory := filepath.Join(filesDirectory, ".thumbnails")
+	if err := os.MkdirAll(directory, os.ModeDir|0755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		files:     files,
+		directory: directory,
+		queue:     make(chan *request, backlog),
+		inflight:  make(map[string]*request),
+	}
+	for i := 0; i < workers; i++ {
+		go c.work()
+	}
+
+	return c, nil
+}
+
+// Check if a thumbnail can be generated for a file
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// Check if a thumbnail size is allowed
+func ValidSize(size int) bool {
+	for _, allowed := range Sizes {
+		if size == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the location of a cached thumbnail
+func (c *Cache) location(namespacedPath string, size int) string {
+	return filepath.Join(c.directory, namespacedPath, strconv.Itoa(size)+".jpg")
+}
+
+// Open a thumbnail of a file, generating it if missing or outdated
+func (c *Cache) Open(namespacedPath string, size int) (storage.File, error) {
+	if !Supported(namespacedPath) {
+		return nil, ErrUnsupported
+	}
+
+	// Use the cached thumbnail if it is newer than the image
+	source, err := c.files.Stat(namespacedPath)
+	if err != nil {
+		return nil, err
+	}
+	thumbnail := c.location(namespacedPath, size)
+	if cached, err := os.Stat(thumbnail); err != nil || cached.ModTime().Before(source.ModTime()) {
+		// Wait for a worker to generate it
+		done := make(chan error, 1)
+		if err := c.submit(namespacedPath, size, done); err != nil {
+			return nil, err
+		}
+		if err := <-done; err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(thumbnail)
+	if err != nil {
+		return nil, err
+	}
+
+	// Thumbnails are protected the same way as the images they came from
+	if sealer, ok := c.files.(storage.Sealer); ok {
+		unsealed, err := sealer.Unseal(namespacedPath, file)
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return unsealed, nil
+	}
+	return file, nil
+}
+
+// Queue a thumbnail for generation, joining any identical request in progress
+func (c *Cache) submit(namespacedPath string, size int, done chan error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := c.location(namespacedPath, size)
+	if existing, ok := c.inflight[key]; ok {
+		if done != nil {
+			existing.done = append(existing.done, done)
+		}
+		return nil
+	}
+
+	req := &request{namespacedPath: namespacedPath, size: size}
+	if done != nil {
+		req.done = append(req.done, done)
+	}
+
+	select {
+	case c.queue <- req:
+		c.inflight[key] = req
+		return nil
+	default:
+		return ErrBusy
+	}
+}
+
+// Generate queued thumbnails
+func (c *Cache) work() {
+	for req := range c.queue {
+		err := c.generate(req.namespacedPath, req.size)
+
+		c.lock.Lock()
+		delete(c.inflight, c.location(req.namespacedPath, req.size))
+		waiting := req.done
+		c.lock.Unlock()
+
+		for _, done := range waiting {
+			done <- err
+		}
+	}
+}
+
+// Decode, scale, and write a thumbnail
+func (c *Cache) generate(namespacedPath string, size int) error {
+	in, err := c.files.Open(namespacedPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Refuse to decode enormous images
+	config, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return err
+	} else if config.Width*config.Height > maxPixels {
+		return ErrUnsupported
+	}
+	if _, err := in.Seek(0, 0); err != nil {
+		return err
+	}
+
+	// Only the first frame of animated images is decoded
+	source, _, err := image.Decode(in)
+	if err != nil {
+		return err
+	}
+
+	// Fit within a square keeping the aspect ratio
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, maxInt(1, height*size/width)
+		} else {
+			width, height = maxInt(1, width*size/height), size
+		}
+	}
+
+	// Flatten any transparency onto white
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(scaled, scaled.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), source, bounds, draw.Over, nil)
+
+	// Write atomically so readers never see a partial thumbnail
+	destination := c.location(namespacedPath, size)
+	if err := os.MkdirAll(filepath.Dir(destination), os.ModeDir|0755); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(destination), ".thumbnail-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	var sealed io.WriteCloser = out
+	if sealer, ok := c.files.(storage.Sealer); ok {
+		if sealed, err = sealer.Seal(namespacedPath, out); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+
+	if err := jpeg.Encode(sealed, scaled, &jpeg.Options{Quality: 80}); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if sealed != out {
+		if err := sealed.Close(); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), destination)
+}
+
+// Remove cached thumbnails for a path and everything beneath it
+func (c *Cache) Invalidate(namespacedPath string) error {
+	return os.RemoveAll(filepath.Join(c.directory, namespacedPath))
+}
+
+// Keep the cache consistent with changes to users' files
+func (c *Cache) Handle(event events.Event) {
+	var err error
+	switch event.Type {
+	case events.Created:
+		// Generate the listing thumbnail ahead of time
+		if Supported(event.Path) {
+			if err := c.submit(event.Path, DefaultSize, nil); err != nil && err != ErrBusy {
+				log.Printf("ERROR: failed to queue thumbnail for %s: %v\n", event.Path, err)
+			}
+		}
+	case events.Modified, events.Deleted:
+		err = c.Invalidate(event.Path)
+	case events.Moved:
+		if err = c.Invalidate(event.From); err == nil {
+			err = c.Invalidate(event.Path)
+		}
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to invalidate thumbnails for %s: %v\n", event.Path, err)
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
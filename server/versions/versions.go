@@ -0,0 +1,343 @@
+package versions
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/models"
+	"github.com/akrantz01/bookpi/server/storage"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage for the previous contents of user files
+type Store struct {
+	directory string
+	files     storage.Storage
+	keep      int
+	maxAge    time.Duration
+	db        *bolt.DB
+	lock      sync.Mutex
+}
+
+// Create a version store under the files directory for files kept in storage
+func New(filesDirectory string, files storage.Storage, keep int, maxAge time.Duration, db *bolt.DB) (*Store, error) {
+	directory := filepath.Join(filesDirectory, ".versions")
+	if err := os.MkdirAll(directory, os.ModeDir|0755); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		directory: directory,
+		files:     files,
+		keep:      keep,
+		maxAge:    maxAge,
+		db:        db,
+	}, nil
+}
+
+// Get the location of a version's contents on disk
+func (s *Store) location(path string, version models.Version) string {
+	return filepath.Join(s.directory, owner(path), version.Id)
+}
+
+// Copy the current contents of a file into its history
+func (s *Store) Snapshot(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.snapshot(path)
+}
+
+func (s *Store) snapshot(path string) error {
+	// Nothing to keep if the file does not exist yet
+	info, err := s.files.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if info.IsDir() {
+		return nil
+	}
+
+	// Get existing history or create it
+	history, err := models.FindHistory(path, s.db)
+	if err != nil {
+		return err
+	} else if history == nil {
+		history = models.NewHistory(path)
+	}
+
+	// Copy contents into version storage
+	version := models.NewVersion(info.Size())
+	if err := os.MkdirAll(filepath.Join(s.directory, owner(path)), os.ModeDir|0755); err != nil {
+		return err
+	}
+	if err := s.save(path, s.location(path, version)); err != nil {
+		return err
+	}
+
+	// Add version and drop those outside of retention
+	history.AddVersion(version)
+	s.prune(history)
+
+	return history.Save(s.db)
+}
+
+// Remove versions outside of the retention policy. No more than the newest few are ever kept,
+// and of those only the ones within the maximum age if there is one.
+func (s *Store) prune(history *models.History) {
+	cutoff := time.Now().Add(-s.maxAge).Unix()
+
+	var kept []models.Version
+	for i, version := range history.Versions {
+		if i < s.keep && (s.maxAge == 0 || version.Created >= cutoff) {
+			kept = append(kept, version)
+			continue
+		}
+
+		_ = os.Remove(s.location(history.Path, version))
+	}
+
+	if kept == nil {
+		kept = []models.Version{}
+	}
+	history.Versions = kept
+}
+
+// List the versions of a file from newest to oldest
+func (s *Store) List(path string) ([]models.Version, error) {
+	history, err := models.FindHistory(path, s.db)
+	if err != nil {
+		return nil, err
+	} else if history == nil {
+		return []models.Version{}, nil
+	}
+
+	return history.Versions, nil
+}
+
+// Open a version of a file for reading
+func (s *Store) Open(path, id string) (storage.File, *models.Version, error) {
+	history, err := models.FindHistory(path, s.db)
+	if err != nil {
+		return nil, nil, err
+	} else if history == nil {
+		return nil, nil, nil
+	}
+
+	version := history.FindVersion(id)
+	if version == nil {
+		return nil, nil, nil
+	}
+
+	file, err := s.read(path, *version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, version, nil
+}
+
+// Replace the current contents of a file with a previous version
+func (s *Store) Restore(path, id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	history, err := models.FindHistory(path, s.db)
+	if err != nil {
+		return false, err
+	} else if history == nil {
+		return false, nil
+	}
+
+	version := history.FindVersion(id)
+	if version == nil {
+		return false, nil
+	}
+
+	// Keep the current contents before replacing them
+	if err := s.snapshot(path); err != nil {
+		return false, err
+	}
+
+	// The current contents are only replaced once the copy completes
+	in, err := s.read(path, *version)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := s.files.Create(path)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Abort()
+		return false, err
+	}
+
+	return true, out.Commit()
+}
+
+// Follow a file or directory to its new location
+func (s *Store) Move(oldPath, newPath string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketVersions)
+
+		// Collect all histories at or below the old path
+		moved := make(map[string][]byte)
+		for _, key := range keysUnder(bucket, oldPath) {
+			moved[newPath+strings.TrimPrefix(key, oldPath)] = bucket.Get([]byte(key))
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		// Re-insert under their new paths
+		for key, value := range moved {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Delete the history of a file or all files within a directory
+func (s *Store) Remove(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketVersions)
+
+		for _, key := range keysUnder(bucket, path) {
+			// Remove the stored contents
+			var history models.History
+			if err := json.Unmarshal(bucket.Get([]byte(key)), &history); err != nil {
+				return err
+			}
+			for _, version := range history.Versions {
+				_ = os.Remove(s.location(key, version))
+			}
+
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Delete all versions of a user's files
+func (s *Store) RemoveUser(username string) error {
+	if err := s.Remove(username); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(s.directory, username))
+}
+
+// Get the number of bytes used by a user's versions
+func (s *Store) Usage(username string) (int64, error) {
+	var total int64
+	err := filepath.Walk(filepath.Join(s.directory, username), func(_ string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return total, err
+}
+
+// Get all keys equal to or nested under a path
+func keysUnder(bucket *bolt.Bucket, path string) []string {
+	var keys []string
+	if bucket.Get([]byte(path)) != nil {
+		keys = append(keys, path)
+	}
+
+	prefix := []byte(path + "/")
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, string(k))
+	}
+
+	return keys
+}
+
+// Get the user owning a namespaced path
+func owner(path string) string {
+	return strings.SplitN(filepath.ToSlash(path), "/", 2)[0]
+}
+
+// Copy the contents of a file in storage to version storage
+func (s *Store) save(path, destination string) error {
+	in, err := s.files.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Versions are protected the same way as the files they came from
+	var sealed io.WriteCloser = out
+	if sealer, ok := s.files.(storage.Sealer); ok {
+		if sealed, err = sealer.Seal(path, out); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+
+	if _, err := io.Copy(sealed, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if sealed != out {
+		if err := sealed.Close(); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+// Open the contents of a version for reading
+func (s *Store) read(path string, version models.Version) (storage.File, error) {
+	file, err := os.Open(s.location(path, version))
+	if err != nil {
+		return nil, err
+	}
+
+	if sealer, ok := s.files.(storage.Sealer); ok {
+		unsealed, err := sealer.Unseal(path, file)
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return unsealed, nil
+	}
+	return file, nil
+}
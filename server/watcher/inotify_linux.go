@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package watcher
+
+import (
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Changes which make a directory's contents worth comparing again
+const mask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ATTRIB | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// Something changed in a directory, or too much changed to know what
+type change struct {
+	directory string
+	overflow  bool
+}
+
+// Receives changes to watched directories from the kernel
+type notifier struct {
+	root    string
+	fd      int
+	changes chan change
+
+	// Watch descriptors and the namespaced paths they watch
+	paths map[int]string
+	wds   map[string]int
+	lock  sync.Mutex
+}
+
+// Start receiving changes beneath the root directory
+func newNotifier(root string) (*notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &notifier{
+		root:    root,
+		fd:      fd,
+		changes: make(chan change, 256),
+		paths:   make(map[int]string),
+		wds:     make(map[string]int),
+	}
+	go n.read()
+	return n, nil
+}
+
+// Watch a directory for changes to its contents
+func (n *notifier) add(namespacedPath string) {
+	wd, err := unix.InotifyAddWatch(n.fd, filepath.Join(n.root, filepath.FromSlash(namespacedPath)), mask)
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		return
+	} else if err != nil {
+		log.Printf("ERROR: failed to watch %s: %v\n", namespacedPath, err)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if previous, ok := n.paths[wd]; ok {
+		delete(n.wds, previous)
+	}
+	n.paths[wd] = namespacedPath
+	n.wds[namespacedPath] = wd
+}
+
+// Follow a directory and everything beneath it to a new location since watches stay with the directory
+func (n *notifier) move(from, to string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for namespacedPath, wd := range n.wds {
+		if namespacedPath == from || strings.HasPrefix(namespacedPath, from+"/") {
+			moved := to + strings.TrimPrefix(namespacedPath, from)
+			delete(n.wds, namespacedPath)
+			n.wds[moved] = wd
+			n.paths[wd] = moved
+		}
+	}
+}
+
+// Get the namespaced path watched by a descriptor
+func (n *notifier) path(wd int) (string, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	namespacedPath, ok := n.paths[wd]
+	return namespacedPath, ok
+}
+
+// Stop tracking a descriptor the kernel removed
+func (n *notifier) remove(wd int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if namespacedPath, ok := n.paths[wd]; ok {
+		delete(n.paths, wd)
+		if n.wds[namespacedPath] == wd {
+			delete(n.wds, namespacedPath)
+		}
+	}
+}
+
+// Turn events from the kernel into changed directories
+func (n *notifier) read() {
+	defer close(n.changes)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		read, err := unix.Read(n.fd, buf)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			log.Printf("ERROR: failed to read file changes: %v\n", err)
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= read; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				n.changes <- change{overflow: true}
+				continue
+			} else if event.Mask&unix.IN_IGNORED != 0 {
+				n.remove(int(event.Wd))
+				continue
+			}
+
+			if directory, ok := n.path(int(event.Wd)); ok {
+				n.changes <- change{directory: directory}
+			}
+		}
+	}
+}
+
+// Get the inode of a file so it can be recognized after moving
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package watcher
+
+import (
+	"errors"
+	"os"
+)
+
+// Something changed in a directory, or too much changed to know what
+type change struct {
+	directory string
+	overflow  bool
+}
+
+// Only Linux can be notified of changes, so changes are found by scanning instead
+type notifier struct {
+	changes chan change
+}
+
+func newNotifier(_ string) (*notifier, error) {
+	return nil, errors.New("watching for changes is only supported on linux")
+}
+
+func (n *notifier) add(_ string) {}
+
+func (n *notifier) move(_, _ string) {}
+
+// Files cannot be recognized after moving without inodes
+func inode(_ os.FileInfo) uint64 {
+	return 0
+}
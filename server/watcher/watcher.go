@@ -0,0 +1,542 @@
+package watcher
+
+import (
+	"encoding/json"
+	"github.com/akrantz01/bookpi/server/events"
+	"github.com/akrantz01/bookpi/server/models"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long changes are collected before being compared against what is known
+const settle = time.Second
+
+// What was last seen of a file or directory on disk
+type entry struct {
+	Inode     uint64 `json:"i,omitempty"`
+	Size      int64  `json:"s"`
+	Modified  int64  `json:"m"`
+	Directory bool   `json:"d,omitempty"`
+}
+
+// Check if two entries describe the same contents
+func (e entry) same(other entry) bool {
+	return e.Directory == other.Directory && (e.Directory || (e.Size == other.Size && e.Modified == other.Modified))
+}
+
+// Notices changes made to the files directory without going through the server and
+// publishes them as events so everything built on top of the files stays up to date
+type Watcher struct {
+	root string
+	bus  *events.Bus
+	db   *bolt.DB
+
+	// Everything known to be on disk, keyed by namespaced path
+	known   map[string]entry
+	pending map[string]*entry
+	lock    sync.Mutex
+
+	notify *notifier
+}
+
+// Create a watcher for a files directory, loading what was on disk when the server last ran
+func New(root string, bus *events.Bus, db *bolt.DB) (*Watcher, error) {
+	w := &Watcher{
+		root:    root,
+		bus:     bus,
+		db:      db,
+		known:   make(map[string]entry),
+		pending: make(map[string]*entry),
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(models.BucketWatcher).ForEach(func(k, v []byte) error {
+			var e entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			w.known[string(k)] = e
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Watch for changes until the server stops, first catching up on anything changed while it was down
+func (w *Watcher) Run() {
+	notify, err := newNotifier(w.root)
+	if err != nil {
+		log.Printf("ERROR: failed to watch files directory, only changes made while stopped will be found: %v\n", err)
+	}
+	w.lock.Lock()
+	w.notify = notify
+	w.lock.Unlock()
+
+	go w.persist(5 * time.Second)
+
+	// Nothing has changed on the first run since nothing was known before it
+	initial := len(w.known) == 0
+	if err := w.rescan(!initial); err != nil {
+		log.Printf("ERROR: failed to scan files directory for changes: %v\n", err)
+	}
+
+	if w.notify == nil {
+		return
+	}
+
+	// Compare each changed directory once its changes settle down
+	dirty := make(map[string]bool)
+	overflowed := false
+	var timer <-chan time.Time
+	for {
+		select {
+		case change, ok := <-w.notify.changes:
+			if !ok {
+				return
+			} else if change.overflow {
+				overflowed = true
+			} else {
+				dirty[change.directory] = true
+			}
+			if timer == nil {
+				timer = time.After(settle)
+			}
+
+		case <-timer:
+			var err error
+			if overflowed {
+				err = w.rescan(true)
+			} else {
+				err = w.reconcile(dirty)
+			}
+			if err != nil {
+				log.Printf("ERROR: failed to find changes in files directory: %v\n", err)
+			}
+
+			dirty = make(map[string]bool)
+			overflowed = false
+			timer = nil
+		}
+	}
+}
+
+// Keep track of changes made through the server so they are not mistaken for outside changes
+func (w *Watcher) Handle(event events.Event) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var err error
+	switch event.Type {
+	case events.Created, events.Modified:
+		err = w.refresh(event.Path)
+	case events.Moved:
+		w.move(event.From, event.Path)
+		err = w.refresh(event.Path)
+	case events.Deleted:
+		w.forget(event.Path)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: failed to record change to %s: %v\n", event.Path, err)
+	}
+}
+
+// Compare everything on disk against what is known
+func (w *Watcher) rescan(publish bool) error {
+	w.lock.Lock()
+	found := make(map[string]entry)
+	err := w.walk("", found)
+	if err != nil {
+		w.lock.Unlock()
+		return err
+	}
+
+	known := make(map[string]entry, len(w.known))
+	for namespacedPath, e := range w.known {
+		known[namespacedPath] = e
+	}
+	changes := w.apply(known, found)
+	w.lock.Unlock()
+
+	if publish {
+		w.publish(changes)
+	}
+	return nil
+}
+
+// Compare the contents of directories which changed against what is known
+func (w *Watcher) reconcile(directories map[string]bool) error {
+	w.lock.Lock()
+	known := make(map[string]entry)
+	found := make(map[string]entry)
+	for directory := range directories {
+		// Directories which are new or gone are handled with their parent
+		if info, err := os.Lstat(w.location(directory)); err != nil || !info.IsDir() {
+			continue
+		} else if _, ok := w.known[directory]; !ok && directory != "" {
+			continue
+		}
+
+		infos, err := ioutil.ReadDir(w.location(directory))
+		if err != nil {
+			w.lock.Unlock()
+			return err
+		}
+		for _, info := range infos {
+			if namespacedPath := path.Join(directory, info.Name()); included(namespacedPath, info) {
+				found[namespacedPath] = describe(info)
+			}
+		}
+		for namespacedPath, e := range w.known {
+			if namespacedPath != "" && path.Dir(namespacedPath) == directory || (directory == "" && !strings.Contains(namespacedPath, "/")) {
+				known[namespacedPath] = e
+			}
+		}
+	}
+
+	// Directories which appeared or vanished bring everything beneath them along
+	for namespacedPath, e := range found {
+		if previous, ok := known[namespacedPath]; e.Directory && (!ok || !previous.Directory) {
+			if err := w.walk(namespacedPath, found); err != nil {
+				w.lock.Unlock()
+				return err
+			}
+		}
+	}
+	for namespacedPath, e := range known {
+		if current, ok := found[namespacedPath]; e.Directory && (!ok || !current.Directory) {
+			for beneath, child := range w.known {
+				if strings.HasPrefix(beneath, namespacedPath+"/") {
+					known[beneath] = child
+				}
+			}
+		}
+	}
+
+	changes := w.apply(known, found)
+	w.lock.Unlock()
+
+	w.publish(changes)
+	return nil
+}
+
+// Work out what changed between what was known and what was found for the same paths,
+// recording what was found
+func (w *Watcher) apply(known, found map[string]entry) []events.Event {
+	var vanished, appeared, modified []string
+	for namespacedPath, e := range known {
+		if current, ok := found[namespacedPath]; !ok || current.Directory != e.Directory {
+			vanished = append(vanished, namespacedPath)
+		} else if !current.same(e) {
+			modified = append(modified, namespacedPath)
+		}
+	}
+	for namespacedPath, e := range found {
+		if previous, ok := known[namespacedPath]; !ok || previous.Directory != e.Directory {
+			appeared = append(appeared, namespacedPath)
+		}
+	}
+	sortByDepth(vanished)
+	sortByDepth(appeared)
+	sort.Strings(modified)
+
+	// Anything which appeared with the same identity as something which vanished was moved
+	byInode := make(map[uint64]string)
+	for _, namespacedPath := range appeared {
+		if inode := found[namespacedPath].Inode; inode != 0 {
+			byInode[inode] = namespacedPath
+		}
+	}
+	consumed := make(map[string]bool)
+	gone := make(map[string]bool)
+	var changes []events.Event
+	for _, from := range vanished {
+		before := known[from]
+		to, ok := byInode[before.Inode]
+		if consumed[from] || !ok || before.Inode == 0 || consumed[to] || found[to].Directory != before.Directory || (!before.Directory && found[to].Size != before.Size) {
+			continue
+		}
+
+		consumed[from], consumed[to] = true, true
+		changes = append(changes, events.NewMove(from, to))
+		if !found[to].same(before) {
+			changes = append(changes, events.New(events.Modified, to))
+		}
+
+		// Everything beneath a directory moves with it
+		for _, beneath := range vanished {
+			if !strings.HasPrefix(beneath, from+"/") {
+				continue
+			}
+			counterpart := to + strings.TrimPrefix(beneath, from)
+			if current, ok := found[counterpart]; ok && !consumed[counterpart] && current.Directory == known[beneath].Directory {
+				consumed[beneath], consumed[counterpart] = true, true
+				if !current.same(known[beneath]) {
+					changes = append(changes, events.New(events.Modified, counterpart))
+				}
+			} else if !ok {
+				// Removed after moving, so it is reported where it was moved to
+				consumed[beneath] = true
+				if !gone[path.Dir(beneath)] {
+					changes = append(changes, events.New(events.Deleted, counterpart))
+				}
+				gone[beneath] = true
+			}
+		}
+	}
+
+	// Only the top of anything removed or added is reported, not counting users' directories
+	for _, namespacedPath := range vanished {
+		if !consumed[namespacedPath] && !contains(vanished, consumed, path.Dir(namespacedPath)) {
+			changes = append(changes, events.New(events.Deleted, namespacedPath))
+		}
+	}
+	for _, namespacedPath := range appeared {
+		if !consumed[namespacedPath] && !contains(appeared, consumed, path.Dir(namespacedPath)) {
+			changes = append(changes, events.New(events.Created, namespacedPath))
+		}
+	}
+	for _, namespacedPath := range modified {
+		changes = append(changes, events.New(events.Modified, namespacedPath))
+	}
+
+	// Remember what was found
+	for _, namespacedPath := range vanished {
+		if _, ok := found[namespacedPath]; !ok {
+			w.set(namespacedPath, nil)
+		}
+	}
+	for namespacedPath, e := range found {
+		e := e
+		w.set(namespacedPath, &e)
+	}
+
+	return changes
+}
+
+// Send out changes, leaving out the users' directories themselves
+func (w *Watcher) publish(changes []events.Event) {
+	for _, event := range changes {
+		if !strings.Contains(event.Path, "/") {
+			continue
+		}
+		w.bus.Publish(event)
+	}
+}
+
+// Bring what is known about a path and everything beneath it up to date with the disk
+func (w *Watcher) refresh(namespacedPath string) error {
+	info, err := os.Lstat(w.location(namespacedPath))
+	if os.IsNotExist(err) {
+		w.forget(namespacedPath)
+		return nil
+	} else if err != nil {
+		return err
+	} else if !included(namespacedPath, info) {
+		return nil
+	}
+
+	// Directories created along the way are new too
+	for parent := path.Dir(namespacedPath); parent != "."; parent = path.Dir(parent) {
+		if _, ok := w.known[parent]; ok {
+			break
+		}
+
+		info, err := os.Lstat(w.location(parent))
+		if err != nil || !included(parent, info) {
+			break
+		}
+		described := describe(info)
+		w.set(parent, &described)
+		if w.notify != nil {
+			w.notify.add(parent)
+		}
+	}
+
+	described := describe(info)
+	w.set(namespacedPath, &described)
+	if info.IsDir() {
+		found := make(map[string]entry)
+		if err := w.walk(namespacedPath, found); err != nil {
+			return err
+		}
+		for beneath, e := range found {
+			e := e
+			w.set(beneath, &e)
+		}
+	}
+	return nil
+}
+
+// Point what is known about a path and everything beneath it at its new location
+func (w *Watcher) move(from, to string) {
+	for namespacedPath, e := range w.known {
+		if namespacedPath == from || strings.HasPrefix(namespacedPath, from+"/") {
+			e := e
+			w.set(namespacedPath, nil)
+			w.set(to+strings.TrimPrefix(namespacedPath, from), &e)
+		}
+	}
+	if w.notify != nil {
+		w.notify.move(from, to)
+	}
+}
+
+// Forget a path and everything beneath it
+func (w *Watcher) forget(namespacedPath string) {
+	for known := range w.known {
+		if known == namespacedPath || strings.HasPrefix(known, namespacedPath+"/") {
+			w.set(known, nil)
+		}
+	}
+}
+
+// Record what is known about a path, queueing it to be saved
+func (w *Watcher) set(namespacedPath string, e *entry) {
+	if e == nil {
+		delete(w.known, namespacedPath)
+	} else {
+		w.known[namespacedPath] = *e
+	}
+	w.pending[namespacedPath] = e
+}
+
+// Find everything beneath a directory on disk, watching any directories found
+func (w *Watcher) walk(directory string, found map[string]entry) error {
+	return filepath.Walk(w.location(directory), func(location string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(w.root, location)
+		if err != nil {
+			return err
+		}
+		namespacedPath := filepath.ToSlash(relative)
+		if namespacedPath == "." {
+			namespacedPath = ""
+		}
+
+		if namespacedPath != "" && !included(namespacedPath, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() && w.notify != nil {
+			w.notify.add(namespacedPath)
+		}
+		if namespacedPath != "" && namespacedPath != directory {
+			found[namespacedPath] = describe(info)
+		}
+		return nil
+	})
+}
+
+// Save queued changes to what is known periodically
+func (w *Watcher) persist(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := w.Save(); err != nil {
+			log.Printf("ERROR: failed to save known files: %v\n", err)
+		}
+	}
+}
+
+// Save queued changes to what is known so they are not found again on the next start
+func (w *Watcher) Save() error {
+	w.lock.Lock()
+	pending := w.pending
+	w.pending = make(map[string]*entry)
+	w.lock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return w.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(models.BucketWatcher)
+		for namespacedPath, e := range pending {
+			if e == nil {
+				if err := bucket.Delete([]byte(namespacedPath)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(namespacedPath), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get the location of a namespaced path on disk
+func (w *Watcher) location(namespacedPath string) string {
+	return filepath.Join(w.root, filepath.FromSlash(namespacedPath))
+}
+
+// Check if a path is part of a user's files, skipping the server's own directories and symbolic links
+func included(namespacedPath string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return false
+	}
+
+	// Only directories at the top level belong to users
+	if !strings.Contains(namespacedPath, "/") {
+		return info.IsDir() && !strings.HasPrefix(namespacedPath, ".")
+	}
+	return true
+}
+
+// Describe a file or directory as it is on disk
+func describe(info os.FileInfo) entry {
+	e := entry{Inode: inode(info), Directory: info.IsDir()}
+	if !info.IsDir() {
+		e.Size = info.Size()
+		e.Modified = info.ModTime().UnixNano()
+	}
+	return e
+}
+
+// Order paths so parents come before their children
+func sortByDepth(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		if a, b := strings.Count(paths[i], "/"), strings.Count(paths[j], "/"); a != b {
+			return a < b
+		}
+		return paths[i] < paths[j]
+	})
+}
+
+// Check if a path within a user's directory is in a list and was not already accounted for
+func contains(paths []string, consumed map[string]bool, namespacedPath string) bool {
+	if consumed[namespacedPath] || !strings.Contains(namespacedPath, "/") {
+		return false
+	}
+	for _, p := range paths {
+		if p == namespacedPath {
+			return true
+		}
+	}
+	return false
+}